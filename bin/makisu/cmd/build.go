@@ -17,19 +17,26 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"time"
 
 	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
+	"github.com/uber/makisu/lib/utils/gitutil"
 	"github.com/uber/makisu/lib/utils/stringset"
 
 	"github.com/spf13/cobra"
@@ -39,35 +46,91 @@ type buildCmd struct {
 	*cobra.Command
 
 	dockerfilePath string
-	tag            string
-
-	pushRegistries []string
-	replicas       []string
-	registryConfig string
-	destination    string
+	tags           []string
+
+	pushRegistries   []string
+	replicas         []string
+	pushDuringBuild  int
+	pushConcurrency  int
+	pullConcurrency  int
+	digestFile       string
+	digestFileFormat string
+	registryConfig   string
+	searchRegistries []string
+	destination      string
+	oci              bool
+
+	baseImageSignatureKey      string
+	requireBaseImageSignatures bool
 
 	target        string
+	stageTags     []string
 	buildArgs     []string
+	buildArgsFile string
+	secrets       []string
 	allowModifyFS bool
 	commit        string
 	blacklists    []string
+	killOrphans   bool
+	network       string
+
+	platform              string
+	prefetchBaseImages    int
+	stagePlatforms        []string
+	allowPlatformMismatch bool
+
+	maxImageSize         int64
+	allowOversizedImages bool
+
+	defaultLabels []string
+
+	ociAnnotations      []string
+	ociLayerAnnotations []string
+
+	keepFSDir   string
+	keepFSSteps []string
+
+	checkReproducible bool
+
+	debugTag        string
+	debugEntrypoint []string
+	debugCmd        []string
+	debugAppendCmd  []string
+	debugLayer      string
+	debugLayerDest  string
 
-	localCacheTTL      time.Duration
-	redisCacheAddress  string
-	redisCachePassword string
-	redisCacheTTL      time.Duration
-	httpCacheAddress   string
-	httpCacheHeaders   []string
+	cacheStoreFlags
+
+	gitCacheNamespace  string
+	cacheHealthTimeout time.Duration
+	cacheFailOpen      bool
+	cacheRunOutput     int
+	cacheFrom          []string
+	cacheTo            []string
+	inlineCache        bool
 
 	dockerHost    string
 	dockerVersion string
 	dockerScheme  string
 	doLoad        bool
 
-	storageDir       string
-	compressionLevel string
+	storageDir             string
+	chunkLayers            bool
+	compression            string
+	compressionLevel       int
+	compressionFormat      string
+	compressionConcurrency int
+
+	filenamePolicy       string
+	filenameIllegalChars string
+	filenameReplacement  string
+	dirSymlinks          string
 
-	preserveRoot bool
+	provenancePath     string
+	cacheKeyReportPath string
+
+	preserveRoot  bool
+	postBuildUser string
 }
 
 func getBuildCmd() *buildCmd {
@@ -97,25 +160,60 @@ func getBuildCmd() *buildCmd {
 	}
 
 	buildCmd.PersistentFlags().StringVarP(&buildCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
-	buildCmd.PersistentFlags().StringVarP(&buildCmd.tag, "tag", "t", "", "Image tag (required)")
+	buildCmd.PersistentFlags().StringArrayVarP(&buildCmd.tags, "tag", "t", nil, "Image tag (required). Repeat it to also push the image under other tags to the --push registries. Tags can use {{.GitSHA}} and {{.GitShortSHA}}, the git revision of the context dir, {{.Date}}, {{.Timestamp}} and environment variables as {{.Env.<name>}}")
 
-	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.pushRegistries, "push", nil, "Registry to push image to")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.pushRegistries, "push", nil, "Registry to push image to. Repeat it to push to several registries, in parallel")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pushDuringBuild, "push-during-build", 0, "Push up to this many layers concurrently as soon as they are built, while later steps are still running. A failed push, or layers exceeding --max-image-size, stop the build. Set to 0 to push only after the build")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pushConcurrency, "push-concurrency", 0, "Push up to this many layers of an image concurrently. Defaults to the concurrency of the registry config")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.digestFile, "digest-file", "", "Write the digest of the pushed image to this file once all pushes succeeded. Requires --push or --replica")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.digestFileFormat, "digest-file-format", "plain", "Format of --digest-file, could be 'plain' for only the digest of the image, or 'json' for the digests of all pushed images by name")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.registryConfig, "registry-config", "", "Set build-time variables")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.searchRegistries, "search-registry", nil, "Registry to resolve unqualified base image names against, tried in order. Defaults to docker hub if not set")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pullConcurrency, "pull-concurrency", 0, "Pull up to this many layers of a base image concurrently. Defaults to the concurrency of the registry config")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.baseImageSignatureKey, "base-image-signature-key", "", "PEM public key that cosign signatures of base images are verified against. Builds fail on invalid signatures")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.requireBaseImageSignatures, "require-base-image-signatures", false, "Also fail builds on base images without signature, instead of only warning")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.destination, "dest", "", "Destination of the image tar")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.oci, "oci", false, "Save and push images with OCI manifests instead of docker schema2 manifests. The tar at --dest is then an OCI image layout")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.target, "target", "", "Set the target build stage to build.")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.stageTags, "stage-tag", nil, "Also build the given stage as its own image. Format is \"--stage-tag <stage>=<image tag>\"")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.buildArgsFile, "build-args-file", "", "File with one <arg>=<value> build argument per line. Values set with --build-arg take precedence")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.secrets, "secret", nil, "Secret file exposed to RUN steps with --mount=type=secret. It's never written to layers or cache keys. Format is \"--secret id=<id>,src=<path>\"")
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowModifyFS, "modifyfs", false, "Allow makisu to modify files outside of its internal storage dir")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.commit, "commit", "implicit", "Set to explicit to only commit at steps with '#!COMMIT' annotations; Set to implicit to commit at every ADD/COPY/RUN step")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.blacklists, "blacklist", nil, "Makisu will ignore all changes to these locations in the resulting docker images")
-
-	buildCmd.PersistentFlags().DurationVar(&buildCmd.localCacheTTL, "local-cache-ttl", time.Hour*336, "Time-To-Live for local cache")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCachePassword, "redis-cache-password", "", "The password of the Redis server, should match 'requirepass' in redis.conf")
-	buildCmd.PersistentFlags().DurationVar(&buildCmd.redisCacheTTL, "redis-cache-ttl", time.Hour*336, "Time-To-Live for redis cache")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.httpCacheAddress, "http-cache-addr", "", "The address of the http server for cacheID to layer sha mapping")
-	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.httpCacheHeaders, "http-cache-header", nil, "Request header for http cache server. Format is \"--http-cache-header <header>:<value>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.killOrphans, "kill-orphans", false, "Kill processes left running by a RUN command once it exits, before its layer is committed")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.network, "network", "host", "Network mode of RUN steps without --network, could be 'host' or 'none'. 'none' runs them in a new network namespace without network access")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.platform, "platform", "", "Platform the image is built for, format is \"<os>/<arch>\". If set, base images are pulled for that platform from manifest lists, and the build fails when the resulting image config declares a different platform. Several comma separated platforms build the image for each of them as <tag>-<os>-<arch>, and push a manifest list referencing them as <tag>")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.stagePlatforms, "stage-platform", nil, "Override --platform for the given stage. Format is \"--stage-platform <stage>=<os>/<arch>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowPlatformMismatch, "allow-platform-mismatch", false, "Only warn if the resulting image config doesn't match --platform, or if the host can't run RUN steps for it")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.prefetchBaseImages, "prefetch-base-images", 2, "Number of base images pulled in the background while the build context is hashed. Set to 0 to pull base images only when their stage is built")
+	buildCmd.PersistentFlags().Int64Var(&buildCmd.maxImageSize, "max-image-size", 0, "Fail the build before pushing if an image is larger than this many bytes, counting compressed layers and config. Set to 0 for no limit")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowOversizedImages, "allow-oversized-images", false, "Only warn if an image is larger than --max-image-size")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.ociAnnotations, "oci-annotation", nil, "Annotation of the manifests saved with --oci, ignored otherwise. Values can use {{.Revision}}, {{.Created}} and {{.Stage}}, the alias of the stage of the image. Format is \"--oci-annotation <key>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.ociLayerAnnotations, "oci-layer-annotation", nil, "Annotation of each layer of the manifests saved with --oci, ignored otherwise. Values can use the same fields as --oci-annotation, and {{.Instruction}}, the Dockerfile instruction that created the layer. Format is \"--oci-layer-annotation <key>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.defaultLabels, "default-label", nil, "Label added to every image unless set by a LABEL of its stage. Values can use {{.Revision}}, the git revision of the context dir, and {{.Created}}. Format is \"--default-label <key>=<value>\"")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.keepFSDir, "keep-fs-dir", "", "Save the filesystem after each step to <dir>/<stage>/<step number> for inspection, even if the step fails")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.keepFSSteps, "keep-fs-step", nil, "Only save the filesystem after the given step to --keep-fs-dir. Format is \"--keep-fs-step <stage>/<step number>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.checkReproducible, "check-reproducible", false, "Build a second time without cache, and fail if the layers or configs of the images differ. Timestamps set by makisu are ignored")
+
+	buildCmd.PersistentFlags().StringVar(&buildCmd.debugTag, "debug-tag", "", "Also save a debug variant of the image with this tag, modified by the --debug-* flags")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.debugEntrypoint, "debug-entrypoint", nil, "Entrypoint of the debug variant, one argument per flag")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.debugCmd, "debug-cmd", nil, "Cmd of the debug variant, one argument per flag")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.debugAppendCmd, "debug-append-cmd", nil, "Argument appended to the cmd of the debug variant")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.debugLayer, "debug-layer", "", "Local directory added as an extra layer of the debug variant")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.debugLayerDest, "debug-layer-dest", "/", "Path the --debug-layer directory is copied to in the debug variant")
+
+	buildCmd.cacheStoreFlags.addFlags(buildCmd.Command)
+	buildCmd.PersistentFlags().StringVar(&buildCmd.gitCacheNamespace, "git-cache-namespace", "", "Prefix cache keys with a namespace read from the git repo of the context. Set to 'branch' for the current branch, or to a git config key")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.cacheHealthTimeout, "cache-health-timeout", 10*time.Second, "Time to wait for the remote cache store to answer a health check at the start of the build")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.cacheFailOpen, "cache-fail-open", false, "If the remote cache store is unreachable, build with the local cache or without cache instead of failing. Cache errors during the build are then treated as cache misses")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.cacheRunOutput, "cache-run-output", 0, "Store up to this many bytes of the output of RUN commands with their cache entries, and replay it to the log when they are cached. Set to 0 to disable")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.cacheFrom, "cache-from", nil, "Import the cache entries of a cache image \"<registry>/<repo>:<tag>\" exported by --cache-to. Its layers are pulled from its registry when needed")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.cacheTo, "cache-to", nil, "Export the cache entries used by the build and their layers to a cache image \"<registry>/<repo>:<tag>\", to share the cache with builds on other machines")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.inlineCache, "inline-cache", false, "Embed the cache entries of the layers of built images in their config as a label, so the pushed images can be used with --cache-from")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerHost, "docker-host", utils.DefaultEnv("DOCKER_HOST", "unix:///var/run/docker.sock"), "Docker host to load images to")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerVersion, "docker-version", utils.DefaultEnv("DOCKER_VERSION", "1.21"), "Version string for loading images to docker")
@@ -123,9 +221,20 @@ func getBuildCmd() *buildCmd {
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.doLoad, "load", false, "Load image into docker daemon after build. Requires access to docker socket at location defined by ${DOCKER_HOST}")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.storageDir, "storage", "", "Directory that makisu uses for temp files and cached layers. Mount this path for better caching performance. If modifyfs is set, default to /makisu-storage; Otherwise default to /tmp/makisu-storage")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionLevel, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default'")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.chunkLayers, "chunk-layers", false, "Store layers in the storage dir as content-defined chunks of their uncompressed content, so layers sharing files share storage. Layers are compressed again when read, and layers makisu can't compress again the same are stored as is")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.compression, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default'")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.compressionLevel, "compression-level", -1, "Numeric gzip compression level of created layers, from 0 (no compression) to 9 (smallest layers). Overrides --compression")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionFormat, "compression-format", "gzip", "Compression format of created layers, could be 'gzip', 'zstd'. zstd requires --oci. Base images with either format can be pulled")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.compressionConcurrency, "compression-concurrency", 0, "Number of blocks of a layer compressed in parallel. Set to 1 to compress layers on a single core. Defaults to 16 blocks for gzip, and GOMAXPROCS for zstd")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.filenamePolicy, "filename-policy", "passthrough", "Handling of file names with illegal characters in created layers, could be 'passthrough', 'reject', 'remap'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.filenameIllegalChars, "filename-illegal-chars", `:*?"<>|\`, "Characters considered illegal by --filename-policy")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.filenameReplacement, "filename-replacement", "_", "Replacement of illegal characters if --filename-policy is 'remap'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.dirSymlinks, "dir-symlinks", "follow", "Handling of layer entries under a symlink to a directory from earlier layers, e.g. /lib -> /usr/lib. Set to 'follow' to write them to the link target like at runtime, or 'replace' to replace the link with a directory")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.provenancePath, "provenance", "", "Write build provenance of the target image as JSON to this path. Includes base image digests, context and dockerfile digests and build args, with secret-looking args redacted")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.cacheKeyReportPath, "cache-key-report", "", "Write the cache key of each step, the inputs it was computed from and the digests of the base images as JSON to this path, then exit without building")
 
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.preserveRoot, "preserve-root", false, "Copy / in the storage dir and copy it back after build.")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.postBuildUser, "post-build-user", "", "Switch to <uid>[:<gid>] once the image is built, before pushing, saving or loading it. Building itself runs as root, since layers keep the ownership of files. The storage dir is chowned to that user. Not compatible with --modifyfs")
 
 	buildCmd.MarkFlagRequired("tag")
 	buildCmd.Flags().SortFlags = false
@@ -139,23 +248,146 @@ func (cmd *buildCmd) processFlags() error {
 		return fmt.Errorf("failed to extend blacklist: %s", err)
 	}
 
+	if cmd.keepFSDir != "" {
+		keepFSDir, err := filepath.Abs(cmd.keepFSDir)
+		if err != nil {
+			return fmt.Errorf("resolve keep fs dir: %s", err)
+		}
+		cmd.keepFSDir = keepFSDir
+		cmd.blacklists = append(cmd.blacklists, keepFSDir)
+	} else if len(cmd.keepFSSteps) != 0 {
+		return fmt.Errorf("--keep-fs-step requires --keep-fs-dir")
+	}
 	if len(cmd.blacklists) != 0 {
 		newBlacklist := append(pathutils.DefaultBlacklist, cmd.blacklists...)
 		pathutils.DefaultBlacklist = stringset.FromSlice(newBlacklist).ToSlice()
 		log.Infof("Added %d new items to blacklist: %v", len(cmd.blacklists), cmd.blacklists)
 	}
 
-	if err := tario.SetCompressionLevel(cmd.compressionLevel); err != nil {
+	storage.ChunkLayers = cmd.chunkLayers
+
+	if err := tario.SetCompressionLevel(cmd.compression); err != nil {
 		return fmt.Errorf("set compression level: %s", err)
 	}
+	if cmd.compressionLevel != -1 {
+		if err := tario.SetNumericCompressionLevel(cmd.compressionLevel); err != nil {
+			return fmt.Errorf("set compression level: %s", err)
+		}
+	}
+	if err := tario.SetCompressionFormat(cmd.compressionFormat); err != nil {
+		return fmt.Errorf("set compression format: %s", err)
+	}
+	if err := tario.SetCompressionConcurrency(cmd.compressionConcurrency); err != nil {
+		return fmt.Errorf("set compression concurrency: %s", err)
+	}
+	if tario.CompressionFormat == tario.CompressionZstd && !cmd.oci {
+		return fmt.Errorf("--compression-format zstd requires --oci")
+	}
+
+	if err := snapshot.SetNamePolicy(
+		cmd.filenamePolicy, cmd.filenameIllegalChars, cmd.filenameReplacement); err != nil {
+		return fmt.Errorf("set filename policy: %s", err)
+	}
+	if err := snapshot.SetDirSymlinkPolicy(cmd.dirSymlinks); err != nil {
+		return fmt.Errorf("set dir symlink policy: %s", err)
+	}
 
 	if cmd.commit != "explicit" && cmd.commit != "implicit" {
 		return fmt.Errorf("invalid commit option: %s", cmd.commit)
 	}
 
+	platforms, err := cmd.getPlatforms()
+	if err != nil {
+		return fmt.Errorf("parse platform: %s", err)
+	}
+	if len(platforms) > 1 {
+		if err := cmd.validateMultiPlatform(); err != nil {
+			return err
+		}
+	}
+	if _, err := cmd.getStagePlatforms(); err != nil {
+		return fmt.Errorf("parse stage platforms: %s", err)
+	}
+	if cmd.prefetchBaseImages < 0 {
+		return fmt.Errorf("invalid prefetch base images count: %d", cmd.prefetchBaseImages)
+	}
+	if cmd.pushDuringBuild < 0 {
+		return fmt.Errorf("invalid push during build concurrency: %d", cmd.pushDuringBuild)
+	}
+	if cmd.pushConcurrency < 0 {
+		return fmt.Errorf("invalid push concurrency: %d", cmd.pushConcurrency)
+	}
+	registry.PushConcurrency = cmd.pushConcurrency
+	if cmd.pullConcurrency < 0 {
+		return fmt.Errorf("invalid pull concurrency: %d", cmd.pullConcurrency)
+	}
+	registry.PullConcurrency = cmd.pullConcurrency
+	if len(cmd.tags) > 1 && len(cmd.pushRegistries) == 0 {
+		return fmt.Errorf("more than one -t requires --push")
+	}
+	if cmd.digestFile != "" {
+		if len(cmd.pushRegistries) == 0 && len(cmd.replicas) == 0 {
+			return fmt.Errorf("--digest-file requires --push or --replica")
+		}
+		if cmd.digestFileFormat != "plain" && cmd.digestFileFormat != "json" {
+			return fmt.Errorf("invalid digest file format: %s", cmd.digestFileFormat)
+		}
+	}
+	if err := cmd.cacheStoreFlags.validate(); err != nil {
+		return err
+	}
+	if cmd.cacheRunOutput < 0 {
+		return fmt.Errorf("invalid cache run output size: %d", cmd.cacheRunOutput)
+	}
+	if _, err := parseCacheImageNames(cmd.cacheFrom); err != nil {
+		return fmt.Errorf("parse cache from images: %s", err)
+	}
+	if _, err := parseCacheImageNames(cmd.cacheTo); err != nil {
+		return fmt.Errorf("parse cache to images: %s", err)
+	}
+	if cmd.maxImageSize < 0 {
+		return fmt.Errorf("invalid max image size: %d", cmd.maxImageSize)
+	}
+
+	if cmd.debugTag == "" && (len(cmd.debugEntrypoint) != 0 || len(cmd.debugCmd) != 0 ||
+		len(cmd.debugAppendCmd) != 0 || cmd.debugLayer != "") {
+		return fmt.Errorf("--debug-* flags require --debug-tag")
+	}
+
 	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
+	registry.SearchRegistries = cmd.searchRegistries
+	shell.KillOrphans = cmd.killOrphans
+	step.RunOutputLimit = cmd.cacheRunOutput
+	if err := step.SetRunNetwork(cmd.network); err != nil {
+		return fmt.Errorf("set network: %s", err)
+	}
+	if err := step.SetRunSecrets(cmd.secrets); err != nil {
+		return fmt.Errorf("set secrets: %s", err)
+	}
+	if cmd.baseImageSignatureKey != "" {
+		key, err := ioutil.ReadFile(cmd.baseImageSignatureKey)
+		if err != nil {
+			return fmt.Errorf("read base image signature key: %s", err)
+		}
+		policy, err := registry.NewSignaturePolicy(key, cmd.requireBaseImageSignatures)
+		if err != nil {
+			return fmt.Errorf("create signature policy: %s", err)
+		}
+		registry.ImageSignaturePolicy = policy
+	} else if cmd.requireBaseImageSignatures {
+		return fmt.Errorf("--require-base-image-signatures requires --base-image-signature-key")
+	}
+
+	// Restoring and cleaning up the file system after build requires root.
+	if cmd.postBuildUser != "" {
+		if cmd.allowModifyFS {
+			return fmt.Errorf("--post-build-user is not compatible with --modifyfs, which needs root until makisu exits")
+		} else if _, _, err := utils.ResolveChown(cmd.postBuildUser); err != nil {
+			return fmt.Errorf("resolve post build user: %s", err)
+		}
+	}
 
 	// If modifyfs is true, verify it's not running on Mac.
 	if cmd.allowModifyFS && runtime.GOOS == "darwin" {
@@ -180,14 +412,29 @@ func (cmd *buildCmd) processFlags() error {
 }
 
 func (cmd *buildCmd) newBuildPlan(
-	buildContext *context.BuildContext, imageName image.Name,
-	replicas []image.Name) (*builder.BuildPlan, error) {
+	buildContext *context.BuildContext, imageName image.Name, platform *builder.Platform,
+	replicas []image.Name, stageImages map[string][]image.Name,
+	debugImage *image.Name, useCache bool) (*builder.BuildPlan, error) {
 
 	// Read in and parse dockerfile.
-	dockerfile, err := cmd.getDockerfile(buildContext.ContextDir)
+	dockerfile, buildArgs, err := cmd.getDockerfile(buildContext.ContextDir, platform)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get dockerfile: %s", err)
 	}
+	stagePlatforms, err := cmd.getStagePlatforms()
+	if err != nil {
+		return nil, fmt.Errorf("get stage platforms: %s", err)
+	}
+
+	// Start pulling base images while the build context gets hashed. They
+	// aren't needed if the plan is only used for its cache keys.
+	var puller *step.BaseImagePuller
+	if cmd.prefetchBaseImages > 0 && cmd.cacheKeyReportPath == "" {
+		puller = step.NewBaseImagePuller(buildContext.ImageStore, cmd.prefetchBaseImages)
+		if err := builder.PrefetchBaseImages(puller, dockerfile, platform, stagePlatforms); err != nil {
+			return nil, fmt.Errorf("prefetch base images: %s", err)
+		}
+	}
 
 	// Remove image manifest if an image with the same name already exists.
 	if err := cleanManifest(buildContext, imageName); err != nil {
@@ -198,9 +445,31 @@ func (cmd *buildCmd) newBuildPlan(
 			return nil, fmt.Errorf("failed to clean manifest: %s", err)
 		}
 	}
+	for _, names := range stageImages {
+		for _, name := range names {
+			if err := cleanManifest(buildContext, name); err != nil {
+				return nil, fmt.Errorf("failed to clean manifest: %s", err)
+			}
+		}
+	}
+	if debugImage != nil {
+		if err := cleanManifest(buildContext, *debugImage); err != nil {
+			return nil, fmt.Errorf("failed to clean manifest: %s", err)
+		}
+	}
 
 	// Init cache manager.
-	cacheMgr := cmd.newCacheManager(buildContext, imageName)
+	cacheMgr := cache.NewNoopCacheManager()
+	var cacheImages []image.Name
+	if useCache {
+		cacheMgr, err = cmd.newCacheManager(buildContext, imageName)
+		if err != nil {
+			return nil, fmt.Errorf("init cache manager: %s", err)
+		}
+		if cacheImages, err = parseCacheImageNames(cmd.cacheTo); err != nil {
+			return nil, fmt.Errorf("parse cache to images: %s", err)
+		}
+	}
 
 	// forceCommit will make every step attempt to commit a layer.
 	// Commit is noop for steps other than ADD/COPY/RUN if they are not after an
@@ -208,8 +477,95 @@ func (cmd *buildCmd) newBuildPlan(
 	forceCommit := cmd.commit == "implicit"
 
 	// Create BuildPlan and validate it.
-	return builder.NewBuildPlan(
+	plan, err := builder.NewBuildPlan(
 		buildContext, imageName, replicas, cacheMgr, dockerfile, cmd.allowModifyFS, forceCommit, cmd.target)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.SetStageImages(stageImages); err != nil {
+		return nil, fmt.Errorf("set stage images: %s", err)
+	}
+	plan.SetBuildArgs(buildArgs)
+	if debugImage != nil {
+		debugLayer := cmd.debugLayer
+		if debugLayer != "" {
+			if debugLayer, err = filepath.Abs(debugLayer); err != nil {
+				return nil, fmt.Errorf("failed to resolve debug layer dir: %s", err)
+			}
+		}
+		if err := plan.SetDebugVariant(&builder.DebugVariant{
+			Name:       *debugImage,
+			Entrypoint: cmd.debugEntrypoint,
+			Cmd:        cmd.debugCmd,
+			AppendCmd:  cmd.debugAppendCmd,
+			LayerDir:   debugLayer,
+			LayerDest:  cmd.debugLayerDest,
+		}); err != nil {
+			return nil, fmt.Errorf("set debug variant: %s", err)
+		}
+	}
+	if platform != nil {
+		if err := plan.SetPlatform(*platform, cmd.allowPlatformMismatch); err != nil {
+			return nil, fmt.Errorf("set platform: %s", err)
+		}
+	}
+	if len(stagePlatforms) != 0 {
+		if err := plan.SetStagePlatforms(stagePlatforms); err != nil {
+			return nil, fmt.Errorf("set stage platforms: %s", err)
+		}
+	}
+	if puller != nil {
+		plan.SetBaseImagePuller(puller)
+	}
+	plan.SetMaxImageSize(cmd.maxImageSize, cmd.allowOversizedImages)
+	if len(cacheImages) != 0 {
+		plan.SetCacheImages(cacheImages)
+	}
+	if useCache && cmd.inlineCache {
+		plan.SetInlineCache()
+	}
+	if cmd.oci {
+		plan.SetOCI()
+	}
+	if cmd.pushDuringBuild > 0 && (len(cmd.pushRegistries) > 0 || len(replicas) > 0) {
+		plan.SetLayerPush(cmd.pushRegistries, cmd.pushDuringBuild)
+	}
+	if cmd.keepFSDir != "" {
+		if err := plan.SetKeepFS(cmd.keepFSDir, cmd.keepFSSteps); err != nil {
+			return nil, fmt.Errorf("set keep fs: %s", err)
+		}
+	}
+	var revision string
+	if len(cmd.defaultLabels) != 0 || len(cmd.ociAnnotations) != 0 || len(cmd.ociLayerAnnotations) != 0 {
+		var err error
+		revision, err = gitutil.Revision(buildContext.ContextDir)
+		if err != nil {
+			return nil, fmt.Errorf("get git revision of context dir: %s", err)
+		}
+	}
+	if len(cmd.defaultLabels) != 0 {
+		labels, err := parseKeyValues("default label", cmd.defaultLabels)
+		if err != nil {
+			return nil, fmt.Errorf("get default labels: %s", err)
+		}
+		if err := plan.SetDefaultLabels(labels, revision); err != nil {
+			return nil, fmt.Errorf("set default labels: %s", err)
+		}
+	}
+	if len(cmd.ociAnnotations) != 0 || len(cmd.ociLayerAnnotations) != 0 {
+		annotations, err := parseKeyValues("oci annotation", cmd.ociAnnotations)
+		if err != nil {
+			return nil, fmt.Errorf("get oci annotations: %s", err)
+		}
+		layerAnnotations, err := parseKeyValues("oci layer annotation", cmd.ociLayerAnnotations)
+		if err != nil {
+			return nil, fmt.Errorf("get oci layer annotations: %s", err)
+		}
+		if err := plan.SetOCIAnnotations(annotations, layerAnnotations, revision); err != nil {
+			return nil, fmt.Errorf("set oci annotations: %s", err)
+		}
+	}
+	return plan, nil
 }
 
 // Build image from the specified dockerfile.
@@ -252,35 +608,121 @@ func (cmd *buildCmd) Build(contextDir string) error {
 	}
 
 	// Create and execute build plan.
+	if err := cmd.expandTags(contextDirAbs, time.Now()); err != nil {
+		return fmt.Errorf("failed to expand tags: %s", err)
+	}
 	imageName, err := cmd.getTargetImageName()
 	if err != nil {
 		return fmt.Errorf("failed to get target image name: %s", err)
 	}
-	var parsedReplicas []image.Name
-	for _, replica := range cmd.replicas {
-		parsedReplicas = append(parsedReplicas, image.MustParseName(replica))
+	platforms, err := cmd.getPlatforms()
+	if err != nil {
+		return fmt.Errorf("failed to get platforms: %s", err)
+	}
+	if len(platforms) > 1 {
+		return cmd.buildPlatforms(buildContext, imageName, platforms)
+	}
+	var platform *builder.Platform
+	if len(platforms) == 1 {
+		platform = &platforms[0]
+	}
+	parsedReplicas := cmd.getReplicaNames()
+	stageImages, err := cmd.getStageImageNames()
+	if err != nil {
+		return fmt.Errorf("failed to get stage image names: %s", err)
+	}
+	var debugImage *image.Name
+	if cmd.debugTag != "" {
+		name := imageName.WithTag(cmd.debugTag)
+		debugImage = &name
 	}
-	buildPlan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
+	buildPlan, err := cmd.newBuildPlan(
+		buildContext, imageName, platform, parsedReplicas, stageImages, debugImage, true)
 	if err != nil {
 		return fmt.Errorf("failed to create build plan: %s", err)
 	}
-	if _, err = buildPlan.Execute(); err != nil {
+	if cmd.cacheKeyReportPath != "" {
+		report, err := buildPlan.CacheKeyReport()
+		if err != nil {
+			return fmt.Errorf("failed to compute cache key report: %s", err)
+		}
+		if err := report.WriteFile(cmd.cacheKeyReportPath); err != nil {
+			return fmt.Errorf("failed to write cache key report: %s", err)
+		}
+		log.Infof("Wrote cache key report to %s", cmd.cacheKeyReportPath)
+		return nil
+	}
+	manifests, err := buildPlan.ExecuteStages()
+	if err != nil {
 		return fmt.Errorf("failed to execute build plan: %s", err)
 	}
+	if stats := buildPlan.CacheStats(); stats.Hits+stats.Misses > 0 {
+		statsPath := filepath.Join(cmd.storageDir, pathutils.CacheStatsFileName)
+		if err := cache.AddStats(statsPath, stats); err != nil {
+			log.Warnf("Failed to save cache stats: %s", err)
+		}
+		log.Infof("Cache hits: %d, misses: %d", stats.Hits, stats.Misses)
+	}
+	if cmd.checkReproducible {
+		// Images of the second build replace the ones of the first build.
+		buildPlan, manifests, err = cmd.rebuildAndDiff(
+			buildContext, buildPlan, imageName, platform, parsedReplicas, stageImages, debugImage)
+		if err != nil {
+			return fmt.Errorf("failed to check reproducibility: %s", err)
+		}
+	}
 	log.Infof("Successfully built image %s", imageName.ShortName())
+	if cmd.provenancePath != "" {
+		if err := cmd.writeProvenance(buildContext, buildPlan, manifests); err != nil {
+			return fmt.Errorf("failed to write provenance: %s", err)
+		}
+	}
+	if policy, ok := snapshot.TarNamePolicy.(*snapshot.RemapNamePolicy); ok {
+		if remapped := policy.Remapped(); len(remapped) > 0 {
+			log.Warnf("Remapped %d file names in created layers: %v", len(remapped), remapped)
+		}
+	}
+	for stage, names := range buildPlan.StageImages() {
+		for _, name := range names {
+			log.Infof("Successfully built image %s from stage %s", name.ShortName(), stage)
+		}
+	}
 
-	// Push image to registries that were specified in the --push flag.
+	// The remaining steps only need the storage dir and network access.
+	if err := cmd.switchToPostBuildUser(); err != nil {
+		return err
+	}
+
+	// Push image to registries that were specified in the --push flag, and
+	// to the replicas, all in parallel.
+	digests := registry.NewPushedDigests()
+	var targets []pushTarget
 	for _, registry := range cmd.pushRegistries {
-		target := imageName.WithRegistry(registry)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+		targets = append(targets, pushTarget{imageName.WithRegistry(registry), true})
+	}
+	for _, replica := range buildPlan.Replicas() {
+		targets = append(targets, pushTarget{replica, true})
+	}
+	if debugImage != nil {
+		for _, registry := range cmd.pushRegistries {
+			targets = append(targets, pushTarget{debugImage.WithRegistry(registry), false})
 		}
 	}
-	for _, replica := range cmd.replicas {
-		target := image.MustParseName(replica)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+	for _, names := range buildPlan.StageImages() {
+		for _, name := range names {
+			for _, registry := range cmd.pushRegistries {
+				targets = append(targets, pushTarget{name.WithRegistry(registry), false})
+			}
+		}
+	}
+	if err := pushImages(buildContext, targets, digests); err != nil {
+		return fmt.Errorf("failed to push image: %s", err)
+	}
+	if cmd.digestFile != "" {
+		if err := digests.WriteFile(cmd.digestFile, cmd.digestFileFormat); err != nil {
+			return fmt.Errorf("failed to write digest file: %s", err)
 		}
+		log.Infof("Wrote image digest %s to %s", digests.Digest, cmd.digestFile)
 	}
 
 	// Optionally save image as a tar file.
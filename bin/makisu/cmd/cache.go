@@ -0,0 +1,464 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/spf13/cobra"
+)
+
+// cacheStoreFlags are the flags configuring the cache key-value store, shared
+// by the build and cache commands.
+type cacheStoreFlags struct {
+	command *cobra.Command
+
+	localCacheTTL      time.Duration
+	redisCacheAddress  string
+	redisCachePassword string
+	redisCacheUsername string
+	redisCacheMaster   string
+	redisCacheCluster  bool
+	redisCacheTLS      bool
+	redisCacheTLSCA    string
+	redisCacheTLSCert  string
+	redisCacheTLSKey   string
+	redisCacheTLSSkip  bool
+	redisCacheTTL      time.Duration
+	httpCacheAddress   string
+	httpCacheHeaders   []string
+	httpCacheToken     string
+	httpCacheUsername  string
+	httpCachePassword  string
+	httpCacheTLSCA     string
+	httpCacheTLSCert   string
+	httpCacheTLSKey    string
+	httpCacheTLSSkip   bool
+	httpCacheTTL       time.Duration
+	s3CacheBucket      string
+	s3CachePrefix      string
+	s3CacheRegion      string
+	s3CacheTTL         time.Duration
+	gcsCacheBucket     string
+	gcsCachePrefix     string
+	gcsCacheTTL        time.Duration
+	cacheTTL           time.Duration
+}
+
+// addFlags adds the cache store flags to the persistent flags of the command.
+func (f *cacheStoreFlags) addFlags(command *cobra.Command) {
+	f.command = command
+	flags := command.PersistentFlags()
+	flags.DurationVar(&f.localCacheTTL, "local-cache-ttl", time.Hour*336, "Time-To-Live for local cache. Set to 0 to disable the local cache")
+	flags.StringVar(&f.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping. Comma separated addresses of cluster nodes or sentinels are accepted with --redis-cache-cluster or --redis-cache-sentinel-master")
+	flags.StringVar(&f.redisCachePassword, "redis-cache-password", "", "The password of the Redis server, should match 'requirepass' in redis.conf")
+	flags.StringVar(&f.redisCacheUsername, "redis-cache-username", "", "The ACL user of the Redis server to authenticate as with --redis-cache-password. Defaults to the default user")
+	flags.StringVar(&f.redisCacheMaster, "redis-cache-sentinel-master", "", "Name of the master to discover through the Redis Sentinels at --redis-cache-addr")
+	flags.BoolVar(&f.redisCacheCluster, "redis-cache-cluster", false, "Connect to a Redis Cluster with --redis-cache-addr as seed nodes")
+	flags.BoolVar(&f.redisCacheTLS, "redis-cache-tls", false, "Connect to the Redis server with TLS. Also enabled by rediss:// addresses and the other --redis-cache-tls-* flags")
+	flags.StringVar(&f.redisCacheTLSCA, "redis-cache-tls-ca", "", "CA certificate file or dir to verify the Redis server with, in addition to the system ones")
+	flags.StringVar(&f.redisCacheTLSCert, "redis-cache-tls-cert", "", "Client certificate file to authenticate to the Redis server with")
+	flags.StringVar(&f.redisCacheTLSKey, "redis-cache-tls-key", "", "Key file of --redis-cache-tls-cert")
+	flags.BoolVar(&f.redisCacheTLSSkip, "redis-cache-tls-skip-verify", false, "Don't verify the certificate of the Redis server. Insecure, for testing only")
+	flags.DurationVar(&f.redisCacheTTL, "redis-cache-ttl", time.Hour*336, "Time-To-Live for redis cache. Set to 0 for entries that never expire")
+	flags.StringVar(&f.httpCacheAddress, "http-cache-addr", "", "The address of the http server for cacheID to layer sha mapping")
+	flags.StringArrayVar(&f.httpCacheHeaders, "http-cache-header", nil, "Request header for http cache server. Format is \"--http-cache-header <header>:<value>\"")
+	flags.StringVar(&f.httpCacheToken, "http-cache-token", "", "Bearer token sent in the Authorization header of requests to the http cache server")
+	flags.StringVar(&f.httpCacheUsername, "http-cache-username", "", "Username of the basic auth of requests to the http cache server")
+	flags.StringVar(&f.httpCachePassword, "http-cache-password", "", "Password of the basic auth of requests to the http cache server")
+	flags.StringVar(&f.httpCacheTLSCA, "http-cache-tls-ca", "", "CA certificate file or dir to verify the https cache server with, in addition to the system ones")
+	flags.StringVar(&f.httpCacheTLSCert, "http-cache-tls-cert", "", "Client certificate file to authenticate to the https cache server with")
+	flags.StringVar(&f.httpCacheTLSKey, "http-cache-tls-key", "", "Key file of --http-cache-tls-cert")
+	flags.BoolVar(&f.httpCacheTLSSkip, "http-cache-tls-skip-verify", false, "Don't verify the certificate of the https cache server. Insecure, for testing only")
+	flags.DurationVar(&f.httpCacheTTL, "http-cache-ttl", time.Hour*336, "Time-To-Live for http cache, sent to the server in the Makisu-Cache-TTL header of PUT requests, in seconds. Set to 0 to omit the header for entries that never expire")
+	flags.StringVar(&f.s3CacheBucket, "s3-cache-bucket", "", "The S3 bucket for cacheID to layer sha mapping. Credentials are read from the environment, the AWS config files or the IAM role")
+	flags.StringVar(&f.s3CachePrefix, "s3-cache-prefix", "", "Prefix of the keys of the S3 cache objects")
+	flags.StringVar(&f.s3CacheRegion, "s3-cache-region", "", "Region of the S3 cache bucket. Defaults to the region of the AWS environment")
+	flags.DurationVar(&f.s3CacheTTL, "s3-cache-ttl", time.Hour*336, "Time-To-Live for S3 cache. Older objects are ignored, a lifecycle rule of the bucket should delete them")
+	flags.StringVar(&f.gcsCacheBucket, "gcs-cache-bucket", "", "The Google Cloud Storage bucket for cacheID to layer sha mapping. Requests use the Application Default Credentials")
+	flags.StringVar(&f.gcsCachePrefix, "gcs-cache-prefix", "", "Prefix of the names of the GCS cache objects")
+	flags.DurationVar(&f.gcsCacheTTL, "gcs-cache-ttl", time.Hour*336, "Time-To-Live for GCS cache, stored in the custom metadata of objects. Expired objects are ignored, a lifecycle rule of the bucket should delete them")
+	flags.DurationVar(&f.cacheTTL, "cache-ttl", 0, "Time-To-Live of cache entries, overriding the TTL flags of all cache stores if set. Set to 0 for entries that never expire, --local-cache-ttl=0 still disables the local cache")
+}
+
+// validate checks the values of the cache store flags.
+func (f *cacheStoreFlags) validate() error {
+	if f.redisCacheMaster != "" && f.redisCacheCluster {
+		return fmt.Errorf("--redis-cache-sentinel-master and --redis-cache-cluster are exclusive")
+	}
+	if (f.redisCacheTLSCert == "") != (f.redisCacheTLSKey == "") {
+		return fmt.Errorf("--redis-cache-tls-cert and --redis-cache-tls-key must be set together")
+	}
+	if (f.httpCacheTLSCert == "") != (f.httpCacheTLSKey == "") {
+		return fmt.Errorf("--http-cache-tls-cert and --http-cache-tls-key must be set together")
+	}
+	if f.httpCacheToken != "" && (f.httpCacheUsername != "" || f.httpCachePassword != "") {
+		return fmt.Errorf("--http-cache-token and --http-cache-username/--http-cache-password are exclusive")
+	}
+	for _, ttl := range []time.Duration{
+		f.cacheTTL, f.localCacheTTL, f.redisCacheTTL, f.httpCacheTTL, f.s3CacheTTL, f.gcsCacheTTL} {
+		if ttl < 0 {
+			return fmt.Errorf("invalid cache ttl: %s", ttl)
+		}
+	}
+	return nil
+}
+
+// newLocalStore returns the local cache store, in the storage dir of the image
+// store.
+func (f *cacheStoreFlags) newLocalStore(imageStore *storage.ImageStore) (keyvalue.Store, error) {
+	fullpath := path.Join(imageStore.RootDir, pathutils.CacheKeyValueFileName)
+	return keyvalue.NewFSStore(fullpath, imageStore.SandboxDir, f.storeTTL(f.localCacheTTL))
+}
+
+// remoteStore returns the constructor of the remote cache store configured by
+// the flags and a description of it, or nil if there is none.
+func (f *cacheStoreFlags) remoteStore() (func() (keyvalue.Store, error), string, error) {
+	if f.redisCacheAddress != "" {
+		tlsConfig, err := f.getRedisTLSConfig()
+		if err != nil {
+			return nil, "", fmt.Errorf("get redis tls config: %s", err)
+		}
+		return func() (keyvalue.Store, error) {
+			return keyvalue.NewRedisStoreWithOptions(keyvalue.RedisOptions{
+				Addrs:      strings.Split(f.redisCacheAddress, ","),
+				MasterName: f.redisCacheMaster,
+				Cluster:    f.redisCacheCluster,
+				Username:   f.redisCacheUsername,
+				Password:   f.redisCachePassword,
+				TLSConfig:  tlsConfig,
+			}, f.storeTTL(f.redisCacheTTL))
+		}, fmt.Sprintf("redis at %s", f.redisCacheAddress), nil
+	} else if f.httpCacheAddress != "" {
+		tlsConfig, err := f.getHTTPCacheTLSConfig()
+		if err != nil {
+			return nil, "", fmt.Errorf("get http cache tls config: %s", err)
+		}
+		return func() (keyvalue.Store, error) {
+			return keyvalue.NewHTTPStoreWithOptions(keyvalue.HTTPOptions{
+				Address:     f.httpCacheAddress,
+				Headers:     f.httpCacheHeaders,
+				BearerToken: f.httpCacheToken,
+				Username:    f.httpCacheUsername,
+				Password:    f.httpCachePassword,
+				TLSConfig:   tlsConfig,
+			}, f.storeTTL(f.httpCacheTTL))
+		}, fmt.Sprintf("http server at %s", f.httpCacheAddress), nil
+	} else if f.s3CacheBucket != "" {
+		return func() (keyvalue.Store, error) {
+			return keyvalue.NewS3Store(
+				f.s3CacheBucket, f.s3CachePrefix, f.s3CacheRegion, f.storeTTL(f.s3CacheTTL))
+		}, fmt.Sprintf("S3 bucket %s", f.s3CacheBucket), nil
+	} else if f.gcsCacheBucket != "" {
+		return func() (keyvalue.Store, error) {
+			return keyvalue.NewGCSStore(f.gcsCacheBucket, f.gcsCachePrefix, f.storeTTL(f.gcsCacheTTL))
+		}, fmt.Sprintf("GCS bucket %s", f.gcsCacheBucket), nil
+	}
+	return nil, "", nil
+}
+
+// storeTTL returns the Time-To-Live of the entries of a cache store configured
+// with the given ttl flag, or --cache-ttl if it is set.
+func (f *cacheStoreFlags) storeTTL(ttl time.Duration) time.Duration {
+	if f.command != nil && f.command.PersistentFlags().Changed("cache-ttl") {
+		return f.cacheTTL
+	}
+	return ttl
+}
+
+// getRedisTLSConfig returns the TLS config of the redis cache client, or nil if
+// none of the --redis-cache-tls* flags are set.
+func (f *cacheStoreFlags) getRedisTLSConfig() (*tls.Config, error) {
+	if !f.redisCacheTLS && f.redisCacheTLSCA == "" && f.redisCacheTLSCert == "" &&
+		!f.redisCacheTLSSkip {
+		return nil, nil
+	}
+	return buildCacheTLSConfig(
+		f.redisCacheTLSCA, f.redisCacheTLSCert, f.redisCacheTLSKey, f.redisCacheTLSSkip)
+}
+
+// getHTTPCacheTLSConfig returns the TLS config of the http cache client, or nil
+// if none of the --http-cache-tls* flags are set.
+func (f *cacheStoreFlags) getHTTPCacheTLSConfig() (*tls.Config, error) {
+	if f.httpCacheTLSCA == "" && f.httpCacheTLSCert == "" && !f.httpCacheTLSSkip {
+		return nil, nil
+	}
+	return buildCacheTLSConfig(
+		f.httpCacheTLSCA, f.httpCacheTLSCert, f.httpCacheTLSKey, f.httpCacheTLSSkip)
+}
+
+// buildCacheTLSConfig returns the TLS config of a cache store client from the
+// CA, client cert and key files.
+func buildCacheTLSConfig(ca, cert, key string, skipVerify bool) (*tls.Config, error) {
+	config := &httputil.TLSConfig{
+		CA: httputil.X509Pair{
+			Disabled: skipVerify,
+			Cert:     httputil.Secret{Path: ca},
+		},
+		Client: httputil.X509Pair{
+			Cert: httputil.Secret{Path: cert},
+			Key:  httputil.Secret{Path: key},
+		},
+	}
+	return config.BuildClient()
+}
+
+type cacheCmd struct {
+	*cobra.Command
+	cacheStoreFlags
+
+	storageDir  string
+	namespace   string
+	resetStats  bool
+	purgeAll    bool
+	purgeLayers bool
+}
+
+func getCacheCmd() *cacheCmd {
+	cacheCmd := &cacheCmd{
+		Command: &cobra.Command{
+			Use:   "cache",
+			Short: "Inspect and purge the cache entries of builds",
+		},
+	}
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the entries of the cache store and their layers",
+		Args:  cobra.NoArgs,
+		Run: func(ccmd *cobra.Command, args []string) {
+			cacheCmd.run(cacheCmd.List)
+		},
+	}
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show the cache hits and misses of builds using the storage dir, and the size of the cache",
+		Args:  cobra.NoArgs,
+		Run: func(ccmd *cobra.Command, args []string) {
+			cacheCmd.run(cacheCmd.Stats)
+		},
+	}
+	statsCmd.Flags().BoolVar(&cacheCmd.resetStats, "reset", false, "Reset the cache hits and misses after showing them")
+	purgeCmd := &cobra.Command{
+		Use:   "purge [flags] [<cache ID>...]",
+		Short: "Delete entries from the cache store, and optionally their layers from the storage dir",
+		Args: func(ccmd *cobra.Command, args []string) error {
+			if cacheCmd.purgeAll == (len(args) != 0) {
+				return errors.New("Requires either cache IDs as arguments or --all")
+			}
+			return nil
+		},
+		Run: func(ccmd *cobra.Command, args []string) {
+			cacheCmd.run(func(store keyvalue.Store, imageStore *storage.ImageStore) error {
+				return cacheCmd.Purge(store, imageStore, args)
+			})
+		},
+	}
+	purgeCmd.Flags().BoolVar(&cacheCmd.purgeAll, "all", false, "Delete all entries of the cache store")
+	purgeCmd.Flags().BoolVar(&cacheCmd.purgeLayers, "layers", false, "Also delete the layers of the deleted entries from the storage dir. They are pulled from the registry again by builds that need them")
+
+	cacheCmd.PersistentFlags().StringVar(&cacheCmd.storageDir, "storage", "/tmp/makisu-storage", "Storage dir of the builds, holding the local cache store, the cached layers and the cache stats. Builds with --modifyfs default to /makisu-storage")
+	cacheCmd.PersistentFlags().StringVar(&cacheCmd.namespace, "namespace", "", "Only use the entries of a cache namespace, as created by builds with --git-cache-namespace. Entries of all namespaces are listed by default, and cache IDs given to purge are looked up without namespace")
+	cacheCmd.addFlags(cacheCmd.Command)
+	cacheCmd.Flags().SortFlags = false
+	cacheCmd.PersistentFlags().SortFlags = false
+
+	cacheCmd.AddCommand(listCmd, statsCmd, purgeCmd)
+	return cacheCmd
+}
+
+// run runs fn with the configured cache store and the image store of the
+// storage dir, and exits on errors.
+func (cmd *cacheCmd) run(fn func(keyvalue.Store, *storage.ImageStore) error) {
+	if err := cmd.validate(); err != nil {
+		log.Errorf("failed to process flags: %s", err)
+		os.Exit(1)
+	}
+	// Layers chunked by builds are read, and purged, through the chunked store.
+	storage.ChunkLayers = storage.HasChunkedLayers(cmd.storageDir)
+	imageStore, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		log.Errorf("failed to init image store: %s", err)
+		os.Exit(1)
+	}
+	// Only remove the sandbox of this command, builds may be running.
+	defer os.RemoveAll(imageStore.SandboxDir)
+
+	store, err := cmd.newStore(imageStore)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err := fn(store, imageStore); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// newStore returns the remote cache store if one is configured, the local one
+// otherwise, restricted to --namespace if it is set.
+func (cmd *cacheCmd) newStore(imageStore *storage.ImageStore) (keyvalue.Store, error) {
+	var store keyvalue.Store
+	newRemoteStore, remoteName, err := cmd.remoteStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure cache store: %s", err)
+	} else if newRemoteStore != nil {
+		if store, err = newRemoteStore(); err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", remoteName, err)
+		}
+	} else if cmd.localCacheTTL == 0 {
+		return nil, fmt.Errorf("no cache store configured")
+	} else if store, err = cmd.newLocalStore(imageStore); err != nil {
+		return nil, fmt.Errorf("failed to init local cache store: %s", err)
+	}
+	return keyvalue.NewNamespaceStore(store, cmd.namespace), nil
+}
+
+// List prints the entries of the cache store, with the digest of their layer
+// and the size of their command output.
+func (cmd *cacheCmd) List(store keyvalue.Store, imageStore *storage.ImageStore) error {
+	entries, err := cache.ListEntries(store)
+	if err != nil {
+		return fmt.Errorf("failed to list cache entries: %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tCACHE ID\tLAYER\tOUTPUT")
+	for _, entry := range entries {
+		namespace := entry.Namespace
+		if namespace == "" {
+			namespace = "<none>"
+		}
+		layer := string(entry.Layer)
+		if layer == "" {
+			layer = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d bytes\n", namespace, entry.CacheID, layer, len(entry.Output))
+	}
+	return w.Flush()
+}
+
+// Stats prints the cache hits and misses of the builds using the storage dir,
+// the number of entries of the cache store and the size of their layers in the
+// storage dir.
+func (cmd *cacheCmd) Stats(store keyvalue.Store, imageStore *storage.ImageStore) error {
+	statsPath := path.Join(cmd.storageDir, pathutils.CacheStatsFileName)
+	stats, err := cache.ReadStats(statsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cache stats: %s", err)
+	}
+	fmt.Printf("Builds: %d\n", stats.Builds)
+	fmt.Printf("Hits: %d\n", stats.Hits)
+	fmt.Printf("Misses: %d\n", stats.Misses)
+	fmt.Printf("Hit rate: %.1f%%\n", 100*stats.HitRate())
+
+	entries, err := cache.ListEntries(store)
+	if err == keyvalue.ErrNotSupported {
+		fmt.Println("Entries: unknown, the cache store can't be listed")
+	} else if err != nil {
+		return fmt.Errorf("failed to list cache entries: %s", err)
+	} else {
+		layers := make(map[image.Digest]bool)
+		var localLayers int
+		var localSize int64
+		for _, entry := range entries {
+			if entry.Layer == "" || layers[entry.Layer] {
+				continue
+			}
+			layers[entry.Layer] = true
+			if info, err := imageStore.Layers.GetStoreFileStat(entry.Layer.Hex()); err == nil {
+				localLayers++
+				localSize += info.Size()
+			}
+		}
+		fmt.Printf("Entries: %d\n", len(entries))
+		fmt.Printf("Layers: %d, %d in the storage dir (%d bytes)\n", len(layers), localLayers, localSize)
+	}
+
+	if cmd.resetStats {
+		if err := cache.ResetStats(statsPath); err != nil {
+			return fmt.Errorf("failed to reset cache stats: %s", err)
+		}
+	}
+	return nil
+}
+
+// Purge deletes the entries of the cache IDs from the cache store, or all
+// entries with --all. With --layers, their layers are also deleted from the
+// storage dir.
+func (cmd *cacheCmd) Purge(
+	store keyvalue.Store, imageStore *storage.ImageStore, cacheIDs []string) error {
+
+	var entries []cache.Entry
+	if cmd.purgeAll {
+		var err error
+		if entries, err = cache.ListEntries(store); err != nil {
+			return fmt.Errorf("failed to list cache entries: %s", err)
+		}
+	} else {
+		for _, cacheID := range cacheIDs {
+			entry, err := cache.GetEntry(store, cacheID)
+			if err != nil {
+				return fmt.Errorf("failed to get cache entry: %s", err)
+			} else if entry == nil {
+				log.Warnf("No cache entry for cache ID %s", cacheID)
+				continue
+			}
+			entries = append(entries, *entry)
+		}
+	}
+
+	var deletedLayers int
+	for _, entry := range entries {
+		namespaceStore := keyvalue.NewNamespaceStore(store, entry.Namespace)
+		if err := cache.DeleteEntry(namespaceStore, entry.CacheID); err != nil {
+			return fmt.Errorf("failed to delete cache entry: %s", err)
+		}
+		if !cmd.purgeLayers || entry.Layer == "" {
+			continue
+		}
+		err := imageStore.Layers.DeleteStoreFile(entry.Layer.Hex())
+		if err == nil {
+			deletedLayers++
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete layer %s: %s", entry.Layer.Hex(), err)
+		}
+	}
+	log.Infof("Deleted %d cache entries and %d layers", len(entries), deletedLayers)
+
+	// Chunks of deleted layers might not be used by other layers anymore.
+	if chunked, ok := imageStore.Layers.(*storage.ChunkedBlobStore); ok && deletedLayers > 0 {
+		removed, err := chunked.CollectGarbage()
+		if err != nil {
+			return fmt.Errorf("failed to collect layer chunks: %s", err)
+		}
+		log.Infof("Deleted %d unused layer chunks", removed)
+	}
+	return nil
+}
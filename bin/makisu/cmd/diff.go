@@ -55,9 +55,9 @@ func getDiffCmd() *diffCmd {
 func (cmd *diffCmd) Diff(imagesFullName []string) error {
 	var pullImages []image.Name
 	for _, imageFullName := range imagesFullName {
-		pullImage, err := image.ParseNameForPull(imageFullName)
+		pullImage, err := registry.ResolveNameForPull(imageFullName)
 		if err != nil {
-			return fmt.Errorf("parse image %s: %s", pullImage, err)
+			return fmt.Errorf("resolve image %s: %s", imageFullName, err)
 		}
 		pullImages = append(pullImages, pullImage)
 	}
@@ -90,11 +90,11 @@ func (cmd *diffCmd) Diff(imagesFullName []string) error {
 			if err != nil {
 				panic(fmt.Errorf("get reader from image %d layer: %s", i+1, err))
 			}
-			gzipReader, err := tario.NewGzipReader(reader)
+			layerReader, err := tario.NewDecompressionReader(reader)
 			if err != nil {
-				panic(fmt.Errorf("create gzip reader for layer: %s", err))
+				panic(fmt.Errorf("create decompression reader for layer: %s", err))
 			}
-			if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), false); err != nil {
+			if err = memfs.UpdateFromTarReader(tar.NewReader(layerReader), false); err != nil {
 				panic(fmt.Errorf("untar image %d layer reader: %s", i+1, err))
 			}
 		}
@@ -20,10 +20,11 @@ import (
 type pullCmd struct {
 	*cobra.Command
 
-	registry string
-	tag      string
-	cacerts  string
-	extract  string
+	registry    string
+	tag         string
+	cacerts     string
+	extract     string
+	concurrency int
 }
 
 func getPullCmd() *pullCmd {
@@ -49,6 +50,7 @@ func getPullCmd() *pullCmd {
 	pullCmd.PersistentFlags().StringVar(&pullCmd.cacerts, "cacerts", "/etc/ssl/certs", "The location of the CA certs to use for TLS authentication with the registry.")
 
 	pullCmd.PersistentFlags().StringVar(&pullCmd.extract, "extract", "", "The destination of the rootfs that we will untar the image to.")
+	pullCmd.PersistentFlags().IntVar(&pullCmd.concurrency, "pull-concurrency", 0, "Pull up to this many layers concurrently. Defaults to the concurrency of the registry config.")
 	return pullCmd
 }
 
@@ -61,6 +63,7 @@ func (cmd *pullCmd) Pull(repository string) {
 	registry.DefaultDockerHubConfiguration.Security.TLS.CA.Cert.Path = cmd.cacerts
 	registry.ConfigurationMap[image.DockerHubRegistry] = make(registry.RepositoryMap)
 	registry.ConfigurationMap[image.DockerHubRegistry]["library/*"] = registry.DefaultDockerHubConfiguration
+	registry.PullConcurrency = cmd.concurrency
 
 	client := registry.New(store, cmd.registry, repository)
 	manifest, err := client.Pull(cmd.tag)
@@ -102,11 +105,11 @@ func (cmd *pullCmd) Extract(store *storage.ImageStore, manifest *image.Distribut
 		if err != nil {
 			panic(fmt.Errorf("get reader from layer: %s", err))
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		layerReader, err := tario.NewDecompressionReader(reader)
 		if err != nil {
-			panic(fmt.Errorf("create gzip reader for layer: %s", err))
+			panic(fmt.Errorf("create decompression reader for layer: %s", err))
 		}
-		if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), true); err != nil {
+		if err = memfs.UpdateFromTarReader(tar.NewReader(layerReader), true); err != nil {
 			panic(fmt.Errorf("untar reader: %s", err))
 		}
 	}
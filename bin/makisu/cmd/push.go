@@ -38,9 +38,10 @@ type pushCmd struct {
 
 	tag string
 
-	pushRegistries []string
-	replicas       []string
-	registryConfig string
+	pushRegistries  []string
+	replicas        []string
+	pushConcurrency int
+	registryConfig  string
 }
 
 func getPushCmd() *pushCmd {
@@ -73,6 +74,7 @@ func getPushCmd() *pushCmd {
 
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.pushRegistries, "push", nil, "Registry to push image to")
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
+	pushCmd.PersistentFlags().IntVar(&pushCmd.pushConcurrency, "push-concurrency", 0, "Push up to this many layers of an image concurrently. Defaults to the concurrency of the registry config")
 	pushCmd.PersistentFlags().StringVar(&pushCmd.registryConfig, "registry-config", "", "Set build-time variables")
 
 	pushCmd.MarkFlagRequired("tag")
@@ -86,6 +88,10 @@ func (cmd *pushCmd) processFlags() error {
 	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
+	if cmd.pushConcurrency < 0 {
+		return fmt.Errorf("invalid push concurrency: %d", cmd.pushConcurrency)
+	}
+	registry.PushConcurrency = cmd.pushConcurrency
 
 	return nil
 }
@@ -77,6 +77,7 @@ func Execute() {
 	rootCmd.AddCommand(getPullCmd().Command)
 	rootCmd.AddCommand(getPushCmd().Command)
 	rootCmd.AddCommand(getDiffCmd().Command)
+	rootCmd.AddCommand(getCacheCmd().Command)
 	if err := rootCmd.Execute(); err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -16,14 +16,20 @@ package cmd
 
 import (
 	ctx "context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/uber/makisu/lib/builder"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
@@ -35,10 +41,19 @@ import (
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/utils"
+	"github.com/uber/makisu/lib/utils/gitutil"
 	"github.com/uber/makisu/lib/utils/stringset"
 )
 
 func initRegistryConfig(registryConfig string) error {
+	dockerConfig, err := security.LoadDockerConfig(security.DefaultDockerConfigPath())
+	if err != nil {
+		return fmt.Errorf("load docker config: %s", err)
+	}
+	security.GlobalDockerConfig = dockerConfig
+
 	if registryConfig == "" {
 		return nil
 	}
@@ -51,50 +66,60 @@ func initRegistryConfig(registryConfig string) error {
 
 // Finds a way to get the dockerfile.
 // If the context passed in is not a local path, then it will try to clone the
-// git repo.
-func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, error) {
+// git repo. The target platform args are set to the given platform, or the
+// build platform if it's nil. The build args the dockerfile was parsed with
+// are returned with its stages.
+func (cmd *buildCmd) getDockerfile(
+	contextDir string, platform *builder.Platform) ([]*dockerfile.Stage, map[string]string, error) {
+
 	fi, err := os.Lstat(contextDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
+		return nil, nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
 	} else if !fi.Mode().IsDir() {
-		return nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
-	}
-
-	dockerfilePath := cmd.dockerfilePath
-	if !path.IsAbs(dockerfilePath) {
-		dockerfilePath = path.Join(contextDir, dockerfilePath)
+		return nil, nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
 	}
 
 	log.Infof("Using build context: %s", contextDir)
-	contents, err := ioutil.ReadFile(dockerfilePath)
+	contents, err := ioutil.ReadFile(cmd.getDockerfilePath(contextDir))
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate/find dockerfile in context: %s", err)
+		return nil, nil, fmt.Errorf("failed to generate/find dockerfile in context: %s", err)
 	}
 
-	buildArgMap := make(map[string]string)
-	for _, pair := range cmd.buildArgs {
-		parts := strings.Split(pair, "=")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("failed to parse build-arg %s: %s", pair, err)
-		}
-		buildArgMap[parts[0]] = parts[1]
+	buildArgMap, err := dockerfile.ParseBuildArgs(cmd.buildArgs, cmd.buildArgsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse build args: %s", err)
+	}
+	buildPlatform := runtime.GOOS + "/" + runtime.GOARCH
+	targetPlatform := buildPlatform
+	if platform != nil {
+		targetPlatform = platform.String()
 	}
+	dockerfile.SetPlatformArgs(buildArgMap, buildPlatform, targetPlatform)
 
 	dockerfile, err := dockerfile.ParseFile(string(contents), buildArgMap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse dockerfile: %s", err)
+		return nil, nil, fmt.Errorf("failed to parse dockerfile: %s", err)
 	}
-	return dockerfile, nil
+	return dockerfile, buildArgMap, nil
+}
+
+// getDockerfilePath returns the path of the dockerfile, relative paths being
+// relative to the context dir.
+func (cmd *buildCmd) getDockerfilePath(contextDir string) string {
+	if path.IsAbs(cmd.dockerfilePath) {
+		return cmd.dockerfilePath
+	}
+	return path.Join(contextDir, cmd.dockerfilePath)
 }
 
 func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
-	if cmd.tag == "" {
+	if len(cmd.tags) == 0 || cmd.tags[0] == "" {
 		msg := "please specify a target image name: makisu build -t=(<registry:port>/)<repo>:<tag> ./"
 		return image.Name{}, errors.New(msg)
 	}
 
 	// Parse the target's image name into its components.
-	targetImageName := image.MustParseName(cmd.tag)
+	targetImageName := image.MustParseName(cmd.tags[0])
 	if len(cmd.pushRegistries) == 0 {
 		return targetImageName, nil
 	}
@@ -109,15 +134,378 @@ func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
 	), nil
 }
 
-// pushImage pushes the specified image to docker registry.
-// Exits with non-0 status code if it encounters an error.
-func pushImage(buildContext *context.BuildContext, imageName image.Name) error {
-	registryClient := registry.New(
-		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository())
-	if err := registryClient.Push(imageName.GetTag()); err != nil {
-		return fmt.Errorf("failed to push image: %s", err)
+// getReplicaNames returns the names of the --replica flags, and those of the
+// image in each --push registry under the tags of the -t flags after the first.
+func (cmd *buildCmd) getReplicaNames() []image.Name {
+	var replicas []image.Name
+	for _, replica := range cmd.replicas {
+		replicas = append(replicas, image.MustParseName(replica))
+	}
+	for i := 1; i < len(cmd.tags); i++ {
+		name := image.MustParseName(cmd.tags[i])
+		for _, registry := range cmd.pushRegistries {
+			replicas = append(replicas, name.WithRegistry(registry))
+		}
+	}
+	return replicas
+}
+
+// getStageImageNames parses the --stage-tag values into image names, keyed by
+// stage alias.
+func (cmd *buildCmd) getStageImageNames() (map[string][]image.Name, error) {
+	stageImages := make(map[string][]image.Name)
+	for _, stageTag := range cmd.stageTags {
+		parts := strings.SplitN(stageTag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid stage tag %s, expected <stage>=<image tag>", stageTag)
+		}
+		name, err := image.ParseName(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse image name %s: %s", parts[1], err)
+		}
+		if len(cmd.pushRegistries) != 0 {
+			// Same as the target image, the first --push registry overrides
+			// the one in the image name.
+			name = image.NewImageName(
+				cmd.pushRegistries[0], name.GetRepository(), name.GetTag())
+		}
+		stageImages[parts[0]] = append(stageImages[parts[0]], name)
+	}
+	return stageImages, nil
+}
+
+// getPlatforms parses the comma separated --platform value. It returns nil if
+// no platform is set.
+func (cmd *buildCmd) getPlatforms() ([]builder.Platform, error) {
+	if cmd.platform == "" {
+		return nil, nil
+	}
+	var platforms []builder.Platform
+	seen := make(map[builder.Platform]bool)
+	for _, value := range strings.Split(cmd.platform, ",") {
+		platform, err := builder.ParsePlatform(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		if seen[platform] {
+			return nil, fmt.Errorf("duplicate platform %s", platform)
+		}
+		seen[platform] = true
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// getStagePlatforms parses the --stage-platform values, keyed by stage.
+func (cmd *buildCmd) getStagePlatforms() (map[string]builder.Platform, error) {
+	stagePlatforms := make(map[string]builder.Platform)
+	for _, stagePlatform := range cmd.stagePlatforms {
+		parts := strings.SplitN(stagePlatform, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid stage platform %s, expected <stage>=<os>/<arch>", stagePlatform)
+		}
+		platform, err := builder.ParsePlatform(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		stagePlatforms[parts[0]] = platform
+	}
+	return stagePlatforms, nil
+}
+
+// parseKeyValues parses flag values of the form <key>=<value>, like the
+// --default-label ones. name is the name of the values used in errors.
+func parseKeyValues(name string, values []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %s, expected <key>=<value>", name, value)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+// tagMetadata is the build metadata -t values can expand, as in
+// "myimage:{{.GitSHA}}-{{.Date}}".
+type tagMetadata struct {
+	// Date is the date the build started, as 20060102 in UTC.
+	Date string
+	// Timestamp is the time the build started, in Unix seconds.
+	Timestamp int64
+	// Env are the environment variables of makisu, as in "{{.Env.BUILD_ID}}".
+	Env map[string]string
+
+	revision string
+}
+
+// GitSHA returns the commit checked out in the git repo of the context dir.
+func (m tagMetadata) GitSHA() (string, error) {
+	if m.revision == "" {
+		return "", errors.New("context dir is not in a git repo")
+	}
+	return m.revision, nil
+}
+
+// GitShortSHA returns the first 7 characters of GitSHA.
+func (m tagMetadata) GitShortSHA() (string, error) {
+	revision, err := m.GitSHA()
+	if err != nil {
+		return "", err
+	}
+	if len(revision) > 7 {
+		revision = revision[:7]
+	}
+	return revision, nil
+}
+
+// expandTags expands the templates in the -t values with the metadata of the
+// build of contextDir, which starts at the given time.
+func (cmd *buildCmd) expandTags(contextDir string, start time.Time) error {
+	var metadata *tagMetadata
+	for i, tag := range cmd.tags {
+		if !strings.Contains(tag, "{{") {
+			continue
+		}
+		if metadata == nil {
+			revision, err := gitutil.Revision(contextDir)
+			if err != nil {
+				return fmt.Errorf("get git revision of context dir: %s", err)
+			}
+			metadata = &tagMetadata{
+				Date:      start.UTC().Format("20060102"),
+				Timestamp: start.Unix(),
+				Env:       make(map[string]string),
+				revision:  revision,
+			}
+			for _, env := range os.Environ() {
+				if parts := strings.SplitN(env, "=", 2); len(parts) == 2 {
+					metadata.Env[parts[0]] = parts[1]
+				}
+			}
+		}
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return fmt.Errorf("parse tag %s: %s", tag, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, metadata); err != nil {
+			return fmt.Errorf("expand tag %s: %s", tag, err)
+		}
+		log.Infof("Expanded tag %s to %s", tag, b.String())
+		cmd.tags[i] = b.String()
+	}
+	return nil
+}
+
+// rebuildAndDiff builds the images again without cache, in a new build
+// context, and fails with the differences if they don't match the images of
+// the first build. It returns the plan and manifests of the second build.
+func (cmd *buildCmd) rebuildAndDiff(
+	buildContext *context.BuildContext, first *builder.BuildPlan, imageName image.Name,
+	platform *builder.Platform, replicas []image.Name, stageImages map[string][]image.Name,
+	debugImage *image.Name) (*builder.BuildPlan, map[string]*image.DistributionManifest, error) {
+
+	log.Info("Building again without cache to check reproducibility")
+	secondContext, err := context.NewBuildContext(
+		buildContext.RootDir, buildContext.ContextDir, buildContext.ImageStore)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create build context: %s", err)
+	}
+	defer secondContext.Cleanup()
+	if cmd.allowModifyFS {
+		secondContext.MemFS.Remove()
+		defer secondContext.MemFS.Remove()
+	}
+
+	second, err := cmd.newBuildPlan(
+		secondContext, imageName, platform, replicas, stageImages, debugImage, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create build plan: %s", err)
+	}
+	manifests, err := second.ExecuteStages()
+	if err != nil {
+		return nil, nil, fmt.Errorf("execute build plan: %s", err)
+	}
+	diffs, err := builder.DiffBuilds(first, second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("diff builds: %s", err)
+	}
+	if len(diffs) > 0 {
+		for _, diff := range diffs {
+			log.Errorf("Build is not reproducible: %s", diff)
+		}
+		return nil, nil, fmt.Errorf("found %d differences between builds", len(diffs))
+	}
+	log.Info("Build is reproducible")
+	return second, manifests, nil
+}
+
+// validateMultiPlatform checks that the flags are supported when building for
+// several platforms. Only the manifest list is pushed, so outputs of a single
+// image can't be produced.
+func (cmd *buildCmd) validateMultiPlatform() error {
+	if len(cmd.pushRegistries) == 0 {
+		return fmt.Errorf("building for several platforms requires --push")
+	}
+	unsupported := []struct {
+		flag string
+		set  bool
+	}{
+		{"--replica", len(cmd.replicas) != 0},
+		{"more than one -t", len(cmd.tags) > 1},
+		{"--stage-tag", len(cmd.stageTags) != 0},
+		{"--debug-tag", cmd.debugTag != ""},
+		{"--check-reproducible", cmd.checkReproducible},
+		{"--provenance", cmd.provenancePath != ""},
+		{"--cache-key-report", cmd.cacheKeyReportPath != ""},
+		{"--dest", cmd.destination != ""},
+		{"--load", cmd.doLoad},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported when building for several platforms", u.flag)
+		}
+	}
+	return nil
+}
+
+// buildPlatforms builds the image once for each platform, tagged
+// <tag>-<os>-<arch>, then pushes them and a manifest list referencing them
+// under the target tag to each --push registry.
+func (cmd *buildCmd) buildPlatforms(
+	buildContext *context.BuildContext, imageName image.Name, platforms []builder.Platform) error {
+
+	var platformTags []registry.PlatformTag
+	for _, platform := range platforms {
+		tag := fmt.Sprintf("%s-%s-%s", imageName.GetTag(), platform.OS, platform.Architecture)
+		if err := cmd.buildPlatform(buildContext, imageName.WithTag(tag), platform); err != nil {
+			return fmt.Errorf("failed to build platform %s: %s", platform, err)
+		}
+		platformTags = append(platformTags, registry.PlatformTag{
+			Tag:      tag,
+			Platform: image.Platform{OS: platform.OS, Architecture: platform.Architecture},
+		})
+	}
+
+	if err := cmd.switchToPostBuildUser(); err != nil {
+		return err
+	}
+	digests := registry.NewPushedDigests()
+	for _, pushRegistry := range cmd.pushRegistries {
+		target := imageName.WithRegistry(pushRegistry)
+		registryClient := registry.New(
+			buildContext.ImageStore, target.GetRegistry(), target.GetRepository())
+		digest, err := registryClient.PushManifestList(target.GetTag(), platformTags)
+		if err != nil {
+			return fmt.Errorf("failed to push manifest list: %s", err)
+		}
+		digests.Add(target, digest, true)
+		log.Infof("Successfully pushed manifest list %s to %s", target, target.GetRegistry())
+	}
+	if cmd.digestFile != "" {
+		if err := digests.WriteFile(cmd.digestFile, cmd.digestFileFormat); err != nil {
+			return fmt.Errorf("failed to write digest file: %s", err)
+		}
+		log.Infof("Wrote image digest %s to %s", digests.Digest, cmd.digestFile)
+	}
+	log.Infof("Finished building %s for %d platforms", imageName.ShortName(), len(platforms))
+	return nil
+}
+
+// buildPlatform builds the image for one platform in a new build context, so
+// the file system starts clean for every platform.
+func (cmd *buildCmd) buildPlatform(
+	buildContext *context.BuildContext, imageName image.Name, platform builder.Platform) error {
+
+	log.Infof("Building image %s for platform %s", imageName.ShortName(), platform)
+	platformContext, err := context.NewBuildContext(
+		buildContext.RootDir, buildContext.ContextDir, buildContext.ImageStore)
+	if err != nil {
+		return fmt.Errorf("create build context: %s", err)
+	}
+	defer platformContext.Cleanup()
+	if cmd.allowModifyFS {
+		platformContext.MemFS.Remove()
+		defer platformContext.MemFS.Remove()
+	}
+
+	plan, err := cmd.newBuildPlan(platformContext, imageName, &platform, nil, nil, nil, true)
+	if err != nil {
+		return fmt.Errorf("create build plan: %s", err)
+	}
+	if _, err := plan.ExecuteStages(); err != nil {
+		return fmt.Errorf("execute build plan: %s", err)
+	}
+	log.Infof("Successfully built image %s", imageName.ShortName())
+	return nil
+}
+
+// switchToPostBuildUser drops privileges to the --post-build-user, if set.
+func (cmd *buildCmd) switchToPostBuildUser() error {
+	if cmd.postBuildUser == "" {
+		return nil
+	}
+	uid, gid, err := utils.ResolveChown(cmd.postBuildUser)
+	if err != nil {
+		return fmt.Errorf("failed to resolve post build user: %s", err)
+	}
+	if err := utils.DropPrivileges(uid, gid, cmd.storageDir); err != nil {
+		return fmt.Errorf("failed to drop privileges: %s", err)
+	}
+	log.Infof("Dropped privileges to uid %d, gid %d", uid, gid)
+	return nil
+}
+
+// pushTarget is an image to push, and whether it's the target image of the
+// build rather than a stage or debug image.
+type pushTarget struct {
+	name   image.Name
+	target bool
+}
+
+// pushImages pushes the images to their docker registries in parallel, and
+// records their digests, as the target image's for targets. The outcome of
+// each push is logged, and the returned error lists the failed ones.
+func pushImages(
+	buildContext *context.BuildContext, targets []pushTarget,
+	digests *registry.PushedDigests) error {
+
+	pushed := make([]image.Digest, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := targets[i].name
+			registryClient := registry.New(
+				buildContext.ImageStore, name.GetRegistry(), name.GetRepository())
+			pushed[i], errs[i] = registryClient.PushWithDigest(name.GetTag())
+			if errs[i] != nil {
+				log.Errorf("Failed to push %s to %s: %s", name, name.GetRegistry(), errs[i])
+				return
+			}
+			log.Infof("Successfully pushed %s to %s", name, name.GetRegistry())
+		}(i)
+	}
+	wg.Wait()
+
+	// Digests are recorded in order, so the first target sets the digest of
+	// the build.
+	var failed []string
+	for i, t := range targets {
+		if errs[i] != nil {
+			failed = append(failed, t.name.String())
+			continue
+		}
+		digests.Add(t.name, pushed[i], t.target)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to push %d of %d images: %s",
+			len(failed), len(targets), strings.Join(failed, ", "))
 	}
-	log.Infof("Successfully pushed %s to %s", imageName, imageName.GetRegistry())
 	return nil
 }
 
@@ -145,7 +533,11 @@ func (cmd *buildCmd) loadImage(buildContext *context.BuildContext, imageName ima
 func (cmd *buildCmd) saveImage(buildContext *context.BuildContext, imageName image.Name) error {
 	log.Infof("Saving image %s at location %s", imageName.ShortName(), cmd.destination)
 	tarer := cli.NewDefaultImageTarer(buildContext.ImageStore)
-	if tar, err := tarer.CreateTarReadCloser(imageName); err != nil {
+	createTar := tarer.CreateTarReadCloser
+	if cmd.oci {
+		createTar = tarer.CreateOCILayoutTarReadCloser
+	}
+	if tar, err := createTar(imageName); err != nil {
 		return fmt.Errorf("failed to create a tarball from image layers and manifests: %s", err)
 	} else if err := fileio.ReaderToFile(tar, cmd.destination); err != nil {
 		return fmt.Errorf("failed to write image tarball to destination %s: %s", cmd.destination, err)
@@ -153,6 +545,35 @@ func (cmd *buildCmd) saveImage(buildContext *context.BuildContext, imageName ima
 	return nil
 }
 
+// writeProvenance writes the provenance of the target image as JSON to the
+// --provenance path.
+func (cmd *buildCmd) writeProvenance(
+	buildContext *context.BuildContext, plan *builder.BuildPlan,
+	manifests map[string]*image.DistributionManifest) error {
+
+	contents, err := ioutil.ReadFile(cmd.getDockerfilePath(buildContext.ContextDir))
+	if err != nil {
+		return fmt.Errorf("read dockerfile: %s", err)
+	}
+	buildArgs, err := dockerfile.ParseBuildArgs(cmd.buildArgs, cmd.buildArgsFile)
+	if err != nil {
+		return fmt.Errorf("parse build args: %s", err)
+	}
+	provenance, err := plan.Provenance(manifests, contents, buildContext.ContextDir, buildArgs)
+	if err != nil {
+		return fmt.Errorf("get provenance: %s", err)
+	}
+	b, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal provenance: %s", err)
+	}
+	if err := ioutil.WriteFile(cmd.provenancePath, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("write provenance: %s", err)
+	}
+	log.Infof("Wrote provenance to %s", cmd.provenancePath)
+	return nil
+}
+
 // cleanManifest removes specified image manifest from local filesystem.
 func cleanManifest(buildContext *context.BuildContext, imageName image.Name) error {
 	repo, tag := imageName.GetRepository(), imageName.GetTag()
@@ -164,35 +585,50 @@ func cleanManifest(buildContext *context.BuildContext, imageName image.Name) err
 }
 
 // newCacheManager inits and returns a cache manager object.
-func (cmd *buildCmd) newCacheManager(buildContext *context.BuildContext, imageName image.Name) cache.Manager {
-	var kvStore keyvalue.Store
-	var err error
-	if cmd.redisCacheAddress != "" {
-		log.Infof("Using redis at %s for cacheID storage", cmd.redisCacheAddress)
+func (cmd *buildCmd) newCacheManager(
+	buildContext *context.BuildContext, imageName image.Name) (cache.Manager, error) {
 
-		kvStore, err = keyvalue.NewRedisStore(cmd.redisCacheAddress, cmd.redisCachePassword, cmd.redisCacheTTL)
-		if err != nil {
-			log.Errorf("Failed to connect to redis store: %s", err)
-		}
-	} else if cmd.httpCacheAddress != "" {
-		log.Infof("Using http server at %s for cacheID storage", cmd.httpCacheAddress)
+	var kvStore keyvalue.Store
+	newLocalStore := func() (keyvalue.Store, error) {
+		log.Infof("Using local file at %s for cacheID storage",
+			path.Join(buildContext.ImageStore.RootDir, pathutils.CacheKeyValueFileName))
+		return cmd.newLocalStore(buildContext.ImageStore)
+	}
+	var fallback func() (keyvalue.Store, error)
+	if cmd.localCacheTTL != 0 {
+		fallback = newLocalStore
+	}
+	newRemoteStore, remoteName, err := cmd.remoteStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure cache store: %s", err)
+	}
+	if newRemoteStore != nil {
+		log.Infof("Using %s for cacheID storage", remoteName)
 
-		kvStore, err = keyvalue.NewHTTPStore(cmd.httpCacheAddress, cmd.httpCacheHeaders...)
+		kvStore, err = keyvalue.Connect(
+			newRemoteStore, fallback, cmd.cacheHealthTimeout, cmd.cacheFailOpen)
 		if err != nil {
-			log.Errorf("Failed to instantiate cache id store: %s", err)
+			return nil, fmt.Errorf("failed to connect to %s: %s", remoteName, err)
 		}
 	} else if cmd.localCacheTTL != 0 {
-		fullpath := path.Join(buildContext.ImageStore.RootDir, pathutils.CacheKeyValueFileName)
-		log.Infof("Using local file at %s for cacheID storage", fullpath)
-
-		kvStore, err = keyvalue.NewFSStore(
-			fullpath, buildContext.ImageStore.SandboxDir, cmd.localCacheTTL)
+		kvStore, err = newLocalStore()
 		if err != nil {
 			log.Errorf("Failed to init local cache ID store: %s", err)
 		}
-	} else {
-		log.Infof("No cache option provided, not using cache")
-		return cache.NewNoopCacheManager()
+	}
+	if kvStore == nil {
+		if len(cmd.cacheFrom) == 0 && len(cmd.cacheTo) == 0 && !cmd.inlineCache {
+			log.Infof("No cache option provided, not using cache")
+			return cache.NewNoopCacheManager(), nil
+		}
+		// Cache images still need a store for the entries of this build.
+		log.Infof("Using memory for cacheID storage, only cache images are shared between builds")
+		kvStore = keyvalue.NewMemStore()
+	}
+
+	if cmd.gitCacheNamespace != "" {
+		namespace := cache.GitNamespace(buildContext.ContextDir, cmd.gitCacheNamespace)
+		kvStore = keyvalue.NewNamespaceStore(kvStore, namespace)
 	}
 
 	var registryClient registry.Client
@@ -204,7 +640,36 @@ func (cmd *buildCmd) newCacheManager(buildContext *context.BuildContext, imageNa
 		registryClient = registry.New(
 			buildContext.ImageStore, registryAddr, imageName.GetRepository())
 	}
-	return cache.New(buildContext.ImageStore, kvStore, registryClient)
+	cacheMgr := cache.New(buildContext.ImageStore, kvStore, registryClient)
+
+	// Cache images are optional: the first build doesn't have any yet.
+	cacheImages, err := parseCacheImageNames(cmd.cacheFrom)
+	if err != nil {
+		return nil, fmt.Errorf("parse cache from images: %s", err)
+	}
+	for _, name := range cacheImages {
+		client := registry.New(buildContext.ImageStore, name.GetRegistry(), name.GetRepository())
+		if err := cacheMgr.ImportImage(client, name.GetTag()); err != nil {
+			log.Warnf("Failed to import cache image %s: %s", name, err)
+			continue
+		}
+		log.Infof("Imported cache image %s", name)
+	}
+	return cacheMgr, nil
+}
+
+// parseCacheImageNames parses the --cache-from or --cache-to values into image
+// names.
+func parseCacheImageNames(values []string) ([]image.Name, error) {
+	var names []image.Name
+	for _, value := range values {
+		name, err := image.ParseName(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse image name %s: %s", value, err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
 }
 
 func maybeBlacklistVarRun() error {
@@ -8,7 +8,7 @@ require (
 	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
 	github.com/alicebob/miniredis v2.4.5+incompatible
 	github.com/andres-erbsen/clock v0.0.0-20160526145045-9e14626cd129
-	github.com/aws/aws-sdk-go v1.30.1 // indirect
+	github.com/aws/aws-sdk-go v1.30.1
 	github.com/awslabs/amazon-ecr-credential-helper v0.4.0
 	github.com/axw/gocov v0.0.0-20170322000131-3a69a0d2a4ef
 	github.com/cenkalti/backoff v2.2.1+incompatible
@@ -28,8 +28,7 @@ require (
 	github.com/gorilla/mux v1.6.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/juju/ratelimit v1.0.1
-	github.com/klauspost/compress v1.4.1 // indirect
-	github.com/klauspost/cpuid v1.2.0 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/klauspost/pgzip v1.2.1
 	github.com/matm/gocov-html v0.0.0-20160206185555-f6dd0fd0ebc7
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
@@ -51,7 +50,7 @@ require (
 	go.uber.org/zap v1.9.1
 	golang.org/x/lint v0.0.0-20190301231843-5614ed5bae6f
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/tools v0.0.0-20190425150028-36563e24a262
 	gopkg.in/yaml.v2 v2.2.2
 )
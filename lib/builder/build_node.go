@@ -26,6 +26,8 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/tario"
+
+	"github.com/pkg/errors"
 )
 
 // buildNodeOptions wraps options that are specified when a node is built.
@@ -35,6 +37,12 @@ type buildNodeOptions struct {
 	modifyFS    bool // If true, the node will modify the file system.
 }
 
+// linkedStep is implemented by steps that can create their layer
+// independently of the previous ones, like COPY --link.
+type linkedStep interface {
+	LinkCacheID() string
+}
+
 // buildNode corresponds to a single BuildStep and its metadata.
 type buildNode struct {
 	step.BuildStep
@@ -45,6 +53,9 @@ type buildNode struct {
 
 	// digestPair are the layer(s) committed or fetched by this node.
 	digestPairs []*image.DigestPair
+
+	// cachedOutput is the command output stored with the fetched layer.
+	cachedOutput string
 }
 
 // newBuildNode initializes a buildNode.
@@ -68,6 +79,9 @@ func (n *buildNode) Build(
 		return nil, fmt.Errorf("apply config: %s", err)
 	}
 
+	if n.digestPairs == nil && !opts.skipBuild {
+		n.pullLinkedCacheLayer(cacheMgr)
+	}
 	cached := n.digestPairs != nil
 	if cached {
 		// The step was cached.
@@ -81,8 +95,10 @@ func (n *buildNode) Build(
 
 	if opts.skipBuild {
 		log.Infof("* Skipping execution; a later step was cached *")
+		n.replayOutput()
 	} else if cached {
 		log.Infof("* Skipping execution; cache was applied *")
+		n.replayOutput()
 	} else if err := n.doExecute(cacheMgr, opts); err != nil {
 		return nil, fmt.Errorf("do execute: %s", err)
 	} else if !n.HasCommit() && !opts.forceCommit {
@@ -135,13 +151,14 @@ func (n *buildNode) applyLayer(digestPair *image.DigestPair, modifyfs bool) erro
 	if err != nil {
 		return fmt.Errorf("get reader from layer: %s", err)
 	}
-	gzipReader, err := tario.NewGzipReader(reader)
+	layerReader, err := tario.NewDecompressionReader(reader)
 	if err != nil {
-		return fmt.Errorf("create gzip reader for layer: %s", err)
+		return fmt.Errorf("create decompression reader for layer: %s", err)
 	}
+	defer layerReader.Close()
 	log.Infof("* Applying cache layer %s (unpack=%v)",
 		digestPair.GzipDescriptor.Digest.Hex(), modifyfs)
-	if err := n.ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyfs); err != nil {
+	if err := n.ctx.MemFS.UpdateFromTarReader(tar.NewReader(layerReader), modifyfs); err != nil {
 		return fmt.Errorf("untar reader: %s", err)
 	}
 	return nil
@@ -159,23 +176,88 @@ func (n *buildNode) pushCacheLayer(cacheMgr cache.Manager) error {
 			digestPair.GzipDescriptor.Digest, digestPair.GzipDescriptor.Size)
 	}
 	log.Infof("* Pushing with cache ID %s", n.CacheID())
-	return cacheMgr.PushCache(n.CacheID(), digestPair)
+	if err := cacheMgr.PushCache(n.CacheID(), digestPair); err != nil {
+		return err
+	}
+	if linked, ok := n.BuildStep.(linkedStep); ok && digestPair != nil {
+		if id := linked.LinkCacheID(); id != "" {
+			log.Infof("* Pushing with linked cache ID %s", id)
+			if err := cacheMgr.PushCache(id, digestPair); err != nil {
+				return err
+			}
+		}
+	}
+	if run, ok := n.BuildStep.(*step.RunStep); ok && run.Output() != "" {
+		return cacheMgr.PushOutput(n.CacheID(), run.Output())
+	}
+	return nil
 }
 
 // pullCacheLayer pulls cached layers for this node's digest pair(s).
 func (n *buildNode) pullCacheLayer(cacheMgr cache.Manager) bool {
 	digestPair, err := cacheMgr.PullCache(n.CacheID())
 	if err != nil {
-		// TODO: distinguish cache not found and pull failure.
-		log.Errorf("Failed to fetch intermediate layer with cache ID %s: %s", n.CacheID(), err)
+		// Entries whose layer can't be pulled are treated as misses, the step
+		// is rebuilt and its new layer overwrites the entry.
+		if errors.Cause(err) == cache.ErrorLayerNotFound {
+			log.Errorf("Failed to fetch intermediate layer with cache ID %s: %s", n.CacheID(), err)
+		} else {
+			log.Warnf("Failed to pull cached layer with cache ID %s, rebuilding: %s", n.CacheID(), err)
+		}
 		return false
 	} else if digestPair == nil {
 		return true
 	}
 	n.digestPairs = []*image.DigestPair{digestPair}
+
+	if _, ok := n.BuildStep.(*step.RunStep); ok && step.RunOutputLimit > 0 {
+		if n.cachedOutput, err = cacheMgr.PullOutput(n.CacheID()); err != nil {
+			log.Warnf("Failed to pull cached output with cache ID %s: %s", n.CacheID(), err)
+		}
+	}
 	return true
 }
 
+// pullLinkedCacheLayer pulls the layer of a linked step that was cached after
+// different previous steps. It also pushes it with the node's cache ID, so the
+// next builds find it without breaking the cache chain. It doesn't pull
+// anything if changes of previous steps are not committed yet, since they
+// would have been part of the layer.
+func (n *buildNode) pullLinkedCacheLayer(cacheMgr cache.Manager) {
+	linked, ok := n.BuildStep.(linkedStep)
+	if !ok || n.ctx.MustScan || len(n.ctx.CopyOps) > 0 {
+		return
+	}
+	id := linked.LinkCacheID()
+	if id == "" {
+		return
+	}
+	digestPair, err := cacheMgr.PullCache(id)
+	if err != nil {
+		log.Infof("* No layer cached with linked cache ID %s: %s", id, err)
+		return
+	} else if digestPair == nil {
+		return
+	}
+	log.Infof("* Reusing layer cached with linked cache ID %s", id)
+	n.digestPairs = []*image.DigestPair{digestPair}
+	if err := cacheMgr.PushCache(n.CacheID(), digestPair); err != nil {
+		log.Warnf("Failed to push linked layer with cache ID %s: %s", n.CacheID(), err)
+	}
+}
+
+// replayOutput logs the command output stored with the cached layer, so
+// cached and uncached builds log the same output.
+func (n *buildNode) replayOutput() {
+	if n.cachedOutput == "" {
+		return
+	}
+	log.Infof("* Replaying cached output of %s *", n.String())
+	for _, line := range strings.Split(strings.TrimSuffix(n.cachedOutput, "\n"), "\n") {
+		log.Infof("[cached] %s", line)
+	}
+}
+
 func (opts *buildNodeOptions) String() string {
 	s := []string{}
 	if opts.skipBuild {
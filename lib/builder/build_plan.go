@@ -19,12 +19,17 @@ import (
 	"hash/crc32"
 	"os"
 	"strconv"
+	"strings"
+	"text/template"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/stringset"
 )
@@ -47,6 +52,10 @@ type BuildPlan struct {
 	stages []*buildStage
 	// Which stage is the target for this plan
 	stageTarget string
+	// Additional stages to save as their own images, keyed by stage alias.
+	stageImages map[string][]image.Name
+	// Optional debug variant of the target image.
+	debugVariant *DebugVariant
 
 	// TODO: this is not used for now.
 	// Aliases of stages.
@@ -58,6 +67,41 @@ type BuildPlan struct {
 	// stages list to support `COPY --from=<image>`.
 	stageIndexAliases map[string]*buildStage
 
+	// platform is the platform base images are pulled for, and that output
+	// images must declare. Validation is skipped if it's nil.
+	// fromPlatforms, set by `FROM --platform`, overrides it for some stages,
+	// and stagePlatforms overrides both, keyed by alias.
+	platform              *Platform
+	fromPlatforms         map[string]Platform
+	stagePlatforms        map[string]Platform
+	allowPlatformMismatch bool
+
+	// maxImageSize limits the compressed size of saved images, if positive.
+	maxImageSize         int64
+	allowOversizedImages bool
+
+	// defaultLabels are added to all saved images, see SetDefaultLabels.
+	defaultLabels map[string]*template.Template
+	revision      string
+
+	// ociAnnotations and ociLayerAnnotations are added to OCI manifests and
+	// their layers, see SetOCIAnnotations.
+	ociAnnotations      map[string]*template.Template
+	ociLayerAnnotations map[string]*template.Template
+
+	// layerPusher pushes layers while the build goes on, see SetLayerPush.
+	layerPusher *layerPusher
+
+	// cacheImages are the cache images exported after the build, see
+	// SetCacheImages.
+	cacheImages []image.Name
+	// inlineCache is set if saved images embed their cache, see
+	// SetInlineCache.
+	inlineCache bool
+
+	// buildArgs resolve the ARG triggers of base images, see SetBuildArgs.
+	buildArgs map[string]string
+
 	opts *buildPlanOptions
 }
 
@@ -77,6 +121,7 @@ func NewBuildPlan(
 		stageTarget:       stageTarget,
 		stageAliases:      make(map[string]struct{}),
 		stageIndexAliases: make(map[string]*buildStage),
+		fromPlatforms:     make(map[string]Platform),
 		opts: &buildPlanOptions{
 			forceCommit:   forceCommit,
 			allowModifyFS: allowModifyFS,
@@ -86,17 +131,212 @@ func NewBuildPlan(
 	if err := plan.processStagesAndAliases(ctx, parsedStages); err != nil {
 		return nil, fmt.Errorf("process stages and aliases: %s", err)
 	}
+	if err := plan.dedupeImageNames(); err != nil {
+		return nil, fmt.Errorf("check image names: %s", err)
+	}
+	if len(plan.fromPlatforms) > 0 {
+		if err := plan.applyPlatforms(); err != nil {
+			return nil, fmt.Errorf("apply platforms: %s", err)
+		}
+	}
+	// Stages sharing a base image resolve and pull it only once.
+	plan.SetBaseImagePuller(step.NewBaseImagePuller(ctx.ImageStore, 1))
 
 	return plan, nil
 }
 
+// SetPlatform makes the plan pull base images for the given platform, and
+// verify that the output image configs declare it. A mismatch fails the build
+// unless allowMismatch is set, in which case it's only logged. So do stages
+// with RUN steps that the host can't run for their platform. Stages with
+// `FROM --platform` keep their own platform.
+func (plan *BuildPlan) SetPlatform(platform Platform, allowMismatch bool) error {
+	plan.platform = &platform
+	plan.allowPlatformMismatch = allowMismatch
+	return plan.applyPlatforms()
+}
+
+// SetStagePlatforms overrides the platform of the given stages, keyed by
+// alias. Their base images are pulled for that platform, and if they produce
+// images, those must declare it.
+func (plan *BuildPlan) SetStagePlatforms(platforms map[string]Platform) error {
+	for alias := range platforms {
+		if _, ok := plan.stageAliases[alias]; !ok {
+			return fmt.Errorf("stage not found in dockerfile %s", alias)
+		}
+	}
+	plan.stagePlatforms = make(map[string]Platform)
+	for alias, platform := range platforms {
+		plan.stagePlatforms[alias] = platform
+	}
+	return plan.applyPlatforms()
+}
+
+// stagePlatform returns the platform of a stage, or nil if it has none.
+func (plan *BuildPlan) stagePlatform(alias string) *Platform {
+	if platform, ok := plan.stagePlatforms[alias]; ok {
+		return &platform
+	} else if platform, ok := plan.fromPlatforms[alias]; ok {
+		return &platform
+	}
+	return plan.platform
+}
+
+// applyPlatforms sets the platform of the FROM step of each stage, which
+// changes the cache IDs of all following steps.
+func (plan *BuildPlan) applyPlatforms() error {
+	for _, stage := range plan.stages {
+		platform := plan.stagePlatform(stage.alias)
+		if platform == nil {
+			continue
+		}
+		if from, ok := stage.nodes[0].BuildStep.(*step.FromStep); ok {
+			from.SetPlatform(image.Platform{OS: platform.OS, Architecture: platform.Architecture})
+		}
+	}
+	return plan.updateCacheIDs()
+}
+
+// SetBaseImagePuller makes the FROM steps of all stages get their base
+// images from the puller, so they wait for images it's prefetching instead of
+// pulling them again. By default, the plan has a puller that doesn't prefetch.
+func (plan *BuildPlan) SetBaseImagePuller(puller *step.BaseImagePuller) {
+	for _, stage := range plan.stages {
+		if from, ok := stage.nodes[0].BuildStep.(*step.FromStep); ok {
+			from.SetBaseImagePuller(puller)
+		}
+	}
+}
+
+// SetMaxImageSize makes the plan fail if any image it saves is larger than
+// size bytes, counting compressed layers and config. If allowOversized is set,
+// it only warns instead. A non-positive size disables the check.
+func (plan *BuildPlan) SetMaxImageSize(size int64, allowOversized bool) {
+	plan.maxImageSize = size
+	plan.allowOversizedImages = allowOversized
+}
+
+// SetBuildArgs sets the build args ARG triggers inherited from base images
+// are resolved with, as ARG directives of the dockerfile are.
+func (plan *BuildPlan) SetBuildArgs(args map[string]string) {
+	plan.buildArgs = args
+}
+
+// SetCacheImages makes the plan export the cache entries pulled or pushed by
+// the build to the given cache images once it's done, with their layers, so
+// later builds on other machines can import them.
+func (plan *BuildPlan) SetCacheImages(names []image.Name) {
+	plan.cacheImages = names
+}
+
+// SetInlineCache makes the plan embed the cache key-value pairs of the layers
+// of each image it saves in the image config, as the cache.InlineCacheLabel
+// label. Later builds can then import the pushed image as a cache image.
+func (plan *BuildPlan) SetInlineCache() {
+	plan.inlineCache = true
+}
+
+// SetOCI makes the plan save all images with OCI manifests instead of docker
+// schema2 manifests. Layers and configs are the same in both formats.
+func (plan *BuildPlan) SetOCI() {
+	for _, stage := range plan.stages {
+		stage.oci = true
+	}
+}
+
+// SetStageImages makes the plan also save the result of each given stage as
+// its own images, in addition to the target image. Stages shared between them
+// are only built once.
+func (plan *BuildPlan) SetStageImages(stageImages map[string][]image.Name) error {
+	for alias := range stageImages {
+		if _, ok := plan.stageAliases[alias]; !ok {
+			return fmt.Errorf("stage not found in dockerfile %s", alias)
+		}
+	}
+	plan.stageImages = make(map[string][]image.Name)
+	for alias, names := range stageImages {
+		plan.stageImages[alias] = names
+	}
+	return plan.dedupeImageNames()
+}
+
+// Replicas returns the alternative names of the target image.
+func (plan *BuildPlan) Replicas() []image.Name {
+	return plan.replicas
+}
+
+// StageImages returns the names of the images built from stages other than
+// the target stage, keyed by stage alias.
+func (plan *BuildPlan) StageImages() map[string][]image.Name {
+	return plan.stageImages
+}
+
+// CacheStats returns the cache hits and misses of the steps executed so far.
+func (plan *BuildPlan) CacheStats() cache.Stats {
+	return plan.cacheMgr.Stats()
+}
+
+// dedupeImageNames fails if two different stages would produce images with
+// the same repository and tag, as they would overwrite each other. The same
+// name given more than once for a stage is dropped with a warning.
+func (plan *BuildPlan) dedupeImageNames() error {
+	owners := make(map[string]string)
+	seen := make(map[string]bool)
+	dedupe := func(alias string, names []image.Name) ([]image.Name, error) {
+		var result []image.Name
+		for _, name := range names {
+			key := name.GetRepository() + ":" + name.GetTag()
+			if owner, ok := owners[key]; ok && owner != alias {
+				return nil, fmt.Errorf(
+					"image %s is produced by both stage %s and stage %s", key, owner, alias)
+			}
+			if seen[name.String()] {
+				log.Warnf("Ignoring duplicate image name %s of stage %s", name, alias)
+				continue
+			}
+			owners[key] = alias
+			seen[name.String()] = true
+			result = append(result, name)
+		}
+		return result, nil
+	}
+
+	if len(plan.stages) == 0 {
+		return nil
+	}
+	targetStage := plan.targetStage()
+	names, err := dedupe(targetStage.alias, append([]image.Name{plan.target}, plan.replicas...))
+	if err != nil {
+		return err
+	}
+	plan.target, plan.replicas = names[0], names[1:]
+
+	for _, stage := range plan.stages {
+		if _, ok := plan.stageImages[stage.alias]; !ok {
+			continue
+		}
+		names, err := dedupe(stage.alias, plan.stageImages[stage.alias])
+		if err != nil {
+			return err
+		}
+		plan.stageImages[stage.alias] = names
+	}
+
+	if plan.debugVariant != nil {
+		if _, err := dedupe("debug variant", []image.Name{plan.debugVariant.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (plan *BuildPlan) processStagesAndAliases(
 	ctx *context.BuildContext, parsedStages dockerfile.Stages) error {
 
-	checksum := crc32.ChecksumIEEE([]byte(utils.BuildHash + fmt.Sprintf("%v", plan.opts)))
-	seedCacheID := fmt.Sprintf("%x", checksum)
+	seedCacheID := plan.seedCacheID()
 
 	existingAliases := make(map[string]struct{})
+	remoteImages := make(map[string]struct{})
 	for i, parsedStage := range parsedStages {
 		// Record alias.
 		if parsedStage.From.Alias != "" {
@@ -111,6 +351,13 @@ func (plan *BuildPlan) processStagesAndAliases(
 			parsedStage.From.Alias = strconv.Itoa(i)
 		}
 		existingAliases[parsedStage.From.Alias] = struct{}{}
+		if parsedStage.From.Platform != "" {
+			platform, err := ParsePlatform(parsedStage.From.Platform)
+			if err != nil {
+				return fmt.Errorf("parse platform of stage %s: %s", parsedStage.From.Alias, err)
+			}
+			plan.fromPlatforms[parsedStage.From.Alias] = platform
+		}
 
 		// Add this stage to the plan.
 		stage, err := newBuildStage(
@@ -133,24 +380,30 @@ func (plan *BuildPlan) processStagesAndAliases(
 				append(plan.copyFromDirs[alias], dirs...),
 			).ToSlice()
 
-			if _, ok := existingAliases[alias]; !ok {
-				// If the alias was an image name and not already handled,
-				// prepend a fake stage with the alias to download that image.
-				if name, err := image.ParseNameForPull(alias); err != nil || !name.IsValid() {
-					return fmt.Errorf("copy from nonexistent stage %s", alias)
-				}
-				remoteImageStage, err := newRemoteImageStage(
-					plan.baseCtx, alias, seedCacheID, plan.opts)
-				if err != nil {
-					return fmt.Errorf("new image stage: %s", err)
-				}
+			if _, ok := existingAliases[alias]; ok {
+				continue
+			} else if _, ok := remoteImages[alias]; ok {
+				// Image already pulled by a stage of an earlier COPY --from.
+				continue
+			}
 
-				// Append to stage list and update cache id.
-				plan.stages = append(plan.stages, remoteImageStage)
-				// TODO: instead of chaining cache ID, it's better to calculate
-				// from scratch before executing a stage.
-				seedCacheID = remoteImageStage.nodes[len(remoteImageStage.nodes)-1].CacheID()
+			// If the alias was an image name and not already handled,
+			// prepend a fake stage with the alias to download that image.
+			if name, err := image.ParseNameForPull(alias); err != nil || !name.IsValid() {
+				return fmt.Errorf("copy from nonexistent stage %s", alias)
 			}
+			remoteImageStage, err := newRemoteImageStage(
+				plan.baseCtx, alias, seedCacheID, plan.opts)
+			if err != nil {
+				return fmt.Errorf("new image stage: %s", err)
+			}
+			remoteImages[alias] = struct{}{}
+
+			// Append to stage list and update cache id.
+			plan.stages = append(plan.stages, remoteImageStage)
+			// TODO: instead of chaining cache ID, it's better to calculate
+			// from scratch before executing a stage.
+			seedCacheID = remoteImageStage.nodes[len(remoteImageStage.nodes)-1].CacheID()
 		}
 
 		// Append to stage list and update cache id.
@@ -170,14 +423,79 @@ func (plan *BuildPlan) processStagesAndAliases(
 	return nil
 }
 
-// Execute executes all build stages in order.
+// seedCacheID returns the cache ID the cache IDs of all steps are chained
+// from. Layers compressed with another format than gzip are cached separately.
+func (plan *BuildPlan) seedCacheID() string {
+	seed := utils.BuildHash + fmt.Sprintf("%v", plan.opts)
+	if tario.CompressionFormat != tario.CompressionGzip {
+		seed += tario.CompressionFormat
+	}
+	checksum := crc32.ChecksumIEEE([]byte(seed))
+	return fmt.Sprintf("%x", checksum)
+}
+
+// updateCacheIDs recomputes the cache IDs of all steps after some of them
+// changed, chaining them in the same order as processStagesAndAliases.
+func (plan *BuildPlan) updateCacheIDs() error {
+	seedCacheID := plan.seedCacheID()
+	for _, stage := range plan.stages {
+		for _, node := range stage.nodes {
+			if err := node.SetCacheID(stage.ctx, seedCacheID); err != nil {
+				return fmt.Errorf("set cache id of %s: %s", node.String(), err)
+			}
+			seedCacheID = node.CacheID()
+		}
+	}
+	return nil
+}
+
+// Execute executes all build stages in order, and returns the manifest of the
+// target image.
 func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
+	manifests, err := plan.ExecuteStages()
+	if err != nil {
+		return nil, err
+	}
+	return manifests[plan.targetStage().alias], nil
+}
+
+// ExecuteStages executes all build stages in order, and returns the manifests
+// of the target image and of the images set with SetStageImages, keyed by
+// stage alias.
+func (plan *BuildPlan) ExecuteStages() (map[string]*image.DistributionManifest, error) {
 	// We need to backup the original env to restore it between stages
 	orignalEnv := utils.ConvertStringSliceToMap(os.Environ())
 
-	var currStage *buildStage
-	for k := 0; k < len(plan.stages); k++ {
-		currStage = plan.stages[k]
+	// Final stages are the ones that produce images. Only them and the
+	// stages they copy from need to be built.
+	targetStage := plan.targetStage()
+	var finalStages []*buildStage
+	for _, stage := range plan.stages {
+		if _, ok := plan.stageImages[stage.alias]; ok || stage == targetStage {
+			finalStages = append(finalStages, stage)
+		}
+	}
+	neededStages := plan.neededStages(finalStages)
+	needed := make(map[*buildStage]bool)
+	for _, stage := range neededStages {
+		needed[stage] = true
+	}
+
+	// ONBUILD triggers of base images may add RUN steps, so they are added
+	// before checking the platforms of the stages.
+	if err := plan.addTriggerNodes(neededStages); err != nil {
+		return nil, err
+	}
+	if err := plan.checkRunPlatforms(neededStages); err != nil {
+		return nil, err
+	}
+
+	for k, currStage := range plan.stages {
+		if !needed[currStage] {
+			log.Infof("* Skipping stage %d/%d : %s, not needed by the target or saved stages",
+				k+1, len(plan.stages), currStage.String())
+			continue
+		}
 
 		// TODO: Implicit stages from "COPY --from=<image>" might introduce
 		// confusion here. Print stageIndexAliases instead.
@@ -186,10 +504,11 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 		// Try to pull reusable layers cached from previous builds.
 		currStage.pullCacheLayers(plan.cacheMgr)
 
-		lastStage := k == len(plan.stages)-1
+		_, finalStage := plan.stageImages[currStage.alias]
+		finalStage = finalStage || currStage == targetStage
 		_, copiedFrom := plan.copyFromDirs[currStage.alias]
 
-		if err := plan.executeStage(currStage, lastStage, copiedFrom); err != nil {
+		if err := plan.executeStage(currStage, finalStage, copiedFrom); err != nil {
 			return nil, fmt.Errorf("execute stage: %s", err)
 		}
 
@@ -199,38 +518,228 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 			os.Setenv(k, v)
 		}
 
-		if plan.stageTarget != "" && currStage.alias == plan.stageTarget {
+		if currStage == targetStage && plan.stageTarget != "" {
 			log.Info("Finished building target stage")
-			break
 		}
 	}
 
+	if err := plan.layerPusher.wait(); err != nil {
+		return nil, fmt.Errorf("push layers: %s", err)
+	}
+
 	// Wait for cache layers to be pushed. This will make them available to
 	// other builds ongoing on different machines.
 	if err := plan.cacheMgr.WaitForPush(); err != nil {
 		log.Errorf("Failed to push cache: %s", err)
 	}
+	for _, name := range plan.cacheImages {
+		client := registry.New(plan.baseCtx.ImageStore, name.GetRegistry(), name.GetRepository())
+		if err := plan.cacheMgr.ExportImage(client, name.GetTag()); err != nil {
+			return nil, fmt.Errorf("export cache image %s: %s", name, err)
+		}
+		log.Infof("Exported cache to cache image %s", name)
+	}
+
+	manifests := make(map[string]*image.DistributionManifest)
+	for _, stage := range finalStages {
+		alias := stage.alias
+		// Refuse to save a mislabeled image.
+		if platform := plan.stagePlatform(alias); platform != nil {
+			if err := validatePlatform(stage.lastImageConfig, *platform); err != nil {
+				if !plan.allowPlatformMismatch {
+					return nil, fmt.Errorf("validate platform of stage %s: %s", alias, err)
+				}
+				log.Warnf("Ignoring platform mismatch of stage %s: %s", alias, err)
+			}
+		}
+		if err := plan.applyDefaultLabels(stage); err != nil {
+			return nil, fmt.Errorf("apply default labels to stage %s: %s", alias, err)
+		}
+		if err := plan.applyOCIAnnotations(stage); err != nil {
+			return nil, fmt.Errorf("apply oci annotations to stage %s: %s", alias, err)
+		}
+		if plan.inlineCache {
+			if err := plan.applyInlineCache(stage); err != nil {
+				return nil, fmt.Errorf("apply inline cache to stage %s: %s", alias, err)
+			}
+		}
+
+		var names []image.Name
+		if stage == targetStage {
+			names = append(names, plan.target)
+			names = append(names, plan.replicas...)
+		}
+		names = append(names, plan.stageImages[alias]...)
+
+		// Save image manifests.
+		var manifest *image.DistributionManifest
+		for _, name := range names {
+			var err error
+			manifest, err = stage.saveManifest(plan.baseCtx.ImageStore, name)
+			if err != nil {
+				return nil, fmt.Errorf("save image manifest %s: %s", name, err)
+			}
+		}
+		manifests[alias] = manifest
+
+		// Print out the image size.
+		size := int64(0)
+		for _, layer := range manifest.Layers {
+			size += layer.Size
+		}
+		log.Infow(fmt.Sprintf("Computed total image size %d", size),
+			"total_image_size", size, "stage", alias)
+
+		if err := plan.checkImageSize(manifest); err != nil {
+			if !plan.allowOversizedImages {
+				return nil, fmt.Errorf("check size of stage %s: %s", alias, err)
+			}
+			log.Warnf("Ignoring size of stage %s: %s", alias, err)
+		}
+	}
+
+	if plan.debugVariant != nil {
+		if _, err := plan.saveDebugVariant(targetStage); err != nil {
+			return nil, fmt.Errorf("save debug variant: %s", err)
+		}
+	}
 
-	// Save image manifest.
-	manifest, err := currStage.saveManifest(plan.baseCtx.ImageStore, plan.target)
+	return manifests, nil
+}
+
+// neededStages returns the stages that have to be built to produce the final
+// stages, in build order: the final stages, and the stages they copy from,
+// directly or not.
+func (plan *BuildPlan) neededStages(finalStages []*buildStage) []*buildStage {
+	stagesByAlias := make(map[string]*buildStage)
+	for _, stage := range plan.stages {
+		stagesByAlias[stage.alias] = stage
+	}
+	needed := make(map[*buildStage]bool)
+	var visit func(stage *buildStage)
+	visit = func(stage *buildStage) {
+		if needed[stage] {
+			return
+		}
+		needed[stage] = true
+		for alias := range stage.copyFromDirs {
+			if from, ok := stagesByAlias[alias]; ok {
+				visit(from)
+			}
+		}
+	}
+	for _, stage := range finalStages {
+		visit(stage)
+	}
+
+	var stages []*buildStage
+	for _, stage := range plan.stages {
+		if needed[stage] {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+// applyInlineCache sets the inline cache label of the image of the stage.
+func (plan *BuildPlan) applyInlineCache(stage *buildStage) error {
+	var layers []image.Digest
+	for _, node := range stage.nodes {
+		for _, digestPair := range node.digestPairs {
+			layers = append(layers, digestPair.GzipDescriptor.Digest)
+		}
+	}
+	label, err := plan.cacheMgr.InlineCache(layers)
 	if err != nil {
-		return nil, fmt.Errorf("save image manifest %s: %s", plan.target, err)
+		return fmt.Errorf("get inline cache: %s", err)
 	}
-	for _, replica := range plan.replicas {
-		_, err := currStage.saveManifest(plan.baseCtx.ImageStore, replica)
+	if stage.lastImageConfig.Config == nil {
+		stage.lastImageConfig.Config = &image.ContainerConfig{}
+	}
+	config := stage.lastImageConfig.Config
+	config.Labels = utils.MergeStringMaps(
+		config.Labels, map[string]string{cache.InlineCacheLabel: label})
+	return nil
+}
+
+// addTriggerNodes adds the ONBUILD triggers of the base images of the given
+// stages. Cache IDs are chained across stages, so those of all steps are
+// recomputed if any trigger was added.
+func (plan *BuildPlan) addTriggerNodes(stages []*buildStage) error {
+	var added bool
+	for _, stage := range stages {
+		ok, err := stage.addTriggerNodes(plan.buildArgs)
 		if err != nil {
-			return nil, fmt.Errorf("save alias manifest %s: %s", replica, err)
+			return fmt.Errorf("add onbuild triggers of stage %s: %s", stage.alias, err)
 		}
+		added = added || ok
+	}
+	if !added {
+		return nil
 	}
+	return plan.updateCacheIDs()
+}
+
+// targetStage returns the stage that produces the target image.
+func (plan *BuildPlan) targetStage() *buildStage {
+	if plan.stageTarget != "" {
+		for _, stage := range plan.stages {
+			if stage.alias == plan.stageTarget {
+				return stage
+			}
+		}
+	}
+	return plan.stages[len(plan.stages)-1]
+}
 
-	// Print out the image size.
-	size := int64(0)
-	for _, layer := range manifest.Layers {
+// checkImageSize fails if the image of the manifest is larger than
+// maxImageSize, with the size of each of its layers.
+func (plan *BuildPlan) checkImageSize(manifest *image.DistributionManifest) error {
+	return plan.checkLayersSize(&manifest.Config, manifest.Layers)
+}
+
+// checkLayersSize fails if the given config, if any, and layers are larger
+// than maxImageSize, with the size of each of them.
+func (plan *BuildPlan) checkLayersSize(config *image.Descriptor, layers []image.Descriptor) error {
+	if plan.maxImageSize <= 0 {
+		return nil
+	}
+	var size int64
+	var report []string
+	if config != nil {
+		size += config.Size
+		report = append(report, fmt.Sprintf("config %s: %d bytes", config.Digest.Hex(), config.Size))
+	}
+	for _, layer := range layers {
 		size += layer.Size
 	}
-	log.Infow(fmt.Sprintf("Computed total image size %d", size), "total_image_size", size)
+	if size <= plan.maxImageSize {
+		return nil
+	}
+	for i, layer := range layers {
+		report = append(report, fmt.Sprintf("layer %d %s: %d bytes", i, layer.Digest.Hex(), layer.Size))
+	}
+	return fmt.Errorf("image size %d bytes exceeds limit of %d bytes (%s)",
+		size, plan.maxImageSize, strings.Join(report, ", "))
+}
 
-	return manifest, nil
+// checkRunPlatforms fails fast if any of the stages has RUN steps, and is
+// built for a platform the host can't run binaries of. RUN steps would fail
+// with exec format errors otherwise.
+func (plan *BuildPlan) checkRunPlatforms(stages []*buildStage) error {
+	for _, stage := range stages {
+		platform := plan.stagePlatform(stage.alias)
+		if platform == nil || !stage.hasRunSteps() {
+			continue
+		}
+		if err := checkCanRun(*platform); err != nil {
+			if !plan.allowPlatformMismatch {
+				return fmt.Errorf("stage %s has RUN steps for platform %s: %s", stage.alias, platform, err)
+			}
+			log.Warnf("Stage %s has RUN steps for platform %s: %s", stage.alias, platform, err)
+		}
+	}
+	return nil
 }
 
 func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom bool) error {
@@ -15,17 +15,37 @@
 package builder
 
 import (
+	"archive/tar"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/httputil"
+	"github.com/uber/makisu/lib/utils/testutil"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestBuildPlanExecution(t *testing.T) {
@@ -47,7 +67,7 @@ func TestBuildPlanExecution(t *testing.T) {
 		dockerfile.EnvDirectiveFixture("TESTENV=test2", map[string]string{"TESTENV": "test2"}),
 		dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
 	}
-	stages := []*dockerfile.Stage{{from, directives}}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
 
 	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
 	require.NoError(err)
@@ -88,7 +108,11 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	directives3 := []dockerfile.Directive{
 		dockerfile.CopyDirectiveFixture("", "", "stage1", []string{"/hello2"}, "/hello2"),
 	}
-	stages := []*dockerfile.Stage{{from1, nil}, {from2, directives2}, {from3, directives3}}
+	stages := []*dockerfile.Stage{
+		{From: from1},
+		{From: from2, Directives: directives2},
+		{From: from3, Directives: directives3},
+	}
 
 	// Here we need to set the allowModifyFS to true because we copy
 	// files across stages.
@@ -106,7 +130,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	directives := []dockerfile.Directive{
 		dockerfile.CopyDirectiveFixture("", "", "bad_stage", []string{"/hello"}, "/hello"),
 	}
-	stages = []*dockerfile.Stage{{from, directives}}
+	stages = []*dockerfile.Stage{{From: from, Directives: directives}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
 	require.Error(err)
@@ -117,7 +141,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 		dockerfile.CopyDirectiveFixture("", "", "stage2", []string{"/hello"}, "/hello"),
 	}
 	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "stage2")
-	stages = []*dockerfile.Stage{{from1, directives1}, {from2, nil}}
+	stages = []*dockerfile.Stage{{From: from1, Directives: directives1}, {From: from2}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
 	require.Error(err)
@@ -140,7 +164,7 @@ func TestBuildPlanBadRun(t *testing.T) {
 		dockerfile.RunDirectiveFixture("ls .", "ls ."),
 		dockerfile.RunDirectiveFixture("bad_executable", "bad_executable"),
 	}
-	stages := []*dockerfile.Stage{{from, directives}}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
 
 	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
 	require.NoError(err)
@@ -164,7 +188,7 @@ func TestDuplicateStageAlias(t *testing.T) {
 	// Same image same alias.
 	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias")
 	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias")
-	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}}
+	stages := []*dockerfile.Stage{{From: from1}, {From: from2}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
 	require.Error(err)
@@ -172,7 +196,7 @@ func TestDuplicateStageAlias(t *testing.T) {
 	// Same image different alias.
 	from1 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias1")
 	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
-	stages = []*dockerfile.Stage{{from1, nil}, {from2, nil}}
+	stages = []*dockerfile.Stage{{From: from1}, {From: from2}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
 	require.NoError(err)
@@ -193,7 +217,7 @@ func TestTargetStageMissing(t *testing.T) {
 	// Same image same alias.
 	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias1")
 	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
-	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}}
+	stages := []*dockerfile.Stage{{From: from1}, {From: from2}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias3")
 	require.Error(err)
@@ -215,8 +239,965 @@ func TestTargetStageOk(t *testing.T) {
 	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias1")
 	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
 	from3 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias3")
-	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}, {from3, nil}}
+	stages := []*dockerfile.Stage{{From: from1}, {From: from2}, {From: from3}}
 
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias2")
 	require.NoError(err)
 }
+
+func TestCopyFromImageStages(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	// The same image copied from by two stages is only pulled once.
+	from1 := dockerfile.FromDirectiveFixture("", "scratch", "first")
+	copy1 := dockerfile.CopyDirectiveFixture(
+		"", "", "busybox:1.36", []string{"/bin/busybox"}, "/busybox")
+	from2 := dockerfile.FromDirectiveFixture("", "scratch", "second")
+	copy2 := dockerfile.CopyDirectiveFixture(
+		"", "", "busybox:1.36", []string{"/bin/sh"}, "/sh")
+	stages := []*dockerfile.Stage{
+		{From: from1, Directives: []dockerfile.Directive{copy1}},
+		{From: from2, Directives: []dockerfile.Directive{copy2}},
+	}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+	require.Len(plan.stages, 3)
+	require.Equal("busybox:1.36", plan.stages[0].alias)
+	require.ElementsMatch([]string{"/bin/busybox", "/bin/sh"}, plan.copyFromDirs["busybox:1.36"])
+
+	// Copying from an image requires modifyfs.
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	require.Error(err)
+}
+
+func TestBuildPlanPlatform(t *testing.T) {
+	tests := []struct {
+		desc          string
+		platform      string
+		allowMismatch bool
+		succeeds      bool
+	}{
+		{"matching platform", "linux/amd64", false, true},
+		{"mismatching platform", "linux/arm64", false, false},
+		{"mismatching platform with override", "linux/arm64", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+			require.NoError(err)
+			platform, err := ParsePlatform(test.platform)
+			require.NoError(err)
+			require.NoError(plan.SetPlatform(platform, test.allowMismatch))
+
+			_, err = plan.Execute()
+			if test.succeeds {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), "build platform is linux/arm64")
+			}
+		})
+	}
+}
+
+func TestBuildPlanRunPlatform(t *testing.T) {
+	defer func(host Platform, dir string) {
+		hostPlatform = host
+		binfmtMiscDir = dir
+	}(hostPlatform, binfmtMiscDir)
+	hostPlatform = Platform{OS: "linux", Architecture: "amd64"}
+
+	tests := []struct {
+		desc          string
+		platform      string
+		run           bool
+		emulator      string
+		allowMismatch bool
+		succeeds      bool
+	}{
+		{"native", "linux/amd64", true, "", false, true},
+		{"natively supported arch", "linux/386", true, "", false, true},
+		{"no emulator", "linux/arm64", true, "", false, false},
+		{"no emulator without RUN", "linux/arm64", false, "", false, true},
+		{"no emulator with override", "linux/arm64", true, "", true, true},
+		{"emulator", "linux/arm64", true, "enabled\ninterpreter /usr/bin/qemu-aarch64\n", false, true},
+		{"disabled emulator", "linux/arm64", true, "disabled\ninterpreter /usr/bin/qemu-aarch64\n", false, false},
+		{"other os", "windows/amd64", true, "", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			binfmtMiscDir = filepath.Join(ctx.RootDir, "binfmt_misc")
+			require.NoError(os.MkdirAll(binfmtMiscDir, 0755))
+			if test.emulator != "" {
+				require.NoError(ioutil.WriteFile(
+					filepath.Join(binfmtMiscDir, "qemu-aarch64"), []byte(test.emulator), 0644))
+			}
+
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+			directives := []dockerfile.Directive{
+				dockerfile.CopyDirectiveFixture("", "", "", []string{"."}, "/app/"),
+			}
+			if test.run {
+				directives = append(directives, dockerfile.RunDirectiveFixture("make", "make"))
+			}
+			stages := []*dockerfile.Stage{{
+				From:       dockerfile.FromDirectiveFixture("", "scratch", ""),
+				Directives: directives,
+			}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+			require.NoError(err)
+			platform, err := ParsePlatform(test.platform)
+			require.NoError(err)
+			require.NoError(plan.SetPlatform(platform, test.allowMismatch))
+
+			err = plan.checkRunPlatforms(plan.stages)
+			if test.succeeds {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), "stage 0 has RUN steps for platform "+test.platform)
+			}
+		})
+	}
+}
+
+func TestBuildPlanAddTriggerNodes(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	client := triggerClientFixture(t, ctx, ctrl, []string{"RUN make"}, nil)
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	stages := []*dockerfile.Stage{{
+		From:       dockerfile.FromDirectiveFixture("alpine:latest AS base", "alpine:latest", "base"),
+		Directives: []dockerfile.Directive{dockerfile.CmdDirectiveFixture("ls", []string{"ls"})},
+	}, {
+		From:       dockerfile.FromDirectiveFixture("scratch", "scratch", ""),
+		Directives: []dockerfile.Directive{dockerfile.CmdDirectiveFixture("ls", []string{"ls"})},
+	}}
+	plan, err := NewBuildPlan(ctx, target, nil, cache.NewNoopCacheManager(), stages, true, false, "")
+	require.NoError(err)
+	step.SetRegistryClientFixture(plan.stages[0].nodes[0].BuildStep.(*step.FromStep), client)
+
+	platform, err := ParsePlatform("windows/amd64")
+	require.NoError(err)
+	plan.platform = &platform
+	require.NoError(plan.checkRunPlatforms(plan.stages))
+
+	base, last := plan.stages[0], plan.stages[1]
+	baseCacheID := base.nodes[1].CacheID()
+	lastCacheID := last.nodes[1].CacheID()
+	require.NoError(plan.addTriggerNodes(plan.stages))
+	require.Len(base.nodes, 3)
+	require.Equal("RUN make", base.nodes[1].CacheKeyInputs().Instruction)
+
+	// Cache IDs of the steps after the triggers, in later stages too, are
+	// chained from them.
+	require.NotEqual(baseCacheID, base.nodes[2].CacheID())
+	require.NotEqual(lastCacheID, last.nodes[1].CacheID())
+
+	// RUN triggers are subject to the platform check.
+	err = plan.checkRunPlatforms(plan.stages)
+	require.Error(err)
+	require.Contains(err.Error(), "stage base has RUN steps for platform windows/amd64")
+}
+
+func TestBuildPlanStagePlatforms(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	newPlan := func() *BuildPlan {
+		stages := []*dockerfile.Stage{{
+			From: dockerfile.FromDirectiveFixture("", "scratch", "builder"),
+			Directives: []dockerfile.Directive{
+				dockerfile.EnvDirectiveFixture("STAGE=builder", map[string]string{"STAGE": "builder"}),
+			},
+		}, {
+			From: dockerfile.FromDirectiveFixture("", "scratch", "final"),
+			Directives: []dockerfile.Directive{
+				dockerfile.EnvDirectiveFixture("STAGE=final", map[string]string{"STAGE": "final"}),
+			},
+		}}
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+		require.NoError(err)
+		return plan
+	}
+	cacheIDs := func(plan *BuildPlan, alias string) []string {
+		var ids []string
+		for _, stage := range plan.stages {
+			if stage.alias != alias {
+				continue
+			}
+			for _, node := range stage.nodes {
+				ids = append(ids, node.CacheID())
+			}
+		}
+		return ids
+	}
+
+	plan := newPlan()
+	require.Error(plan.SetStagePlatforms(map[string]Platform{
+		"unknown": {OS: "linux", Architecture: "amd64"},
+	}))
+
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	noPlatformIDs := cacheIDs(plan, "builder")
+	require.NoError(plan.SetPlatform(arm64, false))
+	arm64IDs := cacheIDs(plan, "builder")
+	require.NotEqual(noPlatformIDs, arm64IDs)
+
+	// Overriding the platform of the final stage only changes its cache IDs,
+	// and its output is validated against the overridden platform.
+	require.NoError(plan.SetStagePlatforms(map[string]Platform{"final": amd64}))
+	require.Equal(arm64IDs, cacheIDs(plan, "builder"))
+	require.Equal(arm64, *plan.stagePlatform("builder"))
+	require.Equal(amd64, *plan.stagePlatform("final"))
+
+	other := newPlan()
+	require.NoError(other.SetPlatform(arm64, false))
+	require.NoError(other.SetStagePlatforms(map[string]Platform{"final": amd64}))
+	require.Equal(cacheIDs(plan, "final"), cacheIDs(other, "final"))
+
+	_, err := plan.Execute()
+	require.NoError(err)
+}
+
+func TestBuildPlanFromPlatform(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	newPlan := func(platform string) (*BuildPlan, error) {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "builder")
+		from.Platform = platform
+		stages := []*dockerfile.Stage{{From: from}}
+		return NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	}
+
+	_, err := newPlan("linux")
+	require.Error(err)
+
+	plan, err := newPlan("")
+	require.NoError(err)
+	noPlatformID := plan.stages[0].nodes[0].CacheID()
+
+	plan, err = newPlan("linux/arm64")
+	require.NoError(err)
+	require.NotEqual(noPlatformID, plan.stages[0].nodes[0].CacheID())
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	require.Equal(arm64, *plan.stagePlatform("builder"))
+
+	// --platform doesn't override FROM --platform, but --stage-platform does.
+	require.NoError(plan.SetPlatform(amd64, false))
+	require.Equal(arm64, *plan.stagePlatform("builder"))
+	require.NoError(plan.SetStagePlatforms(map[string]Platform{"builder": amd64}))
+	require.Equal(amd64, *plan.stagePlatform("builder"))
+}
+
+func TestBuildPlanStageImages(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo/app", "testtag")
+	tools := image.NewImageName("", "testrepo/tools", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from1 := dockerfile.FromDirectiveFixture("", "scratch", "app")
+	directives1 := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("STAGE=app", map[string]string{"STAGE": "app"}),
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+	}
+	from2 := dockerfile.FromDirectiveFixture("", "scratch", "tools")
+	directives2 := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("STAGE=tools", map[string]string{"STAGE": "tools"}),
+		dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+	}
+	// Stages after the last requested one are never built.
+	from3 := dockerfile.FromDirectiveFixture("", "scratch", "unused")
+	directives3 := []dockerfile.Directive{
+		dockerfile.RunDirectiveFixture("bad_executable", "bad_executable"),
+	}
+	stages := []*dockerfile.Stage{
+		{From: from1, Directives: directives1},
+		{From: from2, Directives: directives2},
+		{From: from3, Directives: directives3},
+	}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "app")
+	require.NoError(err)
+	require.Error(plan.SetStageImages(map[string][]image.Name{"missing": {tools}}))
+	require.NoError(plan.SetStageImages(map[string][]image.Name{"tools": {tools}}))
+
+	manifests, err := plan.ExecuteStages()
+	require.NoError(err)
+	require.Len(manifests, 2)
+	require.NotEqual(manifests["app"].Config.Digest, manifests["tools"].Config.Digest)
+
+	for alias, name := range map[string]image.Name{"app": target, "tools": tools} {
+		r, err := ctx.ImageStore.Manifests.GetStoreFileReader(name.GetRepository(), name.GetTag())
+		require.NoError(err)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		var manifest image.DistributionManifest
+		require.NoError(json.Unmarshal(b, &manifest))
+		require.Equal(manifests[alias].Config.Digest, manifest.Config.Digest)
+
+		r, err = ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+		require.NoError(err)
+		b, err = ioutil.ReadAll(r)
+		require.NoError(err)
+		var config image.Config
+		require.NoError(json.Unmarshal(b, &config))
+		require.Contains(config.Config.Env, "STAGE="+alias)
+		require.Len(config.RootFS.DiffIDs, 1)
+	}
+}
+
+func TestBuildPlanDuplicateImageNames(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo/app", "testtag")
+	replica := image.NewImageName("otherregistry.dev", "testrepo/app", "testtag")
+	tools := image.NewImageName("", "testrepo/tools", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from1 := dockerfile.FromDirectiveFixture("", "scratch", "app")
+	from2 := dockerfile.FromDirectiveFixture("", "scratch", "tools")
+	stages := []*dockerfile.Stage{{From: from1}, {From: from2}}
+
+	t.Run("same name for the same stage is deduped", func(t *testing.T) {
+		plan, err := NewBuildPlan(
+			ctx, target, []image.Name{replica, target, replica}, cacheMgr, stages, true, false, "app")
+		require.NoError(err)
+		require.Equal([]image.Name{replica}, plan.Replicas())
+
+		require.NoError(plan.SetStageImages(map[string][]image.Name{
+			"app":   {target},
+			"tools": {tools, tools},
+		}))
+		require.Empty(plan.StageImages()["app"])
+		require.Equal([]image.Name{tools}, plan.StageImages()["tools"])
+	})
+
+	t.Run("same name for different stages fails", func(t *testing.T) {
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "app")
+		require.NoError(err)
+
+		err = plan.SetStageImages(map[string][]image.Name{"tools": {tools, replica}})
+		require.Error(err)
+		require.Contains(err.Error(), "testrepo/app:testtag")
+	})
+}
+
+func TestBuildPlanCorruptedCacheLayer(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("content"), 0644))
+
+	kvStore := keyvalue.MockStore{}
+
+	build := func(client registry.Client, tag string) *image.DistributionManifest {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+		target := image.NewImageName("", "testrepo", tag)
+		cacheMgr := cache.New(ctx.ImageStore, kvStore, client)
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, true, "")
+		require.NoError(err)
+		manifest, err := plan.Execute()
+		require.NoError(err)
+		return manifest
+	}
+	manifest := build(registry.NoopClientFixture(), "tag1")
+	require.Len(manifest.Layers, 1)
+	layer := manifest.Layers[0].Digest
+
+	// Truncate the cached layer.
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(layer.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	r.Close()
+	require.NoError(ctx.ImageStore.Layers.DeleteStoreFile(layer.Hex()))
+	f, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layer")
+	require.NoError(err)
+	_, err = f.Write(b[:len(b)/2])
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(layer.Hex(), f.Name()))
+
+	// The layer can't be pulled from the registry either, so the step is
+	// rebuilt.
+	ctx.MemFS.Remove()
+	mockClient := mockregistry.NewMockClient(ctrl)
+	mockClient.EXPECT().PullLayer(layer).Return(nil, fmt.Errorf("blob unknown"))
+	mockClient.EXPECT().PushLayer(layer).Return(nil)
+	require.Equal(manifest.Layers, build(mockClient, "tag2").Layers)
+
+	r, err = ctx.ImageStore.Layers.GetStoreFileReader(layer.Hex())
+	require.NoError(err)
+	defer r.Close()
+	digest, err := image.NewDigester().FromReader(r)
+	require.NoError(err)
+	require.Equal(layer, digest)
+}
+
+func TestBuildPlanDeadRemoteCache(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("content"), 0644))
+
+	build := func(kvStore keyvalue.Store, tag string) error {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+		target := image.NewImageName("", "testrepo", tag)
+		cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, true, "")
+		if err != nil {
+			return err
+		}
+		_, err = plan.Execute()
+		return err
+	}
+
+	// Answers the health check, then goes down before the build.
+	server := httptest.NewServer(http.NotFoundHandler())
+	newStore := func() (keyvalue.Store, error) { return keyvalue.NewHTTPStore(server.URL) }
+	midBuildStore, err := keyvalue.Connect(newStore, nil, time.Second, true)
+	require.NoError(t, err)
+	server.Close()
+
+	t.Run("fail_open", func(t *testing.T) {
+		require := require.New(t)
+		kvStore, err := keyvalue.Connect(newStore, nil, time.Second, true)
+		require.NoError(err)
+		require.Nil(kvStore)
+		require.NoError(build(kvStore, "tag1"))
+		require.NoError(build(midBuildStore, "tag2"))
+	})
+
+	t.Run("fail_closed", func(t *testing.T) {
+		require := require.New(t)
+		_, err := keyvalue.Connect(newStore, nil, time.Second, false)
+		require.Error(err)
+	})
+}
+
+func TestBuildPlanCachedRunOutput(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step.RunOutputLimit = 1024
+	defer func() { step.RunOutputLimit = 0 }()
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer log.SetLogger(log.GetLogger())
+	log.SetLogger(zap.New(core).Sugar())
+
+	kvStore := keyvalue.MockStore{}
+	build := func(tag string) {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.RunCommitDirectiveFixture("echo version 1.2.3", "echo version 1.2.3"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+		target := image.NewImageName("", "testrepo", tag)
+		cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+		require.NoError(err)
+		_, err = plan.Execute()
+		require.NoError(err)
+	}
+
+	// Output is captured on cache miss.
+	build("tag1")
+	var outputs []string
+	for k, v := range kvStore {
+		if strings.HasPrefix(k, "makisu_builder_output_") {
+			outputs = append(outputs, v)
+		}
+	}
+	require.Equal([]string{"version 1.2.3\n"}, outputs)
+	require.Equal(0, logs.FilterMessage("[cached] version 1.2.3").Len())
+
+	// And replayed on cache hit.
+	logs.TakeAll()
+	build("tag2")
+	require.Equal(0, logs.FilterMessage("version 1.2.3\n").Len())
+	require.Equal(1, logs.FilterMessage("[cached] version 1.2.3").Len())
+}
+
+func TestBuildPlanSkipUnneededStages(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	t.Run("copy from", func(t *testing.T) {
+		from1 := dockerfile.FromDirectiveFixture("", "scratch", "stage1")
+		from2 := dockerfile.FromDirectiveFixture("", "scratch", "stage2")
+		from3 := dockerfile.FromDirectiveFixture("", "scratch", "stage3")
+		directives3 := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("", "", "stage1", []string{"/hello"}, "/hello"),
+		}
+		from4 := dockerfile.FromDirectiveFixture("", "scratch", "stage4")
+		directives4 := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("", "", "stage3", []string{"/hello"}, "/hello"),
+		}
+		stages := []*dockerfile.Stage{
+			{From: from1},
+			{From: from2},
+			{From: from3, Directives: directives3},
+			{From: from4, Directives: directives4},
+		}
+
+		target := image.NewImageName("", "testrepo", "testtag")
+		cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+		require.NoError(err)
+
+		var aliases []string
+		for _, stage := range plan.neededStages([]*buildStage{plan.targetStage()}) {
+			aliases = append(aliases, stage.alias)
+		}
+		require.Equal([]string{"stage1", "stage3", "stage4"}, aliases)
+	})
+
+	t.Run("execute", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		defer log.SetLogger(log.GetLogger())
+		log.SetLogger(zap.New(core).Sugar())
+
+		stages := []*dockerfile.Stage{{
+			From:       dockerfile.FromDirectiveFixture("", "scratch", "stage1"),
+			Directives: []dockerfile.Directive{dockerfile.RunCommitDirectiveFixture("echo 1", "echo 1")},
+		}, {
+			From:       dockerfile.FromDirectiveFixture("", "scratch", "stage2"),
+			Directives: []dockerfile.Directive{dockerfile.RunCommitDirectiveFixture("echo 2", "echo 2")},
+		}, {
+			From:       dockerfile.FromDirectiveFixture("", "scratch", "stage3"),
+			Directives: []dockerfile.Directive{dockerfile.RunCommitDirectiveFixture("echo 3", "echo 3")},
+		}}
+		target := image.NewImageName("", "testrepo", "testtag")
+		cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "stage2")
+		require.NoError(err)
+		manifests, err := plan.ExecuteStages()
+		require.NoError(err)
+		require.Contains(manifests, "stage2")
+
+		require.Equal(1, logs.FilterMessageSnippet("* Skipping stage 1/3").Len())
+		require.Equal(1, logs.FilterMessageSnippet("* Stage 2/3").Len())
+		require.Equal(0, logs.FilterMessageSnippet("* Stage 1/3").Len())
+		require.Equal(0, logs.FilterMessageSnippet("Stage 3/3").Len())
+	})
+}
+
+func TestBuildPlanMaxImageSize(t *testing.T) {
+	tests := []struct {
+		desc           string
+		maxSize        int64
+		allowOversized bool
+		succeeds       bool
+		warns          bool
+	}{
+		{"no limit", 0, false, true, false},
+		{"under limit", 1 << 30, false, true, false},
+		{"over limit", 1, false, false, false},
+		{"over limit allowed", 1, true, true, true},
+	}
+	for i, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			core, logs := observer.New(zap.InfoLevel)
+			defer log.SetLogger(log.GetLogger())
+			log.SetLogger(zap.New(core).Sugar())
+
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.RunCommitDirectiveFixture("echo hello", "echo hello"),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+			target := image.NewImageName("", "testrepo", fmt.Sprintf("tag%d", i))
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+			require.NoError(err)
+			plan.SetMaxImageSize(test.maxSize, test.allowOversized)
+
+			_, err = plan.Execute()
+			if test.succeeds {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), "exceeds limit of 1 bytes")
+				require.Contains(err.Error(), "layer 0")
+			}
+
+			// Allowed oversized images are reported with their layers.
+			warnings := logs.FilterMessageSnippet("Ignoring size of stage").All()
+			if !test.warns {
+				require.Empty(warnings)
+				return
+			}
+			require.Len(warnings, 1)
+			require.Equal(zap.WarnLevel, warnings[0].Level)
+			require.Contains(warnings[0].Message, "exceeds limit of 1 bytes")
+			require.Contains(warnings[0].Message, "layer 0")
+		})
+	}
+}
+
+func TestBuildPlanDefaultLabels(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.LabelDirectiveFixture("team=infra", map[string]string{"team": "infra"}),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+
+	require.Error(plan.SetDefaultLabels(map[string]string{"bad": "{{.Revision"}, ""))
+	require.NoError(plan.SetDefaultLabels(map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/uber/makisu",
+		"org.opencontainers.image.revision": "{{.Revision}}",
+		"org.opencontainers.image.created":  "{{.Created}}",
+		"team":                              "default",
+	}, "0123abcd"))
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+
+	require.Equal(map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/uber/makisu",
+		"org.opencontainers.image.revision": "0123abcd",
+		"org.opencontainers.image.created":  config.Created.UTC().Format(time.RFC3339),
+		"team":                              "infra",
+	}, config.Config.Labels)
+}
+
+func TestBuildPlanInlineCache(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("echo 1", "echo 1"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, keyvalue.MockStore{}, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	plan.SetInlineCache()
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+
+	var inline struct {
+		Entries map[string]string `json:"entries"`
+	}
+	require.NoError(json.Unmarshal([]byte(config.Config.Labels[cache.InlineCacheLabel]), &inline))
+	var layers []string
+	for _, entry := range inline.Entries {
+		if entry != "MAKISU_CACHE_EMPTY" {
+			layers = append(layers, strings.Split(entry, ",")[1])
+		}
+	}
+	require.Equal([]string{manifest.Layers[0].Digest.Hex()}, layers)
+}
+
+func TestBuildPlanSharedBaseImage(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	testFileDirAlpine := "../../testdata/files/alpine"
+	var manifestRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			atomic.AddInt32(&manifestRequests, 1)
+			w.Header().Set("Content-Type", image.MediaTypeManifest)
+			http.ServeFile(w, r, filepath.Join(testFileDirAlpine, "test_distribution_manifest"))
+		case strings.HasSuffix(r.URL.Path, testutil.SampleImageConfigDigest):
+			http.ServeFile(w, r, filepath.Join(testFileDirAlpine, "test_image_config"))
+		case strings.HasSuffix(r.URL.Path, testutil.SampleLayerTarDigest):
+			http.ServeFile(w, r, filepath.Join(testFileDirAlpine, "test_layer.tar"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	registry.ConfigurationMap[host] = registry.RepositoryMap{".*": registry.Config{
+		Security: security.Config{TLS: &httputil.TLSConfig{Client: httputil.X509Pair{Disabled: true}}},
+	}}
+	defer delete(registry.ConfigurationMap, host)
+
+	// Both stages are built from the same base, named differently.
+	stages := []*dockerfile.Stage{
+		{From: dockerfile.FromDirectiveFixture("", host+"/library/alpine:latest", "first")},
+		{From: dockerfile.FromDirectiveFixture("", host+"/library/alpine", "second")},
+	}
+	target := image.NewImageName("", "testrepo", "second")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+	require.NoError(plan.SetStageImages(map[string][]image.Name{
+		"first": {image.NewImageName("", "testrepo", "first")},
+	}))
+
+	manifests, err := plan.ExecuteStages()
+	require.NoError(err)
+	require.Len(manifests, 2)
+	require.Equal(int32(1), atomic.LoadInt32(&manifestRequests))
+}
+
+func TestBuildPlanKeepFS(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file1"), []byte("one"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file2"), []byte("two"), 0644))
+
+	keepDir, err := ioutil.TempDir("/tmp", "makisu-test-keep-fs")
+	require.NoError(err)
+	defer os.RemoveAll(keepDir)
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("file1 /app/file1", "", "", []string{"file1"}, "/app/file1"),
+		dockerfile.CopyDirectiveFixture("file2 /app/file2", "", "", []string{"file2"}, "/app/file2"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+
+	require.Error(plan.SetKeepFS(keepDir, []string{"0/4"}))
+	require.Error(plan.SetKeepFS(keepDir, []string{"missing/1"}))
+	require.NoError(plan.SetKeepFS(keepDir, []string{"0/2"}))
+
+	// Layers are the same as without saving the filesystem.
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	b, err := ioutil.ReadFile(filepath.Join(keepDir, "0/2/app/file1"))
+	require.NoError(err)
+	require.Equal("one", string(b))
+	_, err = os.Stat(filepath.Join(keepDir, "0/2/app/file2"))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(keepDir, "0/3"))
+	require.True(os.IsNotExist(err))
+}
+
+func TestBuildPlanOCI(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("one"), 0644))
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	plan.SetOCI()
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Equal(image.MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(image.MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Len(manifest.Layers, 1)
+	require.Equal(image.MediaTypeOCILayer, manifest.Layers[0].MediaType)
+
+	r, err := ctx.ImageStore.Manifests.GetStoreFileReader(target.GetRepository(), target.GetTag())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	saved, _, err := image.UnmarshalDistributionManifest(image.MediaTypeOCIManifest, b)
+	require.NoError(err)
+	require.Equal(*manifest, saved)
+}
+
+func TestBuildPlanOCIAnnotations(t *testing.T) {
+	for _, oci := range []bool{true, false} {
+		t.Run(fmt.Sprintf("oci=%v", oci), func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+			require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("one"), 0644))
+
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+				dockerfile.RunCommitDirectiveFixture("echo 1", "echo 1"),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+			require.NoError(err)
+			if oci {
+				plan.SetOCI()
+			}
+			require.Error(plan.SetOCIAnnotations(nil, map[string]string{"bad": "{{.Instruction"}, ""))
+			require.NoError(plan.SetOCIAnnotations(
+				map[string]string{"org.opencontainers.image.revision": "{{.Revision}}"},
+				map[string]string{"com.example.instruction": "{{.Instruction}}"},
+				"0123abcd"))
+
+			manifest, err := plan.Execute()
+			require.NoError(err)
+			require.Len(manifest.Layers, 2)
+
+			r, err := ctx.ImageStore.Manifests.GetStoreFileReader(target.GetRepository(), target.GetTag())
+			require.NoError(err)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			if !oci {
+				require.NotContains(string(b), "annotations")
+				return
+			}
+			saved, _, err := image.UnmarshalDistributionManifest(image.MediaTypeOCIManifest, b)
+			require.NoError(err)
+			require.Equal(map[string]string{"org.opencontainers.image.revision": "0123abcd"}, saved.Annotations)
+			require.Empty(saved.Config.Annotations)
+			require.Equal(map[string]string{"com.example.instruction": "COPY file /file"}, saved.Layers[0].Annotations)
+			require.Equal(map[string]string{"com.example.instruction": "RUN echo 1"}, saved.Layers[1].Annotations)
+		})
+	}
+}
+
+func TestBuildPlanZstdLayers(t *testing.T) {
+	require := require.New(t)
+	defer func() { tario.CompressionFormat = tario.CompressionGzip }()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("one"), 0644))
+	require.NoError(tario.SetCompressionFormat(tario.CompressionZstd))
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	plan.SetOCI()
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 1)
+	require.Equal(image.MediaTypeOCILayerZstd, manifest.Layers[0].MediaType)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Layers[0].Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	layerReader, err := tario.NewDecompressionReader(r)
+	require.NoError(err)
+	defer layerReader.Close()
+	tr := tar.NewReader(layerReader)
+	hdr, err := tr.Next()
+	require.NoError(err)
+	require.Equal("file", hdr.Name)
+}
@@ -50,7 +50,17 @@ type buildStage struct {
 	nodes           []*buildNode
 	lastImageConfig *image.Config
 
-	opts *buildStageOptions
+	opts        *buildStageOptions
+	keepFS      *keepFS
+	layerPusher *layerPusher
+
+	// oci saves the image of the stage with an OCI manifest.
+	oci bool
+	// ociAnnotations are added to the OCI manifest and its layers.
+	ociAnnotations image.OCIAnnotations
+	// remote is set on stages used for `COPY --from=<image>`, which don't run
+	// the ONBUILD triggers of their image.
+	remote bool
 }
 
 // newBuildStage initializes a buildStage.
@@ -105,7 +115,12 @@ func newRemoteImageStage(
 		allowModifyFS: planOpts.allowModifyFS,
 	}
 
-	return newBuildStageHelper(ctx, alias, steps, opts)
+	stage, err := newBuildStageHelper(ctx, alias, steps, opts)
+	if err != nil {
+		return nil, err
+	}
+	stage.remote = true
+	return stage, nil
 }
 
 func newBuildStageHelper(
@@ -166,6 +181,51 @@ func createDockerfileSteps(
 	return steps, nil
 }
 
+// addTriggerNodes inserts nodes running the ONBUILD triggers of the base
+// image right after the FROM node, and returns whether any was added. ARG
+// triggers are resolved with buildArgs. Cache IDs of the following nodes need
+// to be chained from the triggers afterwards, see BuildPlan.addTriggerNodes.
+func (stage *buildStage) addTriggerNodes(buildArgs map[string]string) (bool, error) {
+	if stage.remote || len(stage.nodes) == 0 {
+		return false, nil
+	}
+	from, ok := stage.nodes[0].BuildStep.(*step.FromStep)
+	if !ok {
+		return false, nil
+	}
+	config, err := from.BaseConfig(stage.ctx)
+	if err != nil {
+		return false, fmt.Errorf("get base image config: %s", err)
+	} else if config == nil || config.Config == nil || len(config.Config.OnBuild) == 0 {
+		return false, nil
+	}
+	directives, err := dockerfile.ParseTriggers(
+		config.Config.OnBuild, config.Config.Env, config.Config.Shell, buildArgs)
+	if err != nil {
+		return false, fmt.Errorf("parse onbuild triggers: %s", err)
+	}
+
+	nodes := []*buildNode{stage.nodes[0]}
+	seed := stage.nodes[0].CacheID()
+	for _, directive := range directives {
+		s, err := step.NewDockerfileStep(stage.ctx, directive, seed)
+		if err != nil {
+			return false, fmt.Errorf("onbuild trigger to build step: %s", err)
+		}
+		if _, dirs := s.ContextDirs(); len(dirs) > 0 {
+			return false, fmt.Errorf("onbuild trigger %s copies from another stage", s.String())
+		}
+		if s.RequireOnDisk() {
+			stage.opts.requireOnDisk = true
+		}
+		log.Infof("* Adding ONBUILD trigger of base image: %s", s.String())
+		nodes = append(nodes, newBuildNode(stage.ctx, s))
+		seed = s.CacheID()
+	}
+	stage.nodes = append(nodes, stage.nodes[1:]...)
+	return len(directives) > 0, nil
+}
+
 // build performs the build for that stage. There are side effects that should
 // be expected on each node within the stage.
 func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom bool) error {
@@ -173,6 +233,11 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 	diffIDs := make([]image.Digest, 0)
 	histories := make([]image.History, 0)
 	for i, node := range stage.nodes {
+		// Stop building if layers of the previous steps failed to push.
+		if err := stage.layerPusher.failed(); err != nil {
+			return fmt.Errorf("push layers: %s", err)
+		}
+
 		// Build current step from the previous image config (possibly cached).
 		modifyFS := stage.opts.requireOnDisk || copiedFrom
 		if modifyFS && !stage.opts.allowModifyFS {
@@ -191,8 +256,20 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 		log.Infof("* Step %d/%d (%s) : %s", i+1, len(stage.nodes), nodeOpts.String(), node.String())
 		stage.lastImageConfig, err = node.Build(cacheMgr, stage.lastImageConfig, nodeOpts)
 		if err != nil {
+			if saveErr := stage.saveFS(i, modifyFS); saveErr != nil {
+				log.Errorf("Failed to save filesystem of failed step: %s", saveErr)
+			}
 			return fmt.Errorf("build node: %s", err)
 		}
+		// Skipped steps have no filesystem of their own.
+		if !skipBuild {
+			if err := stage.saveFS(i, modifyFS); err != nil {
+				return fmt.Errorf("save filesystem: %s", err)
+			}
+		}
+		if err := stage.layerPusher.push(stage.alias, node.digestPairs); err != nil {
+			return fmt.Errorf("push layers: %s", err)
+		}
 
 		// Update diff IDs and history information.
 		for _, digestPair := range node.digestPairs {
@@ -253,7 +330,10 @@ func (stage *buildStage) GetDistributionManifest(
 	descriptors := []image.Descriptor{}
 	for _, node := range stage.nodes {
 		for _, digestPair := range node.digestPairs {
-			descriptors = append(descriptors, digestPair.GzipDescriptor)
+			// Annotations of the layers of OCI base images are not kept.
+			descriptor := digestPair.GzipDescriptor
+			descriptor.Annotations = nil
+			descriptors = append(descriptors, descriptor)
 		}
 	}
 
@@ -269,6 +349,10 @@ func (stage *buildStage) saveManifest(
 	if err != nil {
 		return nil, fmt.Errorf("get distribution manifest: %s", err)
 	}
+	if stage.oci {
+		ociManifest := image.ConvertToOCI(*manifest, stage.ociAnnotations)
+		manifest = &ociManifest
+	}
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
 		return nil, fmt.Errorf("marshal manifest: %s", err)
@@ -331,6 +415,16 @@ func (stage *buildStage) latestFetched() int {
 	return latest
 }
 
+// hasRunSteps returns true if the stage runs commands.
+func (stage *buildStage) hasRunSteps() bool {
+	for _, node := range stage.nodes {
+		if _, ok := node.BuildStep.(*step.RunStep); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // String returns the string representation of this stage. This may be useful in debugging issues.
 func (stage *buildStage) String() string {
 	return fmt.Sprintf("(alias=%v,latestfetched=%v)", stage.alias, stage.latestFetched())
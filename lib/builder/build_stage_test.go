@@ -15,15 +15,21 @@
 package builder
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/registry"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -148,3 +154,115 @@ func TestPullCacheLayers(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildStageKeepsBaseDiffIDs(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	testFileDirAlpine := "../../testdata/files/alpine"
+	client, err := registry.PullClientFixture(ctx,
+		filepath.Join(testFileDirAlpine, "test_distribution_manifest"),
+		filepath.Join(testFileDirAlpine, "test_image_config"),
+		filepath.Join(testFileDirAlpine, "test_layer.tar"))
+	require.NoError(err)
+	baseManifest, err := client.PullManifest("latest")
+	require.NoError(err)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "newfile"), []byte("new"), 0644))
+
+	from := step.FromStepFixtureWithClient("", "fakeregistry.dev/library/alpine:latest", "", client)
+	copyStep := step.CopyStepFixtureNoChown("newfile /newfile", "", []string{"newfile"}, "/newfile", true, false)
+	opts := &buildPlanOptions{
+		forceCommit:   false,
+		allowModifyFS: false,
+	}
+	stage, err := newBuildStageHelper(ctx, "", []step.BuildStep{from, copyStep}, opts)
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	require.NoError(stage.build(cacheMgr, true, false))
+
+	baseConfig, err := from.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	baseDiffIDs := baseConfig.RootFS.DiffIDs
+	diffIDs := stage.lastImageConfig.RootFS.DiffIDs
+	require.Len(baseDiffIDs, len(baseManifest.Layers))
+	require.Len(diffIDs, len(baseDiffIDs)+1)
+
+	// Base layers keep their original diffIDs, the new layer gets its own.
+	require.Equal(baseDiffIDs, diffIDs[:len(baseDiffIDs)])
+	require.Equal(stage.nodes[1].digestPairs[0].TarDigest, diffIDs[len(baseDiffIDs)])
+	require.NotContains(baseDiffIDs, diffIDs[len(baseDiffIDs)])
+}
+
+// triggerClientFixture returns a registry client pulling a base image whose
+// config has the given ONBUILD triggers and env.
+func triggerClientFixture(
+	t *testing.T, ctx *context.BuildContext, ctrl *gomock.Controller,
+	triggers, env []string) *mockregistry.MockClient {
+
+	require := require.New(t)
+
+	baseConfig := image.NewDefaultImageConfig()
+	baseConfig.Config.Env = env
+	baseConfig.Config.OnBuild = triggers
+	configBytes, err := json.Marshal(baseConfig)
+	require.NoError(err)
+	configDigest, err := image.NewDigester().FromBytes(configBytes)
+	require.NoError(err)
+	configPath := filepath.Join(ctx.ContextDir, "config")
+	require.NoError(ioutil.WriteFile(configPath, configBytes, 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(configDigest.Hex(), configPath))
+
+	client := mockregistry.NewMockClient(ctrl)
+	client.EXPECT().Pull("latest").Return(&image.DistributionManifest{
+		SchemaVersion: 2,
+		Config:        image.Descriptor{Digest: configDigest},
+	}, nil)
+	return client
+}
+
+func TestBuildStageAddTriggerNodes(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	client := triggerClientFixture(t, ctx, ctrl,
+		[]string{"ENV APP=/app", "WORKDIR ${SRC}", "ARG target", "CMD make ${target}"},
+		[]string{"SRC=/src"})
+
+	from := step.FromStepFixtureWithClient("", "alpine:latest", "", client)
+	cmd := step.NewCmdStep("", []string{"ls"}, false)
+	require.NoError(cmd.SetCacheID(ctx, from.CacheID()))
+	opts := &buildPlanOptions{allowModifyFS: true}
+	stage, err := newBuildStageHelper(ctx, "", []step.BuildStep{from, cmd}, opts)
+	require.NoError(err)
+
+	added, err := stage.addTriggerNodes(map[string]string{"target": "all"})
+	require.NoError(err)
+	require.True(added)
+	require.Len(stage.nodes, 6)
+	require.Equal("ENV APP=/app", stage.nodes[1].CacheKeyInputs().Instruction)
+	require.Equal("WORKDIR /src", stage.nodes[2].CacheKeyInputs().Instruction)
+	require.Equal("CMD make all", stage.nodes[4].CacheKeyInputs().Instruction)
+	require.Equal(cmd, stage.nodes[5].BuildStep)
+
+	// The triggers are not inherited by the image of the stage.
+	config, err := from.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Empty(config.Config.OnBuild)
+
+	// Remote stages don't run triggers.
+	stage.remote = true
+	stage.nodes = stage.nodes[:1]
+	added, err = stage.addTriggerNodes(nil)
+	require.NoError(err)
+	require.False(added)
+	require.Len(stage.nodes, 1)
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// CacheKeyReport lists the cache keys of all steps of a plan, and the inputs
+// they were computed from. It's computed without executing any step.
+type CacheKeyReport struct {
+	Steps []CacheKeyStep `json:"steps"`
+}
+
+// CacheKeyStep is the cache key of one step of a CacheKeyReport.
+type CacheKeyStep struct {
+	Stage string `json:"stage"`
+	// Step is the 1-based index of the step in its stage.
+	Step     int    `json:"step"`
+	CacheKey string `json:"cache_key"`
+	step.CacheKeyInputs
+
+	// BaseImageDigest is the digest of the manifest the base image of FROM
+	// currently points to. The cache key only depends on the name of the base
+	// image, so this tells if a cached FROM is still the same image.
+	BaseImageDigest image.Digest `json:"base_image_digest,omitempty"`
+}
+
+// CacheKeyReport returns the cache keys of all steps of the plan, in the
+// order they are chained. It resolves the digests of the base images, but
+// doesn't pull them.
+func (plan *BuildPlan) CacheKeyReport() (*CacheKeyReport, error) {
+	report := &CacheKeyReport{Steps: []CacheKeyStep{}}
+	for _, stage := range plan.stages {
+		for i, node := range stage.nodes {
+			s := CacheKeyStep{
+				Stage:          stage.alias,
+				Step:           i + 1,
+				CacheKey:       node.CacheID(),
+				CacheKeyInputs: node.CacheKeyInputs(),
+			}
+			if from, ok := node.BuildStep.(*step.FromStep); ok {
+				digest, err := from.ResolveDigest(stage.ctx.ImageStore)
+				if err != nil {
+					return nil, fmt.Errorf("resolve base image of stage %s: %s", stage.alias, err)
+				}
+				s.BaseImageDigest = digest
+			}
+			report.Steps = append(report.Steps, s)
+		}
+	}
+	return report, nil
+}
+
+// WriteFile writes the report as JSON to the given path.
+func (r *CacheKeyReport) WriteFile(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cache key report: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("write cache key report: %s", err)
+	}
+	return nil
+}
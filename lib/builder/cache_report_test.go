@@ -0,0 +1,89 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKeyReport(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mockregistry.NewMockClient(ctrl)
+	client.EXPECT().ResolveDigest("latest").Return(image.Digest("sha256:alpine"), nil).Times(2)
+
+	report := func(content string) *CacheKeyReport {
+		require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "src"), []byte(content), 0644))
+		from := dockerfile.FromDirectiveFixture("alpine:latest", "alpine:latest", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("src /src", "", "", []string{"src"}, "/src"),
+			dockerfile.RunDirectiveFixture("make", "make"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+		target := image.NewImageName("", "testrepo", "tag")
+		plan, err := NewBuildPlan(ctx, target, nil, cache.NewNoopCacheManager(), stages, true, true, "")
+		require.NoError(err)
+		step.SetRegistryClientFixture(plan.stages[0].nodes[0].BuildStep.(*step.FromStep), client)
+		report, err := plan.CacheKeyReport()
+		require.NoError(err)
+		return report
+	}
+
+	first := report("a")
+	require.Len(first.Steps, 3)
+	from, copy, run := first.Steps[0], first.Steps[1], first.Steps[2]
+
+	require.Equal("index.docker.io/library/alpine:latest", from.BaseImage)
+	require.Equal("FROM alpine:latest", from.Instruction)
+	require.Equal(image.Digest("sha256:alpine"), from.BaseImageDigest)
+	require.Empty(copy.BaseImageDigest)
+
+	// Cache keys are chained.
+	require.Equal(from.CacheKey, copy.Seed)
+	require.Equal("COPY src /src", copy.Instruction)
+	require.NotEmpty(copy.ContentHash)
+	require.Equal(copy.CacheKey, run.Seed)
+	require.Equal("RUN make", run.Instruction)
+	require.Empty(run.ContentHash)
+	for i, s := range first.Steps {
+		require.Equal(i+1, s.Step)
+		require.Equal("0", s.Stage)
+	}
+
+	// Changing the copied content changes the key of COPY and the steps after
+	// it, but not the one of FROM.
+	second := report("b")
+	require.Equal(from.CacheKey, second.Steps[0].CacheKey)
+	require.NotEqual(copy.ContentHash, second.Steps[1].ContentHash)
+	require.NotEqual(copy.CacheKey, second.Steps[1].CacheKey)
+	require.NotEqual(run.CacheKey, second.Steps[2].CacheKey)
+}
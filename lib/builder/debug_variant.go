@@ -0,0 +1,143 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// DebugVariant describes a variant of the target image used for debugging. It
+// is derived from the target image after the build, so it doesn't affect the
+// target image or its cache.
+type DebugVariant struct {
+	Name image.Name
+
+	// Entrypoint and Cmd override the ones of the target image if not empty.
+	Entrypoint []string
+	Cmd        []string
+	// AppendCmd is appended to the CMD of the target image.
+	AppendCmd []string
+
+	// LayerDir is a local directory whose content is added as an extra layer
+	// at LayerDest, "/" if empty.
+	LayerDir  string
+	LayerDest string
+}
+
+// SetDebugVariant makes the plan also save a debug variant of the target
+// image.
+func (plan *BuildPlan) SetDebugVariant(variant *DebugVariant) error {
+	plan.debugVariant = variant
+	return plan.dedupeImageNames()
+}
+
+// saveDebugVariant saves the debug variant of the image built by the given
+// stage.
+func (plan *BuildPlan) saveDebugVariant(stage *buildStage) (*image.DistributionManifest, error) {
+	variant := plan.debugVariant
+	config, err := image.NewImageConfigFromCopy(stage.lastImageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("copy image config: %s", err)
+	}
+
+	nodes := append([]*buildNode{}, stage.nodes...)
+	if variant.LayerDir != "" {
+		node, err := newDebugLayerNode(stage.ctx, variant, config)
+		if err != nil {
+			return nil, fmt.Errorf("create debug layer: %s", err)
+		}
+		nodes = append(nodes, node)
+		for _, digestPair := range node.digestPairs {
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digestPair.TarDigest)
+			config.History = append(config.History, image.History{
+				Created:   time.Now(),
+				CreatedBy: fmt.Sprintf("makisu: %s", node.String()),
+				Author:    "makisu",
+			})
+		}
+	}
+
+	if config.Config == nil {
+		config.Config = &image.ContainerConfig{}
+	}
+	if len(variant.Entrypoint) > 0 {
+		config.Config.Entrypoint = variant.Entrypoint
+	}
+	if len(variant.Cmd) > 0 {
+		config.Config.Cmd = variant.Cmd
+	}
+	config.Config.Cmd = append(config.Config.Cmd, variant.AppendCmd...)
+
+	variantStage := &buildStage{
+		ctx:             stage.ctx,
+		alias:           stage.alias,
+		nodes:           nodes,
+		lastImageConfig: config,
+		opts:            stage.opts,
+		oci:             stage.oci,
+	}
+	manifest, err := variantStage.saveManifest(plan.baseCtx.ImageStore, variant.Name)
+	if err != nil {
+		return nil, fmt.Errorf("save image manifest %s: %s", variant.Name, err)
+	}
+	log.Infof("Saved debug variant %s", variant.Name)
+	return manifest, nil
+}
+
+// newDebugLayerNode commits the content of the debug layer dir as a layer. It
+// copies from the dir without touching the file system, the same way COPY
+// does when modifyfs is off.
+func newDebugLayerNode(
+	baseCtx *context.BuildContext, variant *DebugVariant,
+	config *image.Config) (*buildNode, error) {
+
+	ctx, err := context.NewBuildContext(baseCtx.RootDir, variant.LayerDir, baseCtx.ImageStore)
+	if err != nil {
+		return nil, fmt.Errorf("create build context: %s", err)
+	}
+	dest := variant.LayerDest
+	if dest == "" {
+		dest = "/"
+	}
+	args := fmt.Sprintf(". %s", dest)
+	copyStep, err := step.NewCopyStep(step.AddCopyOptions{
+		Args:      args,
+		FromPaths: []string{"."},
+		ToPath:    dest,
+		Commit:    true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new copy step: %s", err)
+	}
+	if err := copyStep.ApplyCtxAndConfig(ctx, config); err != nil {
+		return nil, fmt.Errorf("apply config: %s", err)
+	}
+	if err := copyStep.Execute(ctx, false); err != nil {
+		return nil, fmt.Errorf("execute copy: %s", err)
+	}
+	digestPairs, err := copyStep.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("commit copy: %s", err)
+	}
+	node := newBuildNode(ctx, copyStep)
+	node.digestPairs = digestPairs
+	return node, nil
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadImageFixture(
+	t *testing.T, store *storage.ImageStore, name image.Name) (*image.DistributionManifest, *image.Config) {
+
+	require := require.New(t)
+
+	r, err := store.Manifests.GetStoreFileReader(name.GetRepository(), name.GetTag())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	manifest := new(image.DistributionManifest)
+	require.NoError(json.Unmarshal(b, manifest))
+
+	r, err = store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	config, err := image.NewImageConfigFromJSON(b)
+	require.NoError(err)
+	return manifest, config
+}
+
+func TestBuildPlanDebugVariant(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	layerDir, err := ioutil.TempDir("", "makisu-debug-layer")
+	require.NoError(err)
+	defer os.RemoveAll(layerDir)
+	require.NoError(ioutil.WriteFile(filepath.Join(layerDir, "dlv"), []byte("debugger"), 0755))
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	debug := image.NewImageName("", "testrepo", "testtag-debug")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		dockerfile.EntrypointDirectiveFixture("/app", []string{"/app"}),
+		dockerfile.CmdDirectiveFixture("--port=80", []string{"--port=80"}),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+	require.Error(plan.SetDebugVariant(&DebugVariant{Name: target}))
+	require.NoError(plan.SetDebugVariant(&DebugVariant{
+		Name:       debug,
+		Entrypoint: []string{"/debug/dlv", "exec", "/app", "--"},
+		AppendCmd:  []string{"--verbose"},
+		LayerDir:   layerDir,
+		LayerDest:  "/debug/",
+	}))
+
+	_, err = plan.Execute()
+	require.NoError(err)
+
+	manifest, config := loadImageFixture(t, ctx.ImageStore, target)
+	debugManifest, debugConfig := loadImageFixture(t, ctx.ImageStore, debug)
+
+	// The target image is untouched.
+	require.Equal([]string{"/app"}, config.Config.Entrypoint)
+	require.Equal([]string{"--port=80"}, config.Config.Cmd)
+
+	// The variant has the target's layers plus the injected one.
+	require.Equal([]string{"/debug/dlv", "exec", "/app", "--"}, debugConfig.Config.Entrypoint)
+	require.Equal([]string{"--port=80", "--verbose"}, debugConfig.Config.Cmd)
+	require.Len(debugManifest.Layers, len(manifest.Layers)+1)
+	require.Equal(manifest.Layers, debugManifest.Layers[:len(manifest.Layers)])
+	require.Equal(config.RootFS.DiffIDs, debugConfig.RootFS.DiffIDs[:len(config.RootFS.DiffIDs)])
+	require.Len(debugConfig.RootFS.DiffIDs, len(debugManifest.Layers))
+
+	// The injected layer contains the debug dir.
+	injected := debugManifest.Layers[len(debugManifest.Layers)-1]
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(injected.Digest.Hex())
+	require.NoError(err)
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	tarReader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, header.Name)
+	}
+	require.Contains(names, "debug/dlv")
+}
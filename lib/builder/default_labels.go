@@ -0,0 +1,90 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// LabelMetadata is the build metadata default label values can expand, as in
+// "{{.Revision}}".
+type LabelMetadata struct {
+	// Revision is the git revision of the build context, if any.
+	Revision string
+	// Created is the creation time of the image, in RFC 3339 format.
+	Created string
+}
+
+// SetDefaultLabels makes the plan add the given labels to the config of every
+// image it saves, unless a LABEL of the image's stage sets them. They override
+// labels inherited from base images. Values are templates expanded with
+// LabelMetadata, and revision is the git revision they expand to.
+func (plan *BuildPlan) SetDefaultLabels(labels map[string]string, revision string) error {
+	plan.defaultLabels = make(map[string]*template.Template, len(labels))
+	for key, value := range labels {
+		tmpl, err := template.New(key).Parse(value)
+		if err != nil {
+			return fmt.Errorf("parse default label %s: %s", key, err)
+		}
+		plan.defaultLabels[key] = tmpl
+	}
+	plan.revision = revision
+	return nil
+}
+
+// applyDefaultLabels adds the default labels not set by a LABEL step of the
+// stage to the last image config of the stage.
+func (plan *BuildPlan) applyDefaultLabels(stage *buildStage) error {
+	if len(plan.defaultLabels) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, node := range stage.nodes {
+		if label, ok := node.BuildStep.(*step.LabelStep); ok {
+			for key := range label.Labels() {
+				set[key] = true
+			}
+		}
+	}
+
+	metadata := LabelMetadata{
+		Revision: plan.revision,
+		Created:  stage.lastImageConfig.Created.UTC().Format(time.RFC3339),
+	}
+	labels := make(map[string]string)
+	for key, tmpl := range plan.defaultLabels {
+		if set[key] {
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, metadata); err != nil {
+			return fmt.Errorf("expand default label %s: %s", key, err)
+		}
+		labels[key] = b.String()
+	}
+	if stage.lastImageConfig.Config == nil {
+		stage.lastImageConfig.Config = &image.ContainerConfig{}
+	}
+	config := stage.lastImageConfig.Config
+	config.Labels = utils.MergeStringMaps(config.Labels, labels)
+	return nil
+}
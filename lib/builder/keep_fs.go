@@ -0,0 +1,128 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber/makisu/lib/fileio"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// keepFS describes the steps whose resulting filesystem is saved for
+// inspection, and where.
+type keepFS struct {
+	dir   string
+	steps map[string]bool // "<stage alias>/<step number>", or all if empty
+}
+
+// SetKeepFS makes the plan save the filesystem after the given steps as
+// "<dir>/<stage alias>/<step number>", as plain files, for inspection. Steps
+// are given as "<stage alias>/<step number>", numbered from 1 as in the build
+// logs. All steps are saved if none are given.
+// The filesystem is saved after failed steps too. dir should be blacklisted,
+// so it doesn't end up in the layers of later steps.
+func (plan *BuildPlan) SetKeepFS(dir string, steps []string) error {
+	stages := make(map[string]*buildStage)
+	for _, stage := range plan.stages {
+		stages[stage.alias] = stage
+	}
+	selected := make(map[string]bool)
+	for _, s := range steps {
+		parts := strings.SplitN(s, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid step %s, expected <stage>/<step number>", s)
+		}
+		stage, ok := stages[parts[0]]
+		if !ok {
+			return fmt.Errorf("unknown stage %s", parts[0])
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 || n > len(stage.nodes) {
+			return fmt.Errorf("invalid step number %s of stage %s", parts[1], parts[0])
+		}
+		selected[s] = true
+	}
+	for _, stage := range plan.stages {
+		stage.keepFS = &keepFS{dir: dir, steps: selected}
+	}
+	return nil
+}
+
+// saveFS saves the filesystem after the i-th step of the stage, if it was
+// selected. Stages that modify the local filesystem are copied from it, the
+// others are extracted from the layers committed so far.
+func (stage *buildStage) saveFS(i int, modifyFS bool) error {
+	if stage.keepFS == nil {
+		return nil
+	}
+	step := fmt.Sprintf("%s/%d", stage.alias, i+1)
+	if len(stage.keepFS.steps) != 0 && !stage.keepFS.steps[step] {
+		return nil
+	}
+	dst := filepath.Join(stage.keepFS.dir, step)
+	if err := os.RemoveAll(dst); err != nil {
+		return fmt.Errorf("clean up %s: %s", dst, err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("create %s: %s", dst, err)
+	}
+
+	if modifyFS {
+		blacklist := append([]string{
+			stage.ctx.ContextDir, stage.ctx.ImageStore.RootDir, stage.keepFS.dir,
+		}, pathutils.DefaultBlacklist...)
+		if err := fileio.NewCopier(blacklist).CopyDir(stage.ctx.RootDir, dst); err != nil {
+			return fmt.Errorf("copy root dir: %s", err)
+		}
+	} else {
+		fs, err := snapshot.NewMemFS(clock.New(), dst, nil)
+		if err != nil {
+			return fmt.Errorf("create memfs: %s", err)
+		}
+		for _, node := range stage.nodes[:i+1] {
+			for _, digestPair := range node.digestPairs {
+				if err := extractLayer(stage, fs, digestPair.GzipDescriptor.Digest.Hex()); err != nil {
+					return fmt.Errorf("extract layer %s: %s", digestPair.GzipDescriptor.Digest, err)
+				}
+			}
+		}
+	}
+	log.Infof("* Saved filesystem after step %s to %s", step, dst)
+	return nil
+}
+
+func extractLayer(stage *buildStage, fs *snapshot.MemFS, hex string) error {
+	reader, err := stage.ctx.ImageStore.Layers.GetStoreFileReader(hex)
+	if err != nil {
+		return fmt.Errorf("get reader from layer: %s", err)
+	}
+	defer reader.Close()
+	layerReader, err := tario.NewDecompressionReader(reader)
+	if err != nil {
+		return fmt.Errorf("create decompression reader for layer: %s", err)
+	}
+	defer layerReader.Close()
+	return fs.UpdateFromTarReader(tar.NewReader(layerReader), true)
+}
@@ -0,0 +1,186 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// layerPusher pushes the layers of the stages that produce images to the
+// repositories those images will be pushed to, as soon as they are committed.
+// The push overlaps with the build of the following steps, and the final
+// push of the images finds the layers already there.
+type layerPusher struct {
+	sync.Mutex
+
+	// targets are the images each stage will be pushed as, keyed by alias.
+	targets map[string][]image.Name
+	// sem bounds the number of layers pushed concurrently.
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	pushed map[string]bool // Keyed by repository and layer digest
+	// layers are the layers committed so far by each stage, keyed by alias.
+	layers map[string][]image.Descriptor
+	// err is the first push error. Once set, done is closed, pending pushes
+	// are dropped and the build stops before its next step.
+	err  error
+	done chan struct{}
+
+	// checkSize fails if the layers of an image exceed the image size limit.
+	// Layers are only pushed while their image is within the limit.
+	checkSize func(layers []image.Descriptor) error
+	// newClient returns the registry client used to push to an image's
+	// repository.
+	newClient func(name image.Name) registry.Client
+}
+
+func newLayerPusher(
+	store *storage.ImageStore, targets map[string][]image.Name, concurrency int) *layerPusher {
+
+	return &layerPusher{
+		targets:   targets,
+		sem:       make(chan struct{}, concurrency),
+		pushed:    make(map[string]bool),
+		layers:    make(map[string][]image.Descriptor),
+		done:      make(chan struct{}),
+		checkSize: func([]image.Descriptor) error { return nil },
+		newClient: func(name image.Name) registry.Client {
+			return registry.New(store, name.GetRegistry(), name.GetRepository())
+		},
+	}
+}
+
+// SetLayerPush makes the plan push the layers of the images it builds while
+// the build is still going on, up to concurrency at a time. Images are pushed
+// to the given registries, and replicas to their own. It must be called after
+// SetStageImages. A failed push fails the build, and so does an image growing
+// past the limit of SetMaxImageSize, unless oversized images are allowed.
+func (plan *BuildPlan) SetLayerPush(registries []string, concurrency int) {
+	targets := make(map[string][]image.Name)
+	targetAlias := plan.targetStage().alias
+	for _, registry := range registries {
+		targets[targetAlias] = append(targets[targetAlias], plan.target.WithRegistry(registry))
+		for alias, names := range plan.stageImages {
+			for _, name := range names {
+				targets[alias] = append(targets[alias], name.WithRegistry(registry))
+			}
+		}
+	}
+	targets[targetAlias] = append(targets[targetAlias], plan.replicas...)
+
+	plan.layerPusher = newLayerPusher(plan.baseCtx.ImageStore, targets, concurrency)
+	plan.layerPusher.checkSize = func(layers []image.Descriptor) error {
+		if plan.allowOversizedImages {
+			return nil
+		}
+		return plan.checkLayersSize(nil, layers)
+	}
+	for _, stage := range plan.stages {
+		stage.layerPusher = plan.layerPusher
+	}
+}
+
+// push starts pushing the layers of the given digest pairs to the
+// repositories of the stage's images in the background. Layers already
+// pushed to a repository are skipped. It fails without pushing anything if
+// the layers of the stage so far exceed the image size limit, since the image
+// would be rejected once built.
+func (p *layerPusher) push(alias string, digestPairs []*image.DigestPair) error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if p.err != nil || len(p.targets[alias]) == 0 {
+		return p.err
+	}
+	for _, digestPair := range digestPairs {
+		p.layers[alias] = append(p.layers[alias], digestPair.GzipDescriptor)
+	}
+	if err := p.checkSize(p.layers[alias]); err != nil {
+		p.fail(fmt.Errorf("check size of stage %s: %s", alias, err))
+		return p.err
+	}
+
+	for _, name := range p.targets[alias] {
+		for _, digestPair := range digestPairs {
+			name, digest := name, digestPair.GzipDescriptor.Digest
+			key := fmt.Sprintf("%s/%s@%s", name.GetRegistry(), name.GetRepository(), digest)
+			if p.pushed[key] {
+				continue
+			}
+			p.pushed[key] = true
+
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				select {
+				case p.sem <- struct{}{}:
+					defer func() { <-p.sem }()
+				case <-p.done:
+					return
+				}
+
+				if p.failed() != nil {
+					return
+				}
+				if err := p.newClient(name).PushLayer(digest); err != nil {
+					p.Lock()
+					p.fail(fmt.Errorf("push layer %s to %s: %s", digest.Hex(), name.GetRepository(), err))
+					p.Unlock()
+					return
+				}
+				log.Infof("Pushed layer %s to %s during build", digest.Hex(), name.GetRepository())
+			}()
+		}
+	}
+	return nil
+}
+
+// fail records the first error and cancels the pushes waiting for a slot.
+// It must be called with the lock held.
+func (p *layerPusher) fail(err error) {
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	close(p.done)
+}
+
+// failed returns the first push error, if any.
+func (p *layerPusher) failed() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+// wait waits for all started pushes, and returns the first push error.
+func (p *layerPusher) wait() error {
+	if p == nil {
+		return nil
+	}
+	p.wg.Wait()
+	return p.failed()
+}
@@ -0,0 +1,260 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+const _layerDelay = 50 * time.Millisecond
+
+// layerPushPlanFixture returns a plan that copies two files from the context
+// dir, one layer each.
+func layerPushPlanFixture(t *testing.T, ctx *context.BuildContext) *BuildPlan {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file1"), []byte("one"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file2"), []byte("two"), 0644))
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("file1 /app/file1", "", "", []string{"file1"}, "/app/file1"),
+		dockerfile.CopyDirectiveFixture("file2 /app/file2", "", "", []string{"file2"}, "/app/file2"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	target := image.NewImageName("", "testrepo", "testtag")
+	replica := image.NewImageName("replica.registry", "replicarepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, []image.Name{replica}, cacheMgr, stages, true, true, "")
+	require.NoError(t, err)
+	return plan
+}
+
+func TestBuildPlanLayerPush(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var mu sync.Mutex
+	pushed := make(map[string][]image.Digest)
+	plan := layerPushPlanFixture(t, ctx)
+	plan.SetLayerPush([]string{"push.registry"}, 2)
+	plan.layerPusher.newClient = func(name image.Name) registry.Client {
+		client := mockregistry.NewMockClient(ctrl)
+		client.EXPECT().PushLayer(gomock.Any()).DoAndReturn(func(digest image.Digest) error {
+			mu.Lock()
+			defer mu.Unlock()
+			pushed[name.GetRegistry()] = append(pushed[name.GetRegistry()], digest)
+			return nil
+		})
+		return client
+	}
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	// Each layer is pushed once to the target and once to the replica.
+	layers := manifest.GetLayerDigests()
+	require.ElementsMatch(layers, pushed["push.registry"])
+	require.ElementsMatch(layers, pushed["replica.registry"])
+}
+
+func TestBuildPlanLayerPushFailure(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	plan := layerPushPlanFixture(t, ctx)
+	plan.SetLayerPush(nil, 1)
+	plan.layerPusher.newClient = func(name image.Name) registry.Client {
+		client := mockregistry.NewMockClient(ctrl)
+		client.EXPECT().PushLayer(gomock.Any()).Return(errors.New("connection reset")).AnyTimes()
+		return client
+	}
+
+	_, err := plan.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), "connection reset")
+}
+
+func TestLayerPusherDropsPushesAfterFailure(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	target := image.NewImageName("registry", "repo", "tag")
+	pusher := newLayerPusher(ctx.ImageStore, map[string][]image.Name{"0": {target}}, 1)
+	client := mockregistry.NewMockClient(ctrl)
+	client.EXPECT().PushLayer(image.Digest("sha256:1")).Return(errors.New("unauthorized"))
+	pusher.newClient = func(image.Name) registry.Client { return client }
+
+	require.NoError(pusher.push("0", []*image.DigestPair{{GzipDescriptor: image.Descriptor{Digest: "sha256:1"}}}))
+	require.Error(pusher.wait())
+	require.Error(pusher.failed())
+
+	// Later layers aren't pushed, and stages without images push nothing.
+	require.Error(pusher.push("0", []*image.DigestPair{{GzipDescriptor: image.Descriptor{Digest: "sha256:2"}}}))
+	require.Error(pusher.push("1", []*image.DigestPair{{GzipDescriptor: image.Descriptor{Digest: "sha256:3"}}}))
+	require.Error(pusher.wait())
+}
+
+func TestLayerPusherCancelsQueuedPushesOnFailure(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	target := image.NewImageName("registry", "repo", "tag")
+	pusher := newLayerPusher(ctx.ImageStore, map[string][]image.Name{"0": {target}}, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	client := mockregistry.NewMockClient(ctrl)
+	client.EXPECT().PushLayer(image.Digest("sha256:1")).DoAndReturn(func(image.Digest) error {
+		close(started)
+		<-release
+		return errors.New("unauthorized")
+	})
+	pusher.newClient = func(image.Name) registry.Client { return client }
+
+	// The second layer waits for the first push, and is cancelled by its
+	// failure instead of being pushed.
+	require.NoError(pusher.push("0", []*image.DigestPair{{GzipDescriptor: image.Descriptor{Digest: "sha256:1"}}}))
+	<-started
+	require.NoError(pusher.push("0", []*image.DigestPair{{GzipDescriptor: image.Descriptor{Digest: "sha256:2"}}}))
+	close(release)
+	require.Error(pusher.wait())
+}
+
+func TestBuildPlanLayerPushMaxImageSize(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No layer of an oversized image is pushed.
+	plan := layerPushPlanFixture(t, ctx)
+	plan.SetMaxImageSize(1, false)
+	plan.SetLayerPush([]string{"push.registry"}, 2)
+	plan.layerPusher.newClient = func(name image.Name) registry.Client {
+		return mockregistry.NewMockClient(ctrl)
+	}
+	_, err := plan.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), "exceeds limit of 1 bytes")
+}
+
+func TestBuildPlanLayerPushAllowOversizedImages(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var mu sync.Mutex
+	var pushed []image.Digest
+	plan := layerPushPlanFixture(t, ctx)
+	plan.SetMaxImageSize(1, true)
+	plan.SetLayerPush([]string{"push.registry"}, 2)
+	plan.layerPusher.newClient = func(name image.Name) registry.Client {
+		client := mockregistry.NewMockClient(ctrl)
+		client.EXPECT().PushLayer(gomock.Any()).DoAndReturn(func(digest image.Digest) error {
+			mu.Lock()
+			defer mu.Unlock()
+			pushed = append(pushed, digest)
+			return nil
+		})
+		return client
+	}
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(pushed, 2*len(manifest.Layers))
+}
+
+// TestLayerPusherOverlapsBuild compares pushing layers as soon as they are
+// built with pushing them after the build, with steps and pushes that both
+// take _layerDelay.
+func TestLayerPusherOverlapsBuild(t *testing.T) {
+	const layers = 4
+
+	run := func(overlap bool) time.Duration {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		target := image.NewImageName("registry", "repo", "tag")
+		pusher := newLayerPusher(ctx.ImageStore, map[string][]image.Name{"0": {target}}, 1)
+		pusher.newClient = func(image.Name) registry.Client {
+			client := mockregistry.NewMockClient(ctrl)
+			client.EXPECT().PushLayer(gomock.Any()).DoAndReturn(func(image.Digest) error {
+				time.Sleep(_layerDelay)
+				return nil
+			}).AnyTimes()
+			return client
+		}
+
+		start := time.Now()
+		var built []*image.DigestPair
+		for i := 0; i < layers; i++ {
+			time.Sleep(_layerDelay)
+			digest := image.Digest(fmt.Sprintf("sha256:%d", i))
+			pair := &image.DigestPair{GzipDescriptor: image.Descriptor{Digest: digest}}
+			built = append(built, pair)
+			if overlap {
+				require.NoError(t, pusher.push("0", []*image.DigestPair{pair}))
+			}
+		}
+		if !overlap {
+			require.NoError(t, pusher.push("0", built))
+		}
+		require.NoError(t, pusher.wait())
+		return time.Since(start)
+	}
+
+	serial := run(false)
+	overlapped := run(true)
+	require.True(t, serial >= 2*layers*_layerDelay, "serial took %s", serial)
+	require.True(t, overlapped < serial-_layerDelay,
+		"overlapped took %s, serial took %s", overlapped, serial)
+}
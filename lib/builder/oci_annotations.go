@@ -0,0 +1,116 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// AnnotationMetadata is the build metadata OCI annotation values can expand,
+// as in "{{.Revision}}" or "{{.Instruction}}".
+type AnnotationMetadata struct {
+	LabelMetadata
+	// Stage is the alias of the stage of the image.
+	Stage string
+	// Instruction is the Dockerfile instruction that created the layer. It is
+	// only set for layer annotations.
+	Instruction string
+}
+
+// SetOCIAnnotations makes the plan add the given annotations to the OCI
+// manifests it saves, and layerAnnotations to the descriptors of each of their
+// layers. Values are templates expanded with AnnotationMetadata, and revision is
+// the git revision they expand to. Docker schema2 manifests have no
+// annotations, so they only apply with SetOCI.
+func (plan *BuildPlan) SetOCIAnnotations(
+	annotations, layerAnnotations map[string]string, revision string) error {
+
+	var err error
+	if plan.ociAnnotations, err = parseAnnotations(annotations); err != nil {
+		return err
+	}
+	if plan.ociLayerAnnotations, err = parseAnnotations(layerAnnotations); err != nil {
+		return err
+	}
+	plan.revision = revision
+	return nil
+}
+
+// parseAnnotations parses the values of the annotations as templates.
+func parseAnnotations(annotations map[string]string) (map[string]*template.Template, error) {
+	result := make(map[string]*template.Template, len(annotations))
+	for key, value := range annotations {
+		tmpl, err := template.New(key).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse annotation %s: %s", key, err)
+		}
+		result[key] = tmpl
+	}
+	return result, nil
+}
+
+// expandAnnotations expands the annotation templates with the metadata.
+func expandAnnotations(
+	annotations map[string]*template.Template, metadata AnnotationMetadata) (map[string]string, error) {
+
+	result := make(map[string]string, len(annotations))
+	for key, tmpl := range annotations {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, metadata); err != nil {
+			return nil, fmt.Errorf("expand annotation %s: %s", key, err)
+		}
+		result[key] = b.String()
+	}
+	return result, nil
+}
+
+// applyOCIAnnotations sets the annotations of the OCI manifest of the stage
+// and of its layers, each layer expanding them with the instruction of the
+// step that created it.
+func (plan *BuildPlan) applyOCIAnnotations(stage *buildStage) error {
+	if !stage.oci || (len(plan.ociAnnotations) == 0 && len(plan.ociLayerAnnotations) == 0) {
+		return nil
+	}
+
+	metadata := AnnotationMetadata{
+		LabelMetadata: LabelMetadata{
+			Revision: plan.revision,
+			Created:  stage.lastImageConfig.Created.UTC().Format(time.RFC3339),
+		},
+		Stage: stage.alias,
+	}
+	manifest, err := expandAnnotations(plan.ociAnnotations, metadata)
+	if err != nil {
+		return err
+	}
+	layers := make(map[image.Digest]map[string]string)
+	for _, node := range stage.nodes {
+		metadata.Instruction = node.CacheKeyInputs().Instruction
+		for _, digestPair := range node.digestPairs {
+			annotations, err := expandAnnotations(plan.ociLayerAnnotations, metadata)
+			if err != nil {
+				return err
+			}
+			layers[digestPair.GzipDescriptor.Digest] = annotations
+		}
+	}
+	stage.ociAnnotations = image.OCIAnnotations{Manifest: manifest, Layers: layers}
+	return nil
+}
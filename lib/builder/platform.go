@@ -0,0 +1,112 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// hostPlatform is the platform makisu runs on.
+var hostPlatform = Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+
+// binfmtMiscDir is where the kernel lists the interpreters registered for
+// foreign binaries.
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArchitectures maps architectures to the names QEMU user emulators are
+// registered with in binfmt_misc, e.g. "qemu-aarch64".
+var qemuArchitectures = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"mips64le": "mips64el",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// nativeArchitectures lists the foreign architectures hosts run natively.
+var nativeArchitectures = map[string][]string{
+	"amd64": {"386"},
+}
+
+// Platform is the OS and architecture an image is built for.
+type Platform struct {
+	OS           string
+	Architecture string
+}
+
+// ParsePlatform parses a platform of the form "<os>/<arch>".
+func ParsePlatform(input string) (Platform, error) {
+	parts := strings.Split(input, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected <os>/<arch>", input)
+	}
+	return Platform{OS: parts[0], Architecture: parts[1]}, nil
+}
+
+func (p Platform) String() string {
+	return p.OS + "/" + p.Architecture
+}
+
+// validatePlatform checks that the OS and architecture declared by the image
+// config match the given platform. The layers of the image come from the base
+// images, whose declared platform is carried over into the config, so a
+// mismatch means the image would be mislabeled.
+func validatePlatform(config *image.Config, platform Platform) error {
+	declared := Platform{OS: config.OS, Architecture: config.Architecture}
+	if declared != platform {
+		return fmt.Errorf(
+			"image config declares platform %s but build platform is %s", declared, platform)
+	}
+	return nil
+}
+
+// checkCanRun returns an error if binaries of the given platform can't be run
+// on the host, i.e. it's a different architecture and no binfmt_misc emulator
+// is registered for it.
+func checkCanRun(platform Platform) error {
+	if platform == hostPlatform {
+		return nil
+	} else if platform.OS != hostPlatform.OS {
+		return fmt.Errorf("host platform is %s, %s binaries can't be run", hostPlatform, platform.OS)
+	}
+	for _, arch := range nativeArchitectures[hostPlatform.Architecture] {
+		if arch == platform.Architecture {
+			return nil
+		}
+	}
+	qemuArch, ok := qemuArchitectures[platform.Architecture]
+	if !ok {
+		return fmt.Errorf("host platform is %s, and %s can't be emulated", hostPlatform, platform)
+	}
+	entry := filepath.Join(binfmtMiscDir, "qemu-"+qemuArch)
+	content, err := ioutil.ReadFile(entry)
+	if err != nil || !strings.HasPrefix(string(content), "enabled") {
+		return fmt.Errorf(
+			"host platform is %s, and no emulator for %s is registered in %s. "+
+				"Build on a %s host, or register QEMU user emulators, "+
+				"e.g. with `docker run --privileged --rm tonistiigi/binfmt --install %s`",
+			hostPlatform, platform.Architecture, entry, platform.Architecture, platform.Architecture)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// PrefetchBaseImages starts prefetching the base images of the parsed stages
+// with the puller, before the build plan is created. Each image is pulled for
+// the platform its stage will be built for, decided the same way as
+// BuildPlan.stagePlatform: stagePlatforms, then `FROM --platform`, then
+// platform, which can be nil.
+func PrefetchBaseImages(
+	puller *step.BaseImagePuller, parsedStages dockerfile.Stages,
+	platform *Platform, stagePlatforms map[string]Platform) error {
+
+	for i, parsedStage := range parsedStages {
+		alias := parsedStage.From.Alias
+		if alias == "" {
+			alias = strconv.Itoa(i)
+		}
+		stagePlatform := platform
+		if p, ok := stagePlatforms[alias]; ok {
+			stagePlatform = &p
+		} else if parsedStage.From.Platform != "" {
+			p, err := ParsePlatform(parsedStage.From.Platform)
+			if err != nil {
+				return fmt.Errorf("parse platform of stage %s: %s", alias, err)
+			}
+			stagePlatform = &p
+		}
+
+		var imagePlatform *image.Platform
+		if stagePlatform != nil {
+			imagePlatform = &image.Platform{OS: stagePlatform.OS, Architecture: stagePlatform.Architecture}
+		}
+		if err := puller.Prefetch(parsedStage.From.Image, imagePlatform); err != nil {
+			return fmt.Errorf("prefetch base image of stage %s: %s", alias, err)
+		}
+	}
+	return nil
+}
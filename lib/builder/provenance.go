@@ -0,0 +1,184 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils"
+)
+
+const redactedBuildArg = "REDACTED"
+
+// Build args whose name contains any of these words are redacted from
+// provenance.
+var secretBuildArgWords = []string{
+	"SECRET",
+	"PASSWORD",
+	"PASSWD",
+	"TOKEN",
+	"CREDENTIAL",
+	"KEY",
+	"AUTH",
+}
+
+// Provenance describes how an image was built. It contains no timestamps, so
+// the same build inputs always produce the same provenance.
+type Provenance struct {
+	Builder string `json:"builder"`
+	Image   string `json:"image"`
+	// ManifestDigest is the digest of the image as pushed, ConfigDigest the
+	// one of its config.
+	ManifestDigest image.Digest `json:"manifest_digest"`
+	ConfigDigest   image.Digest `json:"config_digest"`
+	Target         string       `json:"target,omitempty"`
+
+	DockerfileDigest image.Digest      `json:"dockerfile_digest"`
+	ContextDigest    image.Digest      `json:"context_digest"`
+	BuildArgs        map[string]string `json:"build_args,omitempty"`
+	BaseImages       []BaseImage       `json:"base_images"`
+}
+
+// BaseImage is a base image pulled by one of the stages of the build.
+type BaseImage struct {
+	Stage string `json:"stage"`
+	// Name is the name as written in the Dockerfile, PulledName the fully
+	// resolved name it was pulled with.
+	Name         string       `json:"name"`
+	PulledName   string       `json:"pulled_name"`
+	ConfigDigest image.Digest `json:"config_digest"`
+}
+
+// Provenance returns the provenance of the target image built by the plan,
+// given the manifests returned by ExecuteStages, and the Dockerfile, context
+// dir and build args it was built from.
+func (plan *BuildPlan) Provenance(
+	manifests map[string]*image.DistributionManifest, dockerfile []byte,
+	contextDir string, buildArgs map[string]string) (*Provenance, error) {
+
+	manifest, ok := manifests[plan.targetStage().alias]
+	if !ok {
+		return nil, fmt.Errorf("missing manifest of target stage")
+	}
+	manifestDigest, err := manifest.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("hash manifest: %s", err)
+	}
+	dockerfileDigest, err := image.NewDigester().FromBytes(dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("hash dockerfile: %s", err)
+	}
+	contextDigest, err := contextDirDigest(contextDir)
+	if err != nil {
+		return nil, fmt.Errorf("hash context dir: %s", err)
+	}
+
+	provenance := &Provenance{
+		Builder:          "makisu " + utils.BuildHash,
+		Image:            plan.target.String(),
+		ManifestDigest:   manifestDigest,
+		ConfigDigest:     manifest.Config.Digest,
+		Target:           plan.stageTarget,
+		DockerfileDigest: dockerfileDigest,
+		ContextDigest:    contextDigest,
+		BaseImages:       []BaseImage{},
+	}
+	if len(buildArgs) > 0 {
+		provenance.BuildArgs = make(map[string]string, len(buildArgs))
+		for k, v := range buildArgs {
+			if isSecretBuildArg(k) {
+				v = redactedBuildArg
+			}
+			provenance.BuildArgs[k] = v
+		}
+	}
+
+	for _, stage := range plan.stages {
+		if len(stage.nodes) == 0 {
+			continue
+		}
+		from, ok := stage.nodes[0].BuildStep.(*step.FromStep)
+		if !ok || from.GetManifest() == nil {
+			// Built from scratch, or never built.
+			continue
+		}
+		provenance.BaseImages = append(provenance.BaseImages, BaseImage{
+			Stage:        stage.alias,
+			Name:         from.GetImage(),
+			PulledName:   from.GetPulledImage(),
+			ConfigDigest: from.GetManifest().Config.Digest,
+		})
+	}
+	return provenance, nil
+}
+
+func isSecretBuildArg(name string) bool {
+	name = strings.ToUpper(name)
+	for _, word := range secretBuildArgWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextDirDigest hashes the relative paths, types and contents of all files
+// under the context dir, in lexical order. Special files are skipped.
+func contextDirDigest(contextDir string) (image.Digest, error) {
+	digester := image.NewDigester()
+	err := filepath.Walk(contextDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+		var entry io.Reader
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			entry = strings.NewReader(fmt.Sprintf("d %s\n", rel))
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry = strings.NewReader(fmt.Sprintf("l %s %s\n", rel, target))
+		case mode.IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			entry = io.MultiReader(
+				strings.NewReader(fmt.Sprintf("f %s %d\n", rel, fi.Size())), f)
+		default:
+			return nil
+		}
+		_, err = io.Copy(ioutil.Discard, digester.Tee(entry))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
@@ -0,0 +1,111 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPlanProvenance(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("v1"), 0644))
+
+	testFileDirAlpine := "../../testdata/files/alpine"
+	client, err := registry.PullClientFixture(ctx,
+		filepath.Join(testFileDirAlpine, "test_distribution_manifest"),
+		filepath.Join(testFileDirAlpine, "test_image_config"),
+		filepath.Join(testFileDirAlpine, "test_layer.tar"))
+	require.NoError(err)
+	baseManifest, err := client.PullManifest("latest")
+	require.NoError(err)
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	stages := []*dockerfile.Stage{{From: from}}
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+
+	// Replace the scratch stage with one pulling a fixture base image.
+	base := step.FromStepFixtureWithClient("", "fakeregistry.dev/library/alpine:latest", "base", client)
+	stage, err := newBuildStageHelper(ctx, "base", []step.BuildStep{base}, plan.opts)
+	require.NoError(err)
+	_, err = base.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	plan.stages = append([]*buildStage{stage}, plan.stages...)
+
+	manifests := map[string]*image.DistributionManifest{
+		plan.targetStage().alias: {
+			Config: image.Descriptor{Digest: image.Digest("sha256:target")},
+		},
+	}
+	dockerfileContent := []byte("FROM alpine\n")
+	buildArgs := map[string]string{
+		"VERSION":      "1.0",
+		"NPM_TOKEN":    "abc",
+		"db_password":  "def",
+		"GITHUB_AUTH_": "ghi",
+	}
+	provenance, err := plan.Provenance(manifests, dockerfileContent, ctx.ContextDir, buildArgs)
+	require.NoError(err)
+
+	require.Equal(target.String(), provenance.Image)
+	manifestDigest, err := manifests[plan.targetStage().alias].Digest()
+	require.NoError(err)
+	require.Equal(manifestDigest, provenance.ManifestDigest)
+	require.NotEqual(provenance.ConfigDigest, provenance.ManifestDigest)
+	require.Equal(image.Digest("sha256:target"), provenance.ConfigDigest)
+	require.Equal(map[string]string{
+		"VERSION":      "1.0",
+		"NPM_TOKEN":    "REDACTED",
+		"db_password":  "REDACTED",
+		"GITHUB_AUTH_": "REDACTED",
+	}, provenance.BuildArgs)
+	require.Equal([]BaseImage{{
+		Stage:        "base",
+		Name:         "fakeregistry.dev/library/alpine:latest",
+		PulledName:   "fakeregistry.dev/library/alpine:latest",
+		ConfigDigest: baseManifest.Config.Digest,
+	}}, provenance.BaseImages)
+
+	// The same inputs give the same provenance, and context changes are
+	// reflected.
+	again, err := plan.Provenance(manifests, dockerfileContent, ctx.ContextDir, buildArgs)
+	require.NoError(err)
+	require.Equal(provenance, again)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("v2"), 0644))
+	changed, err := plan.Provenance(manifests, dockerfileContent, ctx.ContextDir, buildArgs)
+	require.NoError(err)
+	require.NotEqual(provenance.ContextDigest, changed.ContextDigest)
+	require.Equal(provenance.DockerfileDigest, changed.DockerfileDigest)
+
+	_, err = plan.Provenance(nil, dockerfileContent, ctx.ContextDir, buildArgs)
+	require.Error(err)
+}
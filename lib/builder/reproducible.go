@@ -0,0 +1,118 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// DiffBuilds compares the images built by two executions of plans created
+// from the same Dockerfile, and returns their differences. It compares the
+// diff IDs of the layers of each image, and its config. The timestamps set
+// by makisu and the inline cache label are ignored, since they always differ
+// between builds.
+func DiffBuilds(first, second *BuildPlan) ([]string, error) {
+	secondStages := make(map[string]*buildStage)
+	for _, stage := range second.stages {
+		secondStages[stage.alias] = stage
+	}
+
+	var diffs []string
+	targetStage := first.targetStage()
+	for _, stage := range first.stages {
+		if _, ok := first.stageImages[stage.alias]; !ok && stage != targetStage {
+			continue
+		}
+		other, ok := secondStages[stage.alias]
+		if !ok || other.lastImageConfig == nil {
+			return nil, fmt.Errorf("stage %s missing from second build", stage.alias)
+		}
+		stageDiffs, err := diffStages(stage, other)
+		if err != nil {
+			return nil, fmt.Errorf("diff stage %s: %s", stage.alias, err)
+		}
+		diffs = append(diffs, stageDiffs...)
+	}
+	return diffs, nil
+}
+
+// diffStages compares the image configs two builds of a stage ended with.
+func diffStages(first, second *buildStage) ([]string, error) {
+	var diffs []string
+	firstConfig, secondConfig := first.lastImageConfig, second.lastImageConfig
+	firstIDs, secondIDs := firstConfig.RootFS.DiffIDs, secondConfig.RootFS.DiffIDs
+	if len(firstIDs) != len(secondIDs) {
+		diffs = append(diffs, fmt.Sprintf("stage %s: %d layers in first build, %d in second",
+			first.alias, len(firstIDs), len(secondIDs)))
+	}
+	for i := 0; i < len(firstIDs) && i < len(secondIDs); i++ {
+		if firstIDs[i] == secondIDs[i] {
+			continue
+		}
+		var createdBy string
+		if i < len(firstConfig.History) {
+			createdBy = firstConfig.History[i].CreatedBy
+		}
+		diffs = append(diffs, fmt.Sprintf("stage %s: layer %d (%s) differs: %s != %s",
+			first.alias, i+1, createdBy, firstIDs[i].Hex(), secondIDs[i].Hex()))
+	}
+
+	firstDigest, err := configDigestWithoutTimestamps(firstConfig)
+	if err != nil {
+		return nil, err
+	}
+	secondDigest, err := configDigestWithoutTimestamps(secondConfig)
+	if err != nil {
+		return nil, err
+	}
+	if firstDigest != secondDigest {
+		diffs = append(diffs, fmt.Sprintf("stage %s: config differs: %s != %s",
+			first.alias, firstDigest.Hex(), secondDigest.Hex()))
+	}
+	return diffs, nil
+}
+
+// configDigestWithoutTimestamps returns the digest of a copy of the config
+// with its creation and history timestamps cleared. Diff IDs are cleared too,
+// since layers are compared on their own.
+func configDigestWithoutTimestamps(config *image.Config) (image.Digest, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("marshal image config: %s", err)
+	}
+	normalized, err := image.NewImageConfigFromJSON(b)
+	if err != nil {
+		return "", fmt.Errorf("unmarshal image config: %s", err)
+	}
+	normalized.Created = time.Time{}
+	if normalized.Config != nil {
+		delete(normalized.Config.Labels, cache.InlineCacheLabel)
+	}
+	if normalized.RootFS != nil {
+		normalized.RootFS.DiffIDs = nil
+	}
+	for i := range normalized.History {
+		normalized.History[i].Created = time.Time{}
+	}
+	if b, err = json.Marshal(normalized); err != nil {
+		return "", fmt.Errorf("marshal image config: %s", err)
+	}
+	return image.NewDigester().FromBytes(b)
+}
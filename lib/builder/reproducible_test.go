@@ -0,0 +1,73 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBuilds(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "static"), []byte("static"), 0644))
+
+	writeTime := func() {
+		content := []byte(time.Now().String())
+		require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "time"), content, 0644))
+	}
+	build := func(tag string) *BuildPlan {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("static /static", "", "", []string{"static"}, "/static"),
+			dockerfile.CopyDirectiveFixture("time /time", "", "", []string{"time"}, "/time"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+		target := image.NewImageName("", "testrepo", tag)
+		plan, err := NewBuildPlan(ctx, target, nil, cache.NewNoopCacheManager(), stages, true, true, "")
+		require.NoError(err)
+		_, err = plan.Execute()
+		require.NoError(err)
+		return plan
+	}
+
+	// Same inputs give the same images.
+	writeTime()
+	first := build("first")
+	diffs, err := DiffBuilds(first, build("second"))
+	require.NoError(err)
+	require.Empty(diffs)
+
+	// A step that embeds the current time is reported. The history of the
+	// config contains the cache IDs of the steps, which differ too.
+	first = build("third")
+	writeTime()
+	diffs, err = DiffBuilds(first, build("fourth"))
+	require.NoError(err)
+	require.Len(diffs, 2)
+	require.Contains(diffs[0], "stage 0: layer 2 (makisu: COPY time /time")
+	require.Contains(diffs[1], "stage 0: config differs")
+}
@@ -18,11 +18,13 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/utils"
@@ -57,29 +59,77 @@ type addCopyStep struct {
 	fromPaths     []string
 	toPath        string
 	chown         string
+	chmod         string
 	preserveOwner bool
+	// excludes are the patterns of the paths within the sources that are not
+	// copied.
+	excludes []string
+
+	// heredocs are the contents of the sources given as heredocs, keyed by
+	// source name.
+	heredocs map[string]string
+
+	// link is true if the layer of the step is created on top of an empty
+	// file system. pending is true if changes of previous steps were still
+	// uncommitted when it executed, so they have to be part of its layer.
+	link    bool
+	pending bool
 }
 
-// newAddCopyStep returns a BuildStep from given arguments.
-func newAddCopyStep(
-	directive Directive, args, chown, fromStage string,
-	fromPaths []string, toPath string, commit, preserveOwner bool) (*addCopyStep, error) {
+// AddCopyOptions are the arguments of ADD and COPY steps.
+type AddCopyOptions struct {
+	Args  string
+	Chown string
+	Chmod string
+	// FromStage is the stage or image COPY --from copies from. ADD doesn't
+	// support it.
+	FromStage string
+	FromPaths []string
+	ToPath    string
 
+	Commit        bool
+	PreserveOwner bool
+	Link          bool
+	// Excludes are the patterns of the paths within the sources that are not
+	// copied.
+	Excludes []string
+
+	// Heredocs are the contents of the COPY sources given as heredocs, keyed
+	// by source name.
+	Heredocs map[string]string
+	// Checksum is the expected digest of the remote ADD source, if any.
+	Checksum string
+}
+
+// newAddCopyStep returns a BuildStep from given arguments.
+func newAddCopyStep(directive Directive, opts AddCopyOptions) (*addCopyStep, error) {
+	toPath, fromPaths := opts.ToPath, opts.FromPaths
 	toPath = strings.Trim(toPath, "\"'")
 	for i := range fromPaths {
 		fromPaths[i] = strings.Trim(fromPaths[i], "\"'")
 	}
 
-	if len(fromPaths) > 1 && !(strings.HasSuffix(toPath, "/") || toPath == "." || toPath == "..") {
+	toDir := strings.HasSuffix(toPath, "/") || toPath == "." || toPath == ".."
+	if len(fromPaths) > 1 && !toDir {
 		return nil, fmt.Errorf("copying multiple source files, target must be a directory ending in \"/\"")
 	}
+	for _, fromPath := range fromPaths {
+		if pathutils.HasRecursiveGlob(fromPath) && !toDir {
+			return nil, fmt.Errorf("copying \"**\" patterns, target must be a directory ending in \"/\"")
+		}
+	}
+	// Linked steps always commit their own layer.
 	return &addCopyStep{
-		baseStep:      newBaseStep(directive, args, commit),
-		fromStage:     fromStage,
+		baseStep:      newBaseStep(directive, opts.Args, opts.Commit || opts.Link),
+		fromStage:     opts.FromStage,
 		fromPaths:     fromPaths,
 		toPath:        toPath,
-		chown:         chown,
-		preserveOwner: preserveOwner,
+		chown:         opts.Chown,
+		chmod:         opts.Chmod,
+		preserveOwner: opts.PreserveOwner,
+		excludes:      opts.Excludes,
+		heredocs:      opts.Heredocs,
+		link:          opts.Link,
 	}, nil
 }
 
@@ -92,7 +142,12 @@ func (s *addCopyStep) ContextDirs() (string, []string) {
 	if s.fromStage == "" {
 		return "", nil
 	}
-	return s.fromStage, s.fromPaths
+	dirs := make([]string, len(s.fromPaths))
+	for i, fromPath := range s.fromPaths {
+		// Patterns with "**" are matched against the copy of their base dir.
+		dirs[i] = pathutils.RecursiveGlobBase(fromPath)
+	}
+	return s.fromStage, dirs
 }
 
 // SetCacheID sets the cache ID of the step given a seed SHA256 value.
@@ -102,19 +157,32 @@ func (s *addCopyStep) ContextDirs() (string, []string) {
 func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	// Initialize the checksum with the seed, directive and args.
 	checksum := crc32.NewIEEE()
-	_, err := checksum.Write([]byte(seed + string(s.directive) + s.args))
+	_, err := checksum.Write([]byte(seed + string(s.directive) + s.args + s.chmod))
 	if err != nil {
 		return fmt.Errorf("hash copy directive: %s", err)
 	}
+	s.cacheKeyInputs = s.newCacheKeyInputs(seed)
 	if s.fromStage != "" {
 		// It is copying from a previous stage, rely on the fact that cache IDs
 		// are chained between stages.
 		// TODO: Properly calculate cache ID based on content of files.
+	} else if len(s.heredocs) > 0 {
+		contentChecksum := crc32.NewIEEE()
+		w := io.MultiWriter(checksum, contentChecksum)
+		for _, name := range s.fromPaths {
+			if _, err := w.Write([]byte(name + s.heredocs[name])); err != nil {
+				return fmt.Errorf("hash heredoc %s: %s", name, err)
+			}
+		}
+		s.cacheKeyInputs.ContentHash = fmt.Sprintf("%x", contentChecksum.Sum32())
 	} else {
 		// Update checksum based on content of files to be copied.
-		if err := s.calculateContextChecksum(ctx, checksum); err != nil {
+		contentChecksum := crc32.NewIEEE()
+		w := io.MultiWriter(checksum, contentChecksum)
+		if err := s.calculateContextChecksum(ctx, w); err != nil {
 			return fmt.Errorf("hash context sources: %s", err)
 		}
+		s.cacheKeyInputs.ContentHash = fmt.Sprintf("%x", contentChecksum.Sum32())
 	}
 	s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
 
@@ -125,28 +193,133 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 // the on-disk copy.
 func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err error) {
 	sourceRoot := s.contextRootDir(ctx)
-	sources := s.resolveFromPaths(ctx)
+	sources, relDsts, err := s.resolveFromPaths(ctx)
+	if err != nil {
+		return fmt.Errorf("resolve sources: %s", err)
+	}
+	blacklist := append(pathutils.DefaultBlacklist, ctx.ImageStore.RootDir)
+	if len(s.heredocs) > 0 {
+		if sourceRoot, err = s.writeHeredocs(ctx); err != nil {
+			return fmt.Errorf("write heredocs: %s", err)
+		}
+		sources = make([]string, len(s.fromPaths))
+		for i, name := range s.fromPaths {
+			sources[i] = filepath.Join(sourceRoot, name)
+		}
+		// Heredocs are written to the sandbox dir, under the storage dir.
+		blacklist = pathutils.DefaultBlacklist
+	}
+	return s.copyFrom(ctx, sourceRoot, sources, relDsts, blacklist, modifyFS)
+}
+
+// copyFrom adds the copy of the given sources under sourceRoot to the
+// context. Sources in relDsts are copied to their path under the target
+// instead of into it. If modifyFS is true, it also performs the on-disk copy.
+func (s *addCopyStep) copyFrom(
+	ctx *context.BuildContext, sourceRoot string, sources []string,
+	relDsts map[string]string, blacklist []string, modifyFS bool) error {
+
+	s.pending = ctx.MustScan || len(ctx.CopyOps) > 0
+	excluded, err := s.excludedPaths(sources)
+	if err != nil {
+		return fmt.Errorf("resolve excluded paths: %s", err)
+	}
+	var copyOps []*snapshot.CopyOperation
+	var rest []string
+	for _, source := range sources {
+		relDst, ok := relDsts[source]
+		if !ok {
+			rest = append(rest, source)
+			continue
+		}
+		copyOp, err := s.newCopyOperation(
+			sourceRoot, []string{source}, filepath.Join(s.toPath, relDst), blacklist)
+		if err != nil {
+			return err
+		}
+		copyOps = append(copyOps, copyOp)
+	}
+	if len(rest) > 0 {
+		copyOp, err := s.newCopyOperation(sourceRoot, rest, s.toPath, blacklist)
+		if err != nil {
+			return err
+		}
+		copyOps = append([]*snapshot.CopyOperation{copyOp}, copyOps...)
+	}
+
+	for _, copyOp := range copyOps {
+		copyOp.Exclude(excluded)
+		ctx.CopyOps = append(ctx.CopyOps, copyOp)
+		if modifyFS {
+			if err := copyOp.Execute(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newCopyOperation returns the copy of the given sources under sourceRoot to
+// toPath.
+func (s *addCopyStep) newCopyOperation(
+	sourceRoot string, sources []string, toPath string,
+	blacklist []string) (*snapshot.CopyOperation, error) {
+
 	relPaths := make([]string, len(sources))
 	for i, source := range sources {
+		var err error
 		relPaths[i], err = pathutils.TrimRoot(source, sourceRoot)
 		if err != nil {
-			return fmt.Errorf("trim root: %s", err)
+			return nil, fmt.Errorf("trim root: %s", err)
 		}
 	}
 
 	internal := s.fromStage != ""
-	blacklist := append(pathutils.DefaultBlacklist, ctx.ImageStore.RootDir)
 	copyOp, err := snapshot.NewCopyOperation(
-		relPaths, sourceRoot, s.workingDir, s.toPath, s.chown, blacklist, internal, s.preserveOwner)
+		relPaths, sourceRoot, s.workingDir, toPath, s.chown, s.chmod, blacklist, internal,
+		s.preserveOwner)
 	if err != nil {
-		return fmt.Errorf("invalid copy operation: %s", err)
+		return nil, fmt.Errorf("invalid copy operation: %s", err)
 	}
+	return copyOp, nil
+}
 
-	ctx.CopyOps = append(ctx.CopyOps, copyOp)
-	if modifyFS {
-		return copyOp.Execute()
+// Commit generates an image layer. The layer of linked steps is created on top
+// of an empty file system, unless changes of previous steps are pending.
+func (s *addCopyStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error) {
+	if s.link && !s.pending {
+		return commitLinkedLayer(ctx)
 	}
-	return nil
+	return commitLayer(ctx)
+}
+
+// LinkCacheID returns the cache ID of the layer of a linked step. Unlike
+// CacheID, it only depends on the step and the content it copies, so the layer
+// can be reused after previous steps changed. Returns "" if the step isn't
+// linked, copies from another stage, or its layer has pending changes of
+// previous steps. Valid once the step's config is applied.
+func (s *addCopyStep) LinkCacheID() string {
+	if !s.link || s.pending || s.fromStage != "" {
+		return ""
+	}
+	checksum := crc32.ChecksumIEEE([]byte("link" + string(s.directive) + s.args + s.chmod +
+		s.workingDir + s.cacheKeyInputs.ContentHash))
+	return fmt.Sprintf("%x", checksum)
+}
+
+// writeHeredocs writes the heredocs to a new dir in the sandbox dir, which is
+// kept until the end of the build, and returns the dir.
+func (s *addCopyStep) writeHeredocs(ctx *context.BuildContext) (string, error) {
+	dir, err := ioutil.TempDir(ctx.ImageStore.SandboxDir, "heredocs")
+	if err != nil {
+		return "", fmt.Errorf("create heredocs dir: %s", err)
+	}
+	for name, content := range s.heredocs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return "", fmt.Errorf("write heredoc %s: %s", name, err)
+		}
+	}
+	return dir, nil
 }
 
 // Updates the checksum passed in based on the content of files to be copied in.
@@ -155,10 +328,23 @@ func (s *addCopyStep) calculateContextChecksum(ctx *context.BuildContext, checks
 		return fmt.Errorf("not supported: the copy step has from stage flag")
 	}
 
-	for _, source := range s.resolveFromPaths(ctx) {
+	sources, _, err := s.resolveFromPaths(ctx)
+	if err != nil {
+		return fmt.Errorf("resolve sources: %s", err)
+	}
+	excluded, err := s.excludedPaths(sources)
+	if err != nil {
+		return fmt.Errorf("resolve excluded paths: %s", err)
+	}
+	for _, source := range sources {
 		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				return fmt.Errorf("prev error during walk: %s", err)
+			} else if pathutils.IsDescendantOfAny(path, excluded) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			}
 			return checksumPathContents(ctx, path, fi, checksum)
 		}); err != nil {
@@ -168,11 +354,66 @@ func (s *addCopyStep) calculateContextChecksum(ctx *context.BuildContext, checks
 	return nil
 }
 
-func (s *addCopyStep) resolveFromPaths(ctx *context.BuildContext) []string {
+// excludedPaths returns the paths within the sources that match any of the
+// exclude patterns of the step. Patterns are matched against the paths
+// relative to their source, or the name of the source if it's a file.
+func (s *addCopyStep) excludedPaths(sources []string) ([]string, error) {
+	if len(s.excludes) == 0 {
+		return nil, nil
+	}
+	var excluded []string
+	for _, source := range sources {
+		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := filepath.Base(path)
+			if path == source && fi.IsDir() {
+				return nil
+			} else if path != source {
+				rel = path[len(source)+1:]
+			}
+			for _, pattern := range s.excludes {
+				if pathutils.MatchGlob(pattern, rel) {
+					excluded = append(excluded, path)
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("walk %s: %s", source, err)
+		}
+	}
+	return excluded, nil
+}
+
+// resolveFromPaths returns the absolute paths of the sources matching the
+// patterns of the step. Sources matched by "**" patterns keep their path
+// relative to the base dir of the pattern, returned in relDsts.
+func (s *addCopyStep) resolveFromPaths(
+	ctx *context.BuildContext) ([]string, map[string]string, error) {
+
 	root := s.contextRootDir(ctx)
 	sources := []string{}
+	relDsts := make(map[string]string)
 	for _, source := range s.fromPaths {
 		source = filepath.Join(root, source)
+		if pathutils.HasRecursiveGlob(source) {
+			matches, err := pathutils.GlobRecursive(source)
+			if err != nil {
+				return nil, nil, fmt.Errorf("glob %s: %s", source, err)
+			} else if len(matches) == 0 {
+				sources = append(sources, source)
+			}
+			for _, match := range matches {
+				sources = append(sources, match.Path)
+				relDsts[match.Path] = match.Rel
+			}
+			continue
+		}
 		matches, err := filepath.Glob(source)
 		if err != nil || len(matches) == 0 {
 			sources = append(sources, source)
@@ -180,7 +421,7 @@ func (s *addCopyStep) resolveFromPaths(ctx *context.BuildContext) []string {
 			sources = append(sources, matches...)
 		}
 	}
-	return sources
+	return sources, relDsts, nil
 }
 
 func (s *addCopyStep) contextRootDir(ctx *context.BuildContext) string {
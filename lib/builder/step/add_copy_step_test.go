@@ -24,21 +24,28 @@ func TestContextDirs(t *testing.T) {
 	require := require.New(t)
 
 	srcs := []string{}
-	ac, err := newAddCopyStep(Copy, "", "", "", srcs, "", false, false)
+	ac, err := newAddCopyStep(Copy, AddCopyOptions{
+		FromPaths: srcs,
+	})
 	require.NoError(err)
 	stage, paths := ac.ContextDirs()
 	require.Equal("", stage)
 	require.Len(paths, 0)
 
 	srcs = []string{"src"}
-	ac, err = newAddCopyStep(Copy, "", "", "", srcs, "", false, false)
+	ac, err = newAddCopyStep(Copy, AddCopyOptions{
+		FromPaths: srcs,
+	})
 	require.NoError(err)
 	stage, paths = ac.ContextDirs()
 	require.Equal("", stage)
 	require.Len(paths, 0)
 
 	srcs = []string{"src"}
-	ac, err = newAddCopyStep(Copy, "", "", "stage", srcs, "", false, false)
+	ac, err = newAddCopyStep(Copy, AddCopyOptions{
+		FromStage: "stage",
+		FromPaths: srcs,
+	})
 	require.NoError(err)
 	stage, paths = ac.ContextDirs()
 	require.Equal("stage", stage)
@@ -48,7 +55,10 @@ func TestContextDirs(t *testing.T) {
 func TestTrimmingPaths(t *testing.T) {
 	require := require.New(t)
 
-	ac, err := newAddCopyStep(Copy, "", "", "", []string{"\"/from/path\""}, "\"/to/path\"", false, false)
+	ac, err := newAddCopyStep(Copy, AddCopyOptions{
+		FromPaths: []string{"\"/from/path\""},
+		ToPath:    "\"/to/path\"",
+	})
 	require.NoError(err)
 
 	require.Equal("/from/path", ac.fromPaths[0])
@@ -0,0 +1,119 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/utils/gitutil"
+)
+
+var gitCommitRegexp = regexp.MustCompile(`^[a-f0-9]{40}$`)
+
+// gitSource is a git repo added by ADD, given as <repo>[#<ref>[:<subdir>]].
+type gitSource struct {
+	repo   string
+	ref    string
+	subdir string
+}
+
+func parseGitSource(source string) gitSource {
+	var s gitSource
+	s.repo = source
+	if i := strings.Index(source, "#"); i >= 0 {
+		s.repo = source[:i]
+		s.ref = source[i+1:]
+		if j := strings.Index(s.ref, ":"); j >= 0 {
+			s.subdir = s.ref[j+1:]
+			s.ref = s.ref[:j]
+		}
+	}
+	if s.ref == "" {
+		s.ref = "HEAD"
+	}
+	return s
+}
+
+// resolve returns the commit the ref of the source points to. Tags are
+// preferred over branches, like git does.
+func (s gitSource) resolve() (string, error) {
+	if gitCommitRegexp.MatchString(s.ref) {
+		return s.ref, nil
+	}
+	out, err := gitutil.Run("", "ls-remote", "--", s.repo, s.ref, s.ref+"^{}")
+	if err != nil {
+		return "", err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range []string{
+		"refs/tags/" + s.ref + "^{}",
+		"refs/tags/" + s.ref,
+		"refs/heads/" + s.ref,
+		s.ref + "^{}",
+		s.ref,
+	} {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("ref %s not found", s.ref)
+}
+
+// checkout fetches the given commit of the source into dir, without history
+// and without the .git dir, and returns the path of the subdir.
+func (s gitSource) checkout(dir, commit string) (string, error) {
+	if _, err := gitutil.Run("", "init", "-q", "--", dir); err != nil {
+		return "", err
+	}
+	// Fetching by ref works with all servers, fetching by commit doesn't.
+	fetchRef := s.ref
+	if gitCommitRegexp.MatchString(s.ref) {
+		fetchRef = commit
+	}
+	if _, err := gitutil.Run(dir, "fetch", "-q", "--depth", "1", "--", s.repo, fetchRef); err != nil {
+		return "", err
+	}
+	fetched, err := gitutil.Run(dir, "rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", err
+	} else if fetched != commit {
+		return "", fmt.Errorf("ref %s moved from %s to %s during the build", s.ref, commit, fetched)
+	}
+	if _, err := gitutil.Run(dir, "checkout", "-q", commit); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", fmt.Errorf("remove .git dir: %s", err)
+	}
+
+	source := filepath.Join(dir, s.subdir)
+	if !pathutils.IsDescendantOfAny(source, []string{dir}) {
+		return "", fmt.Errorf("subdir %s is outside of repo", s.subdir)
+	} else if _, err := os.Stat(source); err != nil {
+		return "", fmt.Errorf("subdir %s: %s", s.subdir, err)
+	}
+	return source, nil
+}
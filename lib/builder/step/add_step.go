@@ -14,18 +14,227 @@
 
 package step
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// _downloadIdleTimeout is the time a download of a remote ADD source can
+// stall before it fails.
+const _downloadIdleTimeout = time.Minute
 
 // AddStep is similar to copy, so they depend on a common base.
+// Its sources can also be http(s) URLs, which are downloaded to the sandbox
+// dir and copied from there, or a git repo, which is checked out there.
 type AddStep struct {
 	*addCopyStep
+
+	// checksum is the expected digest of the remote source, if any.
+	checksum string
+	// gitCommit is the commit the ref of the git source resolved to.
+	gitCommit string
+	// downloadDir contains the downloads of the remote sources, once
+	// downloaded.
+	downloadDir string
+	downloads   []string
 }
 
 // NewAddStep creates a new AddStep
-func NewAddStep(args, chown string, fromPaths []string, toPath string, commit, preserverOwner bool) (*AddStep, error) {
-	s, err := newAddCopyStep(Add, args, chown, "", fromPaths, toPath, commit, preserverOwner)
+func NewAddStep(opts AddCopyOptions) (*AddStep, error) {
+	if opts.FromStage != "" {
+		return nil, fmt.Errorf("ADD does not support --from")
+	}
+	s, err := newAddCopyStep(Add, opts)
 	if err != nil {
 		return nil, fmt.Errorf("new add/copy step: %s", err)
 	}
-	return &AddStep{s}, nil
+	return &AddStep{addCopyStep: s, checksum: opts.Checksum}, nil
+}
+
+// remote returns true if the sources of the step are URLs or a git repo.
+func (s *AddStep) remote() bool {
+	return len(s.fromPaths) > 0 && dockerfile.IsRemoteSource(s.fromPaths[0])
+}
+
+// git returns true if the source of the step is a git repo.
+func (s *AddStep) git() bool {
+	return len(s.fromPaths) == 1 && dockerfile.IsGitSource(s.fromPaths[0])
+}
+
+// SetCacheID sets the cache ID of the step given a seed SHA256 value.
+// For remote sources, the URLs and the checksum are part of the args. Without
+// checksum, the sources are downloaded to add their content to the ID. For git
+// repos, the commit their ref resolves to is added to the ID.
+func (s *AddStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	if !s.remote() {
+		return s.addCopyStep.SetCacheID(ctx, seed)
+	}
+
+	checksum := crc32.NewIEEE()
+	if _, err := checksum.Write([]byte(seed + string(s.directive) + s.args + s.chmod)); err != nil {
+		return fmt.Errorf("hash add directive: %s", err)
+	}
+	s.cacheKeyInputs = s.newCacheKeyInputs(seed)
+	contentChecksum := crc32.NewIEEE()
+	w := io.MultiWriter(checksum, contentChecksum)
+	if s.git() {
+		commit, err := parseGitSource(s.fromPaths[0]).resolve()
+		if err != nil {
+			return fmt.Errorf("resolve git ref: %s", err)
+		}
+		if _, err := w.Write([]byte(commit)); err != nil {
+			return fmt.Errorf("hash git commit: %s", err)
+		}
+		s.gitCommit = commit
+	} else if s.checksum != "" {
+		if _, err := w.Write([]byte(s.checksum)); err != nil {
+			return fmt.Errorf("hash checksum: %s", err)
+		}
+	} else {
+		if err := s.download(ctx); err != nil {
+			return fmt.Errorf("download remote sources: %s", err)
+		}
+		for _, source := range s.downloads {
+			f, err := os.Open(source)
+			if err != nil {
+				return fmt.Errorf("open %s: %s", source, err)
+			}
+			_, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("hash %s: %s", source, err)
+			}
+		}
+	}
+	s.cacheKeyInputs.ContentHash = fmt.Sprintf("%x", contentChecksum.Sum32())
+	s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
+	return nil
+}
+
+// Execute executes the add step. Remote sources are downloaded if they
+// weren't yet.
+func (s *AddStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
+	if !s.remote() {
+		return s.addCopyStep.Execute(ctx, modifyFS)
+	}
+	if s.git() {
+		if err := s.checkoutGit(ctx); err != nil {
+			return fmt.Errorf("checkout git repo: %s", err)
+		}
+	} else if s.downloadDir == "" {
+		if err := s.download(ctx); err != nil {
+			return fmt.Errorf("download remote sources: %s", err)
+		}
+	}
+	// Downloads are in the sandbox dir, under the storage dir.
+	return s.copyFrom(ctx, s.downloadDir, s.downloads, nil, pathutils.DefaultBlacklist, modifyFS)
+}
+
+// download downloads the remote sources to a new dir in the sandbox dir, each
+// to a sub dir named after its index. Files are named after the last element
+// of their URL path.
+func (s *AddStep) download(ctx *context.BuildContext) error {
+	dir, err := ioutil.TempDir(ctx.ImageStore.SandboxDir, "downloads")
+	if err != nil {
+		return fmt.Errorf("create downloads dir: %s", err)
+	}
+	var downloads []string
+	for i, source := range s.fromPaths {
+		u, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("parse url %s: %s", source, err)
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = "index.html"
+		}
+		target := filepath.Join(dir, strconv.Itoa(i), name)
+		log.Infof("* Downloading %s", httputil.RedactURL(u))
+		if err := downloadFile(source, target, s.checksum); err != nil {
+			return fmt.Errorf("download %s: %s", httputil.RedactURL(u), err)
+		}
+		downloads = append(downloads, target)
+	}
+	s.downloadDir, s.downloads = dir, downloads
+	return nil
+}
+
+// checkoutGit checks out the resolved commit of the git source to a new dir in
+// the sandbox dir.
+func (s *AddStep) checkoutGit(ctx *context.BuildContext) error {
+	source := parseGitSource(s.fromPaths[0])
+	commit := s.gitCommit
+	if commit == "" {
+		var err error
+		if commit, err = source.resolve(); err != nil {
+			return fmt.Errorf("resolve git ref: %s", err)
+		}
+	}
+	dir, err := ioutil.TempDir(ctx.ImageStore.SandboxDir, "git")
+	if err != nil {
+		return fmt.Errorf("create git dir: %s", err)
+	}
+	log.Infof("* Checking out commit %s of git source", commit)
+	checkout, err := source.checkout(filepath.Join(dir, "repo"), commit)
+	if err != nil {
+		return err
+	}
+	s.downloadDir, s.downloads = dir, []string{checkout}
+	return nil
+}
+
+// downloadFile downloads the file at the url to target with mode 0600, like
+// docker does. Its mtime is set to the Last-Modified header if present. If
+// checksum is set, the file must match it.
+func downloadFile(source, target, checksum string) error {
+	resp, err := httputil.Get(
+		source,
+		httputil.SendTimeout(0),
+		httputil.SendIdleTimeout(_downloadIdleTimeout),
+		httputil.DisableHTTPFallback(),
+		httputil.SendRetry())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("mkdir: %s", err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create file: %s", err)
+	}
+	defer f.Close()
+	digester := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, digester), resp.Body); err != nil {
+		return fmt.Errorf("read body: %s", err)
+	}
+	if checksum != "" {
+		if actual := fmt.Sprintf("sha256:%x", digester.Sum(nil)); actual != checksum {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual)
+		}
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(target, modified, modified); err != nil {
+			return fmt.Errorf("set mtime: %s", err)
+		}
+	}
+	return nil
 }
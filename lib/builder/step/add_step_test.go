@@ -0,0 +1,247 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/gitutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAddStep(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewAddStep(AddCopyOptions{
+		FromStage: "stage",
+		FromPaths: []string{"src"},
+		ToPath:    "dst",
+	})
+	require.Error(err)
+}
+
+func TestAddStepRemote(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	content := "echo v1"
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		io.WriteString(w, content)
+	}))
+	defer server.Close()
+	source := server.URL + "/bin/tool.sh"
+	checksum := func(s string) string { return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s))) }
+
+	newStep := func(checksum string) *AddStep {
+		step, err := NewAddStep(AddCopyOptions{
+			Args:      source+" /opt/",
+			FromPaths: []string{source},
+			ToPath:    "/opt/",
+			Checksum:  checksum,
+			Commit:    true,
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		return step
+	}
+
+	t.Run("WithoutChecksum", func(t *testing.T) {
+		// The content is downloaded to compute the cache ID.
+		step := newStep("")
+		require.Equal(1, downloads)
+		require.Equal(step.CacheID(), newStep("").CacheID())
+		content = "echo v2"
+		require.NotEqual(step.CacheID(), newStep("").CacheID())
+		content = "echo v1"
+
+		require.NoError(step.Execute(context, false))
+		require.Equal(3, downloads)
+		digestPairs, err := step.Commit(context)
+		require.NoError(err)
+		require.Len(digestPairs, 1)
+
+		r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		gzipReader, err := tario.NewGzipReader(r)
+		require.NoError(err)
+		defer gzipReader.Close()
+		tarReader := tar.NewReader(gzipReader)
+		var found bool
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			if header.Name == "opt/tool.sh" {
+				found = true
+				require.Equal(int64(0600), header.Mode&0777)
+				require.True(modified.Equal(header.ModTime))
+				b, err := ioutil.ReadAll(tarReader)
+				require.NoError(err)
+				require.Equal("echo v1", string(b))
+			}
+		}
+		require.True(found)
+	})
+
+	t.Run("WithChecksum", func(t *testing.T) {
+		downloads = 0
+
+		// The checksum replaces the content in the cache ID.
+		step := newStep(checksum("echo v1"))
+		require.Equal(0, downloads)
+		require.NotEqual(step.CacheID(), newStep(checksum("echo v2")).CacheID())
+
+		require.NoError(step.Execute(context, false))
+		require.Equal(1, downloads)
+
+		step = newStep(checksum("echo v2"))
+		require.Error(step.Execute(context, false))
+	})
+}
+
+func TestAddStepGit(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Make https://example.com/repo.git point to a local repo.
+	repo := filepath.Join(context.ContextDir, "repo")
+	config := filepath.Join(context.ContextDir, "gitconfig")
+	require.NoError(ioutil.WriteFile(config, []byte(fmt.Sprintf(
+		"[url \"file://%s\"]\n\tinsteadOf = https://example.com/repo.git\n", repo)), 0644))
+	for k, v := range map[string]string{
+		"GIT_CONFIG_GLOBAL":   config,
+		"GIT_CONFIG_NOSYSTEM": "1",
+		"GIT_AUTHOR_NAME":     "test",
+		"GIT_AUTHOR_EMAIL":    "test@example.com",
+		"GIT_COMMITTER_NAME":  "test",
+		"GIT_COMMITTER_EMAIL": "test@example.com",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		require.NoError(os.Setenv(k, v))
+	}
+	commit := func(content string) string {
+		require.NoError(os.MkdirAll(filepath.Join(repo, "lib"), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(repo, "lib", "a.txt"), []byte(content), 0644))
+		_, err := gitutil.Run(repo, "add", ".")
+		require.NoError(err)
+		_, err = gitutil.Run(repo, "commit", "-q", "-m", content)
+		require.NoError(err)
+		sha, err := gitutil.Run(repo, "rev-parse", "HEAD")
+		require.NoError(err)
+		return sha
+	}
+	_, err := gitutil.Run("", "init", "-q", "-b", "main", repo)
+	require.NoError(err)
+	v1 := commit("v1")
+	_, err = gitutil.Run(repo, "tag", "-a", "v1", "-m", "v1")
+	require.NoError(err)
+
+	newStep := func(source string) *AddStep {
+		step, err := NewAddStep(AddCopyOptions{
+			Args:      source+" /src/",
+			FromPaths: []string{source},
+			ToPath:    "/src/",
+			Commit:    true,
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		return step
+	}
+	files := func(step *AddStep) map[string]string {
+		require.NoError(step.Execute(context, false))
+		digestPairs, err := step.Commit(context)
+		require.NoError(err)
+		require.Len(digestPairs, 1)
+		r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		gzipReader, err := tario.NewGzipReader(r)
+		require.NoError(err)
+		defer gzipReader.Close()
+		result := make(map[string]string)
+		tarReader := tar.NewReader(gzipReader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			if header.Typeflag == tar.TypeReg {
+				b, err := ioutil.ReadAll(tarReader)
+				require.NoError(err)
+				result[header.Name] = string(b)
+			}
+		}
+		return result
+	}
+
+	tag := newStep("https://example.com/repo.git#v1")
+	branch := newStep("https://example.com/repo.git#main")
+	require.Equal(v1, tag.gitCommit)
+	require.Equal(v1, branch.gitCommit)
+
+	// New commits only change the cache ID of steps using refs to them.
+	v2 := commit("v2")
+	require.Equal(tag.CacheID(), newStep("https://example.com/repo.git#v1").CacheID())
+	require.NotEqual(branch.CacheID(), newStep("https://example.com/repo.git#main").CacheID())
+	require.Equal(v2, newStep("https://example.com/repo.git").gitCommit)
+
+	require.Equal(map[string]string{"src/lib/a.txt": "v1"}, files(tag))
+	require.Equal(map[string]string{"src/a.txt": "v2"}, files(newStep("https://example.com/repo.git#main:lib")))
+	require.Equal(map[string]string{"src/lib/a.txt": "v1"}, files(newStep("https://example.com/repo.git#"+v1)))
+
+	// The branch moved since its cache ID was computed.
+	require.Error(branch.Execute(context, false))
+
+	step, err := NewAddStep(AddCopyOptions{
+		FromPaths: []string{"https://example.com/repo.git#missing"},
+		ToPath:    "/src/",
+		Commit:    true,
+	})
+	require.NoError(err)
+	require.Error(step.SetCacheID(context, ""))
+
+	// Repos are never read as git options.
+	marker := filepath.Join(context.ContextDir, "marker")
+	source := gitSource{repo: "--upload-pack=touch " + marker, ref: "main"}
+	_, err = source.resolve()
+	require.Error(err)
+	_, err = source.checkout(filepath.Join(context.ContextDir, "checkout"), v2)
+	require.Error(err)
+	_, err = os.Stat(marker)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,158 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// BaseImagePuller pulls the base images of FROM steps into the image store.
+// Images can be prefetched in the background, so they are downloaded while
+// the build context is prepared. FROM steps then wait for the prefetch of
+// their image instead of pulling it again.
+type BaseImagePuller struct {
+	sync.Mutex
+
+	store *storage.ImageStore
+	// sem bounds the number of images prefetched concurrently.
+	sem   chan struct{}
+	pulls map[string]*basePull // Keyed by image and platform
+
+	// newClient returns the registry client used to pull an image.
+	newClient func(name image.Name, platform *image.Platform) registry.Client
+}
+
+// basePull is the pull of one base image. done is closed once it finished.
+type basePull struct {
+	done        chan struct{}
+	pulledImage string
+	manifest    *image.DistributionManifest
+	err         error
+}
+
+// NewBaseImagePuller returns a new BaseImagePuller that prefetches up to
+// concurrency images at a time.
+func NewBaseImagePuller(store *storage.ImageStore, concurrency int) *BaseImagePuller {
+	return &BaseImagePuller{
+		store: store,
+		sem:   make(chan struct{}, concurrency),
+		pulls: make(map[string]*basePull),
+		newClient: func(name image.Name, platform *image.Platform) registry.Client {
+			if platform != nil {
+				return registry.NewWithPlatform(
+					store, name.GetRegistry(), name.GetRepository(), *platform)
+			}
+			return registry.New(store, name.GetRegistry(), name.GetRepository())
+		},
+	}
+}
+
+// Prefetch starts pulling the image for the given platform in the background,
+// unless it's built from scratch or already being pulled.
+func (p *BaseImagePuller) Prefetch(imageName string, platform *image.Platform) error {
+	if isScratch(imageName) {
+		return nil
+	}
+	imageName, err := normalizeBaseImage(imageName)
+	if err != nil {
+		return err
+	}
+	key := basePullKey(imageName, platform)
+
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.pulls[key]; ok {
+		return nil
+	}
+	pull := &basePull{done: make(chan struct{})}
+	p.pulls[key] = pull
+	go func() {
+		p.sem <- struct{}{}
+		defer func() { <-p.sem }()
+
+		log.Infof("* Prefetching base image %s", imageName)
+		p.pull(pull, imageName, platform)
+		if pull.err != nil {
+			log.Warnf("Failed to prefetch base image %s: %s", imageName, pull.err)
+		}
+	}()
+	return nil
+}
+
+// Pull returns the fully resolved name and the manifest of the image for the
+// given platform. It waits for the image to be prefetched if it's in progress,
+// and pulls it otherwise. Failed prefetches are retried.
+func (p *BaseImagePuller) Pull(
+	imageName string, platform *image.Platform) (string, *image.DistributionManifest, error) {
+
+	imageName, err := normalizeBaseImage(imageName)
+	if err != nil {
+		return "", nil, err
+	}
+	key := basePullKey(imageName, platform)
+
+	p.Lock()
+	pull, ok := p.pulls[key]
+	if ok {
+		p.Unlock()
+		<-pull.done
+		if pull.err == nil {
+			return pull.pulledImage, pull.manifest, nil
+		}
+		p.Lock()
+		if p.pulls[key] == pull {
+			delete(p.pulls, key)
+		}
+		p.Unlock()
+		return p.Pull(imageName, platform)
+	}
+	pull = &basePull{done: make(chan struct{})}
+	p.pulls[key] = pull
+	p.Unlock()
+
+	p.pull(pull, imageName, platform)
+	return pull.pulledImage, pull.manifest, pull.err
+}
+
+// pull pulls the image, records the result and marks the pull as done.
+func (p *BaseImagePuller) pull(pull *basePull, imageName string, platform *image.Platform) {
+	defer close(pull.done)
+
+	pullImage, err := registry.ResolveNameForPull(imageName)
+	if err != nil {
+		pull.err = fmt.Errorf("resolve pull image %s: %s", imageName, err)
+		return
+	}
+	manifest, err := p.newClient(pullImage, platform).Pull(pullImage.GetTag())
+	if err != nil {
+		pull.err = fmt.Errorf("pull image %s: %s", imageName, err)
+		return
+	}
+	pull.pulledImage = pullImage.String()
+	pull.manifest = manifest
+}
+
+func basePullKey(imageName string, platform *image.Platform) string {
+	if platform == nil {
+		return imageName
+	}
+	return fmt.Sprintf("%s@%s/%s", imageName, platform.OS, platform.Architecture)
+}
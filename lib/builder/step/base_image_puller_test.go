@@ -0,0 +1,159 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+const _pullDelay = 100 * time.Millisecond
+
+// slowPullerFixture returns a BaseImagePuller whose registry clients take
+// _pullDelay to pull any image.
+func slowPullerFixture(t *testing.T, ctx *context.BuildContext, concurrency int) *BaseImagePuller {
+	ctrl := gomock.NewController(t)
+	puller := NewBaseImagePuller(ctx.ImageStore, concurrency)
+	puller.newClient = func(name image.Name, platform *image.Platform) registry.Client {
+		client := mockregistry.NewMockClient(ctrl)
+		client.EXPECT().Pull(name.GetTag()).DoAndReturn(func(string) (*image.DistributionManifest, error) {
+			time.Sleep(_pullDelay)
+			return &image.DistributionManifest{SchemaVersion: 2}, nil
+		}).AnyTimes()
+		return client
+	}
+	return puller
+}
+
+func TestBaseImagePullerPrefetch(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	amd64 := &image.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &image.Platform{OS: "linux", Architecture: "arm64"}
+	pulls := make(map[string]int)
+	puller := NewBaseImagePuller(ctx.ImageStore, 2)
+	puller.newClient = func(name image.Name, platform *image.Platform) registry.Client {
+		pulls[basePullKey(name.String(), platform)]++
+		client := mockregistry.NewMockClient(ctrl)
+		client.EXPECT().Pull(name.GetTag()).Return(&image.DistributionManifest{SchemaVersion: 2}, nil)
+		return client
+	}
+
+	require.NoError(puller.Prefetch("scratch", nil))
+	require.NoError(puller.Prefetch("alpine:latest", amd64))
+	require.NoError(puller.Prefetch("index.docker.io/library/alpine:latest", amd64))
+
+	// Same image prefetched under another name is only pulled once.
+	pulledImage, manifest, err := puller.Pull("alpine:latest", amd64)
+	require.NoError(err)
+	require.Equal("index.docker.io/library/alpine:latest", pulledImage)
+	require.Equal(2, manifest.SchemaVersion)
+
+	// Another platform is pulled separately.
+	_, _, err = puller.Pull("alpine:latest", arm64)
+	require.NoError(err)
+	require.Equal(map[string]int{
+		"index.docker.io/library/alpine:latest@linux/amd64": 1,
+		"index.docker.io/library/alpine:latest@linux/arm64": 1,
+	}, pulls)
+}
+
+func TestBaseImagePullerRetriesFailedPrefetch(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	client := mockregistry.NewMockClient(ctrl)
+	gomock.InOrder(
+		client.EXPECT().Pull("latest").Return(nil, errors.New("connection reset")),
+		client.EXPECT().Pull("latest").Return(&image.DistributionManifest{SchemaVersion: 2}, nil),
+	)
+	puller := NewBaseImagePuller(ctx.ImageStore, 1)
+	puller.newClient = func(image.Name, *image.Platform) registry.Client { return client }
+
+	require.NoError(puller.Prefetch("alpine:latest", nil))
+	_, manifest, err := puller.Pull("alpine:latest", nil)
+	require.NoError(err)
+	require.Equal(2, manifest.SchemaVersion)
+}
+
+func TestFromStepWaitsForPrefetch(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	puller := slowPullerFixture(t, ctx, 1)
+	require.NoError(puller.Prefetch("alpine:latest", nil))
+
+	step := FromStepFixture("", "alpine:latest", "")
+	step.SetBaseImagePuller(puller)
+	manifest, err := step.getManifest(ctx.ImageStore)
+	require.NoError(err)
+	require.Equal(2, manifest.SchemaVersion)
+	require.Equal("index.docker.io/library/alpine:latest", step.GetPulledImage())
+}
+
+// TestBaseImagePullerOverlapsContextPreparation compares prefetching base
+// images while the build context is prepared with pulling them first.
+func TestBaseImagePullerOverlapsContextPreparation(t *testing.T) {
+	images := []string{"alpine:latest", "golang:latest"}
+	prepareContext := func() { time.Sleep(_pullDelay) }
+
+	run := func(overlap bool) time.Duration {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		puller := slowPullerFixture(t, ctx, len(images))
+
+		start := time.Now()
+		for _, name := range images {
+			require.NoError(t, puller.Prefetch(name, nil))
+		}
+		if !overlap {
+			for _, name := range images {
+				_, _, err := puller.Pull(name, nil)
+				require.NoError(t, err)
+			}
+		}
+		prepareContext()
+		for _, name := range images {
+			_, _, err := puller.Pull(name, nil)
+			require.NoError(t, err)
+		}
+		return time.Since(start)
+	}
+
+	serial := run(false)
+	overlapped := run(true)
+	require.True(t, serial >= 2*_pullDelay, "serial took %s", serial)
+	require.True(t, overlapped < serial-_pullDelay/2,
+		"overlapped took %s, serial took %s", overlapped, serial)
+}
@@ -31,6 +31,9 @@ type baseStep struct {
 	workingDir string
 	cacheID    string
 	commit     bool
+
+	// cacheKeyInputs are the inputs cacheID was computed from.
+	cacheKeyInputs CacheKeyInputs
 }
 
 // newBaseStep returns a new baseStep. baseStep is not sufficient to implement
@@ -63,6 +66,7 @@ func (s *baseStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	commitStr := fmt.Sprintf("%v", s.commit)
 	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.args + commitStr))
 	s.cacheID = fmt.Sprintf("%x", checksum)
+	s.cacheKeyInputs = s.newCacheKeyInputs(seed)
 	return nil
 }
 
@@ -0,0 +1,49 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import "strings"
+
+// CacheKeyInputs are the inputs the cache ID of a step was computed from, to
+// help understand why a step missed the cache.
+type CacheKeyInputs struct {
+	// Seed is the cache ID of the previous step, or the seed of the plan for
+	// the first step.
+	Seed        string `json:"seed"`
+	Instruction string `json:"instruction"`
+	Commit      bool   `json:"commit"`
+
+	// ContentHash is the checksum of the context files copied by ADD and
+	// COPY, or of the cache inputs of RUN.
+	ContentHash string `json:"content_hash,omitempty"`
+
+	// BaseImage is the normalized name of the image of FROM, and Platform
+	// the platform it's pulled for, if set.
+	BaseImage string `json:"base_image,omitempty"`
+	Platform  string `json:"platform,omitempty"`
+}
+
+// CacheKeyInputs returns the inputs of the cache ID of the step, after it is
+// set using SetCacheID().
+func (s *baseStep) CacheKeyInputs() CacheKeyInputs { return s.cacheKeyInputs }
+
+// newCacheKeyInputs returns the inputs common to the cache IDs of all steps.
+func (s *baseStep) newCacheKeyInputs(seed string) CacheKeyInputs {
+	return CacheKeyInputs{
+		Seed:        seed,
+		Instruction: strings.TrimSpace(string(s.directive) + " " + s.args),
+		Commit:      s.commit,
+	}
+}
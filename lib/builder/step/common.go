@@ -16,6 +16,7 @@ package step
 
 import (
 	"archive/tar"
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -30,7 +31,11 @@ import (
 	"github.com/uber/makisu/lib/tario"
 )
 
-// tarAndGzipDiffs tars and gzips files to a temporary location.
+// Size of the buffer between tar writer and digester/gzip writer.
+const _tarBufferSize = 1 << 20
+
+// tarAndGzipDiffs tars and compresses files to a temporary location, with
+// tario.CompressionFormat.
 // It returns two digesters and the temporary file name.
 func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) error) (
 	gzipDigester hash.Hash, tarDigester hash.Hash, name string, err error) {
@@ -45,19 +50,27 @@ func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) err
 	tarDigester = sha256.New()
 
 	gzipMulti := stream.NewConcurrentMultiWriter(tempGzipTar, gzipDigester)
-	gzipper, err := tario.NewGzipWriter(gzipMulti)
+	gzipper, err := tario.NewCompressionWriter(gzipMulti)
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("new gzip writer: %s", err)
+		return nil, nil, "", fmt.Errorf("new compression writer: %s", err)
 	}
 	defer gzipper.Close()
 
+	// Buffer the tar stream, so that the header and content of each small
+	// file don't take separate writes to the concurrent multi writer.
 	multiWriter := stream.NewConcurrentMultiWriter(tarDigester, gzipper)
-	tarWriter := tar.NewWriter(multiWriter)
-	defer tarWriter.Close()
+	bufferedWriter := bufio.NewWriterSize(multiWriter, _tarBufferSize)
+	tarWriter := tar.NewWriter(bufferedWriter)
 
 	if err := writeDiffs(tarWriter); err != nil {
 		return nil, nil, "", fmt.Errorf("write diffs: %s", err)
 	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, nil, "", fmt.Errorf("close tar writer: %s", err)
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return nil, nil, "", fmt.Errorf("flush tar writer: %s", err)
+	}
 
 	return gzipDigester, tarDigester, tempGzipTar.Name(), nil
 }
@@ -65,17 +78,31 @@ func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) err
 // commitLayer commits a layer by either scan or copy operations, depending on
 // the context.
 func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
-	var writeDiffs func(w *tar.Writer) error
 	if ctx.MustScan {
-		writeDiffs = ctx.MemFS.AddLayerByScan
+		return commitDiffs(ctx, ctx.MemFS.AddLayerByScan)
 	} else if len(ctx.CopyOps) > 0 {
-		writeDiffs = func(w *tar.Writer) error {
+		return commitDiffs(ctx, func(w *tar.Writer) error {
 			return ctx.MemFS.AddLayerByCopyOps(ctx.CopyOps, w)
-		}
-	} else {
-		// Nothing to do, return.
+		})
+	}
+	// Nothing to do, return.
+	return nil, nil
+}
+
+// commitLinkedLayer commits a layer by copy operations performed on top of an
+// empty file system.
+func commitLinkedLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
+	if len(ctx.CopyOps) == 0 {
 		return nil, nil
 	}
+	return commitDiffs(ctx, func(w *tar.Writer) error {
+		return ctx.MemFS.AddLinkedLayerByCopyOps(ctx.CopyOps, w)
+	})
+}
+
+// commitDiffs commits the layer written by writeDiffs.
+func commitDiffs(
+	ctx *context.BuildContext, writeDiffs func(w *tar.Writer) error) ([]*image.DigestPair, error) {
 
 	gzipTarDigester, tarDigester, tempFileName, err := tarAndGzipDiffs(ctx, writeDiffs)
 	if err != nil {
@@ -96,7 +123,7 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 
 	layerTarDigest := image.Digest("sha256:" + tarSHA256)
 	layerGzipDescriptor := image.Descriptor{
-		MediaType: image.MediaTypeLayer,
+		MediaType: tario.LayerMediaType(),
 		Size:      info.Size(),
 		Digest:    image.Digest("sha256:" + gzipTarSHA256),
 	}
@@ -16,13 +16,18 @@ package step
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/tario"
 
 	"github.com/stretchr/testify/require"
@@ -91,6 +96,93 @@ func TestTarAndGzipDiffsAddedFile(t *testing.T) {
 	require.Contains(files, strings.TrimPrefix(filename, context.RootDir))
 }
 
+// writeTinyFiles creates dirs*files tiny files under root.
+func writeTinyFiles(root string, dirs, files int) error {
+	for i := 0; i < dirs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		for j := 0; j < files; j++ {
+			name := filepath.Join(dir, fmt.Sprintf("file%d", j))
+			if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestTarAndGzipDiffsIdenticalToPlainTar(t *testing.T) {
+	require := require.New(t)
+
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(writeTinyFiles(context.RootDir, 10, 100))
+	var paths []string
+	require.NoError(filepath.Walk(context.RootDir, func(p string, fi os.FileInfo, err error) error {
+		if fi.Mode().IsRegular() {
+			paths = append(paths, p)
+		}
+		return err
+	}))
+	sort.Strings(paths)
+	writeDiffs := func(w *tar.Writer) error {
+		for _, p := range paths {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = pathutils.RelPath(p)
+			if err := tario.WriteEntry(w, p, hdr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	expected := sha256.New()
+	w := tar.NewWriter(expected)
+	require.NoError(writeDiffs(w))
+	require.NoError(w.Close())
+
+	_, tarDigester, name, err := tarAndGzipDiffs(context, writeDiffs)
+	require.NoError(err)
+	defer os.Remove(name)
+	require.Equal(expected.Sum(nil), tarDigester.Sum(nil))
+
+	f, err := os.Open(name)
+	require.NoError(err)
+	defer f.Close()
+	require.Len(readGzippedTar(t, f), len(paths))
+}
+
+func BenchmarkTarAndGzipDiffsTinyFiles(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		context, cleanup := context.BuildContextFixture()
+		if err := writeTinyFiles(context.RootDir, 100, 100); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		_, _, name, err := tarAndGzipDiffs(context, context.MemFS.AddLayerByScan)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		os.Remove(name)
+		cleanup()
+		b.StartTimer()
+	}
+}
+
 func TestCommitDiffs(t *testing.T) {
 	require := require.New(t)
 
@@ -102,7 +194,7 @@ func TestCommitDiffs(t *testing.T) {
 		verifyGzippedTar func(io.Reader)
 	}{
 		{
-			NewRunStep("", "touch file1 && touch file2", true),
+			NewRunStep("", "touch file1 && touch file2", nil, "", nil, "", true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -111,7 +203,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "mkdir dir1 && rm file1", true),
+			NewRunStep("", "mkdir dir1 && rm file1", nil, "", nil, "", true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -120,7 +212,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "rm -rf dir1", true),
+			NewRunStep("", "rm -rf dir1", nil, "", nil, "", true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(1, len(files))
@@ -128,7 +220,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "ls ./", true),
+			NewRunStep("", "ls ./", nil, "", nil, "", true),
 			func(f io.Reader) {
 				// Verify no files were tarred, since the command doesn't write to or create any files.
 				files := readGzippedTar(t, f)
@@ -21,12 +21,10 @@ type CopyStep struct {
 	*addCopyStep
 }
 
-// NewCopyStep creates a new CopyStep.
-func NewCopyStep(
-	args, chown, fromStage string, fromPaths []string, toPath string, commit, preserveOwner bool,
-) (*CopyStep, error) {
-
-	s, err := newAddCopyStep(Copy, args, chown, fromStage, fromPaths, toPath, commit, preserveOwner)
+// NewCopyStep creates a new CopyStep. Sources found in heredocs are created
+// with the given content instead of being copied from the context dir.
+func NewCopyStep(opts AddCopyOptions) (*CopyStep, error) {
+	s, err := newAddCopyStep(Copy, opts)
 	if err != nil {
 		return nil, fmt.Errorf("new add/copy step: %s", err)
 	}
@@ -44,7 +44,11 @@ func abs(path string) string {
 func TestNewCopyStep(t *testing.T) {
 	require := require.New(t)
 
-	_, err := NewCopyStep("", validChown, "", []string{"src", "src"}, "dst", false, false)
+	_, err := NewCopyStep(AddCopyOptions{
+		Chown:     validChown,
+		FromPaths: []string{"src", "src"},
+		ToPath:    "dst",
+	})
 	require.Error(err)
 }
 
@@ -418,3 +422,248 @@ func TestCopyStepCommitOnNonCriticalPath(t *testing.T) {
 		}
 	})
 }
+
+func TestCopyStepHeredocs(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	newStep := func(content string) *CopyStep {
+		step, err := NewCopyStep(AddCopyOptions{
+			Args:      "<<EOF /etc/greeting",
+			FromPaths: []string{"EOF"},
+			ToPath:    "/etc/greeting",
+			Commit:    true,
+			Heredocs:  map[string]string{"EOF": content},
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		return step
+	}
+
+	// The content of heredocs is part of the cache ID.
+	step := newStep("hello\n")
+	require.NotEqual(newStep("bye\n").CacheID(), step.CacheID())
+	require.Equal(newStep("hello\n").CacheID(), step.CacheID())
+
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	files := make(map[string]string)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Typeflag == tar.TypeReg {
+			b, err := ioutil.ReadAll(tarReader)
+			require.NoError(err)
+			files[header.Name] = string(b)
+			require.Equal(0, header.Uid)
+		}
+	}
+	require.Equal(map[string]string{"etc/greeting": "hello\n"}, files)
+}
+
+func TestCopyStepRecursiveGlob(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	for _, p := range []string{"go.mod", "a/go.mod", "a/b/go.mod", "a/main.go"} {
+		p = filepath.Join(context.ContextDir, p)
+		require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(ioutil.WriteFile(p, []byte(p), 0644))
+	}
+
+	_, err := NewCopyStep(AddCopyOptions{
+		Args:      "**/go.mod /src",
+		FromPaths: []string{"**/go.mod"},
+		ToPath:    "/src",
+		Commit:    true,
+	})
+	require.Error(err)
+
+	step, err := NewCopyStep(AddCopyOptions{
+		Args:      "**/go.mod /src/",
+		FromPaths: []string{"**/go.mod"},
+		ToPath:    "/src/",
+		Commit:    true,
+	})
+	require.NoError(err)
+	require.NoError(step.SetCacheID(context, ""))
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	var files []string
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Typeflag == tar.TypeReg {
+			files = append(files, header.Name)
+		}
+	}
+	require.ElementsMatch([]string{"src/go.mod", "src/a/go.mod", "src/a/b/go.mod"}, files)
+}
+
+func TestCopyStepChmod(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(os.MkdirAll(filepath.Join(context.ContextDir, "bin"), 0700))
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "bin", "tool"), nil, 0600))
+
+	newStep := func(chmod string) *CopyStep {
+		step, err := NewCopyStep(AddCopyOptions{
+			Args:      "bin /bin/",
+			Chmod:     chmod,
+			FromPaths: []string{"bin"},
+			ToPath:    "/bin/",
+			Commit:    true,
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		return step
+	}
+
+	// The mode is part of the cache ID.
+	step := newStep("755")
+	require.NotEqual(newStep("").CacheID(), step.CacheID())
+	require.NotEqual(newStep("700").CacheID(), step.CacheID())
+	require.Equal(newStep("755").CacheID(), step.CacheID())
+
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	modes := make(map[string]int64)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		modes[header.Name] = header.Mode
+	}
+	require.Equal(int64(0755), modes["bin/tool"])
+}
+
+func TestCopyStepLink(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	src := filepath.Join(context.ContextDir, "a.txt")
+	require.NoError(ioutil.WriteFile(src, []byte("a"), 0644))
+
+	newStep := func(link bool, seed string) *CopyStep {
+		step, err := NewCopyStep(AddCopyOptions{
+			Args:      "a.txt /a.txt",
+			FromPaths: []string{"a.txt"},
+			ToPath:    "/a.txt",
+			Link:      link,
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, seed))
+		return step
+	}
+
+	// Linked steps are always committed.
+	require.False(newStep(false, "").HasCommit())
+	require.True(newStep(true, "").HasCommit())
+
+	// The linked cache ID doesn't depend on previous steps.
+	step := newStep(true, "seed1")
+	require.Equal("", newStep(false, "seed1").LinkCacheID())
+	require.NotEqual(newStep(true, "seed2").CacheID(), step.CacheID())
+	require.Equal(newStep(true, "seed2").LinkCacheID(), step.LinkCacheID())
+	require.NotEqual("", step.LinkCacheID())
+
+	require.NoError(ioutil.WriteFile(src, []byte("b"), 0644))
+	require.NotEqual(newStep(true, "seed1").LinkCacheID(), step.LinkCacheID())
+}
+
+func TestCopyStepExclude(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	for _, p := range []string{"app/main.go", "app/main_test.go", "app/vendor/lib.go", "app/b/b_test.go"} {
+		p = filepath.Join(context.ContextDir, p)
+		require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(ioutil.WriteFile(p, []byte(p), 0644))
+	}
+
+	newStep := func() *CopyStep {
+		step, err := NewCopyStep(AddCopyOptions{
+			Args:      "app /app/",
+			FromPaths: []string{"app"},
+			ToPath:    "/app/",
+			Commit:    true,
+			Excludes:  []string{"vendor", "**/*_test.go"},
+		})
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		return step
+	}
+
+	// Excluded files are not part of the cache ID.
+	step := newStep()
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.ContextDir, "app/vendor/lib.go"), []byte("changed"), 0644))
+	require.Equal(newStep().CacheID(), step.CacheID())
+
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	var files []string
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		files = append(files, header.Name)
+	}
+	require.ElementsMatch([]string{"app", "app/main.go", "app/b/"}, files)
+}
@@ -43,20 +43,29 @@ func NewEnvStep(args string, envs map[string]string, commit bool) BuildStep {
 func (s *EnvStep) UpdateCtxAndConfig(
 	ctx *context.BuildContext, imageConfig *image.Config) (*image.Config, error) {
 
-	// Update in-memory map of merged stage vars from ARG and ENV.
-	for k, v := range s.envs {
-		ctx.StageVars[k] = v
-	}
-
 	// Update image config.
 	config, err := image.NewImageConfigFromCopy(imageConfig)
 	if err != nil {
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
 
+	// Variables left in values by the parser are expanded with the env
+	// inherited from the base image and previous ENV steps, e.g. PATH in
+	// "ENV PATH=/opt/bin:$PATH".
+	inheritedEnv := utils.ConvertStringSliceToMap(config.Config.Env)
 	expandedEnvs := make(map[string]string, len(s.envs))
 	for k, v := range s.envs {
-		expandedEnvs[k] = os.ExpandEnv(v)
+		expandedEnvs[k] = os.Expand(v, func(name string) string {
+			if value, ok := inheritedEnv[name]; ok {
+				return value
+			}
+			return ctx.StageVars[name]
+		})
+	}
+
+	// Update in-memory map of merged stage vars from ARG and ENV.
+	for k, v := range expandedEnvs {
+		ctx.StageVars[k] = v
 	}
 	config.Config.Env = utils.MergeEnv(config.Config.Env, expandedEnvs)
 	return config, nil
@@ -51,6 +51,32 @@ func TestEnvStepUpdateCtxAndConfig(t *testing.T) {
 	}
 }
 
+func TestEnvStepInheritedEnv(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	c := image.NewDefaultImageConfig()
+	c.Config.Env = []string{"PATH=/usr/local/bin:/usr/bin", "HOME=/root"}
+
+	step := NewEnvStep("", map[string]string{"PATH": "/opt/bin:$PATH"}, false)
+	result, err := step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+	require.Equal([]string{"PATH=/opt/bin:/usr/local/bin:/usr/bin", "HOME=/root"}, result.Config.Env)
+	require.Equal("/opt/bin:/usr/local/bin:/usr/bin", ctx.StageVars["PATH"])
+
+	// Later ENV steps see the merged value.
+	step = NewEnvStep("", map[string]string{"PATH": "${PATH}:/extra", "APP": "$HOME/app"}, false)
+	result, err = step.UpdateCtxAndConfig(ctx, result)
+	require.NoError(err)
+	require.Equal([]string{
+		"PATH=/opt/bin:/usr/local/bin:/usr/bin:/extra",
+		"HOME=/root",
+		"APP=/root/app",
+	}, result.Config.Env)
+}
+
 func TestEnvStepNilConfig(t *testing.T) {
 	require := require.New(t)
 
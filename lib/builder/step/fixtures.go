@@ -19,6 +19,8 @@ package step
 import (
 	"fmt"
 	"os"
+
+	"github.com/uber/makisu/lib/registry"
 )
 
 var currUID int
@@ -40,9 +42,30 @@ func FromStepFixture(args, image, alias string) *FromStep {
 	return f
 }
 
+// FromStepFixtureWithClient returns a FromStep that pulls the base image with
+// the given registry client, panicing if it fails, for testing purposes.
+func FromStepFixtureWithClient(args, image, alias string, client registry.Client) *FromStep {
+	f := FromStepFixture(args, image, alias)
+	f.setRegistryClient(client)
+	return f
+}
+
+// SetRegistryClientFixture makes a FromStep pull the base image with the given
+// registry client, for testing purposes.
+func SetRegistryClientFixture(from *FromStep, client registry.Client) {
+	from.setRegistryClient(client)
+}
+
 // AddStepFixture returns a AddStep, panicing if it fails, for testing purposes.
 func AddStepFixture(args string, srcs []string, dst string, commit, preserveOwner bool) *AddStep {
-	c, err := NewAddStep(args, validChown, srcs, dst, commit, preserveOwner)
+	c, err := NewAddStep(AddCopyOptions{
+		Args:          args,
+		Chown:         validChown,
+		FromPaths:     srcs,
+		ToPath:        dst,
+		Commit:        commit,
+		PreserveOwner: preserveOwner,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -51,7 +74,13 @@ func AddStepFixture(args string, srcs []string, dst string, commit, preserveOwne
 
 // AddStepFixtureNoChown returns a AddStep, panicing if it fails, for testing purposes.
 func AddStepFixtureNoChown(args string, srcs []string, dst string, commit, preserveOwner bool) *AddStep {
-	c, err := NewAddStep(args, "", srcs, dst, commit, preserveOwner)
+	c, err := NewAddStep(AddCopyOptions{
+		Args:          args,
+		FromPaths:     srcs,
+		ToPath:        dst,
+		Commit:        commit,
+		PreserveOwner: preserveOwner,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -60,7 +89,15 @@ func AddStepFixtureNoChown(args string, srcs []string, dst string, commit, prese
 
 // CopyStepFixture returns a CopyStep, panicing if it fails, for testing purposes.
 func CopyStepFixture(args, fromStage string, srcs []string, dst string, commit, preserveOwner bool) *CopyStep {
-	c, err := NewCopyStep(args, validChown, fromStage, srcs, dst, commit, preserveOwner)
+	c, err := NewCopyStep(AddCopyOptions{
+		Args:          args,
+		Chown:         validChown,
+		FromStage:     fromStage,
+		FromPaths:     srcs,
+		ToPath:        dst,
+		Commit:        commit,
+		PreserveOwner: preserveOwner,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -69,7 +106,14 @@ func CopyStepFixture(args, fromStage string, srcs []string, dst string, commit,
 
 // CopyStepFixtureNoChown returns a CopyStep, panicing if it fails, for testing purposes.
 func CopyStepFixtureNoChown(args, fromStage string, srcs []string, dst string, commit, preserveOwner bool) *CopyStep {
-	c, err := NewCopyStep(args, "", fromStage, srcs, dst, commit, preserveOwner)
+	c, err := NewCopyStep(AddCopyOptions{
+		Args:          args,
+		FromStage:     fromStage,
+		FromPaths:     srcs,
+		ToPath:        dst,
+		Commit:        commit,
+		PreserveOwner: preserveOwner,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -41,21 +41,23 @@ const (
 type FromStep struct {
 	*baseStep
 
-	image string
-	alias string
-
-	manifest *image.DistributionManifest
-	client   registry.Client
+	image    string
+	alias    string
+	platform *image.Platform
+
+	pulledImage string
+	manifest    *image.DistributionManifest
+	client      registry.Client
+	puller      *BaseImagePuller
 }
 
 // NewFromStep returns a BuildStep from given arguments.
 func NewFromStep(args, imageName, alias string) (*FromStep, error) {
 	if !strings.EqualFold(imageName, image.Scratch) {
-		image, err := image.ParseNameForPull(imageName)
-		if err != nil || !image.IsValid() {
-			return nil, fmt.Errorf("Invalid image name: %s", imageName)
+		var err error
+		if imageName, err = normalizeBaseImage(imageName); err != nil {
+			return nil, err
 		}
-		imageName = image.String()
 	}
 	return &FromStep{
 		baseStep: newBaseStep(From, args, false),
@@ -64,6 +66,20 @@ func NewFromStep(args, imageName, alias string) (*FromStep, error) {
 	}, nil
 }
 
+// normalizeBaseImage returns the name a base image is referred to by.
+func normalizeBaseImage(imageName string) (string, error) {
+	pullImage, err := image.ParseNameForPull(imageName)
+	if err != nil || !pullImage.IsValid() {
+		return "", fmt.Errorf("Invalid image name: %s", imageName)
+	}
+	if parsed, _ := image.ParseName(imageName); !parsed.IsQualified() && len(registry.SearchRegistries) > 0 {
+		// Keep the short name, it will be resolved against the search
+		// registries when the image gets pulled.
+		return parsed.String(), nil
+	}
+	return pullImage.String(), nil
+}
+
 // GetImage returns the image name in From step.
 func (s *FromStep) GetImage() string {
 	return s.image
@@ -74,10 +90,42 @@ func (s *FromStep) GetAlias() string {
 	return s.alias
 }
 
-// SetCacheID sets the cacheID of the step using the name of the base image.
+// SetPlatform makes the step pull the base image for the given platform if
+// it's a manifest list. It must be called before SetCacheID.
+func (s *FromStep) SetPlatform(platform image.Platform) {
+	s.platform = &platform
+}
+
+// SetBaseImagePuller makes the step get its base image from the puller, which
+// might have prefetched it.
+func (s *FromStep) SetBaseImagePuller(puller *BaseImagePuller) {
+	s.puller = puller
+}
+
+// GetPulledImage returns the fully resolved name the base image was pulled
+// with, or an empty string if it hasn't been pulled.
+func (s *FromStep) GetPulledImage() string {
+	return s.pulledImage
+}
+
+// GetManifest returns the manifest of the base image, or nil if it hasn't been
+// pulled or the stage is built from scratch.
+func (s *FromStep) GetManifest() *image.DistributionManifest {
+	return s.manifest
+}
+
+// SetCacheID sets the cacheID of the step using the name and platform of the
+// base image.
 // TODO: Use the sha of that image instead of the image name itself.
 func (s *FromStep) SetCacheID(ctx *context.BuildContext, seed string) error {
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.image))
+	s.cacheKeyInputs = s.newCacheKeyInputs(seed)
+	s.cacheKeyInputs.BaseImage = s.image
+	key := seed + string(s.directive) + s.image
+	if s.platform != nil {
+		key += s.platform.OS + "/" + s.platform.Architecture
+		s.cacheKeyInputs.Platform = s.platform.OS + "/" + s.platform.Architecture
+	}
+	checksum := crc32.ChecksumIEEE([]byte(key))
 	s.cacheID = fmt.Sprintf("%x", checksum)
 	return nil
 }
@@ -122,12 +170,13 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 		if err != nil {
 			return fmt.Errorf("get reader from layer: %s", err)
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		layerReader, err := tario.NewDecompressionReader(reader)
 		if err != nil {
-			return fmt.Errorf("create gzip reader for layer: %s", err)
+			return fmt.Errorf("create decompression reader for layer: %s", err)
 		}
 		log.Infof("* Processing FROM layer %s", descriptor.Digest.Hex())
-		err = ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyFS)
+		err = ctx.MemFS.UpdateFromTarReader(tar.NewReader(layerReader), modifyFS)
+		layerReader.Close()
 		if err != nil {
 			return fmt.Errorf("untar reader: %s", err)
 		}
@@ -157,6 +206,9 @@ func (s *FromStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error
 		return nil, fmt.Errorf("layer digests and descriptors count doesn't match: %s", err)
 	}
 
+	// Base layers are carried through verbatim, so their diffIDs are taken
+	// from the base image config instead of being recomputed. This keeps the
+	// rootfs chain of the resulting image valid.
 	digestPairs := make([]*image.DigestPair, len(config.RootFS.DiffIDs))
 	for i := range config.RootFS.DiffIDs {
 		digestPairs[i] = &image.DigestPair{
@@ -194,6 +246,26 @@ func (s *FromStep) UpdateCtxAndConfig(
 		ctx.StageVars[k] = v
 	}
 
+	// ONBUILD triggers are run by the stage using the image as base, and are
+	// not inherited by its image.
+	config.Config.OnBuild = nil
+	return config, nil
+}
+
+// BaseConfig pulls the base image if needed, and returns its config. It
+// returns nil when building from scratch.
+func (s *FromStep) BaseConfig(ctx *context.BuildContext) (*image.Config, error) {
+	if isScratch(s.image) {
+		return nil, nil
+	}
+	manifest, err := s.getManifest(ctx.ImageStore)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %s", err)
+	}
+	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
+	if err != nil {
+		return nil, fmt.Errorf("get config: %s", err)
+	}
 	return config, nil
 }
 
@@ -202,20 +274,65 @@ func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionMa
 		return s.manifest, nil
 	}
 
+	if s.puller != nil && s.client == nil {
+		pulledImage, manifest, err := s.puller.Pull(s.image, s.platform)
+		if err != nil {
+			return nil, err
+		}
+		s.pulledImage = pulledImage
+		s.manifest = manifest
+		return manifest, nil
+	}
+
 	// Pull image.
-	pullImage, err := image.ParseNameForPull(s.image)
+	pullImage, err := s.initRegistryClient(store)
 	if err != nil {
-		return nil, fmt.Errorf("parse pull image %s: %s", pullImage, err)
+		return nil, err
 	}
-	s.setRegistryClient(registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository()))
 	manifest, err := s.client.Pull(pullImage.GetTag())
 	if err != nil {
 		return nil, fmt.Errorf("pull image %s: %s", s.image, err)
 	}
+	s.pulledImage = pullImage.String()
 	s.manifest = manifest
 	return manifest, nil
 }
 
+// ResolveDigest returns the digest of the manifest the base image name points
+// to in its registry, without pulling the image. It returns an empty digest
+// for scratch.
+func (s *FromStep) ResolveDigest(store *storage.ImageStore) (image.Digest, error) {
+	if isScratch(s.image) {
+		return "", nil
+	}
+	pullImage, err := s.initRegistryClient(store)
+	if err != nil {
+		return "", err
+	}
+	digest, err := s.client.ResolveDigest(pullImage.GetTag())
+	if err != nil {
+		return "", fmt.Errorf("resolve digest of %s: %s", s.image, err)
+	}
+	return digest, nil
+}
+
+// initRegistryClient sets the client that pulls the base image, for its
+// platform if set, unless one is set already. It returns the resolved name of
+// the base image.
+func (s *FromStep) initRegistryClient(store *storage.ImageStore) (image.Name, error) {
+	pullImage, err := registry.ResolveNameForPull(s.image)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("resolve pull image %s: %s", s.image, err)
+	}
+	if s.platform != nil {
+		s.setRegistryClient(registry.NewWithPlatform(
+			store, pullImage.GetRegistry(), pullImage.GetRepository(), *s.platform))
+	} else {
+		s.setRegistryClient(registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository()))
+	}
+	return pullImage, nil
+}
+
 func (s *FromStep) getConfig(
 	configDigest image.Descriptor, imageStore *storage.ImageStore) (*image.Config, error) {
 
@@ -47,3 +47,19 @@ func TestHealthcheckStepUpdateCtxAndConfig(t *testing.T) {
 		Test:        cmd,
 	})
 }
+
+func TestHealthcheckStepNoneOverridesBase(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step, err := NewHealthcheckStep("none", 0, 0, 0, 0, []string{"NONE"}, false)
+	require.NoError(err)
+
+	c := image.NewDefaultImageConfig()
+	c.Config.Healthcheck = &image.HealthConfig{Test: []string{"CMD", "ls", "/"}}
+	result, err := step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+	require.Equal(&image.HealthConfig{Test: []string{"NONE"}}, result.Config.Healthcheck)
+}
@@ -49,3 +49,8 @@ func (s *LabelStep) UpdateCtxAndConfig(
 	config.Config.Labels = utils.MergeStringMaps(config.Config.Labels, s.labels)
 	return config, nil
 }
+
+// Labels returns the labels set by the step.
+func (s *LabelStep) Labels() map[string]string {
+	return s.labels
+}
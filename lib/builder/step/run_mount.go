@@ -0,0 +1,363 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/fileio"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// runCacheDir is the dir of the storage that keeps the caches of
+// `RUN --mount=type=cache` across builds.
+const runCacheDir = "run_cache"
+
+// RunSecrets maps the ids of the secrets available to
+// `RUN --mount=type=secret` to their source files.
+var RunSecrets = make(map[string]string)
+
+// SetRunSecrets sets global var RunSecrets. Each secret has format
+// "id=<id>,src=<path>".
+func SetRunSecrets(secrets []string) error {
+	result := make(map[string]string)
+	for _, secret := range secrets {
+		var id, src string
+		for _, opt := range strings.Split(secret, ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return fmt.Errorf("malformed secret option %s", opt)
+			}
+			switch kv[0] {
+			case "id":
+				id = kv[1]
+			case "src", "source":
+				src = kv[1]
+			default:
+				return fmt.Errorf("unsupported secret option %s", kv[0])
+			}
+		}
+		if id == "" || src == "" {
+			return fmt.Errorf("secret %s requires id and src", secret)
+		} else if _, ok := result[id]; ok {
+			return fmt.Errorf("duplicate secret id %s", id)
+		}
+		if fi, err := os.Stat(src); err != nil {
+			return fmt.Errorf("stat secret %s: %s", id, err)
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("secret %s is not a regular file", id)
+		}
+		result[id] = src
+	}
+	RunSecrets = result
+	return nil
+}
+
+// mounted is a mount set up for the command of a RUN step. Its target is
+// restored by unmount, so mounts are never part of the committed layer.
+type mounted struct {
+	target string
+	// backup is the temp dir holding the original target, if it existed.
+	backup string
+	// created is the topmost parent dir of the target created by mount.
+	created string
+	// temp is a temp file or dir mounted at target, removed by unmount.
+	temp string
+	// mountpoint is set if a file system is mounted at target, instead of a
+	// symlink.
+	mountpoint bool
+}
+
+// mount sets up the mounts of the step. Cache mounts are symlinks to a
+// directory of the storage that is kept across builds, and secret mounts to a
+// copy of the secret in the sandbox dir, both given the owner and mode of the
+// mount. Read-write bind mounts are symlinks to a copy of their source,
+// removed once the command finished so writes are discarded. Read-only bind
+// mounts and tmpfs mounts are real mounts, which requires Linux.
+func (s *RunStep) mount(ctx *context.BuildContext) ([]*mounted, error) {
+	var result []*mounted
+	for _, m := range s.mounts {
+		target := m.Target
+		if filepath.IsAbs(target) {
+			target = filepath.Join(ctx.RootDir, target)
+		} else {
+			target = filepath.Join(s.workingDir, target)
+		}
+
+		var source, temp string
+		var mountFS func(target string) error
+		dir := true
+		switch m.Type {
+		case dockerfile.MountTypeBind:
+			if !m.ReadWrite {
+				src, fi, err := bindSource(ctx, m.Source)
+				if err != nil {
+					return result, fmt.Errorf("bind source %s: %s", m.Source, err)
+				}
+				mountFS = func(target string) error { return bindMount(src, target, true) }
+				dir = fi.IsDir()
+				break
+			}
+			var err error
+			if temp, err = copyBindSource(ctx, m.Source); err != nil {
+				return result, fmt.Errorf("copy bind source %s: %s", m.Source, err)
+			}
+			source = filepath.Join(temp, "source")
+		case dockerfile.MountTypeCache:
+			source = filepath.Join(
+				ctx.ImageStore.RootDir, runCacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(m.ID))))
+			if err := os.MkdirAll(source, 0755); err != nil {
+				return result, fmt.Errorf("create cache dir %s: %s", source, err)
+			}
+			if err := os.Chown(source, m.UID, m.GID); err != nil {
+				return result, fmt.Errorf("chown cache dir %s: %s", source, err)
+			} else if err := os.Chmod(source, m.Mode); err != nil {
+				return result, fmt.Errorf("chmod cache dir %s: %s", source, err)
+			}
+		case dockerfile.MountTypeSecret:
+			src, ok := RunSecrets[m.ID]
+			if !ok {
+				if m.Required {
+					return result, fmt.Errorf("missing required secret %s", m.ID)
+				}
+				log.Infof("* Secret %s not given, skipping its mount", m.ID)
+				continue
+			}
+			var err error
+			if temp, err = copySecret(ctx, src, m); err != nil {
+				return result, fmt.Errorf("copy secret %s: %s", m.ID, err)
+			}
+			source = temp
+		case dockerfile.MountTypeTmpfs:
+			mountFS = tmpfsMount
+		default:
+			return result, fmt.Errorf("unsupported mount type %s", m.Type)
+		}
+
+		var mount *mounted
+		var err error
+		if mountFS != nil {
+			mount, err = mountFSAt(target, dir, mountFS)
+		} else {
+			mount, err = mountAt(source, target)
+		}
+		if err != nil {
+			if temp != "" {
+				os.RemoveAll(temp)
+			}
+			return result, fmt.Errorf("mount %s at %s: %s", m.Type, m.Target, err)
+		}
+		mount.temp = temp
+		result = append(result, mount)
+	}
+	return result, nil
+}
+
+// bindSource returns the path of the given source of a bind mount, resolving
+// symlinks, and its info. It fails if the source is outside of the context dir.
+func bindSource(ctx *context.BuildContext, src string) (string, os.FileInfo, error) {
+	contextDir, err := filepath.EvalSymlinks(ctx.ContextDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve context dir: %s", err)
+	}
+	src = filepath.Join(contextDir, src)
+	if !pathutils.IsDescendantOfAny(src, []string{contextDir}) {
+		return "", nil, fmt.Errorf("source is outside of context dir")
+	}
+	if src, err = filepath.EvalSymlinks(src); err != nil {
+		return "", nil, fmt.Errorf("resolve source: %s", err)
+	} else if !pathutils.IsDescendantOfAny(src, []string{contextDir}) {
+		return "", nil, fmt.Errorf("source links outside of context dir")
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", nil, fmt.Errorf("stat: %s", err)
+	}
+	return src, fi, nil
+}
+
+// copyBindSource copies the given path of the context dir to "source" in a
+// temp dir of the sandbox dir, and returns the temp dir. Commands can then
+// neither modify the context dir nor add files to the layer through the mount.
+func copyBindSource(ctx *context.BuildContext, src string) (string, error) {
+	src, fi, err := bindSource(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	temp, err := ioutil.TempDir(ctx.ImageStore.SandboxDir, "bind")
+	if err != nil {
+		return "", fmt.Errorf("create temp dir: %s", err)
+	}
+	copier := fileio.NewCopier(nil)
+	if fi.IsDir() {
+		err = copier.CopyDir(src, filepath.Join(temp, "source"))
+	} else {
+		err = copier.CopyFile(src, filepath.Join(temp, "source"))
+	}
+	if err != nil {
+		os.RemoveAll(temp)
+		return "", err
+	}
+	return temp, nil
+}
+
+// copySecret copies the secret file to a temp file in the sandbox dir, given
+// the owner and mode of the mount, so commands can't modify the source.
+func copySecret(ctx *context.BuildContext, src string, m *dockerfile.RunMount) (string, error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("open: %s", err)
+	}
+	defer r.Close()
+	w, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "secret")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %s", err)
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		os.Remove(w.Name())
+		return "", fmt.Errorf("copy: %s", err)
+	}
+	if err := w.Chown(m.UID, m.GID); err != nil {
+		os.Remove(w.Name())
+		return "", fmt.Errorf("chown: %s", err)
+	} else if err := w.Chmod(m.Mode); err != nil {
+		os.Remove(w.Name())
+		return "", fmt.Errorf("chmod: %s", err)
+	}
+	return w.Name(), nil
+}
+
+// mountAt moves the target aside if it exists, and replaces it with a
+// symlink to source. Missing parent dirs are created.
+func mountAt(source, target string) (*mounted, error) {
+	mount, err := moveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Symlink(source, target); err != nil {
+		mount.unmount()
+		return nil, fmt.Errorf("symlink: %s", err)
+	}
+	return mount, nil
+}
+
+// mountFSAt moves the target aside like mountAt, and mounts a file system with
+// mountFS on an empty dir created at target, or an empty file if dir is false.
+func mountFSAt(target string, dir bool, mountFS func(target string) error) (*mounted, error) {
+	mount, err := moveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if dir {
+		err = os.Mkdir(target, 0755)
+	} else {
+		err = ioutil.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		mount.unmount()
+		return nil, fmt.Errorf("create mount point: %s", err)
+	}
+	if err := mountFS(target); err != nil {
+		mount.unmount()
+		return nil, err
+	}
+	mount.mountpoint = true
+	return mount, nil
+}
+
+// moveTarget moves the target aside if it exists, or creates its missing
+// parent dirs, so a mount can be set up at target.
+func moveTarget(target string) (*mounted, error) {
+	mount := &mounted{target: target}
+	if _, err := os.Lstat(target); err == nil {
+		backup, err := ioutil.TempDir(filepath.Dir(target), ".makisu-mount")
+		if err != nil {
+			return nil, fmt.Errorf("create backup dir: %s", err)
+		}
+		if err := os.Rename(target, filepath.Join(backup, "target")); err != nil {
+			os.Remove(backup)
+			return nil, fmt.Errorf("move target to backup dir: %s", err)
+		}
+		mount.backup = backup
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("lstat target: %s", err)
+	} else {
+		for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); err == nil || dir == filepath.Dir(dir) {
+				break
+			}
+			mount.created = dir
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("create target parent dir: %s", err)
+		}
+	}
+	return mount, nil
+}
+
+// unmount removes the mount and restores the original target. Parent dirs
+// created by mount are removed if they are still empty.
+func (m *mounted) unmount() error {
+	if m.mountpoint {
+		if err := unmountFS(m.target); err != nil {
+			return fmt.Errorf("unmount %s: %s", m.target, err)
+		}
+		m.mountpoint = false
+	}
+	// Only removes the symlink or mount point, unless the command replaced it.
+	if err := os.RemoveAll(m.target); err != nil {
+		return fmt.Errorf("remove mount %s: %s", m.target, err)
+	}
+	if m.temp != "" {
+		if err := os.RemoveAll(m.temp); err != nil {
+			return fmt.Errorf("remove temp file %s: %s", m.temp, err)
+		}
+	}
+	if m.created != "" {
+		for dir := filepath.Dir(m.target); os.Remove(dir) == nil && dir != m.created; {
+			dir = filepath.Dir(dir)
+		}
+	}
+	if m.backup == "" {
+		return nil
+	}
+	if err := os.Rename(filepath.Join(m.backup, "target"), m.target); err != nil {
+		return fmt.Errorf("restore %s: %s", m.target, err)
+	}
+	if err := os.Remove(m.backup); err != nil {
+		return fmt.Errorf("remove backup dir %s: %s", m.backup, err)
+	}
+	return nil
+}
+
+// unmountAll unmounts the given mounts in reverse order.
+func unmountAll(mounts []*mounted) error {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err := mounts[i].unmount(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindMount mounts source at target, read-only if readOnly is set.
+func bindMount(source, target string, readOnly bool) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount: %s", err)
+	}
+	if readOnly {
+		// MS_RDONLY is ignored when creating a bind mount, it needs a remount.
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			syscall.Unmount(target, syscall.MNT_DETACH)
+			return fmt.Errorf("remount read-only: %s", err)
+		}
+	}
+	return nil
+}
+
+// tmpfsMount mounts an empty tmpfs at target.
+func tmpfsMount(target string) error {
+	if err := syscall.Mount("tmpfs", target, "tmpfs", 0, "mode=1777"); err != nil {
+		return fmt.Errorf("mount tmpfs: %s", err)
+	}
+	return nil
+}
+
+// unmountFS unmounts the file system mounted at target. It is detached even if
+// processes started by the command still use it.
+func unmountFS(target string) error {
+	return syscall.Unmount(target, syscall.MNT_DETACH)
+}
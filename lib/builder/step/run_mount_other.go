@@ -0,0 +1,37 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package step
+
+import "errors"
+
+var errMountNotSupported = errors.New("read-only bind mounts and tmpfs mounts are only supported on linux")
+
+// bindMount mounts source at target, which requires Linux.
+func bindMount(source, target string, readOnly bool) error {
+	return errMountNotSupported
+}
+
+// tmpfsMount mounts an empty tmpfs at target, which requires Linux.
+func tmpfsMount(target string) error {
+	return errMountNotSupported
+}
+
+// unmountFS unmounts the file system mounted at target, which requires Linux.
+func unmountFS(target string) error {
+	return errMountNotSupported
+}
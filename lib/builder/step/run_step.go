@@ -16,28 +16,73 @@ package step
 
 import (
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/shell"
 )
 
+// RunOutputLimit is the maximum number of bytes of command output captured
+// by RUN steps, so it can be stored with their cache entry and replayed when
+// they are cached. 0 disables capturing.
+var RunOutputLimit int
+
+// RunNetwork is the network mode of RUN steps without `--network`, or with
+// `--network=default`. Default to host.
+var RunNetwork = "host"
+
+// SetRunNetwork sets global var RunNetwork. Mode could be "host" or "none".
+func SetRunNetwork(mode string) error {
+	if mode != "host" && mode != "none" {
+		return fmt.Errorf("invalid network mode %s", mode)
+	}
+	RunNetwork = mode
+	return nil
+}
+
 // RunStep implements BuildStep and execute RUN directive
 type RunStep struct {
 	*baseStep
 
-	cmd string
+	cmd    string
+	output *runOutput
+
+	// Context paths whose content is part of the cache ID.
+	cacheInputs []string
+	// Working dir of this step only, set by `RUN --workdir`.
+	workdirOverride string
+	// Mounts set up while the command runs, set by `RUN --mount`.
+	mounts []*dockerfile.RunMount
+	// Network mode of this step, set by `RUN --network`.
+	network string
 
 	// Used by the user step and the run step to determine which user should run a command (format should be <user>[:<group>] or <UID>[:<GID>], default is "" which is 0:0)
 	user string
+	// Shell running the command, set by SHELL. Default is "sh -c".
+	shell []string
 }
 
 // NewRunStep returns a BuildStep from given arguments.
-func NewRunStep(args, cmd string, commit bool) *RunStep {
+func NewRunStep(
+	args, cmd string, cacheInputs []string, workdir string, mounts []*dockerfile.RunMount,
+	network string, commit bool) *RunStep {
+
 	return &RunStep{
-		baseStep: newBaseStep(Run, args, commit),
-		cmd:      cmd,
+		baseStep:        newBaseStep(Run, args, commit),
+		cmd:             cmd,
+		cacheInputs:     cacheInputs,
+		workdirOverride: workdir,
+		mounts:          mounts,
+		network:         network,
 	}
 }
 
@@ -45,18 +90,94 @@ func NewRunStep(args, cmd string, commit bool) *RunStep {
 // layers to be present on disk.
 func (s *RunStep) RequireOnDisk() bool { return true }
 
+// SetCacheID sets the cache ID of the step given a seed SHA256 value.
+// The content of cache inputs and bind mount sources is added to the ID, so
+// changing them busts the cache even if the command stays the same.
+func (s *RunStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	// Steps run without network don't reuse layers built with it. The default
+	// host mode leaves the seed as is, so existing cache entries stay valid.
+	if network := s.networkMode(); network != "host" {
+		seed += " network=" + network
+	}
+	inputs := append([]string{}, s.cacheInputs...)
+	for _, m := range s.mounts {
+		if m.Type == dockerfile.MountTypeBind {
+			inputs = append(inputs, m.Source)
+		}
+	}
+	if len(inputs) == 0 {
+		return s.baseStep.SetCacheID(ctx, seed)
+	}
+
+	checksum := crc32.NewIEEE()
+	commitStr := fmt.Sprintf("%v", s.commit)
+	if _, err := checksum.Write([]byte(seed + string(s.directive) + s.args + commitStr)); err != nil {
+		return fmt.Errorf("hash run directive: %s", err)
+	}
+	// The cache inputs are also hashed on their own for CacheKeyInputs.
+	contentChecksum := crc32.NewIEEE()
+	w := io.MultiWriter(checksum, contentChecksum)
+	for _, input := range inputs {
+		source := filepath.Join(ctx.ContextDir, input)
+		if !pathutils.IsDescendantOfAny(source, []string{ctx.ContextDir}) {
+			return fmt.Errorf("cache input %s is outside of context dir", input)
+		} else if _, err := os.Lstat(source); err != nil {
+			return fmt.Errorf("cache input %s: %s", input, err)
+		}
+		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("prev error during walk: %s", err)
+			}
+			return checksumPathContents(ctx, path, fi, w)
+		}); err != nil {
+			return fmt.Errorf("hash cache input %s: %s", input, err)
+		}
+	}
+	s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
+	s.cacheKeyInputs = s.newCacheKeyInputs(seed)
+	s.cacheKeyInputs.ContentHash = fmt.Sprintf("%x", contentChecksum.Sum32())
+	return nil
+}
+
 // ApplyCtxAndConfig setup the user that should be used to run the command
 // See ./user_step.go to see how it's set in image.Config
 func (s *RunStep) ApplyCtxAndConfig(ctx *context.BuildContext, imageConfig *image.Config) error {
 	// This is from ./base_step.go
 	s.SetWorkingDir(ctx, imageConfig)
 	s.SetEnvFromContext(ctx)
+	if s.workdirOverride != "" {
+		if err := s.overrideWorkingDir(ctx); err != nil {
+			return fmt.Errorf("set working dir: %s", err)
+		}
+	}
 
 	if imageConfig == nil {
 		return nil
 	}
 
 	s.user = imageConfig.Config.User
+	s.shell = imageConfig.Config.Shell
+	return nil
+}
+
+// overrideWorkingDir sets the working dir of the step to the one given by
+// `RUN --workdir`, resolved against the stage's WORKDIR and created if it
+// doesn't exist, like WORKDIR does. The image config is left unchanged.
+func (s *RunStep) overrideWorkingDir(ctx *context.BuildContext) error {
+	workdir := os.ExpandEnv(s.workdirOverride)
+	if filepath.IsAbs(workdir) {
+		s.workingDir = filepath.Join(ctx.RootDir, workdir)
+	} else {
+		s.workingDir = filepath.Join(s.workingDir, workdir)
+	}
+	if _, err := os.Lstat(s.workingDir); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("lstat working dir %s: %s", s.workingDir, err)
+		}
+		if err := os.MkdirAll(s.workingDir, 0755); err != nil {
+			return fmt.Errorf("mkdir all working dir %s: %s", s.workingDir, err)
+		}
+	}
 	return nil
 }
 
@@ -67,5 +188,96 @@ func (s *RunStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 		return errors.New("attempted to execute RUN step without modifying file system")
 	}
 	ctx.MustScan = true
-	return shell.ExecCommand(log.Infof, log.Errorf, s.workingDir, s.user, "sh", "-c", s.cmd)
+	mounts, err := s.mount(ctx)
+	if err != nil {
+		if unmountErr := unmountAll(mounts); unmountErr != nil {
+			log.Errorf("Failed to unmount: %s", unmountErr)
+		}
+		return fmt.Errorf("mount: %s", err)
+	}
+	err = s.exec()
+	if unmountErr := unmountAll(mounts); unmountErr != nil && err == nil {
+		err = fmt.Errorf("unmount: %s", unmountErr)
+	}
+	return err
+}
+
+// networkMode returns the network mode the command of the step runs with.
+func (s *RunStep) networkMode() string {
+	if s.network == "" || s.network == "default" {
+		return RunNetwork
+	}
+	return s.network
+}
+
+// exec runs the command of the step, without network if its network mode is
+// none.
+func (s *RunStep) exec() error {
+	execCommand := shell.ExecCommand
+	if s.networkMode() == "none" {
+		execCommand = shell.ExecCommandWithoutNetwork
+	}
+
+	cmdName, cmdArgs := s.shellCmd()
+	if RunOutputLimit <= 0 {
+		return execCommand(log.Infof, log.Errorf, s.workingDir, s.user, cmdName, cmdArgs...)
+	}
+	s.output = &runOutput{limit: RunOutputLimit}
+	return execCommand(
+		s.output.tee(log.Infof), s.output.tee(log.Errorf), s.workingDir, s.user, cmdName, cmdArgs...)
+}
+
+// shellCmd returns the name and args of the command running the step's
+// command with its shell.
+func (s *RunStep) shellCmd() (string, []string) {
+	if len(s.shell) == 0 {
+		return "sh", []string{"-c", s.cmd}
+	}
+	return s.shell[0], append(append([]string{}, s.shell[1:]...), s.cmd)
+}
+
+// Output returns the command output captured during Execute, up to
+// RunOutputLimit bytes.
+func (s *RunStep) Output() string {
+	if s.output == nil {
+		return ""
+	}
+	return s.output.String()
+}
+
+// runOutput captures stdout and stderr of a command, in the order they were
+// written, up to limit bytes.
+type runOutput struct {
+	sync.Mutex
+
+	limit     int
+	b         []byte
+	truncated bool
+}
+
+// tee returns a stream that writes to the given one and captures the output.
+func (o *runOutput) tee(stream func(string, ...interface{})) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		stream(format, args...)
+		o.write(fmt.Sprintf(format, args...))
+	}
+}
+
+func (o *runOutput) write(p string) {
+	o.Lock()
+	defer o.Unlock()
+	if n := o.limit - len(o.b); len(p) > n {
+		p = p[:n]
+		o.truncated = true
+	}
+	o.b = append(o.b, p...)
+}
+
+func (o *runOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	if o.truncated {
+		return fmt.Sprintf("%s\n[output truncated after %d bytes]\n", o.b, o.limit)
+	}
+	return string(o.b)
 }
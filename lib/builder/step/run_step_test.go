@@ -15,9 +15,19 @@
 package step
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/shell"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +37,425 @@ func TestRunStepExecutionFail(t *testing.T) {
 	context, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	step := NewRunStep("", "echo hello", false)
+	step := NewRunStep("", "echo hello", nil, "", nil, "", false)
 	err := step.Execute(context, false)
 	require.Error(err)
 }
+
+func TestRunStepKillOrphans(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	shell.KillOrphans = true
+	defer func() { shell.KillOrphans = false }()
+
+	// The background process would keep writing to the file if left running.
+	target := filepath.Join(context.RootDir, "out.txt")
+	cmd := fmt.Sprintf("(while true; do date >> %s; sleep 0.1; done) & echo started > %s", target, target)
+	step := NewRunStep("", cmd, nil, "", nil, "", false)
+	require.NoError(step.Execute(context, true))
+
+	fi, err := os.Stat(target)
+	require.NoError(err)
+	time.Sleep(500 * time.Millisecond)
+	fi2, err := os.Stat(target)
+	require.NoError(err)
+	require.Equal(fi.Size(), fi2.Size())
+
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+}
+
+func TestRunStepOutput(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step := NewRunStep("", "echo version 1.2.3", nil, "", nil, "", false)
+	require.NoError(step.Execute(context, true))
+	require.Equal("", step.Output())
+
+	RunOutputLimit = 1024
+	defer func() { RunOutputLimit = 0 }()
+
+	step = NewRunStep("", "echo version 1.2.3; echo warning >&2", nil, "", nil, "", false)
+	require.NoError(step.Execute(context, true))
+	require.Contains(step.Output(), "version 1.2.3\n")
+	require.Contains(step.Output(), "warning\n")
+
+	// Output beyond the limit is dropped.
+	RunOutputLimit = 8
+	step = NewRunStep("", "echo version 1.2.3", nil, "", nil, "", false)
+	require.NoError(step.Execute(context, true))
+	require.Equal("version \n[output truncated after 8 bytes]\n", step.Output())
+}
+
+func TestRunStepCacheInputs(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	input := filepath.Join(context.ContextDir, "inputs", "config.tmpl")
+	other := filepath.Join(context.ContextDir, "other.txt")
+	require.NoError(os.MkdirAll(filepath.Dir(input), 0755))
+	require.NoError(ioutil.WriteFile(input, []byte("v1"), 0644))
+	require.NoError(ioutil.WriteFile(other, []byte("v1"), 0644))
+
+	cacheID := func(cacheInputs []string) string {
+		step := NewRunStep("render", "render config", cacheInputs, "", nil, "", false)
+		require.NoError(step.SetCacheID(context, "seed"))
+		return step.CacheID()
+	}
+	plain := cacheID(nil)
+	withInputs := cacheID([]string{"inputs"})
+	require.NotEqual(plain, withInputs)
+
+	// Editing an undeclared file doesn't change the cache ID.
+	require.NoError(ioutil.WriteFile(other, []byte("v2"), 0644))
+	require.Equal(plain, cacheID(nil))
+	require.Equal(withInputs, cacheID([]string{"inputs"}))
+
+	// Editing a declared input does.
+	require.NoError(ioutil.WriteFile(input, []byte("v2"), 0644))
+	require.Equal(plain, cacheID(nil))
+	require.NotEqual(withInputs, cacheID([]string{"inputs"}))
+
+	for _, inputs := range [][]string{{"missing.txt"}, {"inputs", "missing.txt"}, {"../outside"}} {
+		step := NewRunStep("render", "render config", inputs, "", nil, "", false)
+		require.Error(step.SetCacheID(context, "seed"))
+	}
+}
+
+func TestRunStepWorkdir(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	stageWorkdir := filepath.Join(context.RootDir, "stage")
+	config := image.NewDefaultImageConfig()
+	config.Config.WorkingDir = stageWorkdir
+
+	run := func(args, workdir string) {
+		step := NewRunStep(args, "pwd > pwd.txt", nil, workdir, nil, "", false)
+		require.NoError(step.ApplyCtxAndConfig(context, &config))
+		require.NoError(step.Execute(context, true))
+		newConfig, err := step.UpdateCtxAndConfig(context, &config)
+		require.NoError(err)
+		require.Equal(stageWorkdir, newConfig.Config.WorkingDir)
+	}
+	requirePwd := func(dir string) {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "pwd.txt"))
+		require.NoError(err)
+		require.Equal(dir+"\n", string(b))
+	}
+
+	// Relative dirs are resolved against WORKDIR, and created if missing.
+	run("--workdir=sub pwd > pwd.txt", "sub")
+	requirePwd(filepath.Join(stageWorkdir, "sub"))
+	run("--workdir=/abs pwd > pwd.txt", "/abs")
+	requirePwd(filepath.Join(context.RootDir, "abs"))
+
+	// The next step runs in the unchanged WORKDIR.
+	run("pwd > pwd.txt", "")
+	requirePwd(stageWorkdir)
+}
+
+func TestRunStepShell(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	out := filepath.Join(context.RootDir, "shell.txt")
+	config := image.NewDefaultImageConfig()
+	config.Config.Shell = []string{"/usr/bin/env", "MAKISU_SHELL=custom", "sh", "-c"}
+
+	step := NewRunStep("", "echo ${MAKISU_SHELL:-default} > "+out, nil, "", nil, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, &config))
+	require.NoError(step.Execute(context, true))
+	b, err := ioutil.ReadFile(out)
+	require.NoError(err)
+	require.Equal("custom\n", string(b))
+
+	// Without SHELL, commands run with sh -c.
+	config.Config.Shell = nil
+	require.NoError(step.ApplyCtxAndConfig(context, &config))
+	require.NoError(step.Execute(context, true))
+	b, err = ioutil.ReadFile(out)
+	require.NoError(err)
+	require.Equal("default\n", string(b))
+}
+
+func TestRunStepCacheMount(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := filepath.Join(context.RootDir, "cache")
+	require.NoError(os.Mkdir(target, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(target, "orig.txt"), []byte("orig"), 0644))
+
+	mounts := []*dockerfile.RunMount{{Type: dockerfile.MountTypeCache, Target: "/cache", ID: "test", Mode: 0755}}
+	cmd := fmt.Sprintf("test ! -e %s/orig.txt && echo run >> %s/runs.txt && cp %s/runs.txt %s",
+		target, target, target, context.RootDir)
+	for i := 1; i <= 2; i++ {
+		step := NewRunStep("", cmd, nil, "", mounts, "", false)
+		require.NoError(step.ApplyCtxAndConfig(context, nil))
+		require.NoError(step.Execute(context, true))
+
+		// The cache is kept across steps, and the target is restored.
+		b, err := ioutil.ReadFile(filepath.Join(context.RootDir, "runs.txt"))
+		require.NoError(err)
+		require.Equal(strings.Repeat("run\n", i), string(b))
+		infos, err := ioutil.ReadDir(target)
+		require.NoError(err)
+		require.Len(infos, 1)
+		require.Equal("orig.txt", infos[0].Name())
+	}
+
+	// Failed commands also restore the target.
+	step := NewRunStep("", "exit 1", nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.Error(step.Execute(context, true))
+	_, err := os.Stat(filepath.Join(target, "orig.txt"))
+	require.NoError(err)
+
+	// The cache dir is given the owner and mode of the mount.
+	mounts[0].UID, mounts[0].GID, mounts[0].Mode = 1000, 1001, 0700
+	step = NewRunStep("", fmt.Sprintf("stat -L -c '%%u:%%g:%%a' %s > %s/owner.txt", target, context.RootDir),
+		nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.NoError(step.Execute(context, true))
+	b, err := ioutil.ReadFile(filepath.Join(context.RootDir, "owner.txt"))
+	require.NoError(err)
+	require.Equal("1000:1001:700\n", string(b))
+}
+
+func TestSetRunSecrets(t *testing.T) {
+	require := require.New(t)
+	defer func() { RunSecrets = make(map[string]string) }()
+
+	src, err := ioutil.TempFile("", "secret")
+	require.NoError(err)
+	src.Close()
+	defer os.Remove(src.Name())
+
+	require.NoError(SetRunSecrets([]string{"id=a,src=" + src.Name(), "id=b,source=" + src.Name()}))
+	require.Equal(map[string]string{"a": src.Name(), "b": src.Name()}, RunSecrets)
+
+	require.Error(SetRunSecrets([]string{"id=a"}))
+	require.Error(SetRunSecrets([]string{"src=" + src.Name()}))
+	require.Error(SetRunSecrets([]string{"id=a,src=/does/not/exist"}))
+	require.Error(SetRunSecrets([]string{"id=a,src=" + src.Name(), "id=a,src=" + src.Name()}))
+	require.Error(SetRunSecrets([]string{"id=a,src=" + src.Name() + ",env=A"}))
+}
+
+func TestRunStepSecretMount(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	defer func() { RunSecrets = make(map[string]string) }()
+
+	src := filepath.Join(context.ContextDir, "token")
+	require.NoError(ioutil.WriteFile(src, []byte("s3cr3t"), 0644))
+	require.NoError(SetRunSecrets([]string{"id=token,src=" + src}))
+
+	secretDir := filepath.Join(context.RootDir, "run", "secrets")
+	out := filepath.Join(context.RootDir, "out.txt")
+	mounts := []*dockerfile.RunMount{{
+		Type: dockerfile.MountTypeSecret, Target: "/run/secrets/token", ID: "token",
+		UID: 1000, GID: 1001, Mode: 0440,
+	}}
+	cmd := fmt.Sprintf("cat %s/token > %s && stat -L -c ' %%u:%%g:%%a' %s/token >> %s",
+		secretDir, out, secretDir, out)
+	step := NewRunStep("", cmd, nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.NoError(step.Execute(context, true))
+
+	// The secret is given the owner and mode of the mount.
+	b, err := ioutil.ReadFile(out)
+	require.NoError(err)
+	require.Equal("s3cr3t 1000:1001:440\n", string(b))
+
+	// Neither the secret nor the dirs created for it are left behind.
+	_, err = os.Lstat(filepath.Join(context.RootDir, "run"))
+	require.True(os.IsNotExist(err))
+	infos, err := ioutil.ReadDir(context.ImageStore.SandboxDir)
+	require.NoError(err)
+	for _, info := range infos {
+		require.False(strings.HasPrefix(info.Name(), "secret"))
+	}
+
+	// Missing secrets are skipped, unless required.
+	mounts = []*dockerfile.RunMount{{
+		Type: dockerfile.MountTypeSecret, Target: "/run/secrets/other", ID: "other", Mode: 0400,
+	}}
+	step = NewRunStep("", fmt.Sprintf("test ! -e %s/other", secretDir), nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.NoError(step.Execute(context, true))
+	mounts[0].Required = true
+	require.Error(step.Execute(context, true))
+}
+
+func TestRunStepBindAndTmpfsMounts(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "src.txt"), []byte("v1"), 0644))
+	mounts := []*dockerfile.RunMount{
+		{Type: dockerfile.MountTypeBind, Source: ".", Target: "/src"},
+		{Type: dockerfile.MountTypeBind, Source: "src.txt", Target: "/file.txt"},
+		{Type: dockerfile.MountTypeBind, Source: ".", Target: "/rw", ReadWrite: true},
+		{Type: dockerfile.MountTypeTmpfs, Target: "/scratch"},
+	}
+	root := context.RootDir
+	cmd := fmt.Sprintf("cat %s/src/src.txt %s/file.txt > %s/scratch/out.txt && "+
+		"test \"$(stat -f -c %%T %s/scratch)\" = tmpfs && "+
+		"! touch %s/src/new.txt 2>/dev/null && echo new > %s/rw/new.txt && "+
+		"cp %s/scratch/out.txt %s/out.txt",
+		root, root, root, root, root, root, root, root)
+	step := NewRunStep("", cmd, nil, "", mounts, "", false)
+	require.NoError(step.SetCacheID(context, "seed"))
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.NoError(step.Execute(context, true))
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "out.txt"))
+	require.NoError(err)
+	require.Equal("v1v1", string(b))
+	for _, p := range []string{
+		filepath.Join(root, "src"),
+		filepath.Join(root, "file.txt"),
+		filepath.Join(root, "rw"),
+		filepath.Join(root, "scratch"),
+		filepath.Join(context.ContextDir, "new.txt"),
+	} {
+		_, err := os.Lstat(p)
+		require.True(os.IsNotExist(err), p)
+	}
+
+	// Bind mount sources are part of the cache ID.
+	cacheID := step.CacheID()
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "src.txt"), []byte("v2"), 0644))
+	step = NewRunStep("", cmd, nil, "", mounts, "", false)
+	require.NoError(step.SetCacheID(context, "seed"))
+	require.NotEqual(cacheID, step.CacheID())
+
+	mounts = []*dockerfile.RunMount{{Type: dockerfile.MountTypeBind, Source: "../outside", Target: "/src"}}
+	step = NewRunStep("", "true", nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.Error(step.Execute(context, true))
+
+	// Symlinks can't point bind mounts outside of the context dir.
+	require.NoError(os.Symlink(root, filepath.Join(context.ContextDir, "link")))
+	mounts = []*dockerfile.RunMount{{Type: dockerfile.MountTypeBind, Source: "link", Target: "/src"}}
+	step = NewRunStep("", "true", nil, "", mounts, "", false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.Error(step.Execute(context, true))
+}
+
+func TestRunStepMountsNotCommitted(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mount *dockerfile.RunMount
+		cmd   string
+	}{
+		{
+			"bind",
+			&dockerfile.RunMount{Type: dockerfile.MountTypeBind, Source: ".", Target: "/src/dir", ReadWrite: true},
+			"echo kept > %[1]s/kept.txt && echo new > %[1]s/src/dir/new.txt",
+		},
+		{
+			"cache",
+			&dockerfile.RunMount{Type: dockerfile.MountTypeCache, Target: "/cache/dir", ID: "test", Mode: 0755},
+			"echo kept > %[1]s/kept.txt && echo new > %[1]s/cache/dir/new.txt",
+		},
+		{
+			"secret",
+			&dockerfile.RunMount{Type: dockerfile.MountTypeSecret, Target: "/run/secrets/token", ID: "token", Mode: 0400},
+			"cat %[1]s/run/secrets/token > %[1]s/kept.txt",
+		},
+		{
+			"tmpfs",
+			&dockerfile.RunMount{Type: dockerfile.MountTypeTmpfs, Target: "/scratch/dir"},
+			"echo kept > %[1]s/kept.txt && echo new > %[1]s/scratch/dir/new.txt",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			context, cleanup := context.BuildContextFixture()
+			defer cleanup()
+			defer func() { RunSecrets = make(map[string]string) }()
+
+			src := filepath.Join(context.ContextDir, "token")
+			require.NoError(ioutil.WriteFile(src, []byte("s3cr3t"), 0644))
+			require.NoError(SetRunSecrets([]string{"id=token,src=" + src}))
+
+			cmd := fmt.Sprintf(test.cmd, context.RootDir)
+			step := NewRunStep("", cmd, nil, "", []*dockerfile.RunMount{test.mount}, "", true)
+			require.NoError(step.ApplyCtxAndConfig(context, nil))
+			require.NoError(step.Execute(context, true))
+			digestPairs, err := step.Commit(context)
+			require.NoError(err)
+			require.Len(digestPairs, 1)
+
+			// Only the file written outside of the mount is in the layer, not
+			// the target nor the dirs created for it.
+			f, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+			require.NoError(err)
+			defer f.Close()
+			files := readGzippedTar(t, f)
+			require.Len(files, 1)
+			require.Contains(files, "/kept.txt")
+		})
+	}
+}
+
+func TestRunStepNetwork(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	defer func() { RunNetwork = "host" }()
+
+	require.Error(SetRunNetwork("bridge"))
+
+	out := filepath.Join(context.RootDir, "interfaces.txt")
+	run := func(network string) int {
+		cmd := fmt.Sprintf("tail -n +3 /proc/net/dev | wc -l > %s", out)
+		step := NewRunStep("", cmd, nil, "", nil, network, false)
+		require.NoError(step.ApplyCtxAndConfig(context, nil))
+		if err := step.Execute(context, true); err != nil &&
+			strings.Contains(err.Error(), "operation not permitted") {
+			t.Skip("creating network namespaces requires CAP_SYS_ADMIN")
+		} else {
+			require.NoError(err)
+		}
+		b, err := ioutil.ReadFile(out)
+		require.NoError(err)
+		n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		require.NoError(err)
+		return n
+	}
+
+	// The network mode of all RUN steps is part of the cache ID.
+	cacheID := func() string {
+		step := NewRunStep("", "apk add curl", nil, "", nil, "", false)
+		require.NoError(step.SetCacheID(context, "seed"))
+		return step.CacheID()
+	}
+	host := cacheID()
+	require.NoError(SetRunNetwork("none"))
+	require.NotEqual(host, cacheID())
+	require.NoError(SetRunNetwork("host"))
+	require.Equal(host, cacheID())
+
+	// Only loopback is left without network.
+	require.Equal(1, run("none"))
+	require.NoError(SetRunNetwork("none"))
+	require.Equal(1, run(""))
+	require.Equal(1, run("default"))
+	require.NoError(SetRunNetwork("host"))
+	require.Equal(1, run("none"))
+}
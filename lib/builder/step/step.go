@@ -38,7 +38,9 @@ const (
 	Healthcheck = Directive("HEALTHCHECK")
 	Label       = Directive("LABEL")
 	Maintainer  = Directive("MAINTAINER")
+	Onbuild     = Directive("ONBUILD")
 	Run         = Directive("RUN")
+	Shell       = Directive("SHELL")
 	Stopsignal  = Directive("STOPSIGNAL")
 	User        = Directive("USER")
 	Volume      = Directive("VOLUME")
@@ -61,6 +63,9 @@ type BuildStep interface {
 	// SetCacheID sets the cache ID of the step given a seed value.
 	SetCacheID(ctx *context.BuildContext, seed string) error
 
+	// CacheKeyInputs returns the inputs of the cache ID of the step.
+	CacheKeyInputs() CacheKeyInputs
+
 	// ApplyCtxAndConfig sets up the execution environment using image config
 	// from previous step.
 	// This function will not be skipped.
@@ -92,7 +97,18 @@ func NewDockerfileStep(
 	switch t := d.(type) {
 	case *dockerfile.AddDirective:
 		s, _ := d.(*dockerfile.AddDirective)
-		step, err = NewAddStep(s.Args, s.Chown, s.Srcs, s.Dst, s.Commit, s.PreserveOwner)
+		step, err = NewAddStep(AddCopyOptions{
+			Args:          s.Args,
+			Chown:         s.Chown,
+			Chmod:         s.Chmod,
+			FromPaths:     s.Srcs,
+			ToPath:        s.Dst,
+			Commit:        s.Commit,
+			PreserveOwner: s.PreserveOwner,
+			Link:          s.Link,
+			Excludes:      s.Excludes,
+			Checksum:      s.Checksum,
+		})
 	case *dockerfile.ArgDirective:
 		s, _ := d.(*dockerfile.ArgDirective)
 		step = NewArgStep(s.Args, s.Name, s.ResolvedVal, s.Commit)
@@ -101,7 +117,19 @@ func NewDockerfileStep(
 		step = NewCmdStep(s.Args, s.Cmd, s.Commit)
 	case *dockerfile.CopyDirective:
 		s, _ := d.(*dockerfile.CopyDirective)
-		step, err = NewCopyStep(s.Args, s.Chown, s.FromStage, s.Srcs, s.Dst, s.Commit, s.PreserveOwner)
+		step, err = NewCopyStep(AddCopyOptions{
+			Args:          s.Args,
+			Chown:         s.Chown,
+			Chmod:         s.Chmod,
+			FromStage:     s.FromStage,
+			FromPaths:     s.Srcs,
+			ToPath:        s.Dst,
+			Commit:        s.Commit,
+			PreserveOwner: s.PreserveOwner,
+			Link:          s.Link,
+			Excludes:      s.Excludes,
+			Heredocs:      s.Heredocs,
+		})
 	case *dockerfile.EntrypointDirective:
 		s, _ := d.(*dockerfile.EntrypointDirective)
 		step = NewEntrypointStep(s.Args, s.Entrypoint, s.Commit)
@@ -124,9 +152,16 @@ func NewDockerfileStep(
 	case *dockerfile.MaintainerDirective:
 		s, _ := d.(*dockerfile.MaintainerDirective)
 		step = NewMaintainerStep(s.Args, s.Author, s.Commit)
+	case *dockerfile.OnbuildDirective:
+		s, _ := d.(*dockerfile.OnbuildDirective)
+		step = NewOnbuildStep(s.Args, s.Trigger, s.Commit)
 	case *dockerfile.RunDirective:
 		s, _ := d.(*dockerfile.RunDirective)
-		step = NewRunStep(s.Args, s.Cmd, s.Commit)
+		step = NewRunStep(
+			s.Args, s.Cmd, s.CacheInputs, s.Workdir, s.Mounts, s.Network, s.Commit)
+	case *dockerfile.ShellDirective:
+		s, _ := d.(*dockerfile.ShellDirective)
+		step = NewShellStep(s.Args, s.Shell, s.Commit)
 	case *dockerfile.StopsignalDirective:
 		s, _ := d.(*dockerfile.StopsignalDirective)
 		step = NewStopsignalStep(s.Args, s.Signal, s.Commit)
@@ -16,7 +16,6 @@ package step
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
@@ -26,11 +25,11 @@ import (
 type StopsignalStep struct {
 	*baseStep
 
-	Signal int
+	Signal string
 }
 
 // NewStopsignalStep returns a BuildStep from given arguments.
-func NewStopsignalStep(args string, signal int, commit bool) BuildStep {
+func NewStopsignalStep(args string, signal string, commit bool) BuildStep {
 	return &StopsignalStep{
 		baseStep: newBaseStep(Stopsignal, args, commit),
 		Signal:   signal,
@@ -46,6 +45,6 @@ func (s *StopsignalStep) UpdateCtxAndConfig(
 	if err != nil {
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
-	config.Config.StopSignal = strconv.Itoa(s.Signal)
+	config.Config.StopSignal = s.Signal
 	return config, nil
 }
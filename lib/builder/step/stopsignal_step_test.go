@@ -15,7 +15,6 @@
 package step
 
 import (
-	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -29,12 +28,12 @@ func TestStopsignalStepUpdateCtxAndConfig(t *testing.T) {
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	signal := 9
+	signal := "SIGTERM"
 	step := NewStopsignalStep("", signal, false)
 
 	c := image.NewDefaultImageConfig()
 	result, err := step.UpdateCtxAndConfig(ctx, &c)
 	require.NoError(err)
 
-	require.Equal(strconv.Itoa(signal), result.Config.StopSignal)
+	require.Equal(signal, result.Config.StopSignal)
 }
@@ -0,0 +1,234 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// CacheConfigMediaType is the media type of the config of cache images.
+const CacheConfigMediaType = "application/vnd.makisu.cache.config.v1+json"
+
+// InlineCacheLabel is the label holding the inline cache of images, in the
+// same format as the config of cache images.
+const InlineCacheLabel = "makisu.cache.v1"
+
+// cacheImageConfig is the config of a cache image. Cache images share the
+// build cache between machines without a common kv store: their layers are
+// cached layers, and their config holds the cache key-value pairs.
+type cacheImageConfig struct {
+	Entries map[string]string `json:"entries"`
+}
+
+// ImportImage pulls the config of a cache image, or of an image with an inline
+// cache, so its cache key-value pairs are used on cache misses and its layers
+// are pulled from its registry. Layers are only pulled when needed.
+func (manager *registryCacheManager) ImportImage(client registry.Client, tag string) error {
+	manifest, err := client.PullManifest(tag)
+	if err != nil {
+		return fmt.Errorf("pull manifest: %s", err)
+	}
+	switch manifest.Config.MediaType {
+	case CacheConfigMediaType, image.MediaTypeConfig, image.MediaTypeOCIConfig:
+	default:
+		return fmt.Errorf("not a cache image, config media type is %s", manifest.Config.MediaType)
+	}
+	if _, err := client.PullImageConfig(manifest.Config.Digest); err != nil {
+		return fmt.Errorf("pull config: %s", err)
+	}
+	r, err := manager.imageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return fmt.Errorf("get config reader: %s", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read config: %s", err)
+	}
+	config, err := parseCacheConfig(manifest.Config.MediaType, b)
+	if err != nil {
+		return err
+	}
+
+	manager.Lock()
+	defer manager.Unlock()
+
+	// Pairs of cache images imported first take precedence.
+	for key, entry := range config.Entries {
+		if _, ok := manager.importedKVStore[key]; !ok {
+			manager.importedKVStore[key] = entry
+		}
+	}
+	for _, layer := range manifest.Layers {
+		if _, ok := manager.importedLayers[layer.Digest]; !ok {
+			manager.importedLayers[layer.Digest] = client
+		}
+	}
+	return nil
+}
+
+// parseCacheConfig returns the cache key-value pairs of the config of a cache
+// image, or of the inline cache label of an image config.
+func parseCacheConfig(mediaType string, b []byte) (cacheImageConfig, error) {
+	var config cacheImageConfig
+	if mediaType != CacheConfigMediaType {
+		imageConfig, err := image.NewImageConfigFromJSON(b)
+		if err != nil {
+			return config, fmt.Errorf("unmarshal image config: %s", err)
+		}
+		var label string
+		if imageConfig.Config != nil {
+			label = imageConfig.Config.Labels[InlineCacheLabel]
+		}
+		if label == "" {
+			return config, fmt.Errorf("image has no inline cache")
+		}
+		b = []byte(label)
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("unmarshal cache config: %s", err)
+	}
+	return config, nil
+}
+
+// InlineCache returns the inline cache of an image with the given layers, to
+// set as its InlineCacheLabel label: the cache key-value pairs pulled or pushed
+// by this build that map to one of them, or to no layer.
+func (manager *registryCacheManager) InlineCache(layers []image.Digest) (string, error) {
+	inImage := make(map[image.Digest]bool)
+	for _, layer := range layers {
+		inImage[layer] = true
+	}
+
+	manager.Lock()
+	defer manager.Unlock()
+
+	config := cacheImageConfig{Entries: make(map[string]string)}
+	for key, entry := range manager.usedKVStore {
+		if !strings.HasPrefix(key, _cachePrefix) {
+			continue
+		} else if entry != _cacheEmptyEntry {
+			_, gzipDigest, err := parseEntry(entry)
+			if err != nil {
+				return "", fmt.Errorf("parse entry %s: %s", entry, err)
+			} else if !inImage[gzipDigest] {
+				continue
+			}
+		}
+		config.Entries[key] = entry
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("marshal inline cache: %s", err)
+	}
+	return string(b), nil
+}
+
+// ExportImage pushes a cache image with the cache key-value pairs pulled or
+// pushed by this build, and their layers.
+func (manager *registryCacheManager) ExportImage(client registry.Client, tag string) error {
+	manager.Lock()
+	config := cacheImageConfig{Entries: make(map[string]string)}
+	for key, entry := range manager.usedKVStore {
+		config.Entries[key] = entry
+	}
+	manager.Unlock()
+
+	var layers []image.Descriptor
+	seen := make(map[image.Digest]bool)
+	for key, entry := range config.Entries {
+		if !strings.HasPrefix(key, _cachePrefix) || entry == _cacheEmptyEntry {
+			continue
+		}
+		_, gzipDigest, err := parseEntry(entry)
+		if err != nil {
+			return fmt.Errorf("parse entry %s: %s", entry, err)
+		} else if seen[gzipDigest] {
+			continue
+		}
+		seen[gzipDigest] = true
+		info, err := manager.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+		if err != nil {
+			return fmt.Errorf("stat layer %s: %s", gzipDigest.Hex(), err)
+		}
+		layers = append(layers, image.Descriptor{
+			MediaType: tario.LayerMediaType(),
+			Size:      info.Size(),
+			Digest:    gzipDigest,
+		})
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].Digest < layers[j].Digest })
+
+	configDescriptor, err := manager.saveConfig(config)
+	if err != nil {
+		return fmt.Errorf("save config: %s", err)
+	}
+	for _, layer := range layers {
+		if err := client.PushLayer(layer.Digest); err != nil {
+			return fmt.Errorf("push layer %s: %s", layer.Digest, err)
+		}
+	}
+	if err := client.PushImageConfig(configDescriptor.Digest); err != nil {
+		return fmt.Errorf("push config: %s", err)
+	}
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        configDescriptor,
+		Layers:        layers,
+	}
+	if err := client.PushManifest(tag, manifest); err != nil {
+		return fmt.Errorf("push manifest: %s", err)
+	}
+	return nil
+}
+
+// saveConfig writes the config of a cache image to the image store, and
+// returns its descriptor.
+func (manager *registryCacheManager) saveConfig(config cacheImageConfig) (image.Descriptor, error) {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("marshal config: %s", err)
+	}
+	digest, err := image.NewDigester().FromBytes(configJSON)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("hash config: %s", err)
+	}
+	configPath := path.Join(manager.imageStore.SandboxDir, digest.Hex())
+	if err := ioutil.WriteFile(configPath, configJSON, 0644); err != nil {
+		return image.Descriptor{}, fmt.Errorf("write config: %s", err)
+	}
+	defer os.Remove(configPath)
+	// The same config might have been exported before.
+	err = manager.imageStore.Layers.LinkStoreFileFrom(digest.Hex(), configPath)
+	if err != nil && !os.IsExist(err) {
+		return image.Descriptor{}, fmt.Errorf("commit config to store: %s", err)
+	}
+	return image.Descriptor{
+		MediaType: CacheConfigMediaType,
+		Size:      int64(len(configJSON)),
+		Digest:    digest,
+	}, nil
+}
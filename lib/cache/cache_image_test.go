@@ -0,0 +1,177 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	mockregistry "github.com/uber/makisu/mocks/lib/registry"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheImageExportAndImport(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	content := []byte("layer content")
+	gzipDigest, err := image.NewDigester().FromBytes(content)
+	require.NoError(err)
+	f, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layer")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(gzipDigest.Hex(), f.Name()))
+
+	// Push cache entries, then export them.
+	mockClient := mockregistry.NewMockClient(ctrl)
+	mockClient.EXPECT().PushLayer(gzipDigest).Return(nil)
+	cacheMgr := cache.New(ctx.ImageStore, keyvalue.MockStore{}, mockClient)
+	require.NoError(cacheMgr.PushCache("cacheid1", &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}))
+	require.NoError(cacheMgr.PushCache("cacheid2", nil))
+	require.NoError(cacheMgr.PushOutput("cacheid1", "output"))
+	require.NoError(cacheMgr.WaitForPush())
+
+	var manifest *image.DistributionManifest
+	cacheClient := mockregistry.NewMockClient(ctrl)
+	cacheClient.EXPECT().PushLayer(gzipDigest).Return(nil)
+	cacheClient.EXPECT().PushImageConfig(gomock.Any()).Return(nil)
+	cacheClient.EXPECT().PushManifest("cache", gomock.Any()).
+		Do(func(tag string, m *image.DistributionManifest) { manifest = m }).Return(nil)
+	require.NoError(cacheMgr.ExportImage(cacheClient, "cache"))
+	require.Equal(cache.CacheConfigMediaType, manifest.Config.MediaType)
+	require.Equal([]image.Digest{gzipDigest}, manifest.GetLayerDigests())
+	require.Equal(int64(len(content)), manifest.Layers[0].Size)
+
+	// Import them with an empty kv store, without a local copy of the layer.
+	require.NoError(ctx.ImageStore.Layers.DeleteStoreFile(gzipDigest.Hex()))
+	cacheClient.EXPECT().PullManifest("cache").Return(manifest, nil)
+	cacheClient.EXPECT().PullImageConfig(manifest.Config.Digest).Return(nil, nil)
+	cacheClient.EXPECT().PullLayer(gzipDigest).Return(nil, nil)
+	cacheMgr = cache.New(ctx.ImageStore, keyvalue.MockStore{}, nil)
+	require.NoError(cacheMgr.ImportImage(cacheClient, "cache"))
+
+	pair, err := cacheMgr.PullCache("cacheid1")
+	require.NoError(err)
+	require.Equal(image.Digest("sha256:test"), pair.TarDigest)
+	require.Equal(gzipDigest, pair.GzipDescriptor.Digest)
+	pair, err = cacheMgr.PullCache("cacheid2")
+	require.NoError(err)
+	require.Nil(pair)
+	output, err := cacheMgr.PullOutput("cacheid1")
+	require.NoError(err)
+	require.Equal("output", output)
+	_, err = cacheMgr.PullCache("cacheid3")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+}
+
+func TestCacheImageImportNotCacheImage(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	cacheClient := mockregistry.NewMockClient(ctrl)
+	cacheClient.EXPECT().PullManifest("latest").Return(&image.DistributionManifest{
+		Config: image.Descriptor{MediaType: "application/vnd.example.config+json"},
+	}, nil)
+	cacheMgr := cache.New(ctx.ImageStore, keyvalue.MockStore{}, nil)
+	require.Error(cacheMgr.ImportImage(cacheClient, "latest"))
+
+	require.Error(cache.NewNoopCacheManager().ImportImage(cacheClient, "latest"))
+}
+
+func TestCacheImageInline(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	inImage := image.Digest("sha256:aaaa")
+	notInImage := image.Digest("sha256:bbbb")
+	mockClient := mockregistry.NewMockClient(ctrl)
+	mockClient.EXPECT().PushLayer(gomock.Any()).Return(nil).Times(2)
+	cacheMgr := cache.New(ctx.ImageStore, keyvalue.MockStore{}, mockClient)
+	for cacheID, digest := range map[string]image.Digest{"cacheid1": inImage, "cacheid2": notInImage} {
+		require.NoError(cacheMgr.PushCache(cacheID, &image.DigestPair{
+			TarDigest:      image.Digest("sha256:test"),
+			GzipDescriptor: image.Descriptor{Digest: digest},
+		}))
+	}
+	require.NoError(cacheMgr.PushCache("cacheid3", nil))
+	require.NoError(cacheMgr.WaitForPush())
+
+	label, err := cacheMgr.InlineCache([]image.Digest{inImage})
+	require.NoError(err)
+
+	// Import it from an image config with the label.
+	imageConfig := image.NewDefaultImageConfig()
+	imageConfig.Config.Labels = map[string]string{cache.InlineCacheLabel: label}
+	b, err := json.Marshal(imageConfig)
+	require.NoError(err)
+	configDigest, err := image.NewDigester().FromBytes(b)
+	require.NoError(err)
+	f, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "config")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(configDigest.Hex(), f.Name()))
+
+	imageClient := mockregistry.NewMockClient(ctrl)
+	imageClient.EXPECT().PullManifest("latest").Return(&image.DistributionManifest{
+		Config: image.Descriptor{MediaType: image.MediaTypeConfig, Digest: configDigest},
+		Layers: []image.Descriptor{{Digest: inImage}},
+	}, nil)
+	imageClient.EXPECT().PullImageConfig(configDigest).Return(nil, nil)
+	imageClient.EXPECT().PullLayer(inImage).Return(nil, nil)
+	cacheMgr = cache.New(ctx.ImageStore, keyvalue.MockStore{}, nil)
+	require.NoError(cacheMgr.ImportImage(imageClient, "latest"))
+
+	pair, err := cacheMgr.PullCache("cacheid1")
+	require.NoError(err)
+	require.Equal(inImage, pair.GzipDescriptor.Digest)
+	_, err = cacheMgr.PullCache("cacheid2")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+	pair, err = cacheMgr.PullCache("cacheid3")
+	require.NoError(err)
+	require.Nil(pair)
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 
 	"github.com/pkg/errors"
@@ -33,17 +34,25 @@ import (
 
 const _cachePrefix = "makisu_builder_cache_"
 const _cacheEmptyEntry = "MAKISU_CACHE_EMPTY"
+const _outputPrefix = "makisu_builder_output_"
 
 // Manager is the interface through which we interact with the cacheID -> image layer mapping.
+// The output of the command of a step can also be stored with its cache ID.
 type Manager interface {
 	PullCache(cacheID string) (*image.DigestPair, error)
 	PushCache(cacheID string, digestPair *image.DigestPair) error
+	PullOutput(cacheID string) (string, error)
+	PushOutput(cacheID string, output string) error
 	WaitForPush() error
+	ImportImage(client registry.Client, tag string) error
+	ExportImage(client registry.Client, tag string) error
+	InlineCache(layers []image.Digest) (string, error)
+	Stats() Stats
 }
 
 // noopCacheManager is an implementation of the cache.Manager interface.
-// The PullCache implementation returns errors.Wrap(ErrorLayerNotFound), and the other methods are
-// noops.
+// The PullCache implementation returns errors.Wrap(ErrorLayerNotFound), the cache image methods
+// return an error, and the other methods are noops.
 type noopCacheManager struct{}
 
 // NewNoopCacheManager returns a Manager that does nothing.
@@ -57,10 +66,34 @@ func (manager noopCacheManager) PushCache(cacheID string, digestPair *image.Dige
 	return nil
 }
 
+func (manager noopCacheManager) PullOutput(cacheID string) (string, error) {
+	return "", nil
+}
+
+func (manager noopCacheManager) PushOutput(cacheID string, output string) error {
+	return nil
+}
+
 func (manager noopCacheManager) WaitForPush() error {
 	return nil
 }
 
+func (manager noopCacheManager) ImportImage(client registry.Client, tag string) error {
+	return fmt.Errorf("no cache store configured")
+}
+
+func (manager noopCacheManager) ExportImage(client registry.Client, tag string) error {
+	return fmt.Errorf("no cache store configured")
+}
+
+func (manager noopCacheManager) InlineCache(layers []image.Digest) (string, error) {
+	return "", fmt.Errorf("no cache store configured")
+}
+
+func (manager noopCacheManager) Stats() Stats {
+	return Stats{}
+}
+
 // registryCacheManager uses a docker registry as cache layer storage.
 // It needs an additional key-value store for cache key/layer name lookup.
 // It implements CacheManager interface.
@@ -81,10 +114,35 @@ type registryCacheManager struct {
 	// the following stage.
 	memKVStore map[string]string
 
+	// layerPulls are the layers being pulled from the registry, so layers
+	// needed by several stages pulling cache concurrently are pulled once.
+	layerPulls map[image.Digest]*layerPull
+
+	// importedKVStore stores the cache key-value pairs of the imported cache
+	// images, and importedLayers the clients of the registries their layers
+	// can be pulled from.
+	importedKVStore map[string]string
+	importedLayers  map[image.Digest]registry.Client
+
+	// usedKVStore stores the cache key-value pairs pulled or pushed by this
+	// build, which are exported to cache images.
+	usedKVStore map[string]string
+
+	// stats counts the hits and misses of PullCache.
+	stats Stats
+
 	// registryClient is the client for docker registry.
 	registryClient registry.Client
 }
 
+// layerPull is the pull of a layer from the registry. done is closed once it
+// finished.
+type layerPull struct {
+	done chan struct{}
+	info os.FileInfo
+	err  error
+}
+
 var (
 	// ErrorLayerNotFound is the error returned by Lookup when the layer
 	// requested was not found in the registry.
@@ -103,45 +161,48 @@ func New(
 		return noopCacheManager{}
 	}
 	return &registryCacheManager{
-		imageStore:     imageStore,
-		kvStore:        kvStore,
-		memKVStore:     make(map[string]string),
-		registryClient: registryClient,
+		imageStore:      imageStore,
+		kvStore:         kvStore,
+		memKVStore:      make(map[string]string),
+		layerPulls:      make(map[image.Digest]*layerPull),
+		importedKVStore: make(map[string]string),
+		importedLayers:  make(map[image.Digest]registry.Client),
+		usedKVStore:     make(map[string]string),
+		registryClient:  registryClient,
 	}
 }
 
 // PullCache tries to fetch the layer corresponding to the cache ID.
 // If the layer is not found, it returns ErrorLayerNotFound.
-// This function is blocking.
+// This function is blocking, but the layers of different cache IDs can be
+// pulled concurrently.
 func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPair, error) {
+	digestPair, err := manager.pullCache(cacheID)
+
 	manager.Lock()
 	defer manager.Unlock()
-
-	var entry string
-	var err error
-	key := _cachePrefix + cacheID
-	entry, ok := manager.memKVStore[key]
-	if ok {
-		log.Infof("Found mapping in cacheID mem kv store: %s => %s", cacheID, entry)
+	if err != nil {
+		manager.stats.Misses++
 	} else {
-		for i := 0; ; i++ {
-			entry, err = manager.kvStore.Get(key)
-			if err == nil && entry != "" {
-				break
-			} else if entry == "" {
-				return nil, errors.Wrapf(ErrorLayerNotFound, "find layer %s", cacheID)
-			} else {
-				if i >= 2 {
-					return nil, fmt.Errorf("query cache id %s: %s", cacheID, err)
-				}
-				log.Info("Retrying query for cacheID %s", cacheID)
-				time.Sleep(time.Second)
-			}
-		}
-		log.Infof("Found mapping in cacheID kv store: %s => %s", cacheID, entry)
+		manager.stats.Hits++
 	}
+	return digestPair, err
+}
+
+// Stats returns the hits and misses of PullCache so far.
+func (manager *registryCacheManager) Stats() Stats {
+	manager.Lock()
+	defer manager.Unlock()
+
+	return manager.stats
+}
 
-	if entry == _cacheEmptyEntry {
+func (manager *registryCacheManager) pullCache(cacheID string) (*image.DigestPair, error) {
+	entry, err := manager.lookupEntry(cacheID)
+	if err != nil {
+		return nil, err
+	} else if entry == _cacheEmptyEntry {
+		manager.recordUsed(_cachePrefix+cacheID, entry)
 		return nil, nil
 	}
 
@@ -151,20 +212,22 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	}
 
 	// Check if layer is already on disk.
-	info, err := manager.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+	info, err := manager.statLocalLayer(gzipDigest)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("stat layer %s: %s", entry, err)
 	} else if os.IsNotExist(err) {
-		if manager.registryClient == nil {
+		client := manager.layerClient(gzipDigest)
+		if client == nil {
 			return nil, fmt.Errorf("registry client not configured to pull cache")
 		}
 
 		// Pull layer from docker registry.
-		info, err = manager.registryClient.PullLayer(gzipDigest)
+		info, err = manager.pullLayer(client, gzipDigest)
 		if err != nil {
 			return nil, fmt.Errorf("pull layer %s: %s", entry, err)
 		}
 	}
+	manager.recordUsed(_cachePrefix+cacheID, entry)
 
 	// Info might be nil if the registry client is a test fixture.
 	var size int64
@@ -174,13 +237,130 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	return &image.DigestPair{
 		TarDigest: tarDigest,
 		GzipDescriptor: image.Descriptor{
-			MediaType: image.MediaTypeLayer,
+			MediaType: tario.LayerMediaType(),
 			Size:      size,
 			Digest:    gzipDigest,
 		},
 	}, nil
 }
 
+// lookupEntry returns the entry stored with the cache ID, in memory or in the
+// kv store. The lock is only held to read the in-memory maps, so lookups of
+// different cache IDs don't wait on each other's kv store queries.
+func (manager *registryCacheManager) lookupEntry(cacheID string) (string, error) {
+	key := _cachePrefix + cacheID
+	if entry, ok := manager.memEntry(manager.memKVStore, key); ok {
+		log.Infof("Found mapping in cacheID mem kv store: %s => %s", cacheID, entry)
+		return entry, nil
+	}
+
+	var entry string
+	var err error
+	for i := 0; ; i++ {
+		entry, err = manager.kvStore.Get(key)
+		if err == nil && entry != "" {
+			break
+		} else if entry == "" {
+			if entry, ok := manager.memEntry(manager.importedKVStore, key); ok {
+				log.Infof("Found mapping in cacheID imported kv store: %s => %s", cacheID, entry)
+				return entry, nil
+			}
+			return "", errors.Wrapf(ErrorLayerNotFound, "find layer %s", cacheID)
+		} else {
+			if i >= 2 {
+				return "", fmt.Errorf("query cache id %s: %s", cacheID, err)
+			}
+			log.Info("Retrying query for cacheID %s", cacheID)
+			time.Sleep(time.Second)
+		}
+	}
+	log.Infof("Found mapping in cacheID kv store: %s => %s", cacheID, entry)
+	return entry, nil
+}
+
+// memEntry returns the entry of the key in one of the in-memory kv stores.
+func (manager *registryCacheManager) memEntry(store map[string]string, key string) (string, bool) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	entry, ok := store[key]
+	return entry, ok
+}
+
+// layerClient returns the client of the registry to pull a layer from: the one
+// of the cache image it was imported from if any, the default one otherwise.
+func (manager *registryCacheManager) layerClient(digest image.Digest) registry.Client {
+	manager.Lock()
+	defer manager.Unlock()
+
+	if client, ok := manager.importedLayers[digest]; ok {
+		return client
+	}
+	return manager.registryClient
+}
+
+// recordUsed records a cache key-value pair used by this build, to export it
+// to cache images.
+func (manager *registryCacheManager) recordUsed(key, entry string) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.usedKVStore[key] = entry
+}
+
+// pullLayer pulls the layer from the registry, or waits for it if it's already
+// being pulled.
+func (manager *registryCacheManager) pullLayer(
+	client registry.Client, digest image.Digest) (os.FileInfo, error) {
+
+	manager.Lock()
+	pull, ok := manager.layerPulls[digest]
+	if !ok {
+		pull = &layerPull{done: make(chan struct{})}
+		manager.layerPulls[digest] = pull
+	}
+	manager.Unlock()
+	if ok {
+		<-pull.done
+		return pull.info, pull.err
+	}
+
+	pull.info, pull.err = client.PullLayer(digest)
+	manager.Lock()
+	delete(manager.layerPulls, digest)
+	manager.Unlock()
+	close(pull.done)
+	return pull.info, pull.err
+}
+
+// statLocalLayer returns the FileInfo of a layer in the image store, or an
+// error satisfying os.IsNotExist if it's not there. Layers that don't match
+// their digest, e.g. truncated by an interrupted build, are removed so they
+// can be pulled again.
+func (manager *registryCacheManager) statLocalLayer(digest image.Digest) (os.FileInfo, error) {
+	info, err := manager.imageStore.Layers.GetStoreFileStat(digest.Hex())
+	if err != nil {
+		return nil, err
+	}
+	r, err := manager.imageStore.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get layer reader %s: %s", digest.Hex(), err)
+	}
+	defer r.Close()
+	actual, err := image.NewDigester().FromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("hash layer %s: %s", digest.Hex(), err)
+	} else if actual == digest {
+		return info, nil
+	}
+
+	log.Warnf("Removing corrupted cache layer %s, its digest is %s", digest.Hex(), actual.Hex())
+	if err := manager.imageStore.Layers.DeleteStoreFile(digest.Hex()); err != nil {
+		return nil, fmt.Errorf("delete corrupted layer %s: %s", digest.Hex(), err)
+	}
+	return nil, os.ErrNotExist
+}
+
 // PushCache tries to push an image layer asynchronously.
 func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image.DigestPair) error {
 	manager.Lock()
@@ -189,6 +369,7 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 	key := _cachePrefix + cacheID
 	entry := createEntry(digestPair)
 	manager.memKVStore[key] = entry
+	manager.usedKVStore[key] = entry
 
 	if manager.registryClient == nil {
 		manager.pushErrors.Add(fmt.Errorf("registry client not configured to push cache"))
@@ -221,6 +402,51 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 	return nil
 }
 
+// PullOutput returns the command output stored with the cache ID, or an empty
+// string if there is none.
+func (manager *registryCacheManager) PullOutput(cacheID string) (string, error) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	key := _outputPrefix + cacheID
+	if output, ok := manager.memKVStore[key]; ok {
+		return output, nil
+	}
+	output, err := manager.kvStore.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("query output of cache id %s: %s", cacheID, err)
+	} else if output == "" {
+		output = manager.importedKVStore[key]
+	}
+	if output != "" {
+		manager.usedKVStore[key] = output
+	}
+	return output, nil
+}
+
+// PushOutput stores command output with the cache ID asynchronously.
+func (manager *registryCacheManager) PushOutput(cacheID string, output string) error {
+	manager.Lock()
+	defer manager.Unlock()
+
+	key := _outputPrefix + cacheID
+	manager.memKVStore[key] = output
+	manager.usedKVStore[key] = output
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+
+		manager.Lock()
+		defer manager.Unlock()
+
+		if err := manager.kvStore.Put(key, output); err != nil {
+			manager.pushErrors.Add(fmt.Errorf("store output of cache id %s: %s", cacheID, err))
+		}
+	}()
+	return nil
+}
+
 // WaitForPush blocks until all cache pushes are done or timeout.
 func (manager *registryCacheManager) WaitForPush() error {
 	c := make(chan struct{})
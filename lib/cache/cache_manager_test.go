@@ -15,6 +15,9 @@
 package cache_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
 
@@ -78,6 +81,7 @@ func TestCachePushAndPull(t *testing.T) {
 
 	_, err = cacheMgr.PullCache("cacheid2")
 	require.NoError(err)
+	require.Equal(cache.Stats{Hits: 1, Misses: 1}, cacheMgr.Stats())
 }
 
 func TestCachePullWithOngoingPushing(t *testing.T) {
@@ -122,3 +126,53 @@ func TestCachePullWithOngoingPushing(t *testing.T) {
 	_, err = cacheMgr.PullCache("cacheid2")
 	require.NoError(err)
 }
+
+func TestCachePullCorruptedLocalLayer(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	content := []byte("layer content")
+	gzipDigest, err := image.NewDigester().FromBytes(content)
+	require.NoError(err)
+	pair := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}
+	writeLayer := func(b []byte) {
+		f, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layer")
+		require.NoError(err)
+		defer os.Remove(f.Name())
+		_, err = f.Write(b)
+		require.NoError(err)
+		require.NoError(f.Close())
+		require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(gzipDigest.Hex(), f.Name()))
+	}
+
+	kvStore := keyvalue.MockStore{}
+	mockClient := mockregistry.NewMockClient(ctrl)
+	mockClient.EXPECT().PushLayer(gzipDigest).Return(nil)
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, mockClient)
+	require.NoError(cacheMgr.PushCache("cacheid", pair))
+	require.NoError(cacheMgr.WaitForPush())
+
+	// Intact local layer is used as is.
+	writeLayer(content)
+	result, err := cache.New(ctx.ImageStore, kvStore, mockClient).PullCache("cacheid")
+	require.NoError(err)
+	require.Equal(int64(len(content)), result.GzipDescriptor.Size)
+
+	// Truncated local layer is removed and pulled again.
+	require.NoError(ctx.ImageStore.Layers.DeleteStoreFile(gzipDigest.Hex()))
+	writeLayer(content[:5])
+	mockClient.EXPECT().PullLayer(gzipDigest).Return(nil, fmt.Errorf("digest mismatch"))
+	_, err = cache.New(ctx.ImageStore, kvStore, mockClient).PullCache("cacheid")
+	require.Error(err)
+	require.NotEqual(cache.ErrorLayerNotFound, errors.Cause(err))
+	_, err = ctx.ImageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+	require.True(os.IsNotExist(err))
+}
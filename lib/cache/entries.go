@@ -0,0 +1,115 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// Entry is the cache entry of a step in a key-value store.
+type Entry struct {
+	// Namespace is the namespace of the entry's keys, see
+	// keyvalue.NewNamespaceStore. It is empty for keys without namespace.
+	Namespace string
+	CacheID   string
+	// Layer is the digest of the gzipped layer of the step, empty if the step
+	// didn't create a layer or the entry can't be parsed.
+	Layer image.Digest
+	// Value is the value stored with the cache ID.
+	Value string
+	// Output is the command output stored with the cache ID, if any.
+	Output string
+}
+
+// ListEntries returns the cache entries of the store in all namespaces, sorted
+// by namespace and cache ID. The store must implement keyvalue.Lister.
+func ListEntries(store keyvalue.Store) ([]Entry, error) {
+	lister, ok := store.(keyvalue.Lister)
+	if !ok {
+		return nil, keyvalue.ErrNotSupported
+	}
+	// Namespaced keys don't start with the cache prefix, so all keys are
+	// listed.
+	keys, err := lister.List("")
+	if err != nil {
+		return nil, fmt.Errorf("list cache keys: %s", err)
+	}
+
+	var entries []Entry
+	for _, key := range keys {
+		i := strings.LastIndex(key, _cachePrefix)
+		if i < 0 || (i > 0 && key[i-1] != '/') {
+			continue
+		}
+		namespace := strings.TrimSuffix(key[:i], "/")
+		entry, err := GetEntry(
+			keyvalue.NewNamespaceStore(store, namespace), key[i+len(_cachePrefix):])
+		if err != nil {
+			return nil, err
+		} else if entry != nil {
+			entry.Namespace = namespace
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].CacheID < entries[j].CacheID
+	})
+	return entries, nil
+}
+
+// GetEntry returns the cache entry of the cache ID in the store, or nil if
+// there is none.
+func GetEntry(store keyvalue.Store, cacheID string) (*Entry, error) {
+	value, err := store.Get(_cachePrefix + cacheID)
+	if err != nil {
+		return nil, fmt.Errorf("get cache id %s: %s", cacheID, err)
+	} else if value == "" {
+		return nil, nil
+	}
+	entry := &Entry{CacheID: cacheID, Value: value}
+	if value != _cacheEmptyEntry {
+		if _, gzipDigest, err := parseEntry(value); err == nil {
+			entry.Layer = gzipDigest
+		}
+	}
+	if entry.Output, err = store.Get(_outputPrefix + cacheID); err != nil {
+		return nil, fmt.Errorf("get output of cache id %s: %s", cacheID, err)
+	}
+	return entry, nil
+}
+
+// DeleteEntry deletes the cache entry of the cache ID and its command output
+// from the store. The store must implement keyvalue.Deleter. Entries of a
+// namespace are deleted through keyvalue.NewNamespaceStore.
+func DeleteEntry(store keyvalue.Store, cacheID string) error {
+	deleter, ok := store.(keyvalue.Deleter)
+	if !ok {
+		return keyvalue.ErrNotSupported
+	}
+	for _, key := range []string{_cachePrefix + cacheID, _outputPrefix + cacheID} {
+		if err := deleter.Delete(key); err != nil {
+			return fmt.Errorf("delete cache key %s: %s", key, err)
+		}
+	}
+	return nil
+}
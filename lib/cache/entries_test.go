@@ -0,0 +1,105 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEntries(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	kvStore := keyvalue.MockStore{"unrelated": "value"}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+	require.NoError(cacheMgr.PushCache("cacheid1", &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:testgzip")},
+	}))
+	require.NoError(cacheMgr.PushOutput("cacheid1", "output"))
+	require.NoError(cacheMgr.PushCache("cacheid2", nil))
+	require.NoError(cacheMgr.WaitForPush())
+
+	entries, err := cache.ListEntries(kvStore)
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.Equal("cacheid1", entries[0].CacheID)
+	require.Equal(image.Digest("sha256:testgzip"), entries[0].Layer)
+	require.Equal("output", entries[0].Output)
+	require.Equal("cacheid2", entries[1].CacheID)
+	require.Equal(image.Digest(""), entries[1].Layer)
+
+	entry, err := cache.GetEntry(kvStore, "cacheid1")
+	require.NoError(err)
+	require.Equal(entries[0], *entry)
+	entry, err = cache.GetEntry(kvStore, "cacheid3")
+	require.NoError(err)
+	require.Nil(entry)
+
+	require.NoError(cache.DeleteEntry(kvStore, "cacheid1"))
+	entries, err = cache.ListEntries(kvStore)
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal("cacheid2", entries[0].CacheID)
+	require.Len(kvStore, 2)
+
+	_, err = cache.ListEntries(keyvalue.NewFailOpenStore(kvStore))
+	require.Equal(keyvalue.ErrNotSupported, err)
+}
+
+func TestCacheEntriesNamespaces(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	kvStore := keyvalue.MockStore{}
+	for _, namespace := range []string{"", "main", "feature/x"} {
+		cacheMgr := cache.New(
+			ctx.ImageStore, keyvalue.NewNamespaceStore(kvStore, namespace), registry.NoopClientFixture())
+		require.NoError(cacheMgr.PushCache("cacheid", nil))
+		require.NoError(cacheMgr.WaitForPush())
+	}
+
+	entries, err := cache.ListEntries(kvStore)
+	require.NoError(err)
+	require.Len(entries, 3)
+	for i, namespace := range []string{"", "feature/x", "main"} {
+		require.Equal(namespace, entries[i].Namespace)
+		require.Equal("cacheid", entries[i].CacheID)
+	}
+
+	main := keyvalue.NewNamespaceStore(kvStore, "main")
+	entries, err = cache.ListEntries(main)
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal("", entries[0].Namespace)
+
+	require.NoError(cache.DeleteEntry(main, "cacheid"))
+	entries, err = cache.ListEntries(kvStore)
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.Equal("feature/x", entries[1].Namespace)
+}
@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils/gitutil"
+)
+
+// GitNamespace returns a cache namespace derived from the git repo containing
+// dir. Attribute "branch" uses the current branch; any other attribute is read
+// as a git config value, e.g. "makisu.cachenamespace".
+// It returns an empty namespace with a warning if dir isn't in a git repo, or
+// if the attribute isn't set.
+func GitNamespace(dir, attr string) string {
+	if _, err := gitutil.Run(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		log.Warnf("Not using git cache namespace, %s is not in a git repo: %s", dir, err)
+		return ""
+	}
+
+	var namespace string
+	var err error
+	if attr == "branch" {
+		namespace, err = gitutil.Run(dir, "rev-parse", "--abbrev-ref", "HEAD")
+		if err == nil && namespace == "HEAD" {
+			err = fmt.Errorf("HEAD is detached")
+		}
+	} else {
+		namespace, err = gitutil.Run(dir, "config", "--get", attr)
+	}
+	if err != nil || namespace == "" {
+		log.Warnf("Not using git cache namespace, failed to read %s: %v", attr, err)
+		return ""
+	}
+	log.Infof("Using cache namespace %s from git %s", namespace, attr)
+	return namespace
+}
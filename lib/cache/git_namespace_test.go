@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitNamespace(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", ctx.ContextDir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(err, string(out))
+	}
+
+	// Not a git repo yet.
+	require.Empty(cache.GitNamespace(ctx.ContextDir, "branch"))
+
+	git("init", "-q")
+	git("-c", "user.name=test", "-c", "user.email=test@test", "commit", "-q", "--allow-empty", "-m", "init")
+	git("checkout", "-q", "-b", "main")
+	mainNamespace := cache.GitNamespace(ctx.ContextDir, "branch")
+	require.Equal("main", mainNamespace)
+	git("checkout", "-q", "-b", "feature/x")
+	featureNamespace := cache.GitNamespace(ctx.ContextDir, "branch")
+	require.Equal("feature/x", featureNamespace)
+
+	require.Empty(cache.GitNamespace(ctx.ContextDir, "makisu.cachenamespace"))
+	git("config", "makisu.cachenamespace", "team-a")
+	require.Equal("team-a", cache.GitNamespace(ctx.ContextDir, "makisu.cachenamespace"))
+
+	// Entries pushed on one branch are not found on the other.
+	kvStore := keyvalue.MockStore{}
+	mainCache := cache.New(
+		ctx.ImageStore, keyvalue.NewNamespaceStore(kvStore, mainNamespace), registry.NoopClientFixture())
+	featureCache := cache.New(
+		ctx.ImageStore, keyvalue.NewNamespaceStore(kvStore, featureNamespace), registry.NoopClientFixture())
+
+	require.NoError(featureCache.PushCache("cacheid1", &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:testgzip")},
+	}))
+	require.NoError(featureCache.WaitForPush())
+
+	_, err := featureCache.PullCache("cacheid1")
+	require.NoError(err)
+	_, err = mainCache.PullCache("cacheid1")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+}
@@ -0,0 +1,132 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// _healthCheckKey is read from remote stores to check they are reachable.
+const _healthCheckKey = "makisu_health_check"
+
+// Connect creates a store with newStore and checks that it answers a Get
+// within timeout. If it doesn't, Connect fails unless failOpen is set, in
+// which case it warns and returns the store created by fallback instead, or
+// nil to build without cache. Under failOpen, errors of the connected store are
+// treated as cache misses for the rest of the build.
+func Connect(
+	newStore, fallback func() (Store, error), timeout time.Duration,
+	failOpen bool) (Store, error) {
+
+	store, err := checkHealth(newStore, timeout)
+	if err == nil {
+		if failOpen {
+			return NewFailOpenStore(store), nil
+		}
+		return store, nil
+	} else if !failOpen {
+		return nil, fmt.Errorf("cache store health check: %s", err)
+	}
+
+	if fallback == nil {
+		log.Warnf("Cache store health check failed, building without cache: %s", err)
+		return nil, nil
+	}
+	log.Warnf("Cache store health check failed, falling back to local cache: %s", err)
+	store, err = fallback()
+	if err != nil {
+		log.Warnf("Failed to init local cache store, building without cache: %s", err)
+		return nil, nil
+	}
+	return store, nil
+}
+
+// checkHealth returns the store created by newStore, if it can be created and
+// answers a Get within timeout. Stores that fail the check are cleaned up,
+// including the ones created after the timeout.
+func checkHealth(newStore func() (Store, error), timeout time.Duration) (Store, error) {
+	type result struct {
+		store Store
+		err   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		store, err := newStore()
+		if err == nil {
+			if _, err = store.Get(_healthCheckKey); err != nil {
+				cleanupStore(store)
+				store = nil
+			}
+		}
+		c <- result{store, err}
+	}()
+	select {
+	case r := <-c:
+		return r.store, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-c; r.store != nil {
+				cleanupStore(r.store)
+			}
+		}()
+		return nil, fmt.Errorf("no response after %s", timeout)
+	}
+}
+
+// cleanupStore cleans up a store that won't be used, and only warns if that
+// fails.
+func cleanupStore(store Store) {
+	if err := store.Cleanup(); err != nil {
+		log.Warnf("Failed to clean up cache store: %s", err)
+	}
+}
+
+// failOpenStore logs errors of the underlying store instead of failing, so an
+// unavailable store only disables caching.
+type failOpenStore struct {
+	store Store
+}
+
+// NewFailOpenStore returns a Store that treats failed Gets of the given store
+// as cache misses and ignores failed Puts.
+func NewFailOpenStore(store Store) Store {
+	return &failOpenStore{store}
+}
+
+// Get returns the value of the key, or an empty string if it can't be read.
+func (s *failOpenStore) Get(key string) (string, error) {
+	value, err := s.store.Get(key)
+	if err != nil {
+		log.Warnf("Failed to read cache key %s, treating as miss: %s", key, err)
+		return "", nil
+	}
+	return value, nil
+}
+
+// Put stores the value under the key, and only warns if that fails.
+func (s *failOpenStore) Put(key, value string) error {
+	if err := s.store.Put(key, value); err != nil {
+		log.Warnf("Failed to store cache key %s: %s", key, err)
+	}
+	return nil
+}
+
+// Cleanup cleans up the underlying store.
+func (s *failOpenStore) Cleanup() error {
+	return s.store.Cleanup()
+}
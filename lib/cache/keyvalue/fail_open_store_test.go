@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type brokenStore struct{}
+
+func (brokenStore) Get(string) (string, error) { return "", errors.New("connection refused") }
+func (brokenStore) Put(string, string) error   { return errors.New("connection refused") }
+func (brokenStore) Cleanup() error             { return nil }
+
+type trackedStore struct {
+	MockStore
+	cleaned chan struct{}
+}
+
+func (s *trackedStore) Cleanup() error {
+	close(s.cleaned)
+	return nil
+}
+
+func TestConnect(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	newDeadStore := func() (Store, error) { return NewHTTPStore(server.URL) }
+	newLocalStore := func() (Store, error) { return MockStore{}, nil }
+
+	t.Run("healthy", func(t *testing.T) {
+		require := require.New(t)
+		store, err := Connect(newLocalStore, nil, time.Second, false)
+		require.NoError(err)
+		require.Equal(MockStore{}, store)
+
+		store, err = Connect(newLocalStore, nil, time.Second, true)
+		require.NoError(err)
+		require.IsType(&failOpenStore{}, store)
+	})
+
+	t.Run("fail_closed", func(t *testing.T) {
+		require := require.New(t)
+		_, err := Connect(newDeadStore, newLocalStore, time.Second, false)
+		require.Error(err)
+	})
+
+	t.Run("fail_open", func(t *testing.T) {
+		require := require.New(t)
+		store, err := Connect(newDeadStore, newLocalStore, time.Second, true)
+		require.NoError(err)
+		require.Equal(MockStore{}, store)
+
+		store, err = Connect(newDeadStore, nil, time.Second, true)
+		require.NoError(err)
+		require.Nil(store)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		require := require.New(t)
+		cleaned := make(chan struct{})
+		newSlowStore := func() (Store, error) {
+			time.Sleep(100 * time.Millisecond)
+			return &trackedStore{cleaned: cleaned}, nil
+		}
+		_, err := Connect(newSlowStore, nil, 10*time.Millisecond, false)
+		require.Error(err)
+
+		// The store created after the timeout is cleaned up.
+		select {
+		case <-cleaned:
+		case <-time.After(time.Second):
+			require.FailNow("store created after timeout was not cleaned up")
+		}
+	})
+}
+
+func TestFailOpenStore(t *testing.T) {
+	require := require.New(t)
+
+	store := NewFailOpenStore(brokenStore{})
+	require.NoError(store.Put("k", "v"))
+	v, err := store.Get("k")
+	require.NoError(err)
+	require.Equal("", v)
+}
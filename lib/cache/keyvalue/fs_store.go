@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,7 +40,8 @@ type fsStore struct {
 }
 
 // NewFSStore returns a Store backed by the local filesystem.
-// Entries are stored in json format.
+// Entries are stored in json format, and expire if they were not used for ttl.
+// A ttl of 0 means no expiry.
 // TODO: enforce capacity.
 func NewFSStore(fullpath string, sandboxDir string, ttl time.Duration) (Store, error) {
 	s := &fsStore{
@@ -62,8 +64,10 @@ func NewFSStore(fullpath string, sandboxDir string, ttl time.Duration) (Store, e
 		return s, nil
 	}
 
-	// Remove entries that's older than TTL.
-
+	// Remove entries that's older than TTL. A TTL of 0 means no expiry.
+	if s.ttl <= 0 {
+		return s, nil
+	}
 	for key, entry := range s.entries {
 		if time.Since(time.Unix(entry.Timestamp, 0)) > s.ttl {
 			// Cache expired.
@@ -98,7 +102,12 @@ func (s *fsStore) Put(key, value string) error {
 	}
 
 	s.entries[key] = entry
+	return s.save()
+}
 
+// save writes the entries to the cache id file. It must be called with the
+// lock held.
+func (s *fsStore) save() error {
 	content, err := json.Marshal(s.entries)
 	if err != nil {
 		return fmt.Errorf("marshal cache id file: %s", err)
@@ -120,6 +129,32 @@ func (s *fsStore) Put(key, value string) error {
 	return nil
 }
 
+// List returns the keys starting with prefix.
+func (s *fsStore) List(prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var keys []string
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes the key and saves the remaining entries.
+func (s *fsStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.save()
+}
+
 func (s *fsStore) Cleanup() error {
 	s.Lock()
 	defer s.Unlock()
@@ -65,4 +65,61 @@ func TestFSStore(t *testing.T) {
 		require.NoError(err)
 		require.Equal("b", value)
 	})
+
+	t.Run("ttl", func(t *testing.T) {
+		require := require.New(t)
+
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		require.NoError(err)
+		defer os.RemoveAll(tempDir)
+		tempFile, err := ioutil.TempFile(tempDir, "cache")
+		require.NoError(err)
+
+		store, err := NewFSStore(tempFile.Name(), tempDir, time.Minute)
+		require.NoError(err)
+		require.NoError(store.Put("a", "b"))
+
+		// A ttl of 0 keeps all entries.
+		store, err = NewFSStore(tempFile.Name(), tempDir, 0)
+		require.NoError(err)
+		value, err := store.Get("a")
+		require.NoError(err)
+		require.Equal("b", value)
+
+		store, err = NewFSStore(tempFile.Name(), tempDir, time.Nanosecond)
+		require.NoError(err)
+		value, err = store.Get("a")
+		require.NoError(err)
+		require.Equal("", value)
+	})
+
+	t.Run("list_delete", func(t *testing.T) {
+		require := require.New(t)
+
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		require.NoError(err)
+		defer os.RemoveAll(tempDir)
+		tempFile, err := ioutil.TempFile(tempDir, "cache")
+		require.NoError(err)
+
+		store, err := NewFSStore(tempFile.Name(), tempDir, time.Minute)
+		require.NoError(err)
+		require.NoError(store.Put("a1", "b"))
+		require.NoError(store.Put("a2", "b"))
+		require.NoError(store.Put("c", "d"))
+
+		keys, err := store.(Lister).List("a")
+		require.NoError(err)
+		require.ElementsMatch([]string{"a1", "a2"}, keys)
+
+		require.NoError(store.(Deleter).Delete("a1"))
+		require.NoError(store.(Deleter).Delete("missing"))
+
+		// Deletions are saved.
+		store, err = NewFSStore(tempFile.Name(), tempDir, time.Minute)
+		require.NoError(err)
+		keys, err = store.(Lister).List("")
+		require.NoError(err)
+		require.ElementsMatch([]string{"a2", "c"}, keys)
+	})
 }
@@ -0,0 +1,119 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	_gcsAddress = "https://storage.googleapis.com"
+	_gcsScope   = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	// _gcsExpiresHeader is the custom metadata of objects holding the time
+	// they expire at.
+	_gcsExpiresHeader = "x-goog-meta-makisu-expires"
+)
+
+type gcsStore struct {
+	address string
+	bucket  string
+	prefix  string
+	ttl     time.Duration
+	client  *http.Client
+}
+
+// NewGCSStore returns a new instance of Store backed by a Google Cloud Storage
+// bucket, with one object per key under the given prefix. Requests are
+// authenticated with the Application Default Credentials, e.g. the service
+// account of the GKE node or workload.
+// The expiration time of objects is stored in their custom metadata, and
+// expired objects are treated as missing if ttl is positive. A lifecycle rule
+// of the bucket should delete them eventually.
+func NewGCSStore(bucket, prefix string, ttl time.Duration) (Store, error) {
+	client, err := google.DefaultClient(context.Background(), _gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("find default credentials: %s", err)
+	}
+	return &gcsStore{
+		address: _gcsAddress,
+		bucket:  bucket,
+		prefix:  prefix,
+		ttl:     ttl,
+		client:  client,
+	}, nil
+}
+
+func (store *gcsStore) Get(key string) (string, error) {
+	resp, err := store.client.Get(store.objectURL(key))
+	if err != nil {
+		return "", fmt.Errorf("gcs get key: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status code from gcs: %d", resp.StatusCode)
+	}
+	if expires := resp.Header.Get(_gcsExpiresHeader); expires != "" && store.ttl > 0 {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return "", fmt.Errorf("parse expiration time %s: %s", expires, err)
+		} else if time.Now().After(t) {
+			return "", nil
+		}
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("gcs read key: %s", err)
+	}
+	return string(content), nil
+}
+
+func (store *gcsStore) Put(key, value string) error {
+	req, err := http.NewRequest("PUT", store.objectURL(key), strings.NewReader(value))
+	if err != nil {
+		return fmt.Errorf("failed to create gcs request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if store.ttl > 0 {
+		req.Header.Set(_gcsExpiresHeader, time.Now().Add(store.ttl).UTC().Format(time.RFC3339))
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gcs put key: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code from gcs: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (store *gcsStore) Cleanup() error { return nil }
+
+// objectURL returns the XML API URL of the object of the key.
+func (store *gcsStore) objectURL(key string) string {
+	u := url.URL{Path: "/" + store.bucket + "/" + store.prefix + key}
+	return store.address + u.EscapedPath()
+}
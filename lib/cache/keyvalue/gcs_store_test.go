@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCSStore(t *testing.T) {
+	require := require.New(t)
+
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	expires := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			value, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set(_gcsExpiresHeader, expires[r.URL.Path])
+			w.Write([]byte(value))
+		case "PUT":
+			b, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = string(b)
+			expires[r.URL.Path] = r.Header.Get(_gcsExpiresHeader)
+		}
+	}))
+	defer server.Close()
+
+	store := &gcsStore{
+		address: server.URL,
+		bucket:  "bucket",
+		prefix:  "makisu/",
+		ttl:     time.Hour,
+		client:  http.DefaultClient,
+	}
+
+	val, err := store.Get("k")
+	require.NoError(err)
+	require.Equal("", val)
+
+	require.NoError(store.Put("k", "v"))
+	require.Equal("v", objects["/bucket/makisu/k"])
+	val, err = store.Get("k")
+	require.NoError(err)
+	require.Equal("v", val)
+
+	// Expired objects are missing.
+	expires["/bucket/makisu/k"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	val, err = store.Get("k")
+	require.NoError(err)
+	require.Equal("", val)
+}
@@ -1,16 +1,24 @@
 package keyvalue
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// HTTPTTLHeader is the header of PUT requests to the http cache server that
+// holds the Time-To-Live of the entry, in seconds.
+const HTTPTTLHeader = "Makisu-Cache-TTL"
+
 type httpStore struct {
 	address string
 	headers map[string]string
+	ttl     time.Duration
 	client  *http.Client
 }
 
@@ -20,18 +28,70 @@ type httpStore struct {
 // PUT <address>/key => 200 <= code < 300
 // The "headers" entries are of the form <header>:<value>.
 func NewHTTPStore(address string, headers ...string) (Store, error) {
+	return NewHTTPStoreWithTTL(address, 0, headers...)
+}
+
+// NewHTTPStoreWithTTL returns a new instance of Store backed by an http server,
+// like NewHTTPStore. If ttl is positive, PUT requests carry it in the
+// HTTPTTLHeader header, and the server should expire the entry after it.
+// Otherwise the header is omitted and the entry should never expire.
+func NewHTTPStoreWithTTL(address string, ttl time.Duration, headers ...string) (Store, error) {
+	return NewHTTPStoreWithOptions(HTTPOptions{Address: address, Headers: headers}, ttl)
+}
+
+// HTTPOptions configures the server of an http store and the authentication
+// of its requests.
+type HTTPOptions struct {
+	Address string
+
+	// Headers are of the form <header>:<value>.
+	Headers []string
+
+	// BearerToken is sent in the Authorization header. It is exclusive with
+	// Username and Password, sent with basic auth.
+	BearerToken string
+	Username    string
+	Password    string
+
+	// TLSConfig is used for https addresses, to verify the server with a
+	// custom CA or to send a client certificate.
+	TLSConfig *tls.Config
+}
+
+// NewHTTPStoreWithOptions returns a new instance of Store backed by an http
+// server, like NewHTTPStoreWithTTL.
+func NewHTTPStoreWithOptions(opts HTTPOptions, ttl time.Duration) (Store, error) {
 	headerMap := map[string]string{}
-	for _, tuple := range headers {
+	for _, tuple := range opts.Headers {
 		split := strings.SplitN(tuple, ":", 2)
 		if len(split) != 2 {
 			return nil, fmt.Errorf("Malformed http header: %s, format is <header>:<value>", tuple)
 		}
 		headerMap[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
 	}
+	if opts.BearerToken != "" && (opts.Username != "" || opts.Password != "") {
+		return nil, fmt.Errorf("http bearer token and basic auth are exclusive")
+	}
+	if opts.BearerToken != "" {
+		headerMap["Authorization"] = "Bearer " + opts.BearerToken
+	} else if opts.Username != "" || opts.Password != "" {
+		credentials := []byte(opts.Username + ":" + opts.Password)
+		headerMap["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString(credentials)
+	}
+	client := http.DefaultClient
+	if opts.TLSConfig != nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: opts.TLSConfig,
+			},
+		}
+	}
 	store := &httpStore{
-		address: address,
+		address: opts.Address,
 		headers: headerMap,
-		client:  http.DefaultClient,
+		ttl:     ttl,
+		client:  client,
 	}
 	return store, nil
 }
@@ -71,6 +131,9 @@ func (store *httpStore) Put(key, value string) error {
 		return fmt.Errorf("failed to create cache request: %s", err)
 	}
 	store.addHeaders(req)
+	if store.ttl > 0 {
+		req.Header.Set(HTTPTTLHeader, strconv.FormatInt(int64(store.ttl/time.Second), 10))
+	}
 
 	resp, err := store.client.Do(req)
 	if err != nil {
@@ -15,10 +15,14 @@
 package keyvalue
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/mocks/net/http"
 
@@ -79,4 +83,97 @@ func TestHTTPStore(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, "v", val)
 	})
+
+	t.Run("ttl", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var ttlHeaders []string
+		transport := mockhttp.NewMockRoundTripper(ctrl)
+		transport.EXPECT().RoundTrip(gomock.Any()).
+			DoAndReturn(func(req *http.Request) (*http.Response, error) {
+				ttlHeaders = append(ttlHeaders, req.Header.Get(HTTPTTLHeader))
+				return &http.Response{
+					Body:       ioutil.NopCloser(strings.NewReader("")),
+					StatusCode: http.StatusOK,
+				}, nil
+			}).Times(2)
+
+		store := &httpStore{
+			address: _testURL,
+			ttl:     time.Hour,
+			client:  &http.Client{Transport: transport},
+		}
+		require.NoError(t, store.Put("k", "v"))
+
+		// No header is sent for entries that never expire.
+		store.ttl = 0
+		require.NoError(t, store.Put("k", "v"))
+
+		require.Equal(t, []string{"3600", ""}, ttlHeaders)
+	})
+}
+
+func TestHTTPStoreAuth(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("v"))
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	tlsConfig := &tls.Config{RootCAs: pool}
+
+	t.Run("bearer_token", func(t *testing.T) {
+		require := require.New(t)
+
+		store, err := NewHTTPStoreWithOptions(HTTPOptions{
+			Address:     server.URL,
+			BearerToken: "token",
+			TLSConfig:   tlsConfig,
+		}, 0)
+		require.NoError(err)
+		val, err := store.Get("k")
+		require.NoError(err)
+		require.Equal("v", val)
+		require.Equal("Bearer token", authorization)
+	})
+
+	t.Run("basic_auth", func(t *testing.T) {
+		require := require.New(t)
+
+		store, err := NewHTTPStoreWithOptions(HTTPOptions{
+			Address:   server.URL,
+			Username:  "user",
+			Password:  "pass",
+			TLSConfig: tlsConfig,
+		}, 0)
+		require.NoError(err)
+		require.NoError(store.Put("k", "v"))
+		req := &http.Request{Header: http.Header{"Authorization": {authorization}}}
+		username, password, ok := req.BasicAuth()
+		require.True(ok)
+		require.Equal("user", username)
+		require.Equal("pass", password)
+	})
+
+	t.Run("untrusted_server", func(t *testing.T) {
+		require := require.New(t)
+
+		store, err := NewHTTPStoreWithOptions(HTTPOptions{Address: server.URL}, 0)
+		require.NoError(err)
+		_, err = store.Get("k")
+		require.Error(err)
+	})
+
+	t.Run("exclusive", func(t *testing.T) {
+		_, err := NewHTTPStoreWithOptions(HTTPOptions{
+			Address:     server.URL,
+			BearerToken: "token",
+			Username:    "user",
+		}, 0)
+		require.Error(t, err)
+	})
 }
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"strings"
+	"sync"
+)
+
+// memStore stores cache key-value pairs in memory, for the duration of a build.
+// Unlike MockStore, it is safe for concurrent use.
+type memStore struct {
+	sync.Mutex
+	entries map[string]string
+}
+
+// NewMemStore returns a Store that keeps key-value pairs in memory. It is used
+// when the cache is only shared through cache images.
+func NewMemStore() Store {
+	return &memStore{entries: make(map[string]string)}
+}
+
+// Get returns the value of a key previously set in memory.
+func (s *memStore) Get(key string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.entries[key], nil
+}
+
+// Put stores a key and its value in memory.
+func (s *memStore) Put(key, value string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.entries[key] = value
+	return nil
+}
+
+// List returns the keys in memory starting with prefix.
+func (s *memStore) List(prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var keys []string
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes a key from memory.
+func (s *memStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Cleanup does nothing.
+func (s *memStore) Cleanup() error { return nil }
@@ -0,0 +1,55 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStore(t *testing.T) {
+	require := require.New(t)
+
+	store := NewMemStore()
+	value, err := store.Get("key")
+	require.NoError(err)
+	require.Empty(value)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(store.Put(fmt.Sprintf("key%d", i), "value"))
+		}(i)
+	}
+	wg.Wait()
+
+	value, err = store.Get("key3")
+	require.NoError(err)
+	require.Equal("value", value)
+	keys, err := store.(Lister).List("key")
+	require.NoError(err)
+	require.Len(keys, 10)
+
+	require.NoError(store.(Deleter).Delete("key3"))
+	value, err = store.Get("key3")
+	require.NoError(err)
+	require.Empty(value)
+	require.NoError(store.Cleanup())
+}
@@ -14,6 +14,8 @@
 
 package keyvalue
 
+import "strings"
+
 // MockStore implements Client interface. It stores cache key-value mappings
 // in memory.
 type MockStore map[string]string
@@ -29,5 +31,22 @@ func (m MockStore) Put(key, value string) error {
 	return nil
 }
 
+// List returns the keys in memory starting with prefix.
+func (m MockStore) List(prefix string) ([]string, error) {
+	var keys []string
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes a key from memory.
+func (m MockStore) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
 // Cleanup does nothing, but is implemented to comply with Client interface.
 func (m MockStore) Cleanup() error { return nil }
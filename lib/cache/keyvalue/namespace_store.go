@@ -0,0 +1,78 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import "strings"
+
+// namespaceStore prefixes all keys of the underlying store with a namespace, so
+// builds in different namespaces don't share cache entries.
+type namespaceStore struct {
+	store     Store
+	namespace string
+}
+
+// NewNamespaceStore returns a Store that prefixes all keys of the given store
+// with namespace. An empty namespace returns the store as is.
+func NewNamespaceStore(store Store, namespace string) Store {
+	if namespace == "" {
+		return store
+	}
+	return &namespaceStore{store, namespace}
+}
+
+// Get returns the value of the namespaced key.
+func (s *namespaceStore) Get(key string) (string, error) {
+	return s.store.Get(s.key(key))
+}
+
+// Put stores the value under the namespaced key.
+func (s *namespaceStore) Put(key, value string) error {
+	return s.store.Put(s.key(key), value)
+}
+
+// Cleanup cleans up the underlying store.
+func (s *namespaceStore) Cleanup() error {
+	return s.store.Cleanup()
+}
+
+// List returns the keys of the namespace starting with prefix, without the
+// namespace.
+func (s *namespaceStore) List(prefix string) ([]string, error) {
+	lister, ok := s.store.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	keys, err := lister.List(s.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.key(""))
+	}
+	return keys, nil
+}
+
+// Delete deletes the namespaced key.
+func (s *namespaceStore) Delete(key string) error {
+	deleter, ok := s.store.(Deleter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return deleter.Delete(s.key(key))
+}
+
+func (s *namespaceStore) key(key string) string {
+	return s.namespace + "/" + key
+}
@@ -0,0 +1,62 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceStore(t *testing.T) {
+	require := require.New(t)
+
+	mock := MockStore{}
+	require.Equal(mock, NewNamespaceStore(mock, ""))
+
+	main := NewNamespaceStore(mock, "main")
+	feature := NewNamespaceStore(mock, "feature/x")
+
+	require.NoError(main.Put("key", "main_value"))
+	require.NoError(feature.Put("key", "feature_value"))
+
+	value, err := main.Get("key")
+	require.NoError(err)
+	require.Equal("main_value", value)
+	value, err = feature.Get("key")
+	require.NoError(err)
+	require.Equal("feature_value", value)
+	value, err = mock.Get("key")
+	require.NoError(err)
+	require.Empty(value)
+}
+
+func TestNamespaceStoreListDelete(t *testing.T) {
+	require := require.New(t)
+
+	mock := MockStore{"main/a": "1", "main/b": "2", "feature/a": "3"}
+	main := NewNamespaceStore(mock, "main")
+
+	keys, err := main.(Lister).List("")
+	require.NoError(err)
+	require.ElementsMatch([]string{"a", "b"}, keys)
+
+	require.NoError(main.(Deleter).Delete("a"))
+	require.Equal(MockStore{"main/b": "2", "feature/a": "3"}, mock)
+
+	// The underlying store must support the operations.
+	_, err = NewNamespaceStore(&httpStore{}, "main").(Lister).List("")
+	require.Equal(ErrNotSupported, err)
+}
@@ -15,7 +15,11 @@
 package keyvalue
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -29,22 +33,102 @@ const (
 )
 
 type redisStore struct {
-	cli *redis.Client
+	cli redis.UniversalClient
 	ttl time.Duration
 }
 
+// RedisOptions configures the redis server of a redis store.
+type RedisOptions struct {
+	// Addrs is the address of the server, or the seed addresses of the nodes of
+	// a cluster, or the addresses of the sentinels if MasterName is set.
+	// Addresses can also be redis:// or rediss:// URLs, the latter using TLS.
+	Addrs []string
+	// MasterName is the name of the master to discover through sentinels.
+	MasterName string
+	// Cluster is set if the server is a Redis Cluster.
+	Cluster bool
+	// Username is the ACL user to authenticate as with Password. The default
+	// user is used if it's empty.
+	Username string
+	Password string
+	// TLSConfig enables TLS if it's not nil.
+	TLSConfig *tls.Config
+}
+
 // NewRedisStore returns a new instance of Store backed by a redis server.
 // In this constructor we try to open a connection to redis. If that attempt fails
 // we return an error. If it succeeds we just close that connection.
 func NewRedisStore(addr, password string, ttl time.Duration) (Store, error) {
-	cli := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		MaxRetries:   MaxRetires,
-		DialTimeout:  DialTimeout,
-		ReadTimeout:  ReadTimeout,
-		WriteTimeout: WriteTimeout,
-		Password:     password,
-	})
+	return NewRedisStoreWithOptions(RedisOptions{
+		Addrs:    []string{addr},
+		Password: password,
+	}, ttl)
+}
+
+// NewRedisStoreWithOptions returns a new instance of Store backed by a redis
+// server, a Redis Cluster or the master found through Redis Sentinel.
+// Entries expire after ttl, or never if ttl is 0.
+func NewRedisStoreWithOptions(opts RedisOptions, ttl time.Duration) (Store, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no redis address")
+	} else if opts.MasterName != "" && opts.Cluster {
+		return nil, fmt.Errorf("redis sentinel and cluster are exclusive")
+	}
+	addrs := make([]string, len(opts.Addrs))
+	for i, addr := range opts.Addrs {
+		var err error
+		if addrs[i], err = parseRedisAddr(addr, &opts); err != nil {
+			return nil, fmt.Errorf("parse redis address %s: %s", addr, err)
+		}
+	}
+
+	// The AUTH of go-redis only takes a password, so authenticating as an ACL
+	// user is done when connecting instead.
+	password := opts.Password
+	var onConnect func(*redis.Conn) error
+	if opts.Username != "" {
+		password = ""
+		onConnect = func(conn *redis.Conn) error {
+			return conn.Do("AUTH", opts.Username, opts.Password).Err()
+		}
+	}
+
+	var cli redis.UniversalClient
+	if opts.MasterName != "" {
+		cli = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.MasterName,
+			SentinelAddrs: addrs,
+			OnConnect:     onConnect,
+			MaxRetries:    MaxRetires,
+			DialTimeout:   DialTimeout,
+			ReadTimeout:   ReadTimeout,
+			WriteTimeout:  WriteTimeout,
+			Password:      password,
+			TLSConfig:     opts.TLSConfig,
+		})
+	} else if opts.Cluster {
+		cli = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			OnConnect:    onConnect,
+			MaxRetries:   MaxRetires,
+			DialTimeout:  DialTimeout,
+			ReadTimeout:  ReadTimeout,
+			WriteTimeout: WriteTimeout,
+			Password:     password,
+			TLSConfig:    opts.TLSConfig,
+		})
+	} else {
+		cli = redis.NewClient(&redis.Options{
+			Addr:         addrs[0],
+			OnConnect:    onConnect,
+			MaxRetries:   MaxRetires,
+			DialTimeout:  DialTimeout,
+			ReadTimeout:  ReadTimeout,
+			WriteTimeout: WriteTimeout,
+			Password:     password,
+			TLSConfig:    opts.TLSConfig,
+		})
+	}
 	if _, err := cli.Ping().Result(); err != nil {
 		return nil, err
 	}
@@ -54,6 +138,33 @@ func NewRedisStore(addr, password string, ttl time.Duration) (Store, error) {
 	}, nil
 }
 
+// parseRedisAddr returns the host and port of a redis address. If it's a URL,
+// its credentials are used unless opts has some, and TLS is enabled for
+// rediss:// URLs.
+func parseRedisAddr(addr string, opts *RedisOptions) (string, error) {
+	if !strings.Contains(addr, "://") {
+		return addr, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		if opts.TLSConfig == nil {
+			opts.TLSConfig = &tls.Config{}
+		}
+	default:
+		return "", fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if u.User != nil && opts.Password == "" {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	return u.Host, nil
+}
+
 func (store *redisStore) Get(key string) (string, error) {
 	v, err := store.cli.Get(key).Result()
 	if err == redis.Nil {
@@ -71,4 +182,42 @@ func (store *redisStore) Put(key, value string) error {
 	return nil
 }
 
+// List returns the keys starting with prefix. The keys of a Redis Cluster are
+// scanned on every master.
+func (store *redisStore) List(prefix string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	scan := func(cli redis.Cmdable) error {
+		iter := cli.Scan(0, _redisGlobEscaper.Replace(prefix)+"*", 1000).Iterator()
+		for iter.Next() {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := store.cli.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(func(cli *redis.Client) error { return scan(cli) })
+	} else {
+		err = scan(store.cli)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis scan keys: %s", err)
+	}
+	return keys, nil
+}
+
+// _redisGlobEscaper escapes the special characters of Redis glob patterns.
+var _redisGlobEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (store *redisStore) Delete(key string) error {
+	if _, err := store.cli.Del(key).Result(); err != nil {
+		return fmt.Errorf("redis delete key: %s", err)
+	}
+	return nil
+}
+
 func (store *redisStore) Cleanup() error { return nil }
@@ -15,6 +15,11 @@
 package keyvalue
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -58,4 +63,122 @@ func TestRedisStore(t *testing.T) {
 		require.NoError(err)
 		require.Equal("b", loc)
 	})
+	t.Run("ttl", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+
+		store, err := NewRedisStore(s.Addr(), "", time.Minute)
+		require.NoError(err)
+		require.NoError(store.Put("a", "b"))
+		require.Equal(time.Minute, s.TTL("a"))
+
+		// A ttl of 0 means no expiry.
+		store, err = NewRedisStore(s.Addr(), "", 0)
+		require.NoError(err)
+		require.NoError(store.Put("c", "d"))
+		require.Equal(time.Duration(0), s.TTL("c"))
+	})
+	t.Run("list_delete", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+
+		store, err := NewRedisStore(s.Addr(), "", time.Minute)
+		require.NoError(err)
+		for _, key := range []string{"a*1", "a*2", "ab", "c"} {
+			require.NoError(store.Put(key, "v"))
+		}
+
+		// Glob characters of the prefix are matched literally.
+		keys, err := store.(Lister).List("a*")
+		require.NoError(err)
+		require.ElementsMatch([]string{"a*1", "a*2"}, keys)
+
+		require.NoError(store.(Deleter).Delete("a*1"))
+		require.NoError(store.(Deleter).Delete("missing"))
+		keys, err = store.(Lister).List("")
+		require.NoError(err)
+		require.ElementsMatch([]string{"a*2", "ab", "c"}, keys)
+	})
+	t.Run("password", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+		s.RequireAuth("secret")
+
+		_, err = NewRedisStoreWithOptions(RedisOptions{Addrs: []string{s.Addr()}}, time.Minute)
+		require.Error(err)
+		store, err := NewRedisStoreWithOptions(RedisOptions{
+			Addrs:    []string{s.Addr()},
+			Password: "secret",
+		}, time.Minute)
+		require.NoError(err)
+		require.NoError(store.Put("a", "b"))
+	})
+	t.Run("tls", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+		s.RequireAuth("secret")
+
+		// Terminate TLS in front of miniredis, with the certificate of an
+		// httptest server.
+		server := httptest.NewTLSServer(nil)
+		defer server.Close()
+		l, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+		require.NoError(err)
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				backend, err := net.Dial("tcp", s.Addr())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go io.Copy(backend, conn)
+				go io.Copy(conn, backend)
+			}
+		}()
+
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+		store, err := NewRedisStoreWithOptions(RedisOptions{
+			Addrs:     []string{"rediss://:secret@" + l.Addr().String()},
+			TLSConfig: &tls.Config{RootCAs: pool},
+		}, time.Minute)
+		require.NoError(err)
+		require.NoError(store.Put("a", "b"))
+		loc, err := store.Get("a")
+		require.NoError(err)
+		require.Equal("b", loc)
+	})
+	t.Run("invalid_options", func(t *testing.T) {
+		require := require.New(t)
+
+		_, err := NewRedisStoreWithOptions(RedisOptions{}, time.Minute)
+		require.Error(err)
+		_, err = NewRedisStoreWithOptions(RedisOptions{
+			Addrs:      []string{"localhost:26379"},
+			MasterName: "mymaster",
+			Cluster:    true,
+		}, time.Minute)
+		require.Error(err)
+		_, err = NewRedisStoreWithOptions(RedisOptions{
+			Addrs: []string{"http://localhost:6379"},
+		}, time.Minute)
+		require.Error(err)
+	})
 }
@@ -0,0 +1,128 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type s3Store struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+	ttl    time.Duration
+}
+
+// NewS3Store returns a new instance of Store backed by an S3 bucket, with one
+// object per key under the given prefix. Credentials and the default region
+// are read from the environment, the shared AWS config files or the IAM role of
+// the instance. The credentials need s3:ListBucket, so that missing keys are
+// not reported as access denied.
+// S3 doesn't expire objects by itself, so objects older than ttl are treated
+// as missing if ttl is positive. A lifecycle rule of the bucket should delete
+// them eventually.
+func NewS3Store(bucket, prefix, region string, ttl time.Duration) (Store, error) {
+	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create aws session: %s", err)
+	}
+	return &s3Store{
+		client: s3.New(sess),
+		bucket: bucket,
+		prefix: prefix,
+		ttl:    ttl,
+	}, nil
+}
+
+func (store *s3Store) Get(key string) (string, error) {
+	out, err := store.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.prefix + key),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("s3 get key: %s", err)
+	}
+	defer out.Body.Close()
+	if store.ttl > 0 && out.LastModified != nil && time.Since(*out.LastModified) > store.ttl {
+		return "", nil
+	}
+	content, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return "", fmt.Errorf("s3 read key: %s", err)
+	}
+	return string(content), nil
+}
+
+func (store *s3Store) Put(key, value string) error {
+	_, err := store.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.prefix + key),
+		Body:   bytes.NewReader([]byte(value)),
+	})
+	if err != nil {
+		return fmt.Errorf("s3 put key: %s", err)
+	}
+	return nil
+}
+
+// List returns the keys starting with prefix, under the prefix of the store.
+func (store *s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	err := store.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(store.prefix + prefix),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range out.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), store.prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 list keys: %s", err)
+	}
+	return keys, nil
+}
+
+func (store *s3Store) Delete(key string) error {
+	_, err := store.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.prefix + key),
+	})
+	if err != nil {
+		return fmt.Errorf("s3 delete key: %s", err)
+	}
+	return nil
+}
+
+func (store *s3Store) Cleanup() error { return nil }
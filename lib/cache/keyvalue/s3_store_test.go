@@ -0,0 +1,119 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/require"
+)
+
+// s3ClientFixture stores objects in memory. Other methods of the S3 API panic.
+type s3ClientFixture struct {
+	s3iface.S3API
+	objects  map[string]string
+	modified time.Time
+}
+
+func (c *s3ClientFixture) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	value, ok := c.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(strings.NewReader(value)),
+		LastModified: aws.Time(c.modified),
+	}, nil
+}
+
+func (c *s3ClientFixture) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.objects[*input.Bucket+"/"+*input.Key] = string(b)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *s3ClientFixture) ListObjectsV2Pages(
+	input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+
+	out := &s3.ListObjectsV2Output{}
+	for key := range c.objects {
+		if strings.HasPrefix(key, *input.Bucket+"/"+*input.Prefix) {
+			out.Contents = append(out.Contents, &s3.Object{
+				Key: aws.String(strings.TrimPrefix(key, *input.Bucket+"/")),
+			})
+		}
+	}
+	fn(out, true)
+	return nil
+}
+
+func (c *s3ClientFixture) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(c.objects, *input.Bucket+"/"+*input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestS3Store(t *testing.T) {
+	require := require.New(t)
+
+	client := &s3ClientFixture{objects: make(map[string]string), modified: time.Now()}
+	store := &s3Store{client: client, bucket: "bucket", prefix: "makisu/", ttl: time.Hour}
+
+	val, err := store.Get("k")
+	require.NoError(err)
+	require.Equal("", val)
+
+	require.NoError(store.Put("k", "v"))
+	require.Equal("v", client.objects["bucket/makisu/k"])
+	val, err = store.Get("k")
+	require.NoError(err)
+	require.Equal("v", val)
+
+	// Objects older than the TTL are missing.
+	client.modified = time.Now().Add(-2 * time.Hour)
+	val, err = store.Get("k")
+	require.NoError(err)
+	require.Equal("", val)
+}
+
+func TestS3StoreListDelete(t *testing.T) {
+	require := require.New(t)
+
+	client := &s3ClientFixture{objects: map[string]string{
+		"bucket/makisu/a1": "v",
+		"bucket/makisu/a2": "v",
+		"bucket/makisu/b":  "v",
+		"bucket/other/a3":  "v",
+	}}
+	store := &s3Store{client: client, bucket: "bucket", prefix: "makisu/"}
+
+	keys, err := store.List("a")
+	require.NoError(err)
+	require.ElementsMatch([]string{"a1", "a2"}, keys)
+
+	require.NoError(store.Delete("a1"))
+	keys, err = store.List("")
+	require.NoError(err)
+	require.ElementsMatch([]string{"a2", "b"}, keys)
+}
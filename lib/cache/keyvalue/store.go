@@ -14,6 +14,12 @@
 
 package keyvalue
 
+import "errors"
+
+// ErrNotSupported is returned by stores wrapping another store, if it doesn't
+// support the operation.
+var ErrNotSupported = errors.New("operation not supported by the cache store")
+
 // Store is the interface that the CacheManager relies on to find the mapping
 // between cacheID and layer name.
 // The Get function returns an empty string and no error if the key was not
@@ -24,3 +30,16 @@ type Store interface {
 	Put(string, string) error
 	Cleanup() error
 }
+
+// Lister is implemented by stores that can list their keys, so cache entries
+// can be inspected and purged.
+type Lister interface {
+	// List returns the keys starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// Deleter is implemented by stores that can delete keys. Deleting a missing
+// key is not an error.
+type Deleter interface {
+	Delete(string) error
+}
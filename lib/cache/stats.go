@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Stats counts the cache lookups of builds.
+type Stats struct {
+	Builds int `json:"builds"`
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// HitRate returns the ratio of lookups that were hits, or 0 if there were none.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// ReadStats returns the stats saved at path, or empty stats if the file
+// doesn't exist.
+func ReadStats(path string) (Stats, error) {
+	var stats Stats
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return stats, fmt.Errorf("read cache stats: %s", err)
+	}
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return stats, fmt.Errorf("unmarshal cache stats: %s", err)
+	}
+	return stats, nil
+}
+
+// AddStats adds the lookups of a build to the stats saved at path. Builds
+// sharing the storage dir concurrently may lose some counts.
+func AddStats(path string, build Stats) error {
+	stats, err := ReadStats(path)
+	if err != nil {
+		return err
+	}
+	stats.Builds++
+	stats.Hits += build.Hits
+	stats.Misses += build.Misses
+	return writeStats(path, stats)
+}
+
+// ResetStats removes the stats saved at path.
+func ResetStats(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove cache stats: %s", err)
+	}
+	return nil
+}
+
+func writeStats(path string, stats Stats) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("marshal cache stats: %s", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "cache_stats")
+	if err != nil {
+		return fmt.Errorf("create temp cache stats file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("write cache stats: %s", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("rename cache stats file: %s", err)
+	}
+	return nil
+}
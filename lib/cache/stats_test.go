@@ -0,0 +1,53 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "cache_stats")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache_stats.json")
+
+	stats, err := cache.ReadStats(path)
+	require.NoError(err)
+	require.Equal(cache.Stats{}, stats)
+	require.Equal(0.0, stats.HitRate())
+
+	require.NoError(cache.AddStats(path, cache.Stats{Hits: 3, Misses: 1}))
+	require.NoError(cache.AddStats(path, cache.Stats{Hits: 1, Misses: 3}))
+	stats, err = cache.ReadStats(path)
+	require.NoError(err)
+	require.Equal(cache.Stats{Builds: 2, Hits: 4, Misses: 4}, stats)
+	require.Equal(0.5, stats.HitRate())
+
+	require.NoError(cache.ResetStats(path))
+	require.NoError(cache.ResetStats(path))
+	stats, err = cache.ReadStats(path)
+	require.NoError(err)
+	require.Equal(cache.Stats{}, stats)
+}
@@ -49,7 +49,23 @@ func (tarer DefaultImageTarer) CreateTarReadCloser(imageName image.Name) (io.Rea
 	if err != nil {
 		return nil, err
 	}
+	return tarDirReadCloser(dir)
+}
+
+// CreateOCILayoutTarReadCloser exports an image from the image store as a tar
+// of an OCI image layout, and returns a reader for the tar that automatically
+// closes on EOF.
+func (tarer DefaultImageTarer) CreateOCILayoutTarReadCloser(imageName image.Name) (io.Reader, error) {
+	dir, err := tarer.createOCILayoutDir(imageName)
+	if err != nil {
+		return nil, err
+	}
+	return tarDirReadCloser(dir)
+}
 
+// tarDirReadCloser tars the dir, and returns a reader for the tar that removes
+// the dir once closed.
+func tarDirReadCloser(dir string) (io.Reader, error) {
 	// Create target tar file
 	targetPath := dir + ".tar"
 	if err := snapshot.CreateTarFromDirectory(targetPath, dir); err != nil {
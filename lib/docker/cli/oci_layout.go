@@ -0,0 +1,99 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// createOCILayoutDir links the manifest, config and layers of the image into
+// an OCI image layout in the sandbox dir: an oci-layout file, an index.json
+// referencing the manifest, and all blobs under blobs/sha256.
+func (tarer DefaultImageTarer) createOCILayoutDir(imageName image.Name) (string, error) {
+	repo, tag := imageName.GetRepository(), imageName.GetTag()
+	manifestReader, err := tarer.store.Manifests.GetStoreFileReader(repo, tag)
+	if err != nil {
+		return "", fmt.Errorf("get manifest: %s", err)
+	}
+	defer manifestReader.Close()
+	manifestData, err := ioutil.ReadAll(manifestReader)
+	if err != nil {
+		return "", fmt.Errorf("read manifest: %s", err)
+	}
+	var manifest image.DistributionManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return "", fmt.Errorf("unmarshal manifest: %s", err)
+	}
+	manifestDigest, err := image.NewDigester().FromBytes(manifestData)
+	if err != nil {
+		return "", fmt.Errorf("hash manifest: %s", err)
+	}
+	descriptor := image.Descriptor{
+		MediaType: manifest.MediaType,
+		Size:      int64(len(manifestData)),
+		Digest:    manifestDigest,
+	}
+
+	dir := filepath.Join(tarer.store.SandboxDir, "oci", repo, tag)
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, perm); err != nil {
+		return "", err
+	}
+	log.Infof("OCI layout dir: %s", dir)
+
+	layout, err := json.Marshal(image.OCILayout{ImageLayoutVersion: image.OCILayoutVersion})
+	if err != nil {
+		return "", fmt.Errorf("marshal oci layout: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), layout, perm); err != nil {
+		return "", fmt.Errorf("write oci layout: %s", err)
+	}
+	index, err := json.Marshal(image.OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIIndex,
+		Manifests: []image.OCIIndexEntry{{
+			Descriptor:  descriptor,
+			Annotations: map[string]string{image.AnnotationOCIRefName: tag},
+		}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal index: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), index, perm); err != nil {
+		return "", fmt.Errorf("write index: %s", err)
+	}
+
+	// The manifest blob must have the exact content its digest was computed
+	// from, so it's written as is.
+	manifestPath := filepath.Join(blobsDir, descriptor.Digest.Hex())
+	if err := ioutil.WriteFile(manifestPath, manifestData, perm); err != nil {
+		return "", fmt.Errorf("write manifest blob: %s", err)
+	}
+	digests := append([]image.Digest{manifest.Config.Digest}, manifest.GetLayerDigests()...)
+	for _, digest := range digests {
+		err := tarer.store.Layers.LinkStoreFileTo(digest.Hex(), filepath.Join(blobsDir, digest.Hex()))
+		if err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("link blob %s: %s", digest, err)
+		}
+	}
+	return dir, nil
+}
@@ -41,6 +41,11 @@ func (d *Digester) Digest() Digest {
 	return Digest(fmt.Sprintf("%s:%x", SHA256, d.hash.Sum(nil)))
 }
 
+// Tee returns a reader that writes to the digester what it reads from r.
+func (d *Digester) Tee(r io.Reader) io.Reader {
+	return io.TeeReader(r, d.hash)
+}
+
 // FromReader returns the digest of data from reader.
 func (d Digester) FromReader(rd io.Reader) (Digest, error) {
 	if _, err := io.Copy(d.hash, rd); err != nil {
@@ -44,6 +44,10 @@ type DistributionManifest struct {
 
 	// Layers lists descriptors for all referenced layers, starting from base layer.
 	Layers []Descriptor `json:"layers"`
+
+	// Annotations are arbitrary metadata of the manifest. Only OCI manifests
+	// have them.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // Descriptor describes targeted content.
@@ -57,6 +61,10 @@ type Descriptor struct {
 
 	// Digest uniquely identifies the content.
 	Digest Digest `json:"digest,omitempty"`
+
+	// Annotations are arbitrary metadata of the content. Only descriptors of
+	// OCI manifests have them.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // DigestPair is a pair of uncompressed digest/compressed descriptor of the same layer.
@@ -69,6 +77,7 @@ type DigestPair struct {
 }
 
 // UnmarshalDistributionManifest verifies MediaType and unmarshals manifest.
+// Both docker schema2 and OCI manifests are supported.
 func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManifest, Descriptor, error) {
 	// Need to look up by the actual media type, not the raw contents of the header.
 	// Strip semicolons and anything following them.
@@ -81,7 +90,7 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 		}
 	}
 
-	if mediatype != MediaTypeManifest {
+	if mediatype != MediaTypeManifest && mediatype != MediaTypeOCIManifest {
 		return DistributionManifest{},
 			Descriptor{},
 			fmt.Errorf("unsupported manifest mediatype: %s", mediatype)
@@ -96,7 +105,7 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 	if err != nil {
 		return DistributionManifest{}, Descriptor{}, err
 	}
-	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: MediaTypeManifest}, nil
+	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: mediatype}, nil
 }
 
 // GetLayerDigests returns the list of layer digests of the image.
@@ -113,6 +122,21 @@ func (manifest DistributionManifest) GetConfigDigest() Digest {
 	return manifest.Config.Digest
 }
 
+// Payload returns the manifest as pushed to registries.
+func (manifest DistributionManifest) Payload() ([]byte, error) {
+	return json.MarshalIndent(manifest, "", "   ")
+}
+
+// Digest returns the digest of the manifest as pushed to registries, which
+// identifies the pushed image.
+func (manifest DistributionManifest) Digest() (Digest, error) {
+	payload, err := manifest.Payload()
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest: %s", err)
+	}
+	return NewDigester().FromBytes(payload)
+}
+
 // NewEmptyDescriptor returns a 0 value descriptor.
 func NewEmptyDescriptor() Descriptor {
 	return Descriptor{Digest: Digest("")}
@@ -45,3 +45,20 @@ func TestUnmarshalDistributionManifest(t *testing.T) {
 	require.NoError(err)
 	require.Equal(1, len(manifest.GetLayerDigests()))
 }
+
+func TestDistributionManifestDigest(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(
+		MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+	payload, err := manifest.Payload()
+	require.NoError(err)
+	_, descriptor, err := UnmarshalDistributionManifest(MediaTypeManifest, payload)
+	require.NoError(err)
+
+	digest, err := manifest.Digest()
+	require.NoError(err)
+	require.Equal(descriptor.Digest, digest)
+	require.NotEqual(manifest.Config.Digest, digest)
+}
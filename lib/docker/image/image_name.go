@@ -52,6 +52,12 @@ func (name Name) WithRegistry(registry string) Name {
 	return name
 }
 
+// WithTag makes a copy of the image name and sets the tag.
+func (name Name) WithTag(tag string) Name {
+	name.tag = tag
+	return name
+}
+
 // GetRepository returns image repository
 func (name Name) GetRepository() string {
 	if name.repository == Scratch {
@@ -80,6 +86,11 @@ func (name Name) IsValid() bool {
 	return name.registry != "" && name.repository != "" && name.tag != ""
 }
 
+// IsQualified returns true if the image name contains registry information.
+func (name Name) IsQualified() bool {
+	return name.registry != ""
+}
+
 // ShortName returns the name of the image without the registry information
 func (name Name) ShortName() string {
 	separator := ":"
@@ -158,6 +169,14 @@ func ParseName(input string) (Name, error) {
 // ParseNameForPull parses image name of format <registry>/<repo>:<tag>. If
 // input doesn't contain registry information, apply defaults for dockerhub.
 func ParseNameForPull(input string) (Name, error) {
+	return ParseNameForPullFrom(input, DockerHubRegistry)
+}
+
+// ParseNameForPullFrom parses image name of format <registry>/<repo>:<tag>. If
+// input doesn't contain registry information, the given registry is used
+// instead. Docker hub's library namespace is only applied if the registry is
+// docker hub.
+func ParseNameForPullFrom(input, registry string) (Name, error) {
 	result, err := ParseName(input)
 	if err != nil {
 		return result, err
@@ -167,10 +186,10 @@ func ParseNameForPull(input string) (Name, error) {
 		return result, nil
 	}
 
-	// For docker hub registry.
 	if result.registry == "" {
-		result.registry = DockerHubRegistry
-		if !strings.Contains(result.repository, "/") {
+		result.registry = registry
+		// For docker hub registry.
+		if registry == DockerHubRegistry && !strings.Contains(result.repository, "/") {
 			result.repository = DockerHubNamespace + "/" + result.repository
 		}
 	}
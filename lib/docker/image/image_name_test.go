@@ -86,6 +86,16 @@ func TestParseImageName(t *testing.T) {
 	require.True(name.IsValid())
 	require.Equal("docker-registry01-sjc1:5055/uber-usi/haproxy-agent:sjc1-produ-0000000027", name.String())
 
+	name, err = ParseNameForPullFrom("ubuntu:18.04", "registry.example.com")
+	require.NoError(err)
+	require.Equal("registry.example.com", name.GetRegistry())
+	require.Equal("ubuntu", name.GetRepository())
+	require.Equal("registry.example.com/ubuntu:18.04", name.String())
+
+	name, err = ParseNameForPullFrom("127.0.0.1:5002/ubuntu:18.04", "registry.example.com")
+	require.NoError(err)
+	require.Equal("127.0.0.1:5002", name.GetRegistry())
+
 	name, err = ParseNameForPull("scratch")
 	require.NoError(err)
 	require.Equal("", name.GetRegistry())
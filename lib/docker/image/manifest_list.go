@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+)
+
+// MediaTypeManifestList specifies the mediaType for manifest lists.
+const MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// ManifestList references the manifests of the same image for different
+// platforms.
+type ManifestList struct {
+	// SchemaVersion is the manifest list schema that this list uses.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// MediaType is the media type of this schema.
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Manifests references the manifests of each platform.
+	Manifests []ManifestListEntry `json:"manifests"`
+}
+
+// ManifestListEntry references the manifest of one platform.
+type ManifestListEntry struct {
+	Descriptor
+
+	// Platform is the platform of the referenced image.
+	Platform Platform `json:"platform"`
+}
+
+// Platform describes the platform an image runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// IsManifestList returns true if the Content-Type header value is the media
+// type of manifest lists.
+func IsManifestList(ctHeader string) bool {
+	mediatype, _, err := mime.ParseMediaType(ctHeader)
+	return err == nil && mediatype == MediaTypeManifestList
+}
+
+// UnmarshalManifestList unmarshals a manifest list.
+func UnmarshalManifestList(p []byte) (ManifestList, error) {
+	list := ManifestList{}
+	if err := json.Unmarshal(p, &list); err != nil {
+		return ManifestList{}, err
+	}
+	return list, nil
+}
+
+// Find returns the descriptor of the first manifest for the given OS and
+// architecture.
+func (list ManifestList) Find(os, architecture string) (Descriptor, error) {
+	for _, entry := range list.Manifests {
+		if entry.Platform.OS == os && entry.Platform.Architecture == architecture {
+			return entry.Descriptor, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for platform %s/%s", os, architecture)
+}
@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import "github.com/uber/makisu/lib/utils"
+
+const (
+	// MediaTypeOCIManifest specifies the mediaType for OCI image manifests.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIConfig specifies the mediaType for OCI image configs.
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCILayer is the mediaType used for gzipped layers referenced by
+	// OCI manifests.
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// MediaTypeOCILayerZstd is the mediaType used for zstd compressed layers
+	// referenced by OCI manifests.
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeOCIIndex specifies the mediaType for OCI image indexes.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// OCILayoutVersion is the version of the OCI image layout written to the
+	// oci-layout file.
+	OCILayoutVersion = "1.0.0"
+
+	// AnnotationOCIRefName is the annotation of the OCI index entries that
+	// holds the tag of the image.
+	AnnotationOCIRefName = "org.opencontainers.image.ref.name"
+)
+
+// OCILayout is the content of the oci-layout file of an OCI image layout.
+type OCILayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// OCIIndex is the index.json of an OCI image layout, which references the
+// manifests of the images in the layout.
+type OCIIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []OCIIndexEntry `json:"manifests"`
+}
+
+// OCIIndexEntry references the manifest of one image of an OCI index.
+type OCIIndexEntry struct {
+	Descriptor
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIAnnotations are the annotations added to an OCI manifest and to the
+// descriptors of its layers.
+type OCIAnnotations struct {
+	Manifest map[string]string
+	// Layers are the annotations of the layers, by digest.
+	Layers map[Digest]map[string]string
+}
+
+// ConvertToOCI returns a copy of the manifest with the media types of the
+// manifest, config and layers converted to their OCI equivalent, and the given
+// annotations added. The content of config and layers is the same in both
+// formats, so digests are kept.
+func ConvertToOCI(manifest DistributionManifest, annotations OCIAnnotations) DistributionManifest {
+	result := DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        manifest.Config,
+		Layers:        make([]Descriptor, len(manifest.Layers)),
+		Annotations:   mergeAnnotations(manifest.Annotations, annotations.Manifest),
+	}
+	result.Config.MediaType = MediaTypeOCIConfig
+	for i, layer := range manifest.Layers {
+		if layer.MediaType == MediaTypeLayer {
+			layer.MediaType = MediaTypeOCILayer
+		}
+		layer.Annotations = mergeAnnotations(layer.Annotations, annotations.Layers[layer.Digest])
+		result.Layers[i] = layer
+	}
+	return result
+}
+
+// mergeAnnotations returns the union of the annotations, b overriding a, or nil
+// if there are none so that unmarshaled manifests equal converted ones.
+func mergeAnnotations(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	return utils.MergeStringMaps(a, b)
+}
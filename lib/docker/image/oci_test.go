@@ -0,0 +1,85 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertToOCI(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(
+		MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+
+	oci := ConvertToOCI(manifest, OCIAnnotations{})
+	require.Equal(MediaTypeOCIManifest, oci.MediaType)
+	require.Equal(MediaTypeOCIConfig, oci.Config.MediaType)
+	require.Equal(manifest.Config.Digest, oci.Config.Digest)
+	require.Equal(manifest.GetLayerDigests(), oci.GetLayerDigests())
+	for _, layer := range oci.Layers {
+		require.Equal(MediaTypeOCILayer, layer.MediaType)
+	}
+
+	// The original manifest is unchanged.
+	require.Equal(MediaTypeManifest, manifest.MediaType)
+	require.Equal(MediaTypeLayer, manifest.Layers[0].MediaType)
+
+	// No annotations are added unless given.
+	b, err := json.Marshal(oci)
+	require.NoError(err)
+	require.NotContains(string(b), "annotations")
+}
+
+func TestConvertToOCIAnnotations(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(
+		MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+	layer := manifest.Layers[0].Digest
+
+	oci := ConvertToOCI(manifest, OCIAnnotations{
+		Manifest: map[string]string{"org.opencontainers.image.revision": "abc"},
+		Layers: map[Digest]map[string]string{
+			layer:              {"com.example.instruction": "RUN make"},
+			"sha256:unrelated": {"com.example.instruction": "COPY . /src"},
+		},
+	})
+	require.Equal(map[string]string{"org.opencontainers.image.revision": "abc"}, oci.Annotations)
+	require.Equal(map[string]string{"com.example.instruction": "RUN make"}, oci.Layers[0].Annotations)
+	require.Empty(oci.Config.Annotations)
+
+	// The original manifest is unchanged.
+	require.Empty(manifest.Annotations)
+	require.Empty(manifest.Layers[0].Annotations)
+}
+
+func TestUnmarshalOCIManifest(t *testing.T) {
+	require := require.New(t)
+
+	manifest, descriptor, err := UnmarshalDistributionManifest(
+		MediaTypeOCIManifest+"; charset=utf-8", []byte(busyboxDistManifest))
+	require.NoError(err)
+	require.Equal(MediaTypeOCIManifest, descriptor.MediaType)
+	require.Equal(1, len(manifest.GetLayerDigests()))
+
+	_, _, err = UnmarshalDistributionManifest(MediaTypeOCIIndex, []byte(busyboxDistManifest))
+	require.Error(err)
+}
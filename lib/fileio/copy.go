@@ -71,6 +71,9 @@ type Copier struct {
 	dstDirOwner *Owner
 	// Owner info for dst dir's children, or if dst is to be a file.
 	dstFileAndChildrenOwner *Owner
+	// Permissions of the copied files and dirs, instead of those of the
+	// sources.
+	mode *os.FileMode
 }
 
 // Owner is a tuple of uid+gid, and a flag to indicate whether to overwrite
@@ -115,6 +118,14 @@ func WithDstFileAndChildrenOwner(uid, gid int, overwrite bool) CopyOption {
 	}
 }
 
+// WithMode sets the permissions of all copied files and directories, except
+// symlinks, to the given mode.
+func WithMode(mode os.FileMode) CopyOption {
+	return func(c *Copier) {
+		c.mode = &mode
+	}
+}
+
 // CopyFile copies the content and permissions of the file at src to dst.
 // If the target file exists, its contents and permissions might be overwritten,
 // depending on copier attributes.
@@ -223,12 +234,20 @@ func (c *Copier) copyRegularFile(fi os.FileInfo, src, dst string) error {
 	if err := os.Chown(dst, uid, gid); err != nil {
 		return fmt.Errorf("chown %s: %s", dst, err)
 	}
-	if err := os.Chmod(dst, fi.Mode()); err != nil {
+	if err := os.Chmod(dst, c.fileMode(fi)); err != nil {
 		return fmt.Errorf("chmod %s: %s", dst, err)
 	}
 	return nil
 }
 
+// fileMode returns the mode of the copy of the given source.
+func (c *Copier) fileMode(fi os.FileInfo) os.FileMode {
+	if c.mode == nil {
+		return fi.Mode()
+	}
+	return fi.Mode()&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | *c.mode
+}
+
 func (c *Copier) copySymlink(src, dst string) error {
 	// Remove existing file if path exists.
 	if _, err := os.Lstat(dst); err == nil {
@@ -311,7 +330,7 @@ func (c *Copier) copyDir(src, dst string) error {
 	// Change mode of dst to that of src, and change owner of dst accordingly.
 	// Note: Chmod needs to be called after chown, otherwise setuid and setgid
 	// bits could be unset.
-	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
+	if err := os.Chmod(dst, c.fileMode(srcInfo)); err != nil {
 		return fmt.Errorf("chmod %s: %s", dst, err)
 	}
 	uid, gid := getFileOwners(srcInfo)
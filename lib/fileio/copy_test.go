@@ -115,6 +115,34 @@ func TestCopyFileSetSpecialBit(t *testing.T) {
 	require.Equal(targetFi.Mode(), os.ModePerm|os.ModeSetuid)
 }
 
+func TestCopyDirectoryWithMode(t *testing.T) {
+	require := require.New(t)
+
+	sourceDir, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(sourceDir)
+	targetDir, err := ioutil.TempDir("/tmp", "testCopyTargetDir")
+	require.NoError(err)
+	defer os.RemoveAll(targetDir)
+
+	require.NoError(os.Mkdir(filepath.Join(sourceDir, "dir"), 0700))
+	require.NoError(ioutil.WriteFile(filepath.Join(sourceDir, "dir", "file"), nil, 0600|os.ModeSetuid))
+	require.NoError(os.Symlink("dir/file", filepath.Join(sourceDir, "link")))
+
+	c := NewCopier(pathutils.DefaultBlacklist, WithMode(0750))
+	require.NoError(c.CopyDir(sourceDir, targetDir))
+
+	fi, err := os.Stat(filepath.Join(targetDir, "dir"))
+	require.NoError(err)
+	require.Equal(os.ModeDir|0750, fi.Mode())
+	fi, err = os.Stat(filepath.Join(targetDir, "dir", "file"))
+	require.NoError(err)
+	require.Equal(os.FileMode(0750), fi.Mode())
+	fi, err = os.Lstat(filepath.Join(targetDir, "link"))
+	require.NoError(err)
+	require.True(fi.Mode()&os.ModeSymlink != 0)
+}
+
 func TestCopyFileTargetEmpty(t *testing.T) {
 	require := require.New(t)
 
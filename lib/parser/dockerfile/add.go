@@ -15,14 +15,29 @@
 package dockerfile
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
+var checksumRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
 // AddDirective represents the "ADD" dockerfile command.
 type AddDirective struct {
 	*addCopyDirective
+
+	// Checksum is the expected digest of the remote source, if any.
+	Checksum string
 }
 
+// Variables:
+//   Replaced from ARGs and ENVs from within our stage.
+// Formats:
+//   ADD [--chown=<user>:<group>] [--checksum=sha256:<hex>] ["<src>",... "<dest>"]
+//   ADD [--chown=<user>:<group>] [--checksum=sha256:<hex>] <src>... <dest>
+// Sources can be http(s) URLs, which can't be mixed with local sources, or a
+// single git repo given as <repo>[#<ref>[:<subdir>]].
+// --checksum requires a single URL source that isn't a git repo.
 func newAddDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
@@ -32,11 +47,61 @@ func newAddDirective(base *baseDirective, state *parsingState) (Directive, error
 		return nil, base.err(errMissingArgs)
 	}
 
+	var checksum string
+	for i := 0; i < len(args)-1 && strings.HasPrefix(args[i], "--"); i++ {
+		if val, ok, err := parseStringFlag(args[i], "checksum"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			if !checksumRegexp.MatchString(val) {
+				return nil, base.err(fmt.Errorf("Invalid checksum: %s", val))
+			}
+			checksum = val
+			args = append(args[:i:i], args[i+1:]...)
+			break
+		}
+	}
+
 	d, err := newAddCopyDirective(base, args)
 	if err != nil {
 		return nil, err
 	}
-	return &AddDirective{d}, nil
+
+	var remote, git int
+	for _, src := range d.Srcs {
+		if IsGitSource(src) {
+			git++
+		}
+		if IsRemoteSource(src) {
+			remote++
+		}
+	}
+	if remote > 0 && remote < len(d.Srcs) {
+		return nil, base.err(fmt.Errorf("Remote sources can't be mixed with local sources"))
+	} else if git > 0 && len(d.Srcs) > 1 {
+		return nil, base.err(fmt.Errorf("Git repos can't be added with other sources"))
+	} else if checksum != "" && (remote != 1 || git != 0 || len(d.Srcs) != 1) {
+		return nil, base.err(fmt.Errorf("Flag checksum requires a single remote source"))
+	}
+	return &AddDirective{d, checksum}, nil
+}
+
+// IsRemoteSource returns true if the source of an ADD directive is a URL or a
+// git repo.
+func IsRemoteSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") ||
+		IsGitSource(src)
+}
+
+// IsGitSource returns true if the source of an ADD directive is a git repo,
+// i.e. it starts with git@ or git://, or is a http(s) URL ending with .git,
+// optionally followed by #<ref>.
+func IsGitSource(src string) bool {
+	if strings.HasPrefix(src, "git@") || strings.HasPrefix(src, "git://") {
+		return true
+	}
+	repo := strings.SplitN(src, "#", 2)[0]
+	return (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) &&
+		strings.HasSuffix(repo, ".git")
 }
 
 // Add this command to the build stage.
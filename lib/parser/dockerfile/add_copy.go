@@ -16,15 +16,26 @@ package dockerfile
 
 import (
 	"fmt"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type addCopyDirective struct {
 	*baseDirective
 	Chown         string
+	Chmod         string
 	PreserveOwner bool
 	Srcs          []string
 	Dst           string
+
+	// Link is true if the layer of the directive is created independently
+	// of the previous layers.
+	Link bool
+
+	// Excludes are the patterns of the paths within the sources that are not
+	// copied.
+	Excludes []string
 }
 
 // Variables:
@@ -34,15 +45,18 @@ type addCopyDirective struct {
 //   ADD/COPY [--archive] ["<src>",... "<dest>"]
 //   ADD/COPY [--chown=<user>:<group>] ["<src>",... "<dest>"]
 //   ADD/COPY [--chown=<user>:<group>] <src>... <dest>
+// --chmod=<octal mode>, --link and any number of --exclude=<pattern> can be
+// given in addition to any of these.
 func newAddCopyDirective(base *baseDirective, args []string) (*addCopyDirective, error) {
 	if len(args) == 0 {
 		return nil, base.err(errMissingArgs)
 	}
 
 	// Check the flag numbers here since we only allow zero or one flag here.
-	var chownCount, archiveCount int
-	var chown string
-	var preserveOwner bool
+	var chownCount, archiveCount, chmodCount, linkCount int
+	var excludes []string
+	var chown, chmod string
+	var preserveOwner, link bool
 	for _, arg := range args[:len(args)-1] {
 		if strings.HasPrefix(arg, "--chown") {
 			if val, ok, err := parseStringFlag(arg, "chown"); err != nil {
@@ -54,6 +68,40 @@ func newAddCopyDirective(base *baseDirective, args []string) (*addCopyDirective,
 			}
 		}
 
+		if strings.HasPrefix(arg, "--chmod") {
+			if val, ok, err := parseStringFlag(arg, "chmod"); err != nil {
+				return nil, base.err(err)
+			} else if ok {
+				if mode, err := strconv.ParseUint(val, 8, 32); err != nil || mode > 07777 {
+					return nil, base.err(fmt.Errorf("Invalid chmod mode: %s", val))
+				}
+				chmod = val
+				chmodCount++
+				continue
+			}
+		}
+
+		if strings.HasPrefix(arg, "--exclude") {
+			if val, ok, err := parseStringFlag(arg, "exclude"); err != nil {
+				return nil, base.err(err)
+			} else if ok {
+				if _, err := filepath.Match(val, ""); err != nil {
+					return nil, base.err(fmt.Errorf("Invalid exclude pattern: %s", val))
+				}
+				excludes = append(excludes, val)
+				continue
+			}
+		}
+
+		if strings.HasPrefix(arg, "--link") {
+			if err := parseBoolFlag(arg, "link"); err != nil {
+				return nil, base.err(err)
+			}
+			link = true
+			linkCount++
+			continue
+		}
+
 		if strings.HasPrefix(arg, "--archive") {
 			if err := parseBoolFlag(arg, "archive"); err == nil {
 				archiveCount++
@@ -66,9 +114,10 @@ func newAddCopyDirective(base *baseDirective, args []string) (*addCopyDirective,
 
 	if archiveCount+chownCount >= 2 {
 		return nil, base.err(fmt.Errorf("argument shouldn't contain more than one flag [--chown or --archive]"))
-	} else if archiveCount+chownCount == 1 {
-		args = args[1:]
+	} else if chmodCount >= 2 || linkCount >= 2 {
+		return nil, base.err(fmt.Errorf("argument shouldn't contain more than one --chmod or --link flag"))
 	}
+	args = args[archiveCount+chownCount+chmodCount+linkCount+len(excludes):]
 
 	var parsed []string
 	if json, ok := parseJSONArray(strings.Join(args, " ")); ok {
@@ -81,5 +130,5 @@ func newAddCopyDirective(base *baseDirective, args []string) (*addCopyDirective,
 	}
 	srcs := parsed[:len(parsed)-1]
 	dst := parsed[len(parsed)-1]
-	return &addCopyDirective{base, chown, preserveOwner, srcs, dst}, nil
+	return &addCopyDirective{base, chown, chmod, preserveOwner, srcs, dst, link, excludes}, nil
 }
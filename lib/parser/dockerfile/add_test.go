@@ -68,3 +68,69 @@ func TestNewAddDirective(t *testing.T) {
 		})
 	}
 }
+
+func TestNewAddDirectiveRemote(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"version": "1.2.3"}
+	checksum := "sha256:24454f830cdb571e2c4ad15481119c43b3cafd48dd869a9b2945d1036d1dc68d"
+
+	tests := []struct {
+		desc     string
+		succeed  bool
+		input    string
+		srcs     []string
+		checksum string
+	}{
+		{"url", true, `add https://example.com/tool-${version}.tgz /opt/`,
+			[]string{"https://example.com/tool-1.2.3.tgz"}, ""},
+		{"urls", true, `add http://example.com/a https://example.com/b /opt/`,
+			[]string{"http://example.com/a", "https://example.com/b"}, ""},
+		{"checksum", true, `add --checksum=` + checksum + ` https://example.com/a /a`,
+			[]string{"https://example.com/a"}, checksum},
+		{"checksum after chown", true, `add --chown=user --checksum=` + checksum + ` https://example.com/a /a`,
+			[]string{"https://example.com/a"}, checksum},
+		{"checksum after chmod", true, `add --chmod=755 --checksum=` + checksum + ` https://example.com/a /a`,
+			[]string{"https://example.com/a"}, checksum},
+		{"checksum json", true, `add --checksum=` + checksum + ` ["https://example.com/a", "/a"]`,
+			[]string{"https://example.com/a"}, checksum},
+		{"git ssh", true, `add git@github.com:uber/makisu.git#v0.1.0 /src`,
+			[]string{"git@github.com:uber/makisu.git#v0.1.0"}, ""},
+		{"git https", true, `add https://github.com/uber/makisu.git#master:lib /src`,
+			[]string{"https://github.com/uber/makisu.git#master:lib"}, ""},
+		{"mixed", false, `add https://example.com/a local /opt/`, nil, ""},
+		{"git multiple", false, `add git@github.com:uber/makisu.git https://example.com/a /opt/`, nil, ""},
+		{"git checksum", false, `add --checksum=` + checksum + ` git@github.com:uber/makisu.git /src`, nil, ""},
+		{"checksum local", false, `add --checksum=` + checksum + ` local /a`, nil, ""},
+		{"checksum multiple", false, `add --checksum=` + checksum + ` https://example.com/a https://example.com/b /opt/`, nil, ""},
+		{"checksum bad", false, `add --checksum=md5:abc https://example.com/a /a`, nil, ""},
+		{"checksum empty", false, `add --checksum= https://example.com/a /a`, nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				cast, ok := directive.(*AddDirective)
+				require.True(ok)
+				require.Equal(test.srcs, cast.Srcs)
+				require.Equal(test.checksum, cast.Checksum)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestIsGitSource(t *testing.T) {
+	require := require.New(t)
+
+	require.True(IsGitSource("git@github.com:uber/makisu.git"))
+	require.True(IsGitSource("git://example.com/repo"))
+	require.True(IsGitSource("https://github.com/uber/makisu.git"))
+	require.True(IsGitSource("https://github.com/uber/makisu.git#v1:lib"))
+	require.False(IsGitSource("https://example.com/archive.tar.gz"))
+	require.False(IsGitSource("https://example.com/a#b.git"))
+	require.False(IsGitSource("local.git"))
+}
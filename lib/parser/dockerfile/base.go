@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"unicode"
 )
 
 var (
@@ -33,10 +34,15 @@ type baseDirective struct {
 }
 
 // uncomment the line
+// Comments start with a # at the beginning of the line or after whitespace,
+// so # within words, e.g. in `ADD <repo>.git#<ref>`, is kept.
 func uncomment(line string) string {
 	r := regexp.MustCompile(`#`)
 	for _, idx := range r.FindAllStringIndex(line, -1) {
 		char := idx[0]
+		if char > 0 && !unicode.IsSpace(rune(line[char-1])) {
+			continue
+		}
 		qStatus := make(map[string]bool)
 		// Check for all types of quotes.
 		for _, qRune := range `'"` {
@@ -90,8 +96,8 @@ func (d *baseDirective) err(e error) error {
 
 // replaceVars replaces the variables in the directive's args string
 // using the passed map.
-func (d *baseDirective) replaceVars(vars map[string]string) error {
-	replaced, err := replaceVariables(d.Args, vars)
+func (d *baseDirective) replaceVars(vars map[string]string, escape rune) error {
+	replaced, err := replaceVariables(d.Args, vars, escape)
 	if err != nil {
 		return d.err(fmt.Errorf("Failed to replace variables in input: %s", err))
 	}
@@ -105,13 +111,13 @@ func (d *baseDirective) replaceVarsCurrStage(state *parsingState) error {
 	if state.stageVars == nil {
 		return d.err(errBeforeFirstFrom)
 	}
-	return d.replaceVars(state.stageVars)
+	return d.replaceVars(state.stageVars, state.escape)
 }
 
 // replaceVarsGlobal replaces variables in the args string using the
 // global args map.
 func (d *baseDirective) replaceVarsGlobal(state *parsingState) error {
-	return d.replaceVars(state.globalArgs)
+	return d.replaceVars(state.globalArgs, state.escape)
 }
 
 // replaceVarsCurrStageOrGlobal replaces variables in the args string as follows:
@@ -122,5 +128,5 @@ func (d *baseDirective) replaceVarsCurrStageOrGlobal(state *parsingState) error
 	if vars == nil {
 		vars = state.globalArgs
 	}
-	return d.replaceVars(vars)
+	return d.replaceVars(vars, state.escape)
 }
@@ -0,0 +1,38 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUncomment(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"# comment", ""},
+		{"RUN echo hi # comment", "RUN echo hi "},
+		{"RUN echo hi\t#!COMMIT", "RUN echo hi\t"},
+		{`RUN echo "# not a comment"`, `RUN echo "# not a comment"`},
+		{"ADD https://example.com/repo.git#v1 /src", "ADD https://example.com/repo.git#v1 /src"},
+		{"ADD https://example.com/repo.git#v1 /src #!COMMIT", "ADD https://example.com/repo.git#v1 /src "},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, uncomment(test.line), test.line)
+	}
+}
@@ -0,0 +1,121 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ParseBuildArgs returns the build args read from argsFile, if not empty,
+// overridden by the given "<key>=<value>" pairs.
+func ParseBuildArgs(pairs []string, argsFile string) (map[string]string, error) {
+	args := make(map[string]string)
+	if argsFile != "" {
+		contents, err := ioutil.ReadFile(argsFile)
+		if err != nil {
+			return nil, fmt.Errorf("read build args file: %s", err)
+		}
+		args, err = parseBuildArgsFile(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("parse build args file %s: %s", argsFile, err)
+		}
+	}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("failed to parse build-arg %s: missing '='", pair)
+		}
+		args[parts[0]] = parts[1]
+	}
+	return args, nil
+}
+
+// parseBuildArgsFile parses lines of <key>=<value>. Empty lines and lines
+// starting with '#' are ignored. Values are taken verbatim unless they are
+// wrapped in double quotes, which support Go escape sequences, or in single
+// quotes, which don't support any.
+func parseBuildArgsFile(contents string) (map[string]string, error) {
+	args := make(map[string]string)
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: missing '='", i+1)
+		}
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", i+1)
+		}
+		for _, r := range key {
+			if err := validKeyRune(r); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+		}
+		val, err := unquoteBuildArg(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		args[key] = val
+	}
+	return args, nil
+}
+
+func unquoteBuildArg(val string) (string, error) {
+	if val == "" || (val[0] != '"' && val[0] != '\'') {
+		return val, nil
+	}
+	if len(val) < 2 || val[len(val)-1] != val[0] {
+		return "", fmt.Errorf("missing end quote in value %s", val)
+	}
+	if val[0] == '\'' {
+		return val[1 : len(val)-1], nil
+	}
+	unquoted, err := strconv.Unquote(val)
+	if err != nil {
+		return "", fmt.Errorf("unquote value %s: %s", val, err)
+	}
+	return unquoted, nil
+}
+
+// platformArgs are the args predefined in the global scope, without the need
+// for an ARG directive, if they are passed in.
+var platformArgs = []string{
+	"BUILDPLATFORM", "BUILDOS", "BUILDARCH",
+	"TARGETPLATFORM", "TARGETOS", "TARGETARCH",
+}
+
+// SetPlatformArgs sets the values of the predefined platform args from the
+// given "<os>/<arch>" build and target platforms. Args that are already set
+// are kept.
+func SetPlatformArgs(args map[string]string, buildPlatform, targetPlatform string) {
+	for prefix, platform := range map[string]string{"BUILD": buildPlatform, "TARGET": targetPlatform} {
+		parts := strings.SplitN(platform, "/", 2)
+		values := map[string]string{prefix + "PLATFORM": platform, prefix + "OS": parts[0]}
+		if len(parts) == 2 {
+			values[prefix+"ARCH"] = parts[1]
+		}
+		for k, v := range values {
+			if _, ok := args[k]; !ok {
+				args[k] = v
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBuildArgsFile(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		succeed bool
+		output  map[string]string
+	}{
+		{"key-value", "a=b\nc=d\n", true, map[string]string{"a": "b", "c": "d"}},
+		{"comments and blank lines", "# comment\n\n  a=b\n\t# other\n", true, map[string]string{"a": "b"}},
+		{"spaces around", "  a = b c  ", true, map[string]string{"a": "b c"}},
+		{"empty value", "a=", true, map[string]string{"a": ""}},
+		{"equals in value", "a=b=c", true, map[string]string{"a": "b=c"}},
+		{"double quotes", `a="b c=d # e"`, true, map[string]string{"a": "b c=d # e"}},
+		{"double quotes escape", `a="b \"c\"\\"`, true, map[string]string{"a": `b "c"\`}},
+		{"single quotes", `a='b "c" \n'`, true, map[string]string{"a": `b "c" \n`}},
+		{"later line wins", "a=b\na=c", true, map[string]string{"a": "c"}},
+		{"missing separator", "a", false, nil},
+		{"missing key", "=b", false, nil},
+		{"invalid key", "a b=c", false, nil},
+		{"missing end quote", `a="b`, false, nil},
+		{"mismatched quotes", `a="b'`, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			result, err := parseBuildArgsFile(test.input)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.output, result)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseBuildArgs(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "build-args")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "args")
+	require.NoError(ioutil.WriteFile(argsFile, []byte("a=file\nb=file\n"), 0644))
+
+	// Command line args win over the file.
+	args, err := ParseBuildArgs([]string{"b=cli", "c=x=y"}, argsFile)
+	require.NoError(err)
+	require.Equal(map[string]string{"a": "file", "b": "cli", "c": "x=y"}, args)
+
+	args, err = ParseBuildArgs([]string{"b=cli"}, "")
+	require.NoError(err)
+	require.Equal(map[string]string{"b": "cli"}, args)
+
+	_, err = ParseBuildArgs(nil, filepath.Join(dir, "missing"))
+	require.Error(err)
+	require.Contains(err.Error(), "read build args file")
+
+	_, err = ParseBuildArgs([]string{"b"}, "")
+	require.Error(err)
+}
+
+func TestSetPlatformArgs(t *testing.T) {
+	require := require.New(t)
+
+	args := map[string]string{"TARGETARCH": "custom"}
+	SetPlatformArgs(args, "linux/amd64", "linux/arm64")
+	require.Equal(map[string]string{
+		"BUILDPLATFORM":  "linux/amd64",
+		"BUILDOS":        "linux",
+		"BUILDARCH":      "amd64",
+		"TARGETPLATFORM": "linux/arm64",
+		"TARGETOS":       "linux",
+		"TARGETARCH":     "custom",
+	}, args)
+
+	// Platform args are predefined in the global scope.
+	stages, err := ParseFile(
+		"FROM --platform=$BUILDPLATFORM golang AS builder\nFROM --platform=${TARGETPLATFORM} alpine\n", args)
+	require.NoError(err)
+	require.Len(stages, 2)
+	require.Equal("linux/amd64", stages[0].From.Platform)
+	require.Equal("linux/arm64", stages[1].From.Platform)
+}
@@ -36,12 +36,12 @@ func newCmdDirective(base *baseDirective, state *parsingState) (Directive, error
 		return &CmdDirective{base, cmd}, nil
 	}
 
-	args, err := splitArgs(base.Args, true)
+	args, err := splitArgs(base.Args, true, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
 
-	cmd := append([]string{"/bin/sh", "-c"}, strings.Join(args, " "))
+	cmd := state.shellCmd(strings.Join(args, " "))
 	return &CmdDirective{base, cmd}, nil
 }
 
@@ -15,6 +15,7 @@
 package dockerfile
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -22,6 +23,10 @@ import (
 type CopyDirective struct {
 	*addCopyDirective
 	FromStage string
+
+	// Heredocs are the contents of the sources given as heredocs, keyed by
+	// source name.
+	Heredocs map[string]string
 }
 
 // Variables:
@@ -29,6 +34,9 @@ type CopyDirective struct {
 // Formats:
 //   COPY [--from=<name|index>] [--chown=<user>:<group>] ["<src>",... "<dest>"]
 //   COPY [--from=<name|index>] [--chown=<user>:<group>] <src>... <dest>
+//   COPY [--chown=<user>:<group>] <<EOF... <dest>
+// The sources given as heredocs are named after them, and variables in their
+// content are replaced unless their name is quoted.
 func newCopyDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
@@ -39,17 +47,13 @@ func newCopyDirective(base *baseDirective, state *parsingState) (Directive, erro
 	}
 
 	var fromStage string
-	if val, ok, err := parseStringFlag(args[0], "from"); err != nil {
-		return nil, base.err(err)
-	} else if ok {
-		fromStage = val
-		args = args[1:]
-	} else if len(args) >= 3 {
-		if val, ok, err := parseStringFlag(args[1], "from"); err != nil {
+	for i := 0; i < len(args)-1 && strings.HasPrefix(args[i], "--"); i++ {
+		if val, ok, err := parseStringFlag(args[i], "from"); err != nil {
 			return nil, base.err(err)
 		} else if ok {
 			fromStage = val
-			args = append([]string{args[0]}, args[2:]...)
+			args = append(args[:i:i], args[i+1:]...)
+			break
 		}
 	}
 
@@ -57,7 +61,32 @@ func newCopyDirective(base *baseDirective, state *parsingState) (Directive, erro
 	if err != nil {
 		return nil, err
 	}
-	return &CopyDirective{d, fromStage}, nil
+	if len(state.heredocs) == 0 {
+		return &CopyDirective{d, fromStage, nil}, nil
+	}
+
+	if fromStage != "" {
+		return nil, base.err(fmt.Errorf("Heredocs can't be copied from another stage"))
+	}
+	heredocs := make(map[string]string)
+	for _, heredoc := range state.heredocs {
+		content := heredoc.Content
+		if heredoc.Expand {
+			var err error
+			if content, err = replaceVariables(content, state.stageVars, state.escape); err != nil {
+				return nil, base.err(fmt.Errorf("Failed to replace variables in heredoc: %s", err))
+			}
+		}
+		heredocs[heredoc.Name] = content
+	}
+	for i, src := range d.Srcs {
+		name, ok := heredocName(src)
+		if !ok {
+			return nil, base.err(fmt.Errorf("Heredocs can't be mixed with other sources"))
+		}
+		d.Srcs[i] = name
+	}
+	return &CopyDirective{d, fromStage, heredocs}, nil
 }
 
 // Add this command to the build stage.
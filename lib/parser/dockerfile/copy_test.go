@@ -78,3 +78,125 @@ func TestNewCopyDirective(t *testing.T) {
 		})
 	}
 }
+
+func TestNewCopyDirectiveChmod(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"mode": "755"}
+
+	tests := []struct {
+		desc      string
+		succeed   bool
+		input     string
+		srcs      []string
+		fromStage string
+		chown     string
+		chmod     string
+	}{
+		{"chmod", true, `copy --chmod=755 src dst`, []string{"src"}, "", "", "755"},
+		{"chmod substitution", true, `copy --chmod=$mode src dst`, []string{"src"}, "", "", "755"},
+		{"chmod chown", true, `copy --chown=user --chmod=0640 src dst`, []string{"src"}, "", "user", "0640"},
+		{"chmod from", true, `copy --chmod=755 --from=stage src dst`, []string{"src"}, "stage", "", "755"},
+		{"chmod chown from", true, `copy --chown=user --chmod=755 --from=stage ["src", "dst"]`, []string{"src"}, "stage", "user", "755"},
+		{"chmod archive", true, `copy --archive --chmod=755 src dst`, []string{"src"}, "", "", "755"},
+		{"chmod not octal", false, `copy --chmod=u+x src dst`, nil, "", "", ""},
+		{"chmod too large", false, `copy --chmod=17777 src dst`, nil, "", "", ""},
+		{"chmod empty", false, `copy --chmod= src dst`, nil, "", "", ""},
+		{"chmod twice", false, `copy --chmod=755 --chmod=644 src dst`, nil, "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				cast, ok := directive.(*CopyDirective)
+				require.True(ok)
+				require.Equal(test.srcs, cast.Srcs)
+				require.Equal("dst", cast.Dst)
+				require.Equal(test.fromStage, cast.FromStage)
+				require.Equal(test.chown, cast.Chown)
+				require.Equal(test.chmod, cast.Chmod)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewCopyDirectiveLink(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = make(map[string]string)
+
+	tests := []struct {
+		desc      string
+		succeed   bool
+		input     string
+		fromStage string
+		chmod     string
+		link      bool
+	}{
+		{"no link", true, `copy src dst`, "", "", false},
+		{"link", true, `copy --link src dst`, "", "", true},
+		{"link json", true, `copy --link ["src", "dst"]`, "", "", true},
+		{"link from chmod", true, `copy --link --from=stage --chmod=755 src dst`, "stage", "755", true},
+		{"link bad", false, `copy --link=yes src dst`, "", "", false},
+		{"link twice", false, `copy --link --link src dst`, "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				cast, ok := directive.(*CopyDirective)
+				require.True(ok)
+				require.Equal([]string{"src"}, cast.Srcs)
+				require.Equal("dst", cast.Dst)
+				require.Equal(test.fromStage, cast.FromStage)
+				require.Equal(test.chmod, cast.Chmod)
+				require.Equal(test.link, cast.Link)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewCopyDirectiveExclude(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = make(map[string]string)
+
+	tests := []struct {
+		desc     string
+		succeed  bool
+		input    string
+		excludes []string
+	}{
+		{"no exclude", true, `copy src dst`, nil},
+		{"exclude", true, `copy --exclude=vendor src dst`, []string{"vendor"}},
+		{"exclude twice", true, `copy --exclude=**/*_test.go --link --exclude=vendor src dst`,
+			[]string{"**/*_test.go", "vendor"}},
+		{"exclude json", true, `copy --exclude=*.md ["src", "dst"]`, []string{"*.md"}},
+		{"exclude missing", false, `copy --exclude= src dst`, nil},
+		{"exclude bad", false, `copy --exclude=[ src dst`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				cast, ok := directive.(*CopyDirective)
+				require.True(ok)
+				require.Equal([]string{"src"}, cast.Srcs)
+				require.Equal("dst", cast.Dst)
+				require.Equal(test.excludes, cast.Excludes)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
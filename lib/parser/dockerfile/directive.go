@@ -33,7 +33,9 @@ var directiveConstructors = map[string]directiveConstructor{
 	"healthcheck": newHealthcheckDirective,
 	"label":       newLabelDirective,
 	"maintainer":  newMaintainerDirective,
+	"onbuild":     newOnbuildDirective,
 	"run":         newRunDirective,
+	"shell":       newShellDirective,
 	"stopsignal":  newStopsignalDirective,
 	"user":        newUserDirective,
 	"volume":      newVolumeDirective,
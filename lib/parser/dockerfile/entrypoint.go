@@ -37,13 +37,14 @@ func newEntrypointDirective(base *baseDirective, state *parsingState) (Directive
 	}
 
 	// This is the Shell form (https://docs.docker.com/engine/reference/builder/#shell-form-entrypoint-example)
-	// It is expected to wrap the whole entrypoint into a sh -c command)
-	args, err := splitArgs(base.Args, true)
+	// It is expected to wrap the whole entrypoint into a sh -c command, or the
+	// shell set by SHELL)
+	args, err := splitArgs(base.Args, true, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
 
-	cmd := append([]string{"/bin/sh", "-c"}, strings.Join(args, " "))
+	cmd := state.shellCmd(strings.Join(args, " "))
 	return &EntrypointDirective{base, cmd}, nil
 }
 
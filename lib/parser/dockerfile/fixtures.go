@@ -16,18 +16,18 @@ package dockerfile
 
 // FromDirectiveFixture returns a FromDirective for testing purposes.
 func FromDirectiveFixture(args, image, alias string) *FromDirective {
-	return &FromDirective{&baseDirective{"from", args, false}, image, alias}
+	return &FromDirective{&baseDirective{"from", args, false}, image, alias, ""}
 }
 
 // RunDirectiveFixture returns a RunDirective for testing purposes.
 func RunDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, false}, cmd}
+	return &RunDirective{&baseDirective{"run", args, false}, cmd, nil, "", nil, ""}
 }
 
 // RunCommitDirectiveFixture returns a RunDirective with a commit annotation
 // for testing purposes.
 func RunCommitDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, true}, cmd}
+	return &RunDirective{&baseDirective{"run", args, true}, cmd, nil, "", nil, ""}
 }
 
 // CmdDirectiveFixture returns a CmdDirective for testing purposes.
@@ -51,11 +51,15 @@ func CopyDirectiveFixture(args, chown, fromStage string, srcs []string, dst stri
 		&addCopyDirective{
 			&baseDirective{"copy", args, false},
 			chown,
+			"",
 			false,
 			srcs,
 			dst,
+			false,
+			nil,
 		},
 		fromStage,
+		nil,
 	}
 }
 
@@ -90,9 +94,13 @@ func AddDirectiveFixture(args, chown string, srcs []string, dst string) *AddDire
 		&addCopyDirective{
 			&baseDirective{"add", args, false},
 			chown,
+			"",
 			false,
 			srcs,
 			dst,
+			false,
+			nil,
 		},
+		"",
 	}
 }
@@ -16,22 +16,27 @@ package dockerfile
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
-var errBadAlias = errors.New("Malformed image alias")
+var (
+	errBadAlias    = errors.New("Malformed image alias")
+	errBadPlatform = errors.New("Malformed platform, expected <os>/<arch>")
+)
 
 // FromDirective represents the "FROM" dockerfile command.
 type FromDirective struct {
 	*baseDirective
-	Image string
-	Alias string
+	Image    string
+	Alias    string
+	Platform string
 }
 
 // Variables:
 //   Only replaced using globally defined ARGs (those defined before the first FROM directive.
 // Formats:
-//   FROM <image> [AS <name>]
+//   FROM [--platform=<os>/<arch>] <image> [AS <name>]
 func newFromDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsGlobal(state); err != nil {
 		return nil, err
@@ -41,6 +46,21 @@ func newFromDirective(base *baseDirective, state *parsingState) (Directive, erro
 		return nil, base.err(errMissingArgs)
 	}
 
+	var platform string
+	if val, ok, err := parseStringFlag(args[0], "platform"); err != nil {
+		return nil, base.err(err)
+	} else if ok {
+		parts := strings.Split(val, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, base.err(fmt.Errorf("%s: %s", errBadPlatform, val))
+		}
+		platform = val
+		args = args[1:]
+		if len(args) == 0 {
+			return nil, base.err(errMissingArgs)
+		}
+	}
+
 	var alias string
 	if len(args) > 1 {
 		if len(args) != 3 || !strings.EqualFold(args[1], "as") {
@@ -49,14 +69,15 @@ func newFromDirective(base *baseDirective, state *parsingState) (Directive, erro
 		alias = args[2]
 	}
 
-	return &FromDirective{base, args[0], alias}, nil
+	return &FromDirective{base, args[0], alias, platform}, nil
 }
 
 // update:
 //   1) Adds a new stage to the parsing state containing the from directive.
-//   2) Resets the stage variables.
+//   2) Resets the stage variables and shell.
 func (d *FromDirective) update(state *parsingState) error {
 	state.addStage(newStage(d))
 	state.stageVars = make(map[string]string)
+	state.stageShell = nil
 	return nil
 }
@@ -24,27 +24,35 @@ func TestNewFromDirective(t *testing.T) {
 	buildState := newParsingState(make(map[string]string))
 	buildState.globalArgs["prefix"] = "test_"
 	buildState.globalArgs["suffix"] = "_test"
+	buildState.globalArgs["BUILDPLATFORM"] = "linux/amd64"
 	tests := []struct {
-		desc    string
-		succeed bool
-		input   string
-		image   string
-		alias   string
+		desc     string
+		succeed  bool
+		input    string
+		image    string
+		alias    string
+		platform string
 	}{
-		{"missing args", false, "from ", "", ""},
-		{"no tag, no alias", true, "from test_image", "test_image", ""},
-		{"tag, no alias", true, "from test_image:trusty", "test_image:trusty", ""},
-		{"no tag, alias", true, "from test_image as test_alias", "test_image", "test_alias"},
-		{"tag, alias", true, "from test_image:trusty as test_alias", "test_image:trusty", "test_alias"},
-		{"registry", true, "from 127.0.0.1:5050/test_image:trusty as test_alias", "127.0.0.1:5050/test_image:trusty", "test_alias"},
-		{"mixed case", true, "fRoM test_image:trusty aS test_alias", "test_image:trusty", "test_alias"},
-		{"too few args", false, "from", "", ""},
-		{"too many args", false, "from test_image as test_alias another_arg", "", ""},
-		{"missing alias", false, "from test_image:trusty as", "", ""},
-		{"bad 'as'", false, "from test_image:trusty sa test_alias", "", ""},
-		{"substitution", true, "from ${prefix}image:trusty as alias$suffix", "test_image:trusty", "alias_test"},
-		{"bad substitution", false, "from ${prefiximage:trusty as alias$suffix", "", ""},
-		{"empty substitution", false, "from ${0:+0}", "test_image", ""},
+		{"missing args", false, "from ", "", "", ""},
+		{"no tag, no alias", true, "from test_image", "test_image", "", ""},
+		{"tag, no alias", true, "from test_image:trusty", "test_image:trusty", "", ""},
+		{"no tag, alias", true, "from test_image as test_alias", "test_image", "test_alias", ""},
+		{"tag, alias", true, "from test_image:trusty as test_alias", "test_image:trusty", "test_alias", ""},
+		{"registry", true, "from 127.0.0.1:5050/test_image:trusty as test_alias", "127.0.0.1:5050/test_image:trusty", "test_alias", ""},
+		{"mixed case", true, "fRoM test_image:trusty aS test_alias", "test_image:trusty", "test_alias", ""},
+		{"too few args", false, "from", "", "", ""},
+		{"too many args", false, "from test_image as test_alias another_arg", "", "", ""},
+		{"missing alias", false, "from test_image:trusty as", "", "", ""},
+		{"bad 'as'", false, "from test_image:trusty sa test_alias", "", "", ""},
+		{"substitution", true, "from ${prefix}image:trusty as alias$suffix", "test_image:trusty", "alias_test", ""},
+		{"bad substitution", false, "from ${prefiximage:trusty as alias$suffix", "", "", ""},
+		{"empty substitution", false, "from ${0:+0}", "test_image", "", ""},
+		{"platform", true, "from --platform=linux/arm64 test_image as test_alias", "test_image", "test_alias", "linux/arm64"},
+		{"platform substitution", true, "from --platform=$BUILDPLATFORM test_image", "test_image", "", "linux/amd64"},
+		{"platform missing image", false, "from --platform=linux/arm64", "", "", ""},
+		{"platform empty after substitution", false, "from --platform=$UNDEFINED test_image", "", "", ""},
+		{"platform missing arch", false, "from --platform=linux test_image", "", "", ""},
+		{"platform too many parts", false, "from --platform=linux/arm/v7/x test_image", "", "", ""},
 	}
 
 	for _, test := range tests {
@@ -57,6 +65,7 @@ func TestNewFromDirective(t *testing.T) {
 				require.True(ok)
 				require.Equal(test.image, from.Image)
 				require.Equal(test.alias, from.Alias)
+				require.Equal(test.platform, from.Platform)
 			} else {
 				require.Error(err)
 			}
@@ -39,8 +39,8 @@ func TestNewHealthcheckDirective(t *testing.T) {
 		retries     int
 		test        []string
 	}{
-		{"none", true, "healthcheck none", d0, d0, d0, 0, []string{"None"}},
-		{"none escaped", true, "healthcheck \\\nnoNE", d0, d0, d0, 0, []string{"None"}},
+		{"none", true, "healthcheck none", d0, d0, d0, 0, []string{"NONE"}},
+		{"none escaped", true, "healthcheck \\\nnoNE", d0, d0, d0, 0, []string{"NONE"}},
 		{"empty cmd", false, "healthcheck cmd", d0, d0, d0, 0, nil},
 		{"substitution", true, `healthcheck cMD ["${prefix}this", "cmd${suffix}"]`, d0, d0, d0, 0, []string{"CMD", "test_this", "cmd_test"}},
 		{"substitution 2", true, `healthcheck cmd ["this"$comma "cmd"]`, d0, d0, d0, 0, []string{"CMD", "this", "cmd"}},
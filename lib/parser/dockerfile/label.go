@@ -28,7 +28,7 @@ func newLabelDirective(base *baseDirective, state *parsingState) (Directive, err
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	labels, err := parseKeyVals(base.Args)
+	labels, err := parseKeyVals(base.Args, state.escape)
 	if err != nil {
 		return nil, err
 	}
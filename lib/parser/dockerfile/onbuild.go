@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errBadTrigger = errors.New("ONBUILD trigger can't be ONBUILD, FROM or MAINTAINER")
+
+// OnbuildDirective represents the "ONBUILD" dockerfile command.
+type OnbuildDirective struct {
+	*baseDirective
+	Trigger string
+}
+
+// Variables:
+//
+//	Not replaced, the trigger is stored as is. Variables are replaced when it
+//	is run by the builds using the image as base.
+//
+// Formats:
+//
+//	ONBUILD <instruction>
+func newOnbuildDirective(base *baseDirective, state *parsingState) (Directive, error) {
+	trigger, err := newBaseDirective(base.Args)
+	if err != nil {
+		return nil, base.err(err)
+	} else if trigger == nil {
+		return nil, base.err(errMissingArgs)
+	}
+	switch trigger.t {
+	case "onbuild", "from", "maintainer":
+		return nil, base.err(errBadTrigger)
+	}
+	return &OnbuildDirective{base, base.Args}, nil
+}
+
+// Add this command to the build stage.
+func (d *OnbuildDirective) update(state *parsingState) error {
+	return state.addToCurrStage(d)
+}
+
+// ParseTriggers parses the ONBUILD triggers inherited from a base image into
+// directives, run right after the FROM directive of the stage using it.
+// Variables are replaced using the env of the base image, ARG triggers are
+// resolved with the build args of the child build, and shell forms use the
+// shell of the base image, if any.
+func ParseTriggers(
+	triggers []string, env []string, shell []string, buildArgs map[string]string) ([]Directive, error) {
+
+	if buildArgs == nil {
+		buildArgs = make(map[string]string)
+	}
+	state := newParsingState(buildArgs)
+	state.addStage(newStage(nil))
+	state.stageVars = make(map[string]string)
+	state.stageShell = shell
+	for _, kv := range env {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			state.stageVars[parts[0]] = parts[1]
+		}
+	}
+
+	for i, trigger := range triggers {
+		directive, err := newDirective(trigger, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new directive (trigger %d): %s", i+1, err)
+		} else if directive == nil {
+			continue
+		}
+		switch directive.(type) {
+		case *FromDirective, *MaintainerDirective, *OnbuildDirective:
+			return nil, fmt.Errorf("invalid trigger %d: %s", i+1, errBadTrigger)
+		}
+		if err := directive.update(state); err != nil {
+			return nil, fmt.Errorf("failed to update parser state (trigger %d): %s", i+1, err)
+		}
+	}
+	return state.stages[0].Directives, nil
+}
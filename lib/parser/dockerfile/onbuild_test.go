@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOnbuildDirective(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"prefix": "test_"}
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		input   string
+		trigger string
+	}{
+		{"run", true, "onbuild RUN echo ${prefix}hello", "RUN echo ${prefix}hello"},
+		{"copy", true, "ONBUILD copy . /app", "copy . /app"},
+		{"empty", false, "onbuild ", ""},
+		{"onbuild", false, "onbuild onbuild run ls", ""},
+		{"from", false, "onbuild FROM alpine", ""},
+		{"maintainer", false, "onbuild maintainer me", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				casted, ok := directive.(*OnbuildDirective)
+				require.True(ok)
+				require.Equal(test.trigger, casted.Trigger)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseTriggers(t *testing.T) {
+	require := require.New(t)
+
+	directives, err := ParseTriggers(
+		[]string{"ENV dir=/app", "COPY . ${dir}", "RUN make -C ${dir} ${target}"},
+		[]string{"PATH=/bin", "target=all"}, nil, nil)
+	require.NoError(err)
+	require.Len(directives, 3)
+	copyDirective, ok := directives[1].(*CopyDirective)
+	require.True(ok)
+	require.Equal("/app", copyDirective.Dst)
+	runDirective, ok := directives[2].(*RunDirective)
+	require.True(ok)
+	require.Equal("make -C /app all", runDirective.Cmd)
+
+	_, err = ParseTriggers([]string{"FROM alpine"}, nil, nil, nil)
+	require.Error(err)
+	_, err = ParseTriggers([]string{"BOGUS x"}, nil, nil, nil)
+	require.Error(err)
+}
+
+func TestParseTriggersBuildArgsAndShell(t *testing.T) {
+	require := require.New(t)
+
+	directives, err := ParseTriggers(
+		[]string{"ARG version=1", "ARG target", "RUN make ${target} VERSION=${version}", "CMD make ${target}"},
+		nil, []string{"/bin/bash", "-c"}, map[string]string{"target": "install"})
+	require.NoError(err)
+	require.Len(directives, 4)
+	runDirective, ok := directives[2].(*RunDirective)
+	require.True(ok)
+	require.Equal("make install VERSION=1", runDirective.Cmd)
+	cmdDirective, ok := directives[3].(*CmdDirective)
+	require.True(ok)
+	require.Equal([]string{"/bin/bash", "-c", "make install"}, cmdDirective.Cmd)
+}
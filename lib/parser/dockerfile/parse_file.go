@@ -15,30 +15,51 @@
 package dockerfile
 
 import (
-	"bufio"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
+// heredocRegexp matches heredoc markers, e.g. <<EOF, <<-EOF or <<"EOF".
+var heredocRegexp = regexp.MustCompile(`^<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)$`)
+
+// Heredoc is a here-document of a RUN or COPY directive, e.g. `RUN <<EOF`.
+// Its content is on the lines following the directive, up to a line
+// containing only its name.
+type Heredoc struct {
+	Name    string
+	Content string
+	// Expand is false if the name is quoted, in which case variables in the
+	// content are not replaced.
+	Expand bool
+}
+
 // ParseFile parses dockerfile from given reader, returns a ParsedFile object.
 func ParseFile(filecontents string, args map[string]string) ([]*Stage, error) {
-	filecontents = removeCommentLines(filecontents)
-	filecontents = strings.Replace(filecontents, "\\\n", "", -1)
-	reader := strings.NewReader(filecontents)
-	scanner := bufio.NewScanner(reader)
-
 	if args == nil {
 		args = make(map[string]string)
 	}
 
 	state := newParsingState(args)
+	lines := strings.Split(filecontents, "\n")
+	escape, err := parseParserDirectives(lines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parser directives: %s", err)
+	}
+	state.escape = escape
 	var count int
-	for scanner.Scan() {
+	for i := 0; i < len(lines); {
+		var text string
+		text, i = nextLine(lines, i, escape)
 		count++
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("file scanning failed (line %d): %s", count, err)
+
+		heredocs, next, err := readHeredocs(text, lines, i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read heredocs (line %d): %s", count, err)
 		}
-		text := scanner.Text()
+		i = next
+		state.heredocs = heredocs
+
 		if directive, err := newDirective(text, state); err != nil {
 			return nil, fmt.Errorf("failed to create new directive (line %d): %s", count, err)
 		} else if directive == nil {
@@ -51,17 +72,84 @@ func ParseFile(filecontents string, args map[string]string) ([]*Stage, error) {
 	return state.stages, nil
 }
 
-func removeCommentLines(filecontents string) string {
-	lines := strings.Split(filecontents, "\n")
-	var output string
-	for _, line := range lines {
-		trimmed := strings.Trim(line, " \t")
-		if len(trimmed) != 0 && trimmed[0] == '#' {
+// nextLine returns the logical line starting at lines[i], and the index of
+// the line following it. Lines ending with the escape character are joined
+// with the next one, and comment and empty lines are skipped.
+func nextLine(lines []string, i int, escape rune) (string, int) {
+	var line string
+	for ; i < len(lines); i++ {
+		if isCommentOrEmpty(lines[i]) {
+			continue
+		} else if strings.HasSuffix(lines[i], string(escape)) {
+			line += strings.TrimSuffix(lines[i], string(escape))
 			continue
-		} else if len(trimmed) == 0 {
+		}
+		return line + lines[i], i + 1
+	}
+	return line, i
+}
+
+// readHeredocs reads the content of the heredocs of a RUN or COPY directive
+// from the lines starting at lines[i]. It returns the heredocs, and the index
+// of the line following them.
+func readHeredocs(text string, lines []string, i int) ([]Heredoc, int, error) {
+	fields := strings.Fields(uncomment(text))
+	if len(fields) == 0 {
+		return nil, i, nil
+	}
+	switch strings.ToLower(fields[0]) {
+	case "run", "copy":
+	default:
+		return nil, i, nil
+	}
+
+	var heredocs []Heredoc
+	for _, field := range fields[1:] {
+		m := heredocRegexp.FindStringSubmatch(field)
+		if m == nil || m[2] != m[4] {
 			continue
 		}
-		output += line + "\n"
+		stripTabs, name := m[1] == "-", m[3]
+		var content string
+		for ; ; i++ {
+			if i == len(lines) {
+				return nil, i, fmt.Errorf("heredoc %s not terminated", name)
+			}
+			line := lines[i]
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == name {
+				i++
+				break
+			}
+			content += line + "\n"
+		}
+		heredocs = append(heredocs, Heredoc{name, content, m[2] == ""})
 	}
-	return output
+	return heredocs, i, nil
+}
+
+// heredocBodies returns the content of the heredocs, each followed by a line
+// with its name.
+func heredocBodies(heredocs []Heredoc) string {
+	var bodies string
+	for _, heredoc := range heredocs {
+		bodies += heredoc.Content + heredoc.Name + "\n"
+	}
+	return bodies
+}
+
+// heredocName returns the name of the heredoc if s is a heredoc marker.
+func heredocName(s string) (string, bool) {
+	m := heredocRegexp.FindStringSubmatch(s)
+	if m == nil || m[2] != m[4] {
+		return "", false
+	}
+	return m[3], true
+}
+
+func isCommentOrEmpty(line string) bool {
+	trimmed := strings.Trim(line, " \t")
+	return len(trimmed) == 0 || trimmed[0] == '#'
 }
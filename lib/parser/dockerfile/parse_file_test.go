@@ -89,21 +89,58 @@ func TestParseSucceeds(t *testing.T) {
 	}
 }
 
-func TestRemoveComments(t *testing.T) {
-	t.Run("simple", func(t *testing.T) {
-		contents := `RUN echo asd #!COMMIT
-	RUN apt-get install -y qwasd \
-
-		# asdwqe
-		zxczxd #!COMMIT
-`
-		cleaned := `RUN echo asd #!COMMIT
-	RUN apt-get install -y qwasd \
-		zxczxd #!COMMIT
-`
-		output := removeCommentLines(contents)
-		require.Equal(t, output, cleaned)
-	})
+func TestParseHeredocs(t *testing.T) {
+	require := require.New(t)
+
+	stages, err := ParseFile(`
+FROM alpine
+ENV name=world
+RUN <<EOF
+# Comments and empty lines are kept.
+
+echo hello
+EOF
+RUN cat <<-EOF > /greeting #!COMMIT
+	hello ${name}
+	EOF
+COPY <<EOF <<"RAW" /etc/
+hello ${name}
+EOF
+hello ${name}
+RAW
+`, nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+	directives := stages[0].Directives
+	require.Len(directives, 4)
+
+	run := directives[1].(*RunDirective)
+	require.Equal("# Comments and empty lines are kept.\n\necho hello\n", run.Cmd)
+	require.Contains(run.Args, "echo hello")
+
+	// Heredocs of commands are passed to the shell.
+	run = directives[2].(*RunDirective)
+	require.Equal("cat <<-EOF > /greeting\nhello ${name}\nEOF\n", run.Cmd)
+	require.True(run.Commit)
+
+	// Variables are replaced unless the name is quoted.
+	copyDirective := directives[3].(*CopyDirective)
+	require.Equal([]string{"EOF", "RAW"}, copyDirective.Srcs)
+	require.Equal("/etc/", copyDirective.Dst)
+	require.Equal(map[string]string{
+		"EOF": "hello world\n",
+		"RAW": "hello ${name}\n",
+	}, copyDirective.Heredocs)
+
+	for _, dockerfile := range []string{
+		"FROM alpine\nRUN <<EOF\necho hello\n",
+		"FROM alpine\nRUN [\"sh\", \"<<EOF\"]\necho hello\nEOF\n",
+		"FROM alpine\nCOPY <<EOF file /dst/\nhello\nEOF\n",
+		"FROM alpine\nCOPY --from=builder <<EOF /dst\nhello\nEOF\n",
+	} {
+		_, err := ParseFile(dockerfile, nil)
+		require.Error(err, dockerfile)
+	}
 }
 
 func invalidDirective() []*test {
@@ -127,6 +164,7 @@ func fromOnly() []*test {
 		&baseDirective{"from", "alpine:latest AS alias", false},
 		"alpine:latest",
 		"alias",
+		"",
 	})
 
 	tests = append(tests, &test{
@@ -147,16 +185,19 @@ func fromOnly() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	stage2 := newStage(&FromDirective{
 		&baseDirective{"from", "ubuntu:trusty AS alias2", false},
 		"ubuntu:trusty",
 		"alias2",
+		"",
 	})
 	stage3 := newStage(&FromDirective{
 		&baseDirective{"from", "ubuntu:trusty AS alias3", false},
 		"ubuntu:trusty",
 		"alias3",
+		"",
 	})
 
 	tests = append(tests, &test{
@@ -200,6 +241,7 @@ func globalArgs() []*test {
 		&baseDirective{"from", "${image}:latest AS alias1", false},
 		"${image}:latest",
 		"alias1",
+		"",
 	})
 	tests = append(tests, &test{
 		desc:       "global arg missing",
@@ -217,6 +259,7 @@ func globalArgs() []*test {
 		&baseDirective{"from", "${image}:latest AS alias1", false},
 		"${image}:latest",
 		"alias1",
+		"",
 	})
 	tests = append(tests, &test{
 		desc:       "global arg not set",
@@ -234,6 +277,7 @@ func globalArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 
 	tests = append(tests, &test{
@@ -252,6 +296,7 @@ func globalArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 
 	tests = append(tests, &test{
@@ -266,6 +311,7 @@ func globalArgs() []*test {
 		&baseDirective{"from", "ubuntu:latest AS alias1", false},
 		"ubuntu:latest",
 		"alias1",
+		"",
 	})
 
 	tests = append(tests, &test{
@@ -291,6 +337,7 @@ func stageArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
@@ -314,6 +361,7 @@ func stageArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	stage.addDirective(&ArgDirective{
 		&baseDirective{"arg", "cmd", false},
@@ -345,6 +393,7 @@ func stageArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	paramVal := "ls"
 	stage1.addDirective(&ArgDirective{
@@ -361,6 +410,7 @@ func stageArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias2", false},
 		"alpine:latest",
 		"alias2",
+		"",
 	})
 	stage2.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
@@ -384,6 +434,7 @@ func stageArgs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	paramVal = "ls"
 	stage.addDirective(&ArgDirective{
@@ -436,6 +487,7 @@ func envs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	stage1.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd ls", false},
@@ -449,6 +501,7 @@ func envs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias2", false},
 		"alpine:latest",
 		"alias2",
+		"",
 	})
 	stage2.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
@@ -476,6 +529,7 @@ func envs() []*test {
 		&baseDirective{"from", "alpine:latest AS alias1", false},
 		"alpine:latest",
 		"alias1",
+		"",
 	})
 	stage.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd ls", false},
@@ -554,6 +608,7 @@ func integration() []*test {
 		&baseDirective{"from", "alpine:latest AS test_alias1", false},
 		"alpine:latest",
 		"test_alias1",
+		"",
 	})
 	paramVal1 := "echo"
 	stage1.addDirective(&ArgDirective{
@@ -569,6 +624,10 @@ func integration() []*test {
 	stage1.addDirective(&RunDirective{
 		&baseDirective{"run", "echo echo ubuntu", false},
 		"echo echo ubuntu",
+		nil,
+		"",
+		nil,
+		"",
 	})
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "echo echo ubuntu", false},
@@ -583,6 +642,7 @@ func integration() []*test {
 		&baseDirective{"from", "alpine:latest AS test_alias2", false},
 		"alpine:latest",
 		"test_alias2",
+		"",
 	})
 	paramVal2 := "v2"
 	stage2.addDirective(&ArgDirective{
@@ -610,11 +670,15 @@ func integration() []*test {
 		&addCopyDirective{
 			&baseDirective{"copy", "--from=digest --chown=user:group src1 src2 src3 dst/", true},
 			"user:group",
+			"",
 			false,
 			[]string{"src1", "src2", "src3"},
 			"dst/",
+			false,
+			nil,
 		},
 		"digest",
+		nil,
 	})
 	stage2.addDirective(&WorkdirDirective{
 		&baseDirective{"workdir", "/path/to/home/dir", false},
@@ -625,6 +689,7 @@ func integration() []*test {
 		&baseDirective{"from", "alpine:latest AS test_alias3", false},
 		"alpine:latest",
 		"test_alias3",
+		"",
 	})
 	stage3.addDirective(&MaintainerDirective{
 		&baseDirective{"maintainer", `${alias}-maintainer <${alias}@example.com>`, false},
@@ -634,10 +699,14 @@ func integration() []*test {
 		&addCopyDirective{
 			&baseDirective{"add", `--chown=user:group ["src1", "src2", "src3", "dst/"]`, true},
 			"user:group",
+			"",
 			false,
 			[]string{"src1", "src2", "src3"},
 			"dst/",
+			false,
+			nil,
 		},
+		"",
 	})
 	stage3.addDirective(&ArgDirective{
 		&baseDirective{"arg", "cmd", false},
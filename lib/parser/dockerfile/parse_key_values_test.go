@@ -51,7 +51,7 @@ func TestParseKeyVals(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
 			require := require.New(t)
-			result, err := parseKeyVals(test.input)
+			result, err := parseKeyVals(test.input, '\\')
 			if test.succeed {
 				require.NoError(err)
 				require.Equal(test.output, result)
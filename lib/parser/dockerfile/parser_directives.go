@@ -0,0 +1,59 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// parserDirectiveRegexp matches parser directives, e.g. "# syntax=<image>".
+var parserDirectiveRegexp = regexp.MustCompile(`^#\s*([A-Za-z]+)\s*=\s*(\S+)\s*$`)
+
+// defaultEscape is the escape character used unless the escape parser
+// directive sets another one.
+const defaultEscape = '\\'
+
+// parseParserDirectives reads the parser directives at the top of the
+// Dockerfile and returns the escape character. Parser directives end at the
+// first line that isn't a known directive. The syntax and check directives
+// are known, but ignored.
+func parseParserDirectives(lines []string) (rune, error) {
+	escape := defaultEscape
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		m := parserDirectiveRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			break
+		}
+		name, val := strings.ToLower(m[1]), m[2]
+		switch name {
+		case "escape":
+			if val != "\\" && val != "`" {
+				return 0, fmt.Errorf("Invalid escape character: %s", val)
+			}
+			escape = rune(val[0])
+		case "syntax", "check":
+		default:
+			return escape, nil
+		}
+		if seen[name] {
+			return 0, fmt.Errorf("Parser directive appears twice: %s", name)
+		}
+		seen[name] = true
+	}
+	return escape, nil
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseParserDirectives(t *testing.T) {
+	tests := []struct {
+		desc    string
+		succeed bool
+		input   string
+		escape  rune
+	}{
+		{"none", true, "FROM scratch", '\\'},
+		{"escape", true, "# escape=`\nFROM scratch", '`'},
+		{"escape spaces", true, "#  ESCAPE = `  \nFROM scratch", '`'},
+		{"escape after syntax", true, "# syntax=docker/dockerfile:1\n# escape=`\nFROM scratch", '`'},
+		{"escape after comment", true, "# comment\n# escape=`\nFROM scratch", '\\'},
+		{"escape after empty line", true, "\n# escape=`\nFROM scratch", '\\'},
+		{"escape after unknown", true, "# unknown=value\n# escape=`\nFROM scratch", '\\'},
+		{"escape after directive", true, "FROM scratch\n# escape=`", '\\'},
+		{"escape invalid", false, "# escape=/\nFROM scratch", 0},
+		{"escape twice", false, "# escape=`\n# escape=\\\nFROM scratch", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			escape, err := parseParserDirectives(strings.Split(test.input, "\n"))
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.escape, escape)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseFileEscape(t *testing.T) {
+	require := require.New(t)
+
+	stages, err := ParseFile("# escape=`\n"+
+		"FROM scratch\n"+
+		"ENV DIR=c:\\app `\n"+
+		"    COST=`$5\n"+
+		"COPY [\"src\\\\a.txt\", \"c:\\\\app\\\\\"]\n"+
+		"WORKDIR $DIR\n"+
+		"COPY a.txt $DIR\\\n", nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+	require.Len(stages[0].Directives, 4)
+
+	env, ok := stages[0].Directives[0].(*EnvDirective)
+	require.True(ok)
+	require.Equal(map[string]string{"DIR": "c:\\app", "COST": "$5"}, env.Envs)
+	copy, ok := stages[0].Directives[1].(*CopyDirective)
+	require.True(ok)
+	require.Equal([]string{"src\\a.txt"}, copy.Srcs)
+	require.Equal("c:\\app\\", copy.Dst)
+	workdir, ok := stages[0].Directives[2].(*WorkdirDirective)
+	require.True(ok)
+	require.Equal("c:\\app", workdir.WorkingDir)
+	copy, ok = stages[0].Directives[3].(*CopyDirective)
+	require.True(ok)
+	require.Equal("c:\\app\\", copy.Dst)
+}
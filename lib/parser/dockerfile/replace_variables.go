@@ -20,11 +20,12 @@ import (
 )
 
 // replaceVariables replaces all variables in the input string with their values
-// as defined in the provided map.
-func replaceVariables(input string, vars map[string]string) (string, error) {
+// as defined in the provided map. Variables preceded by the escape character
+// are kept.
+func replaceVariables(input string, vars map[string]string, escape rune) (string, error) {
 	var err error
 	var state replaceVarsState = &replaceVarsStateNone{
-		&replaceVarsBase{vars: vars},
+		&replaceVarsBase{vars: vars, escape: escape},
 	}
 	for i := 0; i < len(input); i++ {
 		state, err = state.nextRune(rune(input[i]))
@@ -51,6 +52,7 @@ type replaceVarsBase struct {
 	currDefaultCmd rune
 	currDefaultVal string
 	escaped        bool
+	escape         rune
 }
 
 func (b *replaceVarsBase) reset() {
@@ -97,10 +99,10 @@ type replaceVarsStateNone struct{ *replaceVarsBase }
 func (s *replaceVarsStateNone) nextRune(r rune) (replaceVarsState, error) {
 	if s.escaped {
 		if r != '$' {
-			s.result += "\\"
+			s.result += string(s.escape)
 		}
 		s.escaped = false
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return s, nil
 	} else if r == '$' {
@@ -167,7 +169,7 @@ func (s *replaceVarsStateVar) nextRune(r rune) (replaceVarsState, error) {
 		// We are not recursing, so just append the result and move on.
 		if len(s.varsInProgress) == 0 {
 			s.result += val
-			if r == '\\' {
+			if r == s.escape {
 				s.escaped = true
 			} else if r == '$' {
 				s.reset()
@@ -312,10 +314,10 @@ func (s *replaceVarsStateVarColon) nextRune(r rune) (replaceVarsState, error) {
 		return s, nil
 	} else if s.escaped {
 		if r != '}' {
-			s.currDefaultVal += "\\"
+			s.currDefaultVal += string(s.escape)
 		}
 		s.escaped = false
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return s, nil
 	} else if r == '}' {
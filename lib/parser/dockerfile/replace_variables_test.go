@@ -44,7 +44,7 @@ func TestReplaceVariable(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			require := require.New(t)
 
-			base := &replaceVarsBase{"", test.vars, test.key, nil, test.defaultCmd, test.defaultVal, false}
+			base := &replaceVarsBase{"", test.vars, test.key, nil, test.defaultCmd, test.defaultVal, false, '\\'}
 			val, ok, err := base.resolveCurrVar()
 			if test.succeed {
 				require.NoError(err)
@@ -113,7 +113,7 @@ func TestReplaceVariables(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			require := require.New(t)
 
-			output, err := replaceVariables(test.input, test.vars)
+			output, err := replaceVariables(test.input, test.vars, '\\')
 			if test.succeed {
 				require.NoError(err)
 			} else {
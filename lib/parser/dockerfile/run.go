@@ -15,6 +15,8 @@
 package dockerfile
 
 import (
+	"fmt"
+	"path"
 	"strings"
 )
 
@@ -22,23 +24,102 @@ import (
 type RunDirective struct {
 	*baseDirective
 	Cmd string
+
+	// CacheInputs are context paths whose content is part of the cache ID.
+	CacheInputs []string
+	// Workdir is the working dir of this command only. Relative paths are
+	// relative to the stage's WORKDIR.
+	Workdir string
+	// Mounts are only present while the command runs.
+	Mounts []*RunMount
+	// Network is the network mode of the command, could be "default", "none"
+	// or "host". Empty means default.
+	Network string
 }
 
 // Variables:
 //   Replaced from ARGs and ENVs from within our stage.
 // Formats:
-//   RUN ["<executable>", "<param>"...]
-//   RUN ["<param>"...]
-//   RUN <command>
+//   RUN [--cache-inputs=<path>,...] [--workdir=<path>] [--mount=<opts>...] [--network=<mode>] ["<executable>", "<param>"...]
+//   RUN [--cache-inputs=<path>,...] [--workdir=<path>] [--mount=<opts>...] [--network=<mode>] ["<param>"...]
+//   RUN [--cache-inputs=<path>,...] [--workdir=<path>] [--mount=<opts>...] [--network=<mode>] <command>
+//   RUN [--cache-inputs=<path>,...] [--workdir=<path>] [--mount=<opts>...] [--network=<mode>] [<command>] <<EOF
+// Heredocs are passed to the shell with the command, which replaces their
+// variables. A heredoc without command is run as a script.
 func newRunDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	if cmd, ok := parseJSONArray(base.Args); ok {
-		return &RunDirective{base, strings.Join(cmd, " ")}, nil
+
+	args := strings.TrimSpace(base.Args)
+	var cacheInputs []string
+	var workdir string
+	var mounts []*RunMount
+	var network string
+	for {
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			break
+		}
+		if val, ok, err := parseStringFlag(fields[0], "cache-inputs"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			for _, input := range strings.Split(val, ",") {
+				if input == "" {
+					return nil, base.err(fmt.Errorf("Empty path in flag: cache-inputs"))
+				} else if path.IsAbs(input) {
+					// Cache IDs are computed before the image file system
+					// exists, so only context paths can be hashed.
+					return nil, base.err(fmt.Errorf(
+						"Cache input %s must be relative to the context dir, image paths are not supported", input))
+				}
+				cacheInputs = append(cacheInputs, input)
+			}
+		} else if val, ok, err := parseStringFlag(fields[0], "workdir"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			workdir = val
+		} else if val, ok, err := parseStringFlag(fields[0], "mount"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			mount, err := parseRunMount(val)
+			if err != nil {
+				return nil, base.err(err)
+			}
+			mounts = append(mounts, mount)
+		} else if val, ok, err := parseStringFlag(fields[0], "network"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			if val != "default" && val != "none" && val != "host" {
+				return nil, base.err(fmt.Errorf("Unsupported network mode: %s", val))
+			}
+			network = val
+		} else {
+			break
+		}
+		args = strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+		if args == "" {
+			return nil, base.err(errMissingArgs)
+		}
+	}
+
+	if cmd, ok := parseJSONArray(args); ok {
+		if len(state.heredocs) > 0 {
+			return nil, base.err(fmt.Errorf("Heredocs can't be used with JSON format"))
+		}
+		return &RunDirective{base, strings.Join(cmd, " "), cacheInputs, workdir, mounts, network}, nil
+	}
+
+	if len(state.heredocs) > 0 {
+		bodies := heredocBodies(state.heredocs)
+		base.Args += "\n" + bodies
+		if _, ok := heredocName(args); ok && len(state.heredocs) == 1 {
+			return &RunDirective{base, state.heredocs[0].Content, cacheInputs, workdir, mounts, network}, nil
+		}
+		return &RunDirective{base, args + "\n" + bodies, cacheInputs, workdir, mounts, network}, nil
 	}
 
-	return &RunDirective{base, base.Args}, nil
+	return &RunDirective{base, args, cacheInputs, workdir, mounts, network}, nil
 }
 
 // Add this command to the build stage.
@@ -0,0 +1,163 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Mount types of RUN directives.
+const (
+	MountTypeBind   = "bind"
+	MountTypeCache  = "cache"
+	MountTypeSecret = "secret"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// RunMount is a mount given to a RUN directive by `--mount=<key>=<value>,...`.
+type RunMount struct {
+	Type string
+	// Source is the path of bind mounts relative to the context dir.
+	Source string
+	Target string
+	// ID identifies the cache of cache mounts, defaulting to the target, and
+	// the secret of secret mounts, defaulting to the target's base name.
+	ID string
+	// Required makes RUN fail if the secret of a secret mount is missing,
+	// instead of running without it.
+	Required bool
+	// ReadWrite makes bind mounts writable, set by `rw`. Writes are discarded
+	// once the command finished. Bind mounts are read-only by default.
+	ReadWrite bool
+	// UID, GID and Mode are the owner and permissions of the dir of cache
+	// mounts, owned by root with mode 0755 by default, and of the file of
+	// secret mounts, owned by root with mode 0400 by default.
+	UID  int
+	GID  int
+	Mode os.FileMode
+}
+
+// parseRunMount parses the value of a `--mount` flag. Mounts are bind mounts
+// by default, like in BuildKit. Boolean options can be given without value.
+func parseRunMount(val string) (*RunMount, error) {
+	mount := &RunMount{Type: MountTypeBind}
+	var readWriteSet, ownerSet, modeSet bool
+	for _, opt := range strings.Split(val, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		key := strings.ToLower(kv[0])
+		switch key {
+		case "required", "ro", "readonly", "rw", "readwrite":
+			b := true
+			if len(kv) == 2 {
+				var err error
+				if b, err = strconv.ParseBool(kv[1]); err != nil {
+					return nil, fmt.Errorf("Malformed mount option: %s", opt)
+				}
+			}
+			switch key {
+			case "required":
+				mount.Required = b
+			case "ro", "readonly":
+				mount.ReadWrite = !b
+				readWriteSet = true
+			case "rw", "readwrite":
+				mount.ReadWrite = b
+				readWriteSet = true
+			}
+			continue
+		}
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Malformed mount option: %s", opt)
+		}
+		switch key {
+		case "type":
+			mount.Type = kv[1]
+		case "source", "src":
+			mount.Source = kv[1]
+		case "target", "dst", "destination":
+			mount.Target = kv[1]
+		case "id":
+			mount.ID = kv[1]
+		case "uid", "gid":
+			id, err := strconv.Atoi(kv[1])
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("Malformed mount option: %s", opt)
+			}
+			if key == "uid" {
+				mount.UID = id
+			} else {
+				mount.GID = id
+			}
+			ownerSet = true
+		case "mode":
+			mode, err := strconv.ParseUint(kv[1], 8, 32)
+			if err != nil || mode > 07777 {
+				return nil, fmt.Errorf("Malformed mount option: %s", opt)
+			}
+			mount.Mode = os.FileMode(mode)
+			ownerSet, modeSet = true, true
+		default:
+			return nil, fmt.Errorf("Unsupported mount option: %s", kv[0])
+		}
+	}
+
+	switch mount.Type {
+	case MountTypeBind:
+		if mount.Source == "" {
+			mount.Source = "."
+		}
+	case MountTypeCache:
+		if mount.ID == "" {
+			mount.ID = mount.Target
+		}
+		if !modeSet {
+			mount.Mode = 0755
+		}
+	case MountTypeSecret:
+		if mount.ID == "" && mount.Target == "" {
+			return nil, fmt.Errorf("Missing secret id or mount target")
+		}
+		if mount.ID == "" {
+			mount.ID = path.Base(mount.Target)
+		}
+		if mount.Target == "" {
+			mount.Target = path.Join("/run/secrets", mount.ID)
+		}
+		if !modeSet {
+			mount.Mode = 0400
+		}
+	case MountTypeTmpfs:
+	default:
+		return nil, fmt.Errorf("Unsupported mount type: %s", mount.Type)
+	}
+	if mount.Target == "" {
+		return nil, fmt.Errorf("Missing mount target")
+	} else if mount.Source != "" && mount.Type != MountTypeBind {
+		return nil, fmt.Errorf("Mount option source is only supported by bind mounts")
+	} else if mount.ID != "" && mount.Type != MountTypeCache && mount.Type != MountTypeSecret {
+		return nil, fmt.Errorf("Mount option id is only supported by cache and secret mounts")
+	} else if mount.Required && mount.Type != MountTypeSecret {
+		return nil, fmt.Errorf("Mount option required is only supported by secret mounts")
+	} else if readWriteSet && mount.Type != MountTypeBind {
+		return nil, fmt.Errorf("Mount options ro and rw are only supported by bind mounts")
+	} else if ownerSet && mount.Type != MountTypeCache && mount.Type != MountTypeSecret {
+		return nil, fmt.Errorf("Mount options uid, gid and mode are only supported by cache and secret mounts")
+	}
+	return mount, nil
+}
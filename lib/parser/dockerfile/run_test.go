@@ -24,16 +24,107 @@ func TestNewRunDirective(t *testing.T) {
 	buildState := newParsingState(make(map[string]string))
 	buildState.stageVars = map[string]string{"prefix": "test_", "suffix": "_test", "comma": ","}
 
+	tests := []struct {
+		desc        string
+		succeed     bool
+		input       string
+		cmd         string
+		cacheInputs []string
+		workdir     string
+	}{
+		{"good json", true, `run ["this", "cmd"]`, "this cmd", nil, ""},
+		{"substitution", true, `run ["${prefix}this", "cmd${suffix}"]`, "test_this cmd_test", nil, ""},
+		{"substitution2", true, `run ["this"$comma "cmd"]`, "this cmd", nil, ""},
+		{"bad substitution", false, `run ["${prefixthis", "cmd${suffix}"]`, "", nil, ""},
+		{"cache inputs", true, `run --cache-inputs=a.txt,dir/b this cmd`, "this cmd", []string{"a.txt", "dir/b"}, ""},
+		{"cache inputs json", true, `run --cache-inputs=a.txt ["this", "cmd"]`, "this cmd", []string{"a.txt"}, ""},
+		{"cache inputs substitution", true, `run --cache-inputs=${prefix}a this cmd`, "this cmd", []string{"test_a"}, ""},
+		{"cache inputs empty", false, `run --cache-inputs= this cmd`, "", nil, ""},
+		{"cache inputs empty path", false, `run --cache-inputs=a,,b this cmd`, "", nil, ""},
+		{"cache inputs no cmd", false, `run --cache-inputs=a`, "", nil, ""},
+		{"cache inputs image path", false, `run --cache-inputs=a,/etc/app.conf this cmd`, "", nil, ""},
+		{"workdir", true, `run --workdir=/app this cmd`, "this cmd", nil, "/app"},
+		{"workdir json", true, `run --workdir=sub ["this", "cmd"]`, "this cmd", nil, "sub"},
+		{"workdir substitution", true, `run --workdir=/${prefix}dir this cmd`, "this cmd", nil, "/test_dir"},
+		{"workdir and cache inputs", true, `run --workdir=/app --cache-inputs=a this cmd`, "this cmd", []string{"a"}, "/app"},
+		{"workdir empty", false, `run --workdir= this cmd`, "", nil, ""},
+		{"workdir no cmd", false, `run --workdir=/app`, "", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				run, ok := directive.(*RunDirective)
+				require.True(ok)
+				require.Equal(test.cmd, run.Cmd)
+				require.Equal(test.cacheInputs, run.CacheInputs)
+				require.Equal(test.workdir, run.Workdir)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewRunDirectiveMounts(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"dir": "/root/.cache"}
+
 	tests := []struct {
 		desc    string
 		succeed bool
 		input   string
-		cmd     string
+		mounts  []*RunMount
 	}{
-		{"good json", true, `run ["this", "cmd"]`, "this cmd"},
-		{"substitution", true, `run ["${prefix}this", "cmd${suffix}"]`, "test_this cmd_test"},
-		{"substitution2", true, `run ["this"$comma "cmd"]`, "this cmd"},
-		{"bad substitution", false, `run ["${prefixthis", "cmd${suffix}"]`, ""},
+		{"cache", true, `run --mount=type=cache,target=/root/.cache pip install .`,
+			[]*RunMount{{"cache", "", "/root/.cache", "/root/.cache", false, false, 0, 0, 0755}}},
+		{"cache id", true, `run --mount=type=cache,id=pip,dst=$dir ["pip", "install", "."]`,
+			[]*RunMount{{"cache", "", "/root/.cache", "pip", false, false, 0, 0, 0755}}},
+		{"multiple", true, `run --mount=type=cache,target=/a --mount=type=cache,target=/b make`,
+			[]*RunMount{
+				{"cache", "", "/a", "/a", false, false, 0, 0, 0755},
+				{"cache", "", "/b", "/b", false, false, 0, 0, 0755},
+			}},
+		{"secret", true, `run --mount=type=secret,id=npmrc npm install`,
+			[]*RunMount{{"secret", "", "/run/secrets/npmrc", "npmrc", false, false, 0, 0, 0400}}},
+		{"secret target", true, `run --mount=type=secret,target=/root/.npmrc,required npm install`,
+			[]*RunMount{{"secret", "", "/root/.npmrc", ".npmrc", true, false, 0, 0, 0400}}},
+		{"secret not required", true, `run --mount=type=secret,id=a,required=false make`,
+			[]*RunMount{{"secret", "", "/run/secrets/a", "a", false, false, 0, 0, 0400}}},
+		{"secret missing id", false, `run --mount=type=secret make`, nil},
+		{"secret malformed required", false, `run --mount=type=secret,id=a,required=maybe make`, nil},
+		{"cache required", false, `run --mount=type=cache,target=/a,required make`, nil},
+		{"missing target", false, `run --mount=type=cache make`, nil},
+		{"unsupported type", false, `run --mount=type=ssh,target=/a make`, nil},
+		{"bind", true, `run --mount=target=/src,ro make`,
+			[]*RunMount{{"bind", ".", "/src", "", false, false, 0, 0, 0}}},
+		{"bind source", true, `run --mount=type=bind,source=go.mod,target=/app/go.mod,readonly=true go mod download`,
+			[]*RunMount{{"bind", "go.mod", "/app/go.mod", "", false, false, 0, 0, 0}}},
+		{"bind rw", true, `run --mount=type=bind,target=/src,rw make`,
+			[]*RunMount{{"bind", ".", "/src", "", false, true, 0, 0, 0}}},
+		{"bind readonly false", true, `run --mount=type=bind,target=/src,readonly=false make`,
+			[]*RunMount{{"bind", ".", "/src", "", false, true, 0, 0, 0}}},
+		{"cache rw", false, `run --mount=type=cache,target=/a,rw make`, nil},
+		{"tmpfs ro", false, `run --mount=type=tmpfs,target=/tmp,ro make`, nil},
+		{"bind from", false, `run --mount=type=bind,from=builder,target=/src make`, nil},
+		{"tmpfs", true, `run --mount=type=tmpfs,target=/tmp make`,
+			[]*RunMount{{"tmpfs", "", "/tmp", "", false, false, 0, 0, 0}}},
+		{"tmpfs missing target", false, `run --mount=type=tmpfs make`, nil},
+		{"tmpfs source", false, `run --mount=type=tmpfs,source=a,target=/tmp make`, nil},
+		{"tmpfs id", false, `run --mount=type=tmpfs,id=a,target=/tmp make`, nil},
+		{"unsupported option", false, `run --mount=type=cache,target=/a,foo=bar make`, nil},
+		{"malformed option", false, `run --mount=type=cache,target make`, nil},
+		{"no cmd", false, `run --mount=type=cache,target=/a`, nil},
+		{"cache owner", true, `run --mount=type=cache,target=/a,uid=1000,gid=1001,mode=0700 make`,
+			[]*RunMount{{"cache", "", "/a", "/a", false, false, 1000, 1001, 0700}}},
+		{"cache malformed uid", false, `run --mount=type=cache,target=/a,uid=me make`, nil},
+		{"cache malformed mode", false, `run --mount=type=cache,target=/a,mode=rwx make`, nil},
+		{"secret owner", true, `run --mount=type=secret,id=a,uid=1000,gid=1001,mode=0440 make`,
+			[]*RunMount{{"secret", "", "/run/secrets/a", "a", false, false, 1000, 1001, 0440}}},
+		{"bind mode", false, `run --mount=type=bind,target=/src,mode=0700 make`, nil},
 	}
 
 	for _, test := range tests {
@@ -44,7 +135,41 @@ func TestNewRunDirective(t *testing.T) {
 				require.NoError(err)
 				run, ok := directive.(*RunDirective)
 				require.True(ok)
-				require.Equal(test.cmd, run.Cmd)
+				require.Equal(test.mounts, run.Mounts)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewRunDirectiveNetwork(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"mode": "none"}
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		input   string
+		network string
+	}{
+		{"unset", true, `run this cmd`, ""},
+		{"none", true, `run --network=none this cmd`, "none"},
+		{"host json", true, `run --network=host ["this", "cmd"]`, "host"},
+		{"substitution", true, `run --network=$mode this cmd`, "none"},
+		{"bad mode", false, `run --network=bridge this cmd`, ""},
+		{"no cmd", false, `run --network=none`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				run, ok := directive.(*RunDirective)
+				require.True(ok)
+				require.Equal(test.network, run.Network)
 			} else {
 				require.Error(err)
 			}
@@ -0,0 +1,54 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import "errors"
+
+var errBadShell = errors.New("SHELL requires a non-empty JSON array")
+
+// defaultShell is the shell of shell-form commands if SHELL isn't set.
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// ShellDirective represents the "SHELL" dockerfile command.
+type ShellDirective struct {
+	*baseDirective
+	Shell []string
+}
+
+// Variables:
+//
+//	Not replaced.
+//
+// Formats:
+//
+//	SHELL ["<executable>", "<param>"...]
+func newShellDirective(base *baseDirective, state *parsingState) (Directive, error) {
+	shell, ok := parseJSONArray(base.Args)
+	if !ok || len(shell) == 0 {
+		return nil, base.err(errBadShell)
+	}
+	return &ShellDirective{base, shell}, nil
+}
+
+// update:
+//  1. Sets the shell of the following shell-form commands of the stage.
+//  2. Adds this command to the build stage.
+func (d *ShellDirective) update(state *parsingState) error {
+	if err := state.addToCurrStage(d); err != nil {
+		return err
+	}
+	state.stageShell = d.Shell
+	return nil
+}
@@ -0,0 +1,78 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewShellDirective(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		input   string
+		shell   []string
+	}{
+		{"bash", true, `shell ["/bin/bash", "-o", "pipefail", "-c"]`, []string{"/bin/bash", "-o", "pipefail", "-c"}},
+		{"not json", false, "shell /bin/bash -c", nil},
+		{"empty", false, "shell []", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				casted, ok := directive.(*ShellDirective)
+				require.True(ok)
+				require.Equal(test.shell, casted.Shell)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestShellDirectiveAffectsShellForm(t *testing.T) {
+	require := require.New(t)
+
+	stages, err := ParseFile(`
+FROM alpine
+CMD echo default
+SHELL ["/bin/bash", "-c"]
+CMD echo bash
+ENTRYPOINT exec server
+CMD ["echo", "exec"]
+FROM alpine
+CMD echo reset
+`, nil)
+	require.NoError(err)
+	require.Len(stages, 2)
+
+	directives := stages[0].Directives
+	require.Len(directives, 5)
+	require.Equal([]string{"/bin/sh", "-c", "echo default"}, directives[0].(*CmdDirective).Cmd)
+	require.Equal([]string{"/bin/bash", "-c", "echo bash"}, directives[2].(*CmdDirective).Cmd)
+	require.Equal([]string{"/bin/bash", "-c", "exec server"}, directives[3].(*EntrypointDirective).Entrypoint)
+	require.Equal([]string{"echo", "exec"}, directives[4].(*CmdDirective).Cmd)
+
+	// The shell is reset by FROM.
+	require.Equal([]string{"/bin/sh", "-c", "echo reset"}, stages[1].Directives[0].(*CmdDirective).Cmd)
+}
@@ -21,11 +21,11 @@ import (
 )
 
 // splitArgs splits a whitespace-delimited string into an array of arguments,
-// not splitting quoted arguments.
-func splitArgs(input string, forShell bool) ([]string, error) {
+// not splitting quoted arguments nor whitespace preceded by the escape character.
+func splitArgs(input string, forShell bool, escape rune) ([]string, error) {
 	var err error
 	var state splitArgsState = &splitArgsStateSpace{
-		&splitArgsBase{args: make([]string, 0), forShell: forShell},
+		&splitArgsBase{args: make([]string, 0), forShell: forShell, escape: escape},
 	}
 	for i := 0; i < len(input); i++ {
 		state, err = state.nextRune(rune(input[i]))
@@ -48,6 +48,7 @@ type splitArgsBase struct {
 	args    []string
 	currArg string
 	escaped bool
+	escape  rune
 	// This allows for shell escaping (keeping quotes and handling quote ending with common char)
 	forShell bool
 }
@@ -66,7 +67,7 @@ func (s *splitArgsStateSpace) nextRune(r rune) (splitArgsState, error) {
 			s.currArg += "\""
 		}
 		return &splitArgsStateQuote{s.splitArgsBase}, nil
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 	} else if s.forShell && (r == '&' || r == '|' || r == ';') {
 		if len(s.currArg) > 0 {
@@ -94,7 +95,7 @@ type splitArgsStateArg struct{ *splitArgsBase }
 func (s *splitArgsStateArg) nextRune(r rune) (splitArgsState, error) {
 	if s.escaped {
 		if !unicode.IsSpace(r) && r != '"' {
-			s.currArg += "\\"
+			s.currArg += string(s.escape)
 		}
 		s.escaped = false
 	} else if unicode.IsSpace(r) {
@@ -125,10 +126,10 @@ type splitArgsStateQuote struct{ *splitArgsBase }
 func (s *splitArgsStateQuote) nextRune(r rune) (splitArgsState, error) {
 	if s.escaped {
 		if r != '"' || s.forShell {
-			s.currArg += "\\"
+			s.currArg += string(s.escape)
 		}
 		s.escaped = false
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return s, nil
 	} else if r == '"' {
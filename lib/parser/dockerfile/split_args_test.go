@@ -46,7 +46,7 @@ func TestSplitArgs(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
 			require := require.New(t)
-			result, err := splitArgs(test.input, test.keepQuotes)
+			result, err := splitArgs(test.input, test.keepQuotes, '\\')
 			if test.succeed {
 				require.NoError(err)
 				require.Equal(test.output, result)
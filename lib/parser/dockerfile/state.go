@@ -49,12 +49,28 @@ type parsingState struct {
 	// ENV directives that occurred during the current stage, used in
 	// variable replacements in other directives in the stage.
 	stageVars map[string]string
+
+	// stageShell is the shell set by the last SHELL directive of the current
+	// stage, used to run shell-form CMD and ENTRYPOINT directives.
+	stageShell []string
+
+	// heredocs are the heredocs of the directive being parsed.
+	heredocs []Heredoc
+
+	// escape is the escape character set by the escape parser directive.
+	escape rune
 }
 
 // newParsingState initializes a blank slate parsingState to begin parsing a dockerfile.
 func newParsingState(vars map[string]string) *parsingState {
+	globalArgs := make(map[string]string)
+	for _, name := range platformArgs {
+		if val, ok := vars[name]; ok {
+			globalArgs[name] = val
+		}
+	}
 	return &parsingState{
-		make([]*Stage, 0), vars, make(map[string]string), nil,
+		make([]*Stage, 0), vars, globalArgs, nil, nil, nil, defaultEscape,
 	}
 }
 
@@ -69,6 +85,16 @@ func (s *parsingState) addStage(stage *Stage) {
 	s.stages = append(s.stages, stage)
 }
 
+// shellCmd returns the command running cmd with the shell of the current
+// stage.
+func (s *parsingState) shellCmd(cmd string) []string {
+	shell := defaultShell
+	if len(s.stageShell) > 0 {
+		shell = s.stageShell
+	}
+	return append(append([]string{}, shell...), cmd)
+}
+
 // Add this command to the build stage.
 func (s *parsingState) addToCurrStage(d Directive) error {
 	stage, err := s.currStage()
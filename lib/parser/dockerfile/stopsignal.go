@@ -17,22 +17,46 @@ package dockerfile
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+// signalNames are the names of the signals STOPSIGNAL accepts, with or
+// without the SIG prefix.
+var signalNames = map[string]bool{
+	"ABRT": true, "ALRM": true, "BUS": true, "CHLD": true, "CONT": true,
+	"FPE": true, "HUP": true, "ILL": true, "INT": true, "IO": true,
+	"KILL": true, "PIPE": true, "PROF": true, "PWR": true, "QUIT": true,
+	"SEGV": true, "STKFLT": true, "STOP": true, "SYS": true, "TERM": true,
+	"TRAP": true, "TSTP": true, "TTIN": true, "TTOU": true, "URG": true,
+	"USR1": true, "USR2": true, "VTALRM": true, "WINCH": true, "XCPU": true,
+	"XFSZ": true,
+}
+
 // StopsignalDirective represents the "STOPSIGNAL" dockerfile command.
 type StopsignalDirective struct {
 	*baseDirective
-	Signal int
+	Signal string
 }
 
+// Variables:
+//
+//	Replaced from ARGs and ENVs from within our stage.
+//
 // Formats:
-//   STOPSIGNAL <value> ...
+//
+//	STOPSIGNAL <number>
+//	STOPSIGNAL <name>
 func newStopsignalDirective(base *baseDirective, state *parsingState) (Directive, error) {
-	signal, err := strconv.Atoi(base.Args)
-	if err != nil {
-		return nil, fmt.Errorf("signal must be integer: %s", err)
-	} else if signal < 0 {
-		return nil, fmt.Errorf("signal must be > 0: %v", signal)
+	if err := base.replaceVarsCurrStage(state); err != nil {
+		return nil, err
+	}
+	signal := base.Args
+	if n, err := strconv.Atoi(signal); err == nil {
+		if n <= 0 {
+			return nil, fmt.Errorf("signal must be > 0: %v", n)
+		}
+	} else if !signalNames[strings.TrimPrefix(strings.ToUpper(signal), "SIG")] {
+		return nil, fmt.Errorf("invalid signal: %s", signal)
 	}
 	return &StopsignalDirective{base, signal}, nil
 }
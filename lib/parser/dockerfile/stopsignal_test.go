@@ -1,3 +1,17 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package dockerfile
 
 import (
@@ -8,16 +22,22 @@ import (
 
 func TestNewStopsignalDirective(t *testing.T) {
 	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"signal": "SIGQUIT"}
 
 	tests := []struct {
 		desc    string
 		succeed bool
 		input   string
-		signal  int
+		signal  string
 	}{
-		{"simple", true, "stopsignal 9", 9},
-		{"not int", false, "stopsignal 123asd", 0},
-		{"bad signal", false, "stopsignal -1", 0},
+		{"simple", true, "stopsignal 9", "9"},
+		{"name", true, "stopsignal SIGTERM", "SIGTERM"},
+		{"name without prefix", true, "stopsignal kill", "kill"},
+		{"substitution", true, "stopsignal $signal", "SIGQUIT"},
+		{"not int", false, "stopsignal 123asd", ""},
+		{"bad signal", false, "stopsignal -1", ""},
+		{"zero", false, "stopsignal 0", ""},
+		{"bad name", false, "stopsignal SIGFOO", ""},
 	}
 
 	for _, test := range tests {
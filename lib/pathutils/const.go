@@ -59,3 +59,7 @@ const DefaultCACertsPath = "/makisu-internal/certs/cacerts.pem"
 
 // CacheKeyValueFileName is the name of local cache key value file.
 const CacheKeyValueFileName = "cache_key_value.json"
+
+// CacheStatsFileName is the name of the file counting the cache hits and
+// misses of builds.
+const CacheStatsFileName = "cache_stats.json"
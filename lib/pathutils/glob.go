@@ -0,0 +1,123 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pathutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const recursiveWildcard = "**"
+
+// GlobMatch is a path matched by GlobRecursive.
+type GlobMatch struct {
+	Path string
+	// Rel is the path relative to the dir matched by the elements of the
+	// pattern before the first "**".
+	Rel string
+}
+
+// HasRecursiveGlob returns true if an element of the pattern is "**".
+func HasRecursiveGlob(pattern string) bool {
+	for _, elem := range strings.Split(pattern, "/") {
+		if elem == recursiveWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// RecursiveGlobBase returns the elements of the pattern before the first "**",
+// or the pattern itself if it has no "**".
+func RecursiveGlobBase(pattern string) string {
+	base, _ := splitRecursiveGlob(pattern)
+	return base
+}
+
+// splitRecursiveGlob splits the pattern into the elements before the first
+// "**" and the elements from it on.
+func splitRecursiveGlob(pattern string) (string, []string) {
+	elems := strings.Split(pattern, "/")
+	for i, elem := range elems {
+		if elem != recursiveWildcard {
+			continue
+		} else if i == 0 {
+			return ".", elems
+		} else if i == 1 && elems[0] == "" {
+			return "/", elems[i:]
+		}
+		return strings.Join(elems[:i], "/"), elems[i:]
+	}
+	return pattern, nil
+}
+
+// GlobRecursive returns the paths matching the pattern, like filepath.Glob,
+// except that "**" elements match any number of directories. Once a directory
+// matches, its children are not matched anymore, as they are part of it.
+// The matches are sorted by path.
+func GlobRecursive(pattern string) ([]GlobMatch, error) {
+	base, rest := splitRecursiveGlob(pattern)
+	bases, err := filepath.Glob(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []GlobMatch
+	for _, base := range bases {
+		err := filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return err
+			} else if rel == "." {
+				return nil
+			}
+			if matchElems(rest, strings.Split(rel, "/")) {
+				matches = append(matches, GlobMatch{Path: p, Rel: rel})
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// MatchGlob returns true if the relative path matches the pattern, like
+// filepath.Match, except that "**" elements match any number of directories.
+func MatchGlob(pattern, rel string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchElems returns true if the path elements match the pattern elements.
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	} else if pattern[0] == recursiveWildcard {
+		return matchElems(pattern[1:], elems) ||
+			(len(elems) > 0 && matchElems(pattern, elems[1:]))
+	} else if len(elems) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], elems[0])
+	return err == nil && ok && matchElems(pattern[1:], elems[1:])
+}
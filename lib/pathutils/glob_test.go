@@ -0,0 +1,111 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pathutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecursiveGlobBase(t *testing.T) {
+	tests := []struct {
+		pattern string
+		base    string
+	}{
+		{"**/go.mod", "."},
+		{"src/**/go.mod", "src"},
+		{"/src/*/**", "/src/*"},
+		{"/**/go.mod", "/"},
+		{"src/*.go", "src/*.go"},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			require.Equal(t, test.base, RecursiveGlobBase(test.pattern))
+			require.Equal(t, test.base != test.pattern, HasRecursiveGlob(test.pattern))
+		})
+	}
+}
+
+func TestGlobRecursive(t *testing.T) {
+	root, err := ioutil.TempDir("", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, p := range []string{
+		"go.mod",
+		"a/go.mod",
+		"a/b/c/go.mod",
+		"a/b/c/main.go",
+		"a/testdata/x/testdata/file",
+		"d/go.sum",
+	} {
+		p = filepath.Join(root, p)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, nil, 0644))
+	}
+
+	tests := []struct {
+		pattern string
+		rels    []string
+	}{
+		{"**/go.mod", []string{"a/b/c/go.mod", "a/go.mod", "go.mod"}},
+		{"a/**/go.mod", []string{"b/c/go.mod", "go.mod"}},
+		{"**/go.*", []string{"a/b/c/go.mod", "a/go.mod", "d/go.sum", "go.mod"}},
+		{"a/**/c/*.go", []string{"b/c/main.go"}},
+		// Children of matched directories are not matched again.
+		{"**/testdata", []string{"a/testdata"}},
+		{"**/missing", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			require := require.New(t)
+			matches, err := GlobRecursive(filepath.Join(root, test.pattern))
+			require.NoError(err)
+			var rels []string
+			for _, match := range matches {
+				rels = append(rels, match.Rel)
+				base := RecursiveGlobBase(filepath.Join(root, test.pattern))
+				require.Equal(filepath.Join(base, match.Rel), match.Path)
+			}
+			require.Equal(test.rels, rels)
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{"vendor", "vendor", true},
+		{"vendor", "a/vendor", false},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "docs/README.md", true},
+		{"**/*.md", "README.md", true},
+		{"a/**/testdata", "a/b/c/testdata", true},
+		{"a/**/testdata", "b/testdata", false},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.rel, func(t *testing.T) {
+			require.Equal(t, test.match, MatchGlob(test.pattern, test.rel))
+		})
+	}
+}
@@ -17,13 +17,17 @@ package registry
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -43,6 +47,63 @@ const (
 	baseStartQuery    = "http://%s/v2/%s/blobs/uploads/"
 )
 
+var (
+	errDigestMismatch   = errors.New("layer digest did not match")
+	errManifestNotFound = errors.New("manifest not found")
+)
+
+// layerPull is a layer being pulled into an image store. It is shared by all
+// concurrent pulls of the layer into that store, which wait for done.
+type layerPull struct {
+	done chan struct{}
+	info os.FileInfo
+	err  error
+}
+
+type layerPullKey struct {
+	store  *storage.ImageStore
+	digest image.Digest
+}
+
+var (
+	layerPullsMutex sync.Mutex
+	layerPulls      = make(map[layerPullKey]*layerPull)
+)
+
+// startLayerPull returns the ongoing pull of the layer into the store, and
+// whether it was just started by the caller, which must then finish it.
+func startLayerPull(store *storage.ImageStore, digest image.Digest) (*layerPull, bool) {
+	layerPullsMutex.Lock()
+	defer layerPullsMutex.Unlock()
+	key := layerPullKey{store, digest}
+	if pull, ok := layerPulls[key]; ok {
+		return pull, false
+	}
+	pull := &layerPull{done: make(chan struct{})}
+	layerPulls[key] = pull
+	return pull, true
+}
+
+// finishLayerPull wakes up the pulls waiting for the layer.
+func finishLayerPull(store *storage.ImageStore, digest image.Digest, pull *layerPull) {
+	layerPullsMutex.Lock()
+	delete(layerPulls, layerPullKey{store, digest})
+	layerPullsMutex.Unlock()
+	close(pull.done)
+}
+
+// RequestHook is called for every HTTP request made to a registry if set,
+// e.g. to keep an audit trail. It's off by default.
+var RequestHook httputil.RequestHook
+
+// PushConcurrency is the number of blobs of an image pushed concurrently, if
+// positive. Otherwise the concurrency of the registry config is used.
+var PushConcurrency int
+
+// PullConcurrency is the number of blobs of an image pulled concurrently, if
+// positive. Otherwise the concurrency of the registry config is used.
+var PullConcurrency int
+
 // Client is the interface through which we can interact with a docker registry. It is used when
 // pulling and pushing images to that registry.
 type Client interface {
@@ -50,6 +111,7 @@ type Client interface {
 	Push(tag string) error
 	PullManifest(tag string) (*image.DistributionManifest, error)
 	PushManifest(tag string, manifest *image.DistributionManifest) error
+	ResolveDigest(tag string) (image.Digest, error)
 	PullLayer(layerDigest image.Digest) (os.FileInfo, error)
 	PushLayer(layerDigest image.Digest) error
 	PullImageConfig(layerDigest image.Digest) (os.FileInfo, error)
@@ -67,6 +129,12 @@ type DockerRegistryClient struct {
 	registry   string
 	repository string
 
+	// platform selects the manifest pulled from manifest lists. Only plain
+	// manifests are accepted if it's nil.
+	platform *image.Platform
+
+	limits *limits
+
 	// TODO: there must be a better way to test this.
 	client *http.Client
 }
@@ -81,26 +149,31 @@ func NewWithClient(store *storage.ImageStore, registry, repository string, clien
 	return newClient(store, registry, repository, client)
 }
 
+// NewWithPlatform returns a new Client that pulls the manifest of the given
+// platform from manifest lists.
+func NewWithPlatform(
+	store *storage.ImageStore, registry, repository string,
+	platform image.Platform) *DockerRegistryClient {
+
+	c := newClient(store, registry, repository, nil)
+	c.platform = &platform
+	return c
+}
+
 func newClient(store *storage.ImageStore, registry, repository string, client *http.Client) *DockerRegistryClient {
 	config := Config{}
 	if registry == image.DockerHubRegistry {
 		config = DefaultDockerHubConfiguration
 	}
-	repoConfig, ok := ConfigurationMap[registry]
-	if ok {
-		for repo, c := range repoConfig {
-			r := regexp.MustCompile(repo)
-			if r.MatchString(repository) {
-				config = c
-				break
-			}
-		}
+	if c, ok := ConfigurationMap[registry].Match(repository); ok {
+		config = c
 	}
 	return &DockerRegistryClient{
 		config:     config.applyDefaults(),
 		registry:   registry,
 		repository: repository,
 		store:      store,
+		limits:     getLimits(registry, config),
 		client:     client,
 	}
 }
@@ -113,28 +186,47 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 	log.Infof("* Started pulling image %s", name)
 	starttime := time.Now()
 
-	manifest, err := c.PullManifest(tag)
+	manifest, digest, err := c.pullManifest(tag)
 	if err != nil {
 		return nil, fmt.Errorf("pull manifest: %s", err)
 	}
+	if err := c.verifySignature(digest); err != nil {
+		return nil, fmt.Errorf("verify signature of image %s: %s", name, err)
+	}
+
+	for _, layer := range append(manifest.GetLayerDigests(), manifest.GetConfigDigest()) {
+		recordBlobSource(c.registry, c.repository, layer)
+	}
 
+	pullConcurrency := c.config.Concurrency
+	if PullConcurrency > 0 {
+		pullConcurrency = PullConcurrency
+	}
 	multiError := utils.NewMultiErrors()
-	workers := concurrency.NewWorkerPool(c.config.Concurrency)
+	workers := concurrency.NewWorkerPool(pullConcurrency)
 	layerSet := make(map[string]interface{})
+	var layers []image.Digest
 	for _, layer := range manifest.GetLayerDigests() {
-		l := layer
-		if _, ok := layerSet[l.Hex()]; ok {
+		if _, ok := layerSet[layer.Hex()]; ok {
 			// Duplicate layer.
 			continue
-		} else {
-			layerSet[l.Hex()] = struct{}{}
 		}
+		layerSet[layer.Hex()] = struct{}{}
+		layers = append(layers, layer)
+	}
+	var pulled int32
+	progress := func() {
+		log.Infof("* Pulled %d/%d blobs of image %s", atomic.AddInt32(&pulled, 1), len(layers)+1, name)
+	}
+	for _, layer := range layers {
+		l := layer
 		workers.Do(func() {
 			if _, err := c.PullLayer(l); err != nil {
 				multiError.Add(fmt.Errorf("pull layer %s: %s", l, err))
 				workers.Stop()
 				return
 			}
+			progress()
 		})
 	}
 	l := manifest.GetConfigDigest()
@@ -144,6 +236,7 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 			workers.Stop()
 			return
 		}
+		progress()
 	})
 	workers.Wait()
 	if err := multiError.Collect(); err != nil {
@@ -159,130 +252,265 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 
 // Push tries to push an image to docker registry, using the ImageStore of the client.
 func (c DockerRegistryClient) Push(tag string) error {
+	_, err := c.PushWithDigest(tag)
+	return err
+}
+
+// PushWithDigest is Push, but also returns the digest of the pushed manifest.
+func (c DockerRegistryClient) PushWithDigest(tag string) (image.Digest, error) {
+	descriptor, err := c.push(tag)
+	return descriptor.Digest, err
+}
+
+// push is Push, but also returns the descriptor of the pushed manifest.
+func (c DockerRegistryClient) push(tag string) (image.Descriptor, error) {
 	name := image.NewImageName(c.registry, c.repository, tag)
 	log.Infof("* Started pushing image %s", name)
 	starttime := time.Now()
 	if found, err := c.manifestExists(tag); err != nil {
-		return fmt.Errorf("check manifest exists for image %s: %s", name, err)
+		return image.Descriptor{}, fmt.Errorf("check manifest exists for image %s: %s", name, err)
 	} else if found {
 		log.Infof("* Image %s already exists, overwriting", name)
 	}
 	manifest, err := c.loadManifest(tag)
 	if err != nil {
-		return fmt.Errorf("load manifest: %s", err)
+		return image.Descriptor{}, fmt.Errorf("load manifest: %s", err)
 	}
 
+	pushConcurrency := c.config.Concurrency
+	if PushConcurrency > 0 {
+		pushConcurrency = PushConcurrency
+	}
 	multiError := utils.NewMultiErrors()
-	workers := concurrency.NewWorkerPool(c.config.Concurrency)
+	workers := concurrency.NewWorkerPool(pushConcurrency)
 	layerSet := make(map[string]interface{})
+	var layers []image.Digest
 	for _, layer := range manifest.GetLayerDigests() {
-		l := layer
-		if _, ok := layerSet[l.Hex()]; ok {
+		if _, ok := layerSet[layer.Hex()]; ok {
 			// Duplicate layer.
 			continue
-		} else {
-			layerSet[l.Hex()] = struct{}{}
+		}
+		layerSet[layer.Hex()] = struct{}{}
+		layers = append(layers, layer)
+	}
+	config := manifest.GetConfigDigest()
+	// Blobs the registry already has are skipped before starting any upload.
+	// Those that couldn't be checked are checked again when pushed.
+	existing := c.existingBlobs(append(layers[:len(layers):len(layers)], config), pushConcurrency)
+
+	var pushed int32
+	progress := func() {
+		log.Infof("* Pushed %d/%d blobs of image %s", atomic.AddInt32(&pushed, 1), len(layers)+1, name)
+	}
+	for _, layer := range layers {
+		l := layer
+		found, checked := existing[l]
+		if found {
+			log.Infof("* Layer %s:%s already exists", c.repository, l)
+			progress()
+			continue
 		}
 		workers.Do(func() {
-			if err := c.PushLayer(l); err != nil {
+			if err := c.pushLayerWithBackoff(l, false, !checked); err != nil {
 				multiError.Add(fmt.Errorf("push layer %s: %s", l, err))
 				workers.Stop()
 				return
 			}
+			progress()
+		})
+	}
+	if found, checked := existing[config]; found {
+		log.Infof("* Image config %s:%s already exists", c.repository, config)
+		progress()
+	} else {
+		workers.Do(func() {
+			if err := c.pushLayerWithBackoff(config, true, !checked); err != nil {
+				multiError.Add(fmt.Errorf("push image config %s: %s", config, err))
+				workers.Stop()
+				return
+			}
+			progress()
 		})
 	}
-	l := manifest.GetConfigDigest()
-	workers.Do(func() {
-		if err := c.PushImageConfig(l); err != nil {
-			multiError.Add(fmt.Errorf("push image config %s: %s", l, err))
-			workers.Stop()
-			return
-		}
-	})
 	workers.Wait()
 	if err := multiError.Collect(); err != nil {
-		return err
+		return image.Descriptor{}, err
 	}
 
-	if err := c.PushManifest(tag, manifest); err != nil {
-		return fmt.Errorf("push manifest: %s", err)
+	descriptor, err := c.pushManifest(tag, manifest)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("push manifest: %s", err)
 	}
-	log.Infow(fmt.Sprintf("* Pushed image %s", name), "duration", time.Since(starttime))
-	return nil
+	log.Infow(fmt.Sprintf("* Pushed image %s", name),
+		"duration", time.Since(starttime), "digest", descriptor.Digest)
+	return descriptor, nil
 }
 
 // PullManifest pulls docker image manifest from the docker registry.
 // It does not save the manifest to the store.
+// If the client has a platform and the tag is a manifest list, the manifest of
+// that platform is pulled.
 func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManifest, error) {
+	manifest, _, err := c.pullManifest(tag)
+	return manifest, err
+}
+
+// ResolveDigest returns the digest of the manifest the tag points to, which is
+// the digest of the manifest list if there is one.
+func (c DockerRegistryClient) ResolveDigest(tag string) (image.Digest, error) {
+	_, digest, err := c.pullManifest(tag)
+	return digest, err
+}
+
+// pullManifest is PullManifest, but also returns the digest the tag resolved
+// to, which is the digest of the manifest list if there is one.
+func (c DockerRegistryClient) pullManifest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	accept := image.MediaTypeManifest + ", " + image.MediaTypeOCIManifest
+	if c.platform != nil {
+		accept = image.MediaTypeManifestList + ", " + accept
+	}
+	body, ctHeader, err := c.getManifest(tag, accept)
+	if err != nil {
+		return nil, "", err
+	}
+	digest, err := image.NewDigester().FromBytes(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("hash manifest: %s", err)
+	}
+
+	if c.platform != nil && image.IsManifestList(ctHeader) {
+		list, err := image.UnmarshalManifestList(body)
+		if err != nil {
+			return nil, "", fmt.Errorf("unmarshal manifest list: %s", err)
+		}
+		descriptor, err := list.Find(c.platform.OS, c.platform.Architecture)
+		if err != nil {
+			return nil, "", fmt.Errorf("find manifest in list: %s", err)
+		}
+		log.Infof("* Resolved %s/%s:%s to manifest %s for platform %s/%s",
+			c.registry, c.repository, tag, descriptor.Digest, c.platform.OS, c.platform.Architecture)
+		body, ctHeader, err = c.getManifest(
+			string(descriptor.Digest), image.MediaTypeManifest+", "+image.MediaTypeOCIManifest)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Parse the manifest according to the content type.
+	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	if err != nil {
+		return nil, "", fmt.Errorf("unmarshal distribution manifest: %s", err)
+	}
+	return &manifest, digest, nil
+}
+
+// getManifest returns the content and Content-Type header of a manifest,
+// accepting the given media types, from the first mirror that has it or from
+// the registry.
+func (c DockerRegistryClient) getManifest(reference, accept string) ([]byte, string, error) {
+	for _, m := range c.mirrors() {
+		body, ctHeader, err := m.getRegistryManifest(reference, accept)
+		if err == nil {
+			return body, ctHeader, nil
+		}
+		log.Warnf("Failed to pull manifest %s:%s from mirror %s, falling back: %s",
+			c.repository, reference, m.registry, err)
+	}
+	return c.getRegistryManifest(reference, accept)
+}
+
+// getRegistryManifest is getManifest, without mirrors.
+func (c DockerRegistryClient) getRegistryManifest(reference, accept string) ([]byte, string, error) {
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
+		return nil, "", fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
 	resp, err := httputil.Send(
 		"GET",
 		URL,
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
+		httputil.SendIdleTimeout(c.config.IdleTimeout),
 		c.config.sendRetry(),
+		httputil.SendRequestHook(RequestHook),
+		httputil.SendRateLimit(c.limits.requests),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest),
-		httputil.SendHeaders(map[string]string{"Accept": image.MediaTypeManifest}))
+		httputil.SendHeaders(map[string]string{"Accept": accept}))
 	if err != nil {
-		return nil, fmt.Errorf("http send error: %s", err)
+		return nil, "", fmt.Errorf("http send error: %s", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
-		return nil, fmt.Errorf("manifest not found")
+		return nil, "", errManifestNotFound
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
+		return nil, "", fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read resp body: %s", err)
+		return nil, "", fmt.Errorf("read resp body: %s", err)
 	}
-	// Parse the manifest according to the content type.
-	ctHeader := resp.Header.Get("Content-Type")
-	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
-	}
-	return &manifest, nil
+	return body, resp.Header.Get("Content-Type"), nil
 }
 
 // PushManifest pushes the manifest to the registry.
 func (c DockerRegistryClient) PushManifest(tag string, manifest *image.DistributionManifest) error {
-	payload, err := json.MarshalIndent(manifest, "", "   ")
+	_, err := c.pushManifest(tag, manifest)
+	return err
+}
+
+// pushManifest is PushManifest, but also returns the descriptor of the
+// manifest as pushed.
+func (c DockerRegistryClient) pushManifest(
+	tag string, manifest *image.DistributionManifest) (image.Descriptor, error) {
+
+	payload, err := manifest.Payload()
 	if err != nil {
-		return fmt.Errorf("marshal manifest: %s", err)
+		return image.Descriptor{}, fmt.Errorf("marshal manifest: %s", err)
+	}
+	return c.putManifest(tag, manifest.MediaType, payload)
+}
+
+// putManifest uploads the payload of a manifest or manifest list of the given
+// media type under the reference, and returns its descriptor.
+func (c DockerRegistryClient) putManifest(
+	reference, mediaType string, payload []byte) (image.Descriptor, error) {
+
+	digest, err := image.NewDigester().FromBytes(payload)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("hash manifest: %s", err)
 	}
 	headers := map[string]string{
-		"Content-Type": manifest.MediaType,
+		"Content-Type": mediaType,
 		"Host":         c.registry,
 	}
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return image.Descriptor{}, fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
 	resp, err := httputil.Send(
 		"PUT",
 		URL,
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
+		httputil.SendIdleTimeout(c.config.IdleTimeout),
 		c.config.sendRetry(),
+		httputil.SendRequestHook(RequestHook),
+		httputil.SendRateLimit(c.limits.requests),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusCreated),
 		httputil.SendHeaders(headers),
 		httputil.SendBody(bytes.NewReader(payload)))
 	if err != nil {
-		return err
+		return image.Descriptor{}, err
 	}
 	defer resp.Body.Close()
-	return nil
+	return image.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: digest}, nil
 }
 
 // PullLayer pulls image layer from the registry, and verifies that the contents
@@ -301,7 +529,7 @@ func (c DockerRegistryClient) PullImageConfig(layerDigest image.Digest) (os.File
 func (c DockerRegistryClient) pullLayerHelper(
 	layerDigest image.Digest, isConfig bool) (os.FileInfo, error) {
 
-	if info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex()); err == nil {
+	if info, err := c.store.Layers.GetStoreFileStat(layerDigest.Hex()); err == nil {
 		if isConfig {
 			log.Infof("* Skipped pulling existing image config %s:%s", c.repository, layerDigest)
 		} else {
@@ -309,44 +537,44 @@ func (c DockerRegistryClient) pullLayerHelper(
 		}
 		return info, nil
 	}
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
-	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
-	}
-
 	if isConfig {
 		log.Infof("* Started pulling image config %s/%s:%s", c.registry, c.repository, layerDigest)
 	} else {
 		log.Infof("* Started pulling layer %s/%s:%s", c.registry, c.repository, layerDigest)
 	}
 
-	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, string(layerDigest))
-	resp, err := httputil.Send(
-		"GET",
-		URL,
-		httputil.SendClient(c.client),
-		opt,
-		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry())
-	if err != nil {
-		return nil, fmt.Errorf("send pull layer request %s: %s", URL, err)
-	}
-	defer resp.Body.Close()
+	// Images sharing a layer may be pulled concurrently into the same store,
+	// and all of them would download into the same download file.
+	pull, first := startLayerPull(c.store, layerDigest)
+	if !first {
+		<-pull.done
+		return pull.info, pull.err
+	}
+	pull.info, pull.err = c.downloadLayerToStore(layerDigest, isConfig)
+	finishLayerPull(c.store, layerDigest, pull)
+	return pull.info, pull.err
+}
 
-	if err := c.store.Layers.CreateDownloadFile(layerDigest.Hex(), 0); err != nil {
-		return nil, fmt.Errorf("create layer file: %s", err)
-	}
-	w, err := c.store.Layers.GetDownloadFileReadWriter(layerDigest.Hex())
-	if err != nil {
-		return nil, fmt.Errorf("get layer file readwriter: %s", err)
-	}
-	defer w.Close()
+func (c DockerRegistryClient) downloadLayerToStore(
+	layerDigest image.Digest, isConfig bool) (os.FileInfo, error) {
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		return nil, fmt.Errorf("copy layer file: %s", err)
+	defer c.limits.startTransfer()()
+	if !c.downloadLayerFromMirrors(layerDigest) {
+		opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+		if err != nil {
+			return nil, fmt.Errorf("get security opt: %s", err)
+		}
+		err = c.downloadLayer(layerDigest, opt)
+		if err == errDigestMismatch {
+			log.Warnf("Layer %s digest did not match, retrying download from scratch", layerDigest)
+			err = c.downloadLayer(layerDigest, opt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("download layer: %s", err)
+		}
 	}
-	if err := c.saveLayer(layerDigest); err != nil {
-		return nil, fmt.Errorf("save layer file: %s", err)
+	if err := c.store.Layers.MoveDownloadFileToStore(layerDigest.Hex()); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("commit layer to store: %s", err)
 	}
 
 	info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex())
@@ -363,24 +591,67 @@ func (c DockerRegistryClient) pullLayerHelper(
 
 // PushLayer pushes the image layer to the registry.
 func (c DockerRegistryClient) PushLayer(layerDigest image.Digest) error {
-	return c.pushLayerWithBackoff(layerDigest, false)
+	return c.pushLayerWithBackoff(layerDigest, false, true)
 }
 
 // PushImageConfig pushes image config blob to the registry.
 // Same as PushLayer, with slightly different log message.
 func (c DockerRegistryClient) PushImageConfig(layerDigest image.Digest) error {
-	return c.pushLayerWithBackoff(layerDigest, true)
+	return c.pushLayerWithBackoff(layerDigest, true, true)
 }
 
-func (c DockerRegistryClient) pushLayerWithBackoff(layerDigest image.Digest, isConfig bool) error {
+// existingBlobs checks concurrently which of the blobs the registry already
+// has. Blobs that couldn't be checked are left out of the returned map.
+func (c DockerRegistryClient) existingBlobs(blobs []image.Digest, parallelism int) map[image.Digest]bool {
+	var mu sync.Mutex
+	existing := make(map[image.Digest]bool)
+	workers := concurrency.NewWorkerPool(parallelism)
+	for _, blob := range blobs {
+		b := blob
+		workers.Do(func() {
+			found, err := c.layerExists(b)
+			if err != nil {
+				log.Warnf("Failed to check if blob %s exists: %s", b, err)
+				return
+			}
+			if found {
+				recordBlobSource(c.registry, c.repository, b)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			existing[b] = found
+		})
+	}
+	workers.Wait()
+	return existing
+}
+
+// pushLayerWithBackoff pushes a blob, retrying failed attempts. Unless
+// checkExists is true, the first attempt assumes the registry doesn't have the
+// blob yet.
+func (c DockerRegistryClient) pushLayerWithBackoff(layerDigest image.Digest, isConfig, checkExists bool) error {
 	multiError := utils.NewMultiErrors()
 	b := c.config.backoff()
+	var reauthenticated bool
 	for {
-		err := c.pushLayerHelper(layerDigest, isConfig)
+		err := c.pushLayerHelper(layerDigest, isConfig, checkExists)
 		if err == nil {
 			break
 		}
 		multiError.Add(err)
+		// The failed attempt may have pushed the blob anyway.
+		checkExists = true
+		// Every attempt authenticates again, and tokens may expire during
+		// long uploads, so unauthorized errors are retried once right away.
+		// Credentials are likely invalid if the registry rejects them again.
+		if httputil.IsStatus(err, http.StatusUnauthorized) {
+			if reauthenticated {
+				break
+			}
+			reauthenticated = true
+			log.Infof("* Failed to push layer: %s, retrying with new credentials...", err)
+			continue
+		}
 		d := b.NextBackOff()
 		if d == backoff.Stop {
 			break
@@ -391,8 +662,12 @@ func (c DockerRegistryClient) pushLayerWithBackoff(layerDigest image.Digest, isC
 		// temporarily unexpected condition on registry side.
 		if httputil.IsNetworkError(err) ||
 			httputil.IsRetryable(err) ||
-			httputil.IsStatus(err, http.StatusInternalServerError) {
+			httputil.IsStatus(err, http.StatusInternalServerError) ||
+			c.config.isRetryCode(err) {
 			log.Infof("* Failed to push layer: %s, retrying...", err)
+			if retryAfter := httputil.ErrRetryAfter(err); retryAfter > d {
+				d = retryAfter
+			}
 			time.Sleep(d)
 			continue
 		}
@@ -401,39 +676,48 @@ func (c DockerRegistryClient) pushLayerWithBackoff(layerDigest image.Digest, isC
 	return multiError.Collect()
 }
 
-func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig bool) error {
-	if found, err := c.layerExists(layerDigest); err != nil {
-		return fmt.Errorf("check layer exists: %s/%s (%s): %w", c.registry, c.repository, layerDigest, err)
-	} else if found {
-		if isConfig {
-			log.Infof("* Skipped pushing existing image config %s:%s", c.repository, layerDigest)
-		} else {
-			log.Infof("* Skipped pushing existing layer %s:%s", c.repository, layerDigest)
+func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig, checkExists bool) error {
+	if checkExists {
+		found, err := c.layerExists(layerDigest)
+		if err != nil {
+			return fmt.Errorf("check layer exists: %s/%s (%s): %w", c.registry, c.repository, layerDigest, err)
+		} else if found {
+			if isConfig {
+				log.Infof("* Image config %s:%s already exists", c.repository, layerDigest)
+			} else {
+				log.Infof("* Layer %s:%s already exists", c.repository, layerDigest)
+			}
+			recordBlobSource(c.registry, c.repository, layerDigest)
+			return nil
 		}
-		return nil
-	}
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
-	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseStartQuery, c.registry, c.repository)
-	resp, err := httputil.Send(
-		"POST",
-		URL,
-		httputil.SendClient(c.client),
-		opt,
-		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
-		httputil.SendAcceptedCodes(http.StatusAccepted),
-		httputil.SendHeaders(map[string]string{"Host": c.registry}))
-	if err != nil {
-		return fmt.Errorf("send start push layer request %s: %w", URL, err)
+	var URL string
+	if from, ok := blobSource(c.registry, layerDigest); ok && from != c.repository {
+		mounted, location, err := c.mountLayer(layerDigest, from)
+		if err != nil {
+			log.Warnf("Failed to mount layer %s from %s, uploading it: %s", layerDigest, from, err)
+		} else if mounted {
+			log.Infof("* Mounted layer %s:%s from %s", c.repository, layerDigest, from)
+			recordBlobSource(c.registry, c.repository, layerDigest)
+			return nil
+		}
+		URL = location
 	}
-	defer resp.Body.Close()
-	URL = resp.Header.Get("Location")
+
+	defer c.limits.startTransfer()()
 	if URL == "" {
-		return fmt.Errorf("empty layer upload URL")
+		URL = fmt.Sprintf(baseStartQuery, c.registry, c.repository)
+		resp, respURL, err := c.sendUpload(
+			"POST", URL, nil, map[string]string{"Host": c.registry}, http.StatusAccepted)
+		if err != nil {
+			return fmt.Errorf("send start push layer request %s: %w", URL, err)
+		}
+		defer resp.Body.Close()
+		URL, err = resolveLocation(respURL, resp.Header.Get("Location"))
+		if err != nil {
+			return fmt.Errorf("layer upload URL: %s", err)
+		}
 	}
 
 	if isConfig {
@@ -441,7 +725,7 @@ func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig
 	} else {
 		log.Infof("* Started pushing layer %s", layerDigest)
 	}
-	URL, err = c.pushLayerContent(layerDigest, URL)
+	URL, err := c.pushLayerContent(layerDigest, URL)
 	if err != nil {
 		return fmt.Errorf("push layer content %s: %w", layerDigest, err)
 	}
@@ -461,6 +745,7 @@ func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig
 	} else {
 		log.Infof("* Finished pushing layer %s", layerDigest)
 	}
+	recordBlobSource(c.registry, c.repository, layerDigest)
 	return nil
 }
 
@@ -478,7 +763,10 @@ func (c DockerRegistryClient) manifestExists(tag string) (bool, error) {
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
+		httputil.SendIdleTimeout(c.config.IdleTimeout),
 		c.config.sendRetry(),
+		httputil.SendRequestHook(RequestHook),
+		httputil.SendRateLimit(c.limits.requests),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest))
 	if err != nil {
 		return false, fmt.Errorf("check manifest exists: %w", err)
@@ -505,7 +793,10 @@ func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
+		httputil.SendIdleTimeout(c.config.IdleTimeout),
 		c.config.sendRetry(),
+		httputil.SendRequestHook(RequestHook),
+		httputil.SendRateLimit(c.limits.requests),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound))
 	if err != nil {
 		return false, fmt.Errorf("check manifest exists: %w", err)
@@ -527,7 +818,6 @@ func (c DockerRegistryClient) pushLayerContent(digest image.Digest, location str
 	if pushChunk == -1 {
 		pushChunk = size
 	}
-	start, endInclusive := int64(0), utils.Min(pushChunk-1, size-1)
 
 	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
 	if err != nil {
@@ -535,76 +825,157 @@ func (c DockerRegistryClient) pushLayerContent(digest image.Digest, location str
 	}
 	defer r.Close()
 
+	b := c.config.backoff()
+	var start int64
 	for start < size {
-		location, err = c.pushOneLayerChunk(location, start, endInclusive, r)
+		endInclusive := utils.Min(start+pushChunk, size) - 1
+		newLocation, received, err := c.pushOneLayerChunk(location, start, endInclusive, size, r)
 		if err != nil {
-			return location, fmt.Errorf("push layer chunk: %w", err)
+			if !isResumableUploadError(err) {
+				return location, fmt.Errorf("push layer chunk: %w", err)
+			}
+			d := b.NextBackOff()
+			if d == backoff.Stop {
+				return location, fmt.Errorf("push layer chunk: %w", err)
+			}
+			// Ask the registry how much of the upload it committed and
+			// continue from there, instead of restarting the whole upload.
+			time.Sleep(d)
+			newLocation, received, statusErr := c.uploadStatus(location)
+			if statusErr != nil {
+				return location, fmt.Errorf("push layer chunk: %w (get upload status: %s)", err, statusErr)
+			}
+			log.Warnf("Resuming upload of layer %s at offset %d: %s", digest.Hex(), received+1, err)
+			location = newLocation
+			start = received + 1
+			continue
 		}
-		start, endInclusive = endInclusive+1, utils.Min(start+pushChunk-1, size-1)
+		location = newLocation
+		if received != endInclusive {
+			// The registry didn't keep the whole chunk, continue from the
+			// offset it reported.
+			log.Warnf("Registry received layer %s up to byte %d instead of %d, resuming from there",
+				digest.Hex(), received, endInclusive)
+			if _, err := r.Seek(received+1, io.SeekStart); err != nil {
+				return location, fmt.Errorf("seek layer file: %s", err)
+			}
+		}
+		start = received + 1
 	}
 	return location, nil
 }
 
-func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endIncluded int64, r io.Reader) (string, error) {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
-	if err != nil {
-		return "", fmt.Errorf("get security opt: %s", err)
-	}
+// pushOneLayerChunk uploads bytes [start, endIncluded] of a layer of the given
+// total size. It returns the new upload location, and the offset of the last
+// byte the registry reports to have received.
+func (c DockerRegistryClient) pushOneLayerChunk(
+	location string, start, endIncluded, size int64, r io.ReadSeeker) (string, int64, error) {
+
 	chunckSize := endIncluded + 1 - start
-	r = io.LimitReader(r, chunckSize)
 	readerOptions := ratelimit.NewBucketWithRate(c.config.PushRate, 1)
+	contentRange := fmt.Sprintf("%d-%d", start, endIncluded)
+	if c.config.PushContentRangeTotal {
+		contentRange = fmt.Sprintf("%s/%d", contentRange, size)
+	}
 	headers := map[string]string{
 		"Host":           c.registry,
 		"Content-Type":   "application/octet-stream",
 		"Content-Length": fmt.Sprintf("%d", chunckSize),
-		"Content-Range":  fmt.Sprintf("%d-%d", start, endIncluded),
+		"Content-Range":  contentRange,
 	}
-	resp, err := httputil.Send(
-		"PATCH",
-		location,
-		httputil.SendClient(c.client),
-		opt,
-		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+	// The chunk is read again if the request is redirected.
+	body := func() (io.Reader, error) {
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek layer file: %s", err)
+		}
+		return ratelimit.Reader(io.LimitReader(r, chunckSize), readerOptions), nil
+	}
+	resp, respURL, err := c.sendUpload(
+		"PATCH", location, body, headers,
 		// Docker registry returns 202
 		// GCR returns 204 on success
 		// AWS ECR returns 201 on success
-		httputil.SendAcceptedCodes(http.StatusAccepted, http.StatusNoContent, http.StatusCreated),
-		httputil.SendHeaders(headers),
-		httputil.SendBody(ratelimit.Reader(r, readerOptions)))
+		http.StatusAccepted, http.StatusNoContent, http.StatusCreated)
 	if err != nil {
-		return "", fmt.Errorf("send push chunk request: %w", err)
+		return "", 0, fmt.Errorf("send push chunk request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	newLocation := resp.Header.Get("Location")
-	if newLocation == "" {
-		return "", fmt.Errorf("empty layer upload URL")
+	newLocation, err := resolveLocation(respURL, resp.Header.Get("Location"))
+	if err != nil {
+		return "", 0, fmt.Errorf("layer upload URL: %s", err)
 	}
-	return newLocation, nil
+
+	received := endIncluded
+	if uploadRange := resp.Header.Get("Range"); uploadRange != "" {
+		received, err = parseUploadRange(uploadRange)
+		if err != nil {
+			return "", 0, fmt.Errorf("parse upload range: %s", err)
+		} else if received < start || received > endIncluded {
+			return "", 0, fmt.Errorf(
+				"registry reported range %s for chunk %d-%d", uploadRange, start, endIncluded)
+		}
+	}
+	return newLocation, received, nil
 }
 
-func (c DockerRegistryClient) commitLayer(location string) error {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+// uploadStatus returns the location of an upload in progress, and the offset
+// of the last byte the registry committed, or -1 if it has none yet.
+func (c DockerRegistryClient) uploadStatus(location string) (string, int64, error) {
+	resp, respURL, err := c.sendUpload(
+		"GET", location, nil, map[string]string{"Host": c.registry}, http.StatusNoContent)
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return "", 0, fmt.Errorf("send upload status request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	newLocation := location
+	if resp.Header.Get("Location") != "" {
+		if newLocation, err = resolveLocation(respURL, resp.Header.Get("Location")); err != nil {
+			return "", 0, fmt.Errorf("layer upload URL: %s", err)
+		}
+	}
+	received := int64(-1)
+	if uploadRange := resp.Header.Get("Range"); uploadRange != "" {
+		if received, err = parseUploadRange(uploadRange); err != nil {
+			return "", 0, fmt.Errorf("parse upload range: %s", err)
+		}
 	}
+	return newLocation, received, nil
+}
 
+// isResumableUploadError returns true if an upload can be resumed after a
+// chunk failed with err.
+func isResumableUploadError(err error) bool {
+	return httputil.IsNetworkError(err) ||
+		httputil.IsRetryable(err) ||
+		httputil.IsStatus(err, http.StatusInternalServerError)
+}
+
+// parseUploadRange returns the end offset of the "Range: 0-<end>" header
+// returned by registries for blob uploads.
+func parseUploadRange(uploadRange string) (int64, error) {
+	parts := strings.Split(strings.TrimPrefix(uploadRange, "bytes="), "-")
+	if len(parts) != 2 || parts[0] != "0" {
+		return 0, fmt.Errorf("invalid range %s", uploadRange)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %s: %s", uploadRange, err)
+	}
+	return end, nil
+}
+
+func (c DockerRegistryClient) commitLayer(location string) error {
 	headers := map[string]string{
 		"Host":           c.registry,
 		"Content-Type":   "application/octet-stream",
 		"Content-Length": fmt.Sprintf("%d", 0),
 	}
-	resp, err := httputil.Send(
-		"PUT",
-		location,
-		httputil.SendClient(c.client),
-		opt,
-		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+	resp, _, err := c.sendUpload(
+		"PUT", location, nil, headers,
 		// Docker registry returns 201 but gcr returns 204 on success.
-		httputil.SendAcceptedCodes(http.StatusCreated, http.StatusNoContent),
-		httputil.SendHeaders(headers))
+		http.StatusCreated, http.StatusNoContent)
 	if err != nil {
 		return fmt.Errorf("commit: %w", err)
 	}
@@ -612,26 +983,201 @@ func (c DockerRegistryClient) commitLayer(location string) error {
 	return nil
 }
 
-// saveLayer moves the layer from the download file to the permanent storage in store.
-func (c DockerRegistryClient) saveLayer(layerDigest image.Digest) error {
-	// Verify that the layers downloaded were correct.
-	r, err := c.store.Layers.GetDownloadFileReader(layerDigest.Hex())
+// sendUpload sends one request of a layer upload to location. 307 and 308
+// redirects are followed here instead of by the http client, so that the body
+// is sent again, and credentials are resolved for the host redirected to.
+// It returns the response, and the URL it was received from, which its
+// Location header is relative to.
+func (c DockerRegistryClient) sendUpload(
+	method, location string, body func() (io.Reader, error), headers map[string]string,
+	acceptedCodes ...int) (*http.Response, string, error) {
+
+	acceptedCodes = append(acceptedCodes, http.StatusTemporaryRedirect, http.StatusPermanentRedirect)
+	for redirects := 0; ; redirects++ {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, "", fmt.Errorf("parse location: %s", err)
+		}
+		host := u.Host
+		if host == "" {
+			host = c.registry
+		}
+		opt, err := c.config.Security.GetHTTPOption(host, c.repository)
+		if err != nil {
+			return nil, "", fmt.Errorf("get security opt: %s", err)
+		}
+		// A body is consumed by the first attempt, so requests carrying one
+		// aren't retried here. Failed chunks are resumed by pushLayerContent.
+		retry := c.config.sendRetry()
+		if body != nil {
+			retry = httputil.SendNoop()
+		}
+		options := []httputil.SendOption{
+			httputil.SendClient(c.client),
+			opt,
+			httputil.SendTimeout(c.config.Timeout),
+			httputil.SendIdleTimeout(c.config.IdleTimeout),
+			retry,
+			httputil.SendRequestHook(RequestHook),
+			httputil.SendRateLimit(c.limits.requests),
+			httputil.SendRedirect(func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}),
+			httputil.SendAcceptedCodes(acceptedCodes...),
+			httputil.SendHeaders(headers),
+		}
+		if body != nil {
+			r, err := body()
+			if err != nil {
+				return nil, "", err
+			}
+			options = append(options, httputil.SendBody(r))
+		}
+		resp, err := httputil.Send(method, location, options...)
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect &&
+			resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, location, nil
+		}
+		resp.Body.Close()
+		if redirects >= c.config.PushRedirects {
+			return nil, "", fmt.Errorf("too many redirects, last one to %s", resp.Header.Get("Location"))
+		}
+		next, err := resolveLocation(location, resp.Header.Get("Location"))
+		if err != nil {
+			return nil, "", fmt.Errorf("redirect location: %s", err)
+		}
+		log.Infof("* Following %d redirect of %s %s to %s", resp.StatusCode, method, location, next)
+		location = next
+	}
+}
+
+// resolveLocation resolves a Location header against the URL of the request
+// it was returned for.
+func resolveLocation(requestURL, location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("empty location")
+	}
+	base, err := url.Parse(requestURL)
 	if err != nil {
-		return fmt.Errorf("get layer file reader: %s", err)
+		return "", fmt.Errorf("parse request url: %s", err)
 	}
-	defer r.Close()
-	if verified, err := layerDigest.Equals(r); err != nil {
-		return fmt.Errorf("verify layer: %s", err)
-	} else if !verified {
-		return fmt.Errorf("layer digest did not match")
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("parse location %s: %s", location, err)
 	}
+	return base.ResolveReference(ref).String(), nil
+}
 
-	if err := c.store.Layers.MoveDownloadFileToStore(layerDigest.Hex()); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("commit layer to store: %s", err)
+// downloadLayer downloads a blob into the download dir of the store and
+// verifies its digest while writing it. If the download is interrupted, it's
+// resumed with a Range request, continuing the hash from the bytes already
+// written, so the blob is not downloaded again.
+// A download file left by another process or a failed mirror is replaced, as
+// its bytes can't be verified until the whole blob is hashed.
+func (c DockerRegistryClient) downloadLayer(layerDigest image.Digest, opt httputil.SendOption) error {
+	err := c.store.Layers.CreateDownloadFile(layerDigest.Hex(), 0)
+	if os.IsExist(err) {
+		if err := c.store.Layers.DeleteDownloadFile(layerDigest.Hex()); err != nil {
+			return fmt.Errorf("delete stale layer file: %s", err)
+		}
+		err = c.store.Layers.CreateDownloadFile(layerDigest.Hex(), 0)
+	}
+	if err != nil {
+		return fmt.Errorf("create layer file: %s", err)
+	}
+	w, err := c.store.Layers.GetDownloadFileReadWriter(layerDigest.Hex())
+	if err != nil {
+		return fmt.Errorf("get layer file readwriter: %s", err)
+	}
+	defer w.Close()
+
+	digester := image.NewDigester()
+	var offset int64
+	var resumes uint64
+	if !c.config.RetryDisabled {
+		resumes = c.config.Retries
+	}
+	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, string(layerDigest))
+	for attempt := uint64(0); ; attempt++ {
+		headers := map[string]string{}
+		if offset > 0 {
+			headers["Range"] = fmt.Sprintf("bytes=%d-", offset)
+		}
+		resp, err := httputil.Send(
+			"GET",
+			URL,
+			httputil.SendClient(c.client),
+			opt,
+			httputil.SendTimeout(c.config.Timeout),
+			httputil.SendIdleTimeout(c.config.IdleTimeout),
+			c.config.sendRetry(),
+			httputil.SendRequestHook(RequestHook),
+			httputil.SendRateLimit(c.limits.requests),
+			httputil.SendAcceptedCodes(http.StatusOK, http.StatusPartialContent),
+			httputil.SendHeaders(headers))
+		if err != nil {
+			return fmt.Errorf("send pull layer request %s: %s", URL, err)
+		}
+		if offset > 0 && resp.StatusCode == http.StatusOK {
+			// The registry ignored the range and sent the whole blob, which
+			// overwrites the partial one.
+			if _, err := w.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				return fmt.Errorf("seek layer file: %s", err)
+			}
+			digester = image.NewDigester()
+			offset = 0
+		}
+		n, err := io.Copy(w, digester.Tee(resp.Body))
+		resp.Body.Close()
+		offset += n
+		if err == nil {
+			break
+		} else if attempt >= resumes {
+			return fmt.Errorf("copy layer file: %s", err)
+		}
+		log.Warnf("Resuming download of layer %s at offset %d: %s", layerDigest, offset, err)
+	}
+
+	if digester.Digest() != layerDigest {
+		return errDigestMismatch
 	}
 	return nil
 }
 
+// mirrors returns clients of the mirrors of the registry, in order.
+func (c DockerRegistryClient) mirrors() []DockerRegistryClient {
+	var mirrors []DockerRegistryClient
+	for _, mirror := range c.config.Mirrors {
+		m := newClient(c.store, mirror, c.repository, c.client)
+		// Mirrors of mirrors are not followed, and failed requests fall back
+		// to the next one instead of being retried.
+		m.config.Mirrors = nil
+		m.config.RetryDisabled = true
+		mirrors = append(mirrors, *m)
+	}
+	return mirrors
+}
+
+// downloadLayerFromMirrors downloads a layer from the first mirror that has
+// it. It returns false if none does.
+func (c DockerRegistryClient) downloadLayerFromMirrors(layerDigest image.Digest) bool {
+	for _, m := range c.mirrors() {
+		opt, err := m.config.Security.GetHTTPOption(m.registry, m.repository)
+		if err == nil {
+			err = m.downloadLayer(layerDigest, opt)
+		}
+		if err == nil {
+			return true
+		}
+		log.Warnf("Failed to pull layer %s from mirror %s, falling back: %s", layerDigest, m.registry, err)
+	}
+	return false
+}
+
 // saveManifest saves given distribution manifest into local store.
 func (c DockerRegistryClient) saveManifest(tag string, manifest *image.DistributionManifest) error {
 	if _, err := c.store.Manifests.GetDownloadOrCacheFileStat(c.repository, tag); err == nil {
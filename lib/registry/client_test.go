@@ -16,14 +16,21 @@ package registry
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/httputil"
 	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -42,6 +49,36 @@ func TestPullManifest(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestRequestHook(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Blobs are pulled concurrently.
+	var mu sync.Mutex
+	var events []httputil.RequestEvent
+	RequestHook = func(e httputil.RequestEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	defer func() { RequestHook = nil }()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+
+	manifest, err := p.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+
+	// Manifest, image config and each layer.
+	require.Len(events, 2+len(manifest.Layers))
+	for _, e := range events {
+		require.Equal("GET", e.Method)
+		require.Equal(http.StatusOK, e.Status)
+		require.Contains(e.URL, "localhost:5055/v2/"+testutil.SampleImageRepoName)
+	}
+}
+
 func TestPullImage(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixture()
@@ -156,6 +193,103 @@ func TestPushImage(t *testing.T) {
 	require.NoError(p.Push(testutil.SampleImageTag))
 }
 
+// concurrencyTransportFixture records the maximum number of requests sent
+// through it at the same time. Requests are delayed so that concurrent ones
+// overlap.
+type concurrencyTransportFixture struct {
+	base     http.RoundTripper
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (t *concurrencyTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.max {
+		t.max = t.inFlight
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.inFlight--
+		t.mu.Unlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	return t.base.RoundTrip(r)
+}
+
+func TestPushImageWithPushConcurrency(t *testing.T) {
+	defer func() { PushConcurrency = 0 }()
+
+	// The sample image has a layer and a config, pushed concurrently unless
+	// the concurrency is 1.
+	for _, pushConcurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", pushConcurrency), func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+			defer cleanup()
+
+			PushConcurrency = pushConcurrency
+			p, err := PushClientFixture(ctx)
+			require.NoError(err)
+			transport := &concurrencyTransportFixture{base: p.client.Transport}
+			p.client.Transport = transport
+
+			require.NoError(p.Push(testutil.SampleImageTag))
+			require.Equal(pushConcurrency, transport.max)
+		})
+	}
+}
+
+// recordingTransportFixture records the requests sent through it.
+type recordingTransportFixture struct {
+	base     http.RoundTripper
+	mu       sync.Mutex
+	requests []string
+}
+
+func (t *recordingTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests = append(t.requests, r.Method+" "+r.URL.String())
+	t.mu.Unlock()
+	return t.base.RoundTrip(r)
+}
+
+func TestPushImageSkipsExistingBlobs(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	name := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
+	layer := layerRequest{name, image.Digest("sha256:" + testutil.SampleLayerTarDigest)}
+	config := layerRequest{name, image.Digest("sha256:" + testutil.SampleImageConfigDigest)}
+	upload := uploadRequest{name}
+	p, err := PushClientFixture(ctx, responseOverride{
+		Method: "HEAD",
+		Target: layer,
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+		},
+	})
+	require.NoError(err)
+	transport := &recordingTransportFixture{base: p.client.Transport}
+	p.client.Transport = transport
+
+	require.NoError(p.Push(testutil.SampleImageTag))
+	require.ElementsMatch([]string{
+		"HEAD " + manifestRequest{name}.getURL(),
+		"HEAD " + layer.getURL(),
+		"HEAD " + config.getURL(),
+		"POST " + upload.getURL(),
+		"PATCH " + upload.getResumeLoc(),
+		"PUT " + upload.getCommitURL(testutil.SampleImageConfigDigest),
+		"PUT " + manifestRequest{name}.getURL(),
+	}, transport.requests)
+}
+
 func TestPushLayerRetry(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
@@ -181,6 +315,30 @@ func TestPushLayerRetry(t *testing.T) {
 	require.EqualError(p.PushLayer(digest), commitError+"; "+commitError)
 }
 
+func TestPushLayerUnauthorizedRetriedOnce(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	image := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
+	url := uploadRequest{image}.getCommitURL(digest)
+	responseOverride := responseOverride{
+		Method: "PUT",
+		Target: simpleRequest{url},
+		Response: &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+		},
+	}
+	p, err := PushClientFixture(ctx, responseOverride)
+	require.NoError(err)
+	p.config.Retries = 5
+	commitError := fmt.Sprintf("commit layer push %s: commit: PUT "+url+" 401", digest)
+	require.EqualError(p.PushLayer(digest), commitError+"; "+commitError)
+}
+
 func TestPushLayerNoRetry(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
@@ -191,3 +349,652 @@ func TestPushLayerNoRetry(t *testing.T) {
 	p.config.Retries = 1
 	require.EqualError(p.PushLayer(image.NewEmptyDigest()), "push layer content : get layer file stat: file does not exist")
 }
+
+// failingReader returns an error after reading all of its data.
+type failingReader struct{ r io.Reader }
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+type blobTransportFixture struct {
+	responses []func() *http.Response
+	ranges    []string
+}
+
+func (t *blobTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.ranges = append(t.ranges, r.Header.Get("Range"))
+	resp := t.responses[0]()
+	t.responses = t.responses[1:]
+	resp.Header = make(http.Header)
+	resp.Request = r
+	return resp, nil
+}
+
+func TestPullLayerResume(t *testing.T) {
+	blob := bytes.Repeat([]byte("makisu layer content "), 1000)
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(t, err)
+	half := len(blob) / 2
+
+	full := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(blob))}
+	}
+	interrupted := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(failingReader{bytes.NewReader(blob[:half])}),
+		}
+	}
+	rest := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Body:       ioutil.NopCloser(bytes.NewReader(blob[half:])),
+		}
+	}
+	corrupted := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(append([]byte("x"), blob[1:]...))),
+		}
+	}
+	resumedRange := fmt.Sprintf("bytes=%d-", half)
+
+	tests := []struct {
+		desc      string
+		responses []func() *http.Response
+		ranges    []string
+		succeeds  bool
+	}{
+		{"resumed with range", []func() *http.Response{interrupted, rest}, []string{"", resumedRange}, true},
+		{"range ignored", []func() *http.Response{interrupted, full}, []string{"", resumedRange}, true},
+		{"digest mismatch retried from scratch", []func() *http.Response{corrupted, full}, []string{"", ""}, true},
+		{"resumed digest mismatch retried from scratch",
+			[]func() *http.Response{interrupted, corrupted, full}, []string{"", resumedRange, ""}, true},
+		{"digest mismatch twice", []func() *http.Response{corrupted, corrupted}, []string{"", ""}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			transport := &blobTransportFixture{responses: test.responses}
+			p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+			p.config.Security.TLS.Client.Disabled = true
+
+			_, err := p.PullLayer(digest)
+			require.Equal(test.ranges, transport.ranges)
+			if !test.succeeds {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+			require.NoError(err)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(blob, b)
+		})
+	}
+}
+
+func TestPullLayerReplacesStaleDownloadFile(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	blob := bytes.Repeat([]byte("makisu layer content "), 1000)
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(err)
+
+	// An interrupted process left a file that isn't a prefix of the blob.
+	require.NoError(ctx.ImageStore.Layers.CreateDownloadFile(digest.Hex(), 0))
+	w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter(digest.Hex())
+	require.NoError(err)
+	_, err = w.Write([]byte("stale"))
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	full := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(blob))}
+	}
+	transport := &blobTransportFixture{responses: []func() *http.Response{full}}
+	p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+	p.config.Security.TLS.Client.Disabled = true
+
+	_, err = p.PullLayer(digest)
+	require.NoError(err)
+	require.Equal([]string{""}, transport.ranges)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob, b)
+}
+
+// layerTransportFixture returns the blob for every request.
+type layerTransportFixture struct {
+	blob []byte
+}
+
+func (t *layerTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(t.blob)),
+		Request:    r,
+	}, nil
+}
+
+func TestPullLayerConcurrentlyIntoSameStore(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	blob := bytes.Repeat([]byte("makisu layer content "), 1000)
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(err)
+
+	// The delay of the transport makes the pulls overlap.
+	transport := &recordingTransportFixture{
+		base: &concurrencyTransportFixture{base: &layerTransportFixture{blob: blob}},
+	}
+	errs := make(chan error, 2)
+	for _, repository := range []string{"repo1", "repo2"} {
+		p := NewWithClient(ctx.ImageStore, "localhost:5055", repository, &http.Client{Transport: transport})
+		p.config.Security.TLS.Client.Disabled = true
+		go func() {
+			_, err := p.PullLayer(digest)
+			errs <- err
+		}()
+	}
+	require.NoError(<-errs)
+	require.NoError(<-errs)
+	require.Len(transport.requests, 1)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob, b)
+}
+
+// chunkTransportFixture accepts upload chunks, keeping at most keep[i] bytes
+// of the i-th chunk, and reports the received range like a registry would.
+// The i-th chunk fails with a network error after that if fail[i] is set.
+// GET requests return the status of the upload.
+type chunkTransportFixture struct {
+	keep          []int
+	fail          []bool
+	received      []byte
+	contentRanges []string
+}
+
+func (t *chunkTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	status := http.StatusNoContent
+	if r.Method == "PATCH" {
+		status = http.StatusAccepted
+		t.contentRanges = append(t.contentRanges, r.Header.Get("Content-Range"))
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.keep) > 0 {
+			if t.keep[0] < len(b) {
+				b = b[:t.keep[0]]
+			}
+			t.keep = t.keep[1:]
+		}
+		t.received = append(t.received, b...)
+		if len(t.fail) > 0 {
+			fail := t.fail[0]
+			t.fail = t.fail[1:]
+			if fail {
+				return nil, errors.New("connection reset by peer")
+			}
+		}
+	}
+	header := make(http.Header)
+	header.Set("Location", "http://localhost:5055/v2/repo/blobs/uploads/1")
+	if len(t.received) > 0 {
+		header.Set("Range", fmt.Sprintf("0-%d", len(t.received)-1))
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Header:     header,
+		Request:    r,
+	}, nil
+}
+
+func TestPushLayerContentChunks(t *testing.T) {
+	blob := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc          string
+		chunk         int64
+		total         bool
+		keep          []int
+		fail          []bool
+		contentRanges []string
+	}{
+		{"single chunk", -1, false, nil, nil, []string{"0-35"}},
+		{"multiple chunks", 10, false, nil, nil, []string{"0-9", "10-19", "20-29", "30-35"}},
+		{"multiple chunks with total", 16, true, nil, nil, []string{"0-15/36", "16-31/36", "32-35/36"}},
+		{"resync to received range", 16, false, []int{16, 10}, nil, []string{"0-15", "16-31", "26-35"}},
+		{"resume after failed chunk", 16, false, []int{16, 5}, []bool{false, true},
+			[]string{"0-15", "16-31", "21-35"}},
+		{"resume after failed first chunk", -1, false, []int{0}, []bool{true}, []string{"0-35", "0-35"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			require.NoError(ctx.ImageStore.Layers.CreateDownloadFile(digest.Hex(), 0))
+			w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter(digest.Hex())
+			require.NoError(err)
+			_, err = w.Write(blob)
+			require.NoError(err)
+			w.Close()
+			require.NoError(ctx.ImageStore.Layers.MoveDownloadFileToStore(digest.Hex()))
+
+			transport := &chunkTransportFixture{keep: test.keep, fail: test.fail}
+			p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+			p.config.Security.TLS.Client.Disabled = true
+			p.config.RetryInterval = time.Millisecond
+			p.config.PushChunk = test.chunk
+			p.config.PushContentRangeTotal = test.total
+
+			_, err = p.pushLayerContent(digest, "http://localhost:5055/v2/repo/blobs/uploads/1")
+			require.NoError(err)
+			require.Equal(test.contentRanges, transport.contentRanges)
+			require.Equal(blob, transport.received)
+		})
+	}
+}
+
+type manifestTransportFixture struct {
+	manifests map[string][]byte // Keyed by reference
+	accepts   []string
+}
+
+func (t *manifestTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.accepts = append(t.accepts, r.Header.Get("Accept"))
+	reference := path.Base(r.URL.Path)
+	body, ok := t.manifests[reference]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header)}, nil
+	}
+	header := make(http.Header)
+	if reference == "latest" {
+		header.Set("Content-Type", image.MediaTypeManifestList)
+	} else {
+		header.Set("Content-Type", image.MediaTypeManifest)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Header:     header,
+	}, nil
+}
+
+func TestPullManifestFromManifestList(t *testing.T) {
+	manifest := func(config image.Digest) []byte {
+		b, err := json.Marshal(image.DistributionManifest{
+			SchemaVersion: 2,
+			MediaType:     image.MediaTypeManifest,
+			Config:        image.Descriptor{MediaType: image.MediaTypeConfig, Digest: config},
+		})
+		require.NoError(t, err)
+		return b
+	}
+	amd64Manifest := manifest(image.Digest("sha256:" + strings.Repeat("a", 64)))
+	arm64Manifest := manifest(image.Digest("sha256:" + strings.Repeat("b", 64)))
+	amd64Digest, err := image.NewDigester().FromBytes(amd64Manifest)
+	require.NoError(t, err)
+	arm64Digest, err := image.NewDigester().FromBytes(arm64Manifest)
+	require.NoError(t, err)
+
+	list, err := json.Marshal(image.ManifestList{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifestList,
+		Manifests: []image.ManifestListEntry{{
+			Descriptor: image.Descriptor{MediaType: image.MediaTypeManifest, Digest: amd64Digest},
+			Platform:   image.Platform{OS: "linux", Architecture: "amd64"},
+		}, {
+			Descriptor: image.Descriptor{MediaType: image.MediaTypeManifest, Digest: arm64Digest},
+			Platform:   image.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc     string
+		platform image.Platform
+		expected []byte
+	}{
+		{"amd64", image.Platform{OS: "linux", Architecture: "amd64"}, amd64Manifest},
+		{"arm64", image.Platform{OS: "linux", Architecture: "arm64"}, arm64Manifest},
+		{"missing platform", image.Platform{OS: "windows", Architecture: "amd64"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			transport := &manifestTransportFixture{manifests: map[string][]byte{
+				"latest":            list,
+				string(amd64Digest): amd64Manifest,
+				string(arm64Digest): arm64Manifest,
+			}}
+			p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+			p.config.Security.TLS.Client.Disabled = true
+			p.platform = &test.platform
+
+			m, err := p.PullManifest("latest")
+			if test.expected == nil {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			b, err := json.Marshal(m)
+			require.NoError(err)
+			require.JSONEq(string(test.expected), string(b))
+			require.Equal([]string{
+				image.MediaTypeManifestList + ", " + image.MediaTypeManifest + ", " + image.MediaTypeOCIManifest,
+				image.MediaTypeManifest + ", " + image.MediaTypeOCIManifest,
+			}, transport.accepts)
+		})
+	}
+
+	t.Run("no platform", func(t *testing.T) {
+		require := require.New(t)
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		transport := &manifestTransportFixture{manifests: map[string][]byte{"latest": list}}
+		p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+		p.config.Security.TLS.Client.Disabled = true
+
+		// Manifest lists aren't accepted, so the registry should not return one.
+		_, err := p.PullManifest("latest")
+		require.Error(err)
+		require.Equal([]string{image.MediaTypeManifest + ", " + image.MediaTypeOCIManifest}, transport.accepts)
+	})
+}
+
+func TestResolveDigest(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	manifest, err := json.Marshal(image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeConfig},
+	})
+	require.NoError(err)
+	expected, err := image.NewDigester().FromBytes(manifest)
+	require.NoError(err)
+
+	transport := &manifestTransportFixture{manifests: map[string][]byte{"v1": manifest}}
+	p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+	p.config.Security.TLS.Client.Disabled = true
+
+	digest, err := p.ResolveDigest("v1")
+	require.NoError(err)
+	require.Equal(expected, digest)
+}
+
+// uploadTransportFixture replies to each "<method> <url>" request with the
+// given status and Location header, and keeps the bodies of accepted chunks.
+type uploadTransportFixture struct {
+	responses map[string]uploadResponse
+	requests  []string
+	received  []byte
+}
+
+type uploadResponse struct {
+	status   int
+	location string
+}
+
+func (t *uploadTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := r.Method + " " + r.URL.String()
+	t.requests = append(t.requests, key)
+	resp, ok := t.responses[key]
+	if !ok {
+		resp = uploadResponse{status: http.StatusNotFound}
+	}
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.status == http.StatusAccepted {
+			t.received = append(t.received, b...)
+		}
+	}
+	header := make(http.Header)
+	if resp.location != "" {
+		header.Set("Location", resp.location)
+	}
+	return &http.Response{
+		StatusCode: resp.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Header:     header,
+		Request:    r,
+	}, nil
+}
+
+func TestPushLayerFollowsUploadRedirects(t *testing.T) {
+	blob := []byte("0123456789abcdefghij")
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(t, err)
+
+	uploads := "/v2/repo/blobs/uploads/"
+	commit := fmt.Sprintf("PUT http://lb-3:5055%s3?digest=%s", uploads, strings.Replace(string(digest), ":", "%3A", 1))
+	responses := map[string]uploadResponse{
+		"POST http://localhost:5055" + uploads:   {http.StatusPermanentRedirect, "http://lb-2:5055" + uploads},
+		"POST http://lb-2:5055" + uploads:        {http.StatusAccepted, uploads + "1"},
+		"PATCH http://lb-2:5055" + uploads + "1": {http.StatusAccepted, uploads + "2"},
+		// Redirected in the middle of the upload.
+		"PATCH http://lb-2:5055" + uploads + "2": {http.StatusTemporaryRedirect, "http://lb-3:5055" + uploads + "2"},
+		"PATCH http://lb-3:5055" + uploads + "2": {http.StatusAccepted, uploads + "3"},
+		commit:                                   {http.StatusCreated, ""},
+	}
+
+	setup := func(t *testing.T) (*DockerRegistryClient, *uploadTransportFixture, func()) {
+		ctx, cleanup := context.BuildContextFixture()
+		require.NoError(t, ctx.ImageStore.Layers.CreateDownloadFile(digest.Hex(), 0))
+		w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter(digest.Hex())
+		require.NoError(t, err)
+		_, err = w.Write(blob)
+		require.NoError(t, err)
+		w.Close()
+		require.NoError(t, ctx.ImageStore.Layers.MoveDownloadFileToStore(digest.Hex()))
+
+		transport := &uploadTransportFixture{responses: responses}
+		p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+		p.config.Security.TLS.Client.Disabled = true
+		p.config.PushChunk = 10
+		p.config.RetryDisabled = true
+		return p, transport, cleanup
+	}
+
+	t.Run("followed", func(t *testing.T) {
+		require := require.New(t)
+		p, transport, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(p.pushLayerHelper(digest, false, true))
+		require.Equal([]string{
+			"HEAD http://localhost:5055/v2/repo/blobs/" + string(digest),
+			"POST http://localhost:5055" + uploads,
+			"POST http://lb-2:5055" + uploads,
+			"PATCH http://lb-2:5055" + uploads + "1",
+			"PATCH http://lb-2:5055" + uploads + "2",
+			"PATCH http://lb-3:5055" + uploads + "2",
+			commit,
+		}, transport.requests)
+		require.Equal(blob, transport.received)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		require := require.New(t)
+		p, _, cleanup := setup(t)
+		defer cleanup()
+		p.config.PushRedirects = -1
+
+		err := p.pushLayerHelper(digest, false, true)
+		require.Error(err)
+		require.Contains(err.Error(), "too many redirects")
+	})
+}
+
+// mirrorTransportFixture serves the requests to a mirror from the upstream
+// registry if the mirror is available, and counts the requests per host.
+type mirrorTransportFixture struct {
+	sync.Mutex
+	upstream  http.RoundTripper
+	registry  string
+	mirror    string
+	available bool
+	requests  map[string]int
+}
+
+func (t *mirrorTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.Lock()
+	t.requests[r.URL.Host]++
+	t.Unlock()
+	if r.URL.Host != t.mirror {
+		return t.upstream.RoundTrip(r)
+	}
+	if !t.available {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+			Request:    r,
+		}, nil
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "http", t.registry
+	upstream := r.WithContext(r.Context())
+	upstream.URL = &u
+	return t.upstream.RoundTrip(upstream)
+}
+
+func TestPullImageFromMirror(t *testing.T) {
+	for _, available := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mirror available %t", available), func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			p, err := PullClientFixtureWithAlpine(ctx)
+			require.NoError(err)
+			transport := &mirrorTransportFixture{
+				upstream:  p.client.Transport,
+				registry:  p.registry,
+				mirror:    "mirror.example.com",
+				available: available,
+				requests:  make(map[string]int),
+			}
+			p.client = &http.Client{Transport: transport}
+			p.config.Mirrors = []string{transport.mirror}
+
+			_, err = p.Pull(testutil.SampleImageTag)
+			require.NoError(err)
+			_, err = p.store.Layers.GetStoreFileStat(testutil.SampleLayerTarDigest)
+			require.NoError(err)
+
+			// Manifest, image config and layer.
+			require.Equal(3, transport.requests[transport.mirror])
+			if available {
+				require.Zero(transport.requests[p.registry])
+			} else {
+				require.Equal(3, transport.requests[p.registry])
+			}
+		})
+	}
+}
+
+// statusTransportFixture answers the first requests with the given statuses,
+// then forwards them.
+type statusTransportFixture struct {
+	http.RoundTripper
+	statuses []int
+}
+
+func (t *statusTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	if len(t.statuses) == 0 {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	status := t.statuses[0]
+	t.statuses = t.statuses[1:]
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+		Header:     make(http.Header),
+		Request:    r,
+	}, nil
+}
+
+func TestPullManifestRetryCodes(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+	p.config.RetryInterval = time.Millisecond
+	p.client.Transport = &statusTransportFixture{p.client.Transport, []int{http.StatusTeapot}}
+
+	_, err = p.PullManifest(testutil.SampleImageTag)
+	require.Error(err)
+
+	p.config.RetryCodes = []int{http.StatusTeapot}
+	p.client.Transport = &statusTransportFixture{p.client.Transport, []int{http.StatusTeapot}}
+	_, err = p.PullManifest(testutil.SampleImageTag)
+	require.NoError(err)
+}
+
+func TestPullImageWithPullConcurrency(t *testing.T) {
+	defer func() { PullConcurrency = 0 }()
+
+	// The image has a layer, listed twice, and a config, pulled concurrently
+	// unless the concurrency is 1.
+	for _, pullConcurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", pullConcurrency), func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			PullConcurrency = pullConcurrency
+			p, err := PullClientFixtureWithAlpineDup(ctx)
+			require.NoError(err)
+			transport := &concurrencyTransportFixture{base: p.client.Transport}
+			p.client.Transport = transport
+
+			_, err = p.Pull(testutil.SampleImageTag)
+			require.NoError(err)
+			require.Equal(pullConcurrency, transport.max)
+		})
+	}
+}
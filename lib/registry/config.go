@@ -19,6 +19,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -45,6 +48,50 @@ type Map map[string]RepositoryMap
 // RepositoryMap contains a map of repo config. Repo name can be a regex.
 type RepositoryMap map[string]Config
 
+// Match returns the config of the most specific repo regex matching the given
+// repository, which is the one with the longest literal prefix, then the
+// longest regex. If that config has no credentials, the credentials of the
+// next most specific match that has some are used, so a ".*" entry can hold
+// registry-wide credentials.
+func (m RepositoryMap) Match(repository string) (Config, bool) {
+	type match struct {
+		repo   string
+		prefix string
+	}
+	var matches []match
+	for repo := range m {
+		r := regexp.MustCompile(repo)
+		if r.MatchString(repository) {
+			prefix, _ := r.LiteralPrefix()
+			matches = append(matches, match{repo, prefix})
+		}
+	}
+	if len(matches) == 0 {
+		return Config{}, false
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if len(matches[i].prefix) != len(matches[j].prefix) {
+			return len(matches[i].prefix) > len(matches[j].prefix)
+		} else if len(matches[i].repo) != len(matches[j].repo) {
+			return len(matches[i].repo) > len(matches[j].repo)
+		}
+		return matches[i].repo < matches[j].repo
+	})
+
+	config := m[matches[0].repo]
+	if config.Security.HasCredentials() {
+		return config, true
+	}
+	for _, match := range matches[1:] {
+		if fallback := m[match.repo].Security; fallback.HasCredentials() {
+			config.Security.BasicAuth = fallback.BasicAuth
+			config.Security.RemoteCredentialsStore = fallback.RemoteCredentialsStore
+			break
+		}
+	}
+	return config, true
+}
+
 // Config contains docker registry client configuration.
 type Config struct {
 	Concurrency     int           `yaml:"concurrency" json:"concurrency"`
@@ -54,12 +101,44 @@ type Config struct {
 	RetryInterval   time.Duration `yaml:"retry_interval" json:"retry_interval"`
 	RetryBackoff    float64       `yaml:"retry_backoff" json:"retry_backoff"`
 	RetryBackoffMax time.Duration `yaml:"retry_backoff_max" json:"retry_backoff_max"`
-	PushRate        float64       `yaml:"push_rate" json:"push_rate"`
+	// Randomization factor of the retry intervals, e.g. 0.5 for intervals
+	// between 50% and 150% of the backoff. If not specified, 0.5 is used.
+	// Set it to -1 to turn off jitter.
+	RetryJitter float64 `yaml:"retry_jitter" json:"retry_jitter"`
+	// Status codes retried in addition to network errors and 429, 502, 503
+	// and 504.
+	RetryCodes []int   `yaml:"retry_codes" json:"retry_codes"`
+	PushRate   float64 `yaml:"push_rate" json:"push_rate"`
+	// Maximum number of requests per second to the registry, shared by all
+	// of its clients. If not specified, requests are not limited.
+	RequestRate float64 `yaml:"request_rate" json:"request_rate"`
+	// Maximum number of blobs pulled from or pushed to the registry at the
+	// same time, shared by all of its clients, unlike Concurrency which
+	// applies to each image. If not specified, only Concurrency applies.
+	MaxTransfers int `yaml:"max_transfers" json:"max_transfers"`
 	// If not specify, a default chunk size will be used.
 	// Set it to -1 to turn off chunk upload.
 	// NOTE: gcr and ecr do not support chunked upload.
-	PushChunk int64           `yaml:"push_chunk" json:"push_chunk"`
-	Security  security.Config `yaml:"security" json:"security"`
+	PushChunk int64 `yaml:"push_chunk" json:"push_chunk"`
+	// Append the total layer size to the Content-Range header of chunks,
+	// i.e. "<start>-<end>/<total>", for registries that require it.
+	PushContentRangeTotal bool `yaml:"push_content_range_total" json:"push_content_range_total"`
+	// Maximum number of 307/308 redirects followed by each request of layer
+	// uploads. If not specified, a default is used.
+	// Set it to -1 to fail on redirects.
+	PushRedirects int `yaml:"push_redirects" json:"push_redirects"`
+	// Abort requests if no bytes are sent or received for this long, so
+	// stalled connections are retried instead of waiting for the timeout.
+	// If not specified, only the timeout applies.
+	IdleTimeout time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	// Pull images without verifying their signatures, even if
+	// ImageSignaturePolicy is set.
+	SkipSignatureVerification bool `yaml:"skip_signature_verification" json:"skip_signature_verification"`
+	// Registries to pull from, in order, before this one, e.g. pull-through
+	// caches of Docker Hub. The registry itself is used if none of them has
+	// the image. Their own entries in the registry config apply to them.
+	Mirrors  []string        `yaml:"mirrors" json:"mirrors"`
+	Security security.Config `yaml:"security" json:"security"`
 }
 
 func (c Config) applyDefaults() Config {
@@ -82,12 +161,18 @@ func (c Config) applyDefaults() Config {
 	if c.RetryBackoffMax == 0 {
 		c.RetryBackoffMax = 30 * time.Second
 	}
+	if c.RetryJitter == 0 {
+		c.RetryJitter = backoff.DefaultRandomizationFactor
+	}
 	if c.PushRate == 0 {
 		c.PushRate = 100 * 1024 * 1024 // 100 MB/s
 	}
 	if c.PushChunk == 0 {
 		c.PushChunk = 50 * 1024 * 1024 // 50 MB
 	}
+	if c.PushRedirects == 0 {
+		c.PushRedirects = 5
+	}
 	c.Security = c.Security.ApplyDefaults()
 	return c
 }
@@ -100,11 +185,23 @@ func (c *Config) backoff() backoff.BackOff {
 	b.InitialInterval = c.RetryInterval
 	b.Multiplier = c.RetryBackoff
 	b.MaxInterval = c.RetryBackoffMax
+	b.RandomizationFactor = math.Max(c.RetryJitter, 0)
+	b.Reset()
 	return backoff.WithMaxRetries(b, c.Retries)
 }
 
 func (c *Config) sendRetry() httputil.SendOption {
-	return httputil.SendRetry(httputil.RetryBackoff(c.backoff()))
+	return httputil.SendRetry(httputil.RetryBackoff(c.backoff()), httputil.RetryCodes(c.RetryCodes...))
+}
+
+// isRetryCode returns true if the status of err is one of RetryCodes.
+func (c *Config) isRetryCode(err error) bool {
+	for _, code := range c.RetryCodes {
+		if httputil.IsStatus(err, code) {
+			return true
+		}
+	}
+	return false
 }
 
 // UpdateGlobalConfig updates the global registry config given either:
@@ -0,0 +1,102 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/registry/security"
+
+	"github.com/cenkalti/backoff"
+	"github.com/docker/engine-api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryMapMatch(t *testing.T) {
+	basic := func(username string) security.Config {
+		return security.Config{BasicAuth: &security.BasicAuthConfig{
+			AuthConfig: types.AuthConfig{Username: username},
+		}}
+	}
+	repoMap := RepositoryMap{
+		".*":              {Security: basic("registry")},
+		"team-a/.*":       {Security: basic("team-a")},
+		"team-a/svc/.*":   {Security: basic("team-a-svc")},
+		"team-a/svc/db.*": {PushChunk: -1},
+		"team-b/.*":       {Security: security.Config{RemoteCredentialsStore: "ecr-login"}},
+	}
+
+	tests := []struct {
+		repository string
+		username   string
+		credsStore string
+		pushChunk  int64
+	}{
+		{repository: "team-a/app", username: "team-a"},
+		{repository: "team-a/svc/api", username: "team-a-svc"},
+		// Most specific match has no credentials, those of the next match
+		// are used.
+		{repository: "team-a/svc/db", username: "team-a-svc", pushChunk: -1},
+		{repository: "team-b/app", credsStore: "ecr-login"},
+		// Registry-level credentials.
+		{repository: "team-c/app", username: "registry"},
+	}
+	for _, test := range tests {
+		t.Run(test.repository, func(t *testing.T) {
+			require := require.New(t)
+
+			config, ok := repoMap.Match(test.repository)
+			require.True(ok)
+			require.Equal(test.pushChunk, config.PushChunk)
+			require.Equal(test.credsStore, config.Security.RemoteCredentialsStore)
+			if test.username == "" {
+				require.Nil(config.Security.BasicAuth)
+			} else {
+				require.Equal(test.username, config.Security.BasicAuth.Username)
+			}
+		})
+	}
+
+	// The repo map itself is unchanged by fallbacks.
+	require.Nil(t, repoMap["team-a/svc/db.*"].Security.BasicAuth)
+}
+
+func TestRepositoryMapMatchNoMatch(t *testing.T) {
+	require := require.New(t)
+
+	_, ok := RepositoryMap{"team-a/.*": {}}.Match("team-b/app")
+	require.False(ok)
+
+	var nilMap RepositoryMap
+	_, ok = nilMap.Match("team-b/app")
+	require.False(ok)
+}
+
+func TestConfigBackoff(t *testing.T) {
+	require := require.New(t)
+
+	c := Config{RetryInterval: time.Second, RetryBackoffMax: 3 * time.Second, Retries: 3, RetryJitter: -1}
+	c = c.applyDefaults()
+	b := c.backoff()
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, backoff.Stop} {
+		require.Equal(expected, b.NextBackOff())
+	}
+
+	c = Config{RetryInterval: time.Second}.applyDefaults()
+	require.Equal(backoff.DefaultRandomizationFactor, c.RetryJitter)
+	d := c.backoff().NextBackOff()
+	require.True(d >= time.Second/2 && d <= 3*time.Second/2)
+}
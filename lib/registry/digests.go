@@ -0,0 +1,91 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// PushedDigests are the manifest digests of the images pushed by a build.
+type PushedDigests struct {
+	// Digest is the digest of the target image.
+	Digest image.Digest `json:"digest"`
+	// Images are the digests of all pushed images, keyed by full name.
+	Images map[string]image.Digest `json:"images"`
+}
+
+// NewPushedDigests returns empty PushedDigests.
+func NewPushedDigests() *PushedDigests {
+	return &PushedDigests{Images: make(map[string]image.Digest)}
+}
+
+// Add records the digest of a pushed image. The first image added as target
+// sets Digest.
+func (d *PushedDigests) Add(name image.Name, digest image.Digest, target bool) {
+	if target && d.Digest == "" {
+		d.Digest = digest
+	}
+	d.Images[name.String()] = digest
+}
+
+// WriteFile atomically writes the digests to path. Format could be "plain",
+// for only the digest of the target image, or "json" for all digests. It
+// fails without writing anything if the target image wasn't pushed.
+func (d *PushedDigests) WriteFile(path, format string) error {
+	if d.Digest == "" {
+		return fmt.Errorf("target image was not pushed")
+	}
+	var b []byte
+	switch format {
+	case "plain":
+		b = []byte(d.Digest + "\n")
+	case "json":
+		var err error
+		if b, err = json.MarshalIndent(d, "", "  "); err != nil {
+			return fmt.Errorf("marshal digests: %s", err)
+		}
+		b = append(b, '\n')
+	default:
+		return fmt.Errorf("invalid digest file format %s", format)
+	}
+
+	// Write to a temp file in the same dir and rename it, so readers never
+	// see a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("write temp file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close temp file: %s", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("chmod temp file: %s", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// manifestCaptureTransport records the body of manifest pushes.
+type manifestCaptureTransport struct {
+	http.RoundTripper
+	manifests [][]byte
+}
+
+func (t *manifestCaptureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "PUT" && strings.Contains(r.URL.Path, "/manifests/") {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		t.manifests = append(t.manifests, b)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestPushedDigestsWriteFile(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(ctx)
+	require.NoError(err)
+	transport := &manifestCaptureTransport{RoundTripper: p.client.Transport}
+	p.client.Transport = transport
+
+	digest, err := p.PushWithDigest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Len(transport.manifests, 1)
+	pushed, err := image.NewDigester().FromBytes(transport.manifests[0])
+	require.NoError(err)
+	require.Equal(pushed, digest)
+
+	name := image.NewImageName(p.registry, p.repository, testutil.SampleImageTag)
+	replica := image.NewImageName("replica", p.repository, testutil.SampleImageTag)
+	digests := NewPushedDigests()
+	digests.Add(name, digest, true)
+	digests.Add(replica, digest, true)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test-digests")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "digest")
+	require.NoError(digests.WriteFile(path, "plain"))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(fmt.Sprintf("%s\n", digest), string(b))
+
+	require.NoError(digests.WriteFile(path, "json"))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	var result PushedDigests
+	require.NoError(json.Unmarshal(b, &result))
+	require.Equal(digest, result.Digest)
+	require.Equal(map[string]image.Digest{
+		name.String():    digest,
+		replica.String(): digest,
+	}, result.Images)
+
+	require.Error(digests.WriteFile(path, "yaml"))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(files, 1)
+}
+
+func TestPushedDigestsNotWrittenOnFailure(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	name := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
+	p, err := PushClientFixture(ctx, responseOverride{
+		Method: "PUT",
+		Target: manifestRequest{name},
+		Response: &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+		},
+	})
+	require.NoError(err)
+	p.config.Retries = 1
+
+	digests := NewPushedDigests()
+	digest, err := p.PushWithDigest(testutil.SampleImageTag)
+	require.Error(err)
+	require.Empty(digest)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test-digests")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "digest")
+	require.Error(digests.WriteFile(path, "plain"))
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err))
+}
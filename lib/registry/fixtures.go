@@ -49,6 +49,11 @@ func (noopClientFixture) PushManifest(tag string, manifest *image.DistributionMa
 	return nil
 }
 
+// ResolveDigest implements registry.Client.ResolveDigest.
+func (noopClientFixture) ResolveDigest(tag string) (image.Digest, error) {
+	return "", nil
+}
+
 // PullLayer implements registry.Client.PullLayer.
 func (noopClientFixture) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
 	return nil, nil
@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+var (
+	limitsMutex sync.Mutex
+	limitsMap   = make(map[string]*limits)
+)
+
+// limits are the request rate and transfer limits of a registry, shared by
+// all of its clients.
+type limits struct {
+	requests  *ratelimit.Bucket
+	transfers chan struct{}
+}
+
+// getLimits returns the limits of the registry with the given config.
+func getLimits(registry string, config Config) *limits {
+	if config.RequestRate <= 0 && config.MaxTransfers <= 0 {
+		return &limits{}
+	}
+	key := fmt.Sprintf("%s %g %d", registry, config.RequestRate, config.MaxTransfers)
+
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	if l, ok := limitsMap[key]; ok {
+		return l
+	}
+	l := &limits{}
+	if config.RequestRate > 0 {
+		// Bursts of up to a second of requests are allowed.
+		l.requests = ratelimit.NewBucketWithRate(config.RequestRate, int64(math.Ceil(config.RequestRate)))
+	}
+	if config.MaxTransfers > 0 {
+		l.transfers = make(chan struct{}, config.MaxTransfers)
+	}
+	limitsMap[key] = l
+	return l
+}
+
+// startTransfer waits until a blob transfer can start, and returns the
+// function to call once it's done.
+func (l *limits) startTransfer() func() {
+	if l.transfers == nil {
+		return func() {}
+	}
+	l.transfers <- struct{}{}
+	return func() { <-l.transfers }
+}
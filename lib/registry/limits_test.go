@@ -0,0 +1,52 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(getLimits("registry.example.com", Config{}).requests)
+
+	config := Config{RequestRate: 10, MaxTransfers: 1}
+	l := getLimits("registry.example.com", config)
+	require.True(l == getLimits("registry.example.com", config))
+	require.False(l == getLimits("other.example.com", config))
+	require.NotNil(l.requests)
+
+	done := l.startTransfer()
+	started := make(chan struct{})
+	go func() {
+		l.startTransfer()()
+		close(started)
+	}()
+	select {
+	case <-started:
+		require.FailNow("second transfer started before the first one was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		require.FailNow("second transfer did not start")
+	}
+}
@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// PlatformTag is the tag of the image built for one platform of a manifest
+// list.
+type PlatformTag struct {
+	Tag      string
+	Platform image.Platform
+}
+
+// PushManifestList pushes the image of each platform tag, then a manifest list
+// referencing them for their platform under tag. If the images have OCI
+// manifests, an OCI image index is pushed instead. It returns the digest of
+// the manifest list.
+func (c DockerRegistryClient) PushManifestList(
+	tag string, platformTags []PlatformTag) (image.Digest, error) {
+
+	if len(platformTags) == 0 {
+		return "", fmt.Errorf("no platform images to push")
+	}
+	name := image.NewImageName(c.registry, c.repository, tag)
+	starttime := time.Now()
+
+	list := image.ManifestList{SchemaVersion: 2, MediaType: image.MediaTypeManifestList}
+	for _, platformTag := range platformTags {
+		descriptor, err := c.push(platformTag.Tag)
+		if err != nil {
+			return "", fmt.Errorf("push image %s: %s", platformTag.Tag, err)
+		}
+		if descriptor.MediaType == image.MediaTypeOCIManifest {
+			list.MediaType = image.MediaTypeOCIIndex
+		}
+		list.Manifests = append(list.Manifests, image.ManifestListEntry{
+			Descriptor: descriptor,
+			Platform:   platformTag.Platform,
+		})
+	}
+	for _, entry := range list.Manifests {
+		if (entry.MediaType == image.MediaTypeOCIManifest) != (list.MediaType == image.MediaTypeOCIIndex) {
+			return "", fmt.Errorf("images of manifest list mix OCI and docker manifests")
+		}
+	}
+
+	payload, err := json.MarshalIndent(list, "", "   ")
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest list: %s", err)
+	}
+	descriptor, err := c.putManifest(tag, list.MediaType, payload)
+	if err != nil {
+		return "", fmt.Errorf("push manifest list: %s", err)
+	}
+	log.Infow(fmt.Sprintf("* Pushed manifest list %s of %d platforms", name, len(platformTags)),
+		"duration", time.Since(starttime), "digest", descriptor.Digest)
+	return descriptor.Digest, nil
+}
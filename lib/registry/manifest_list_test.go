@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushManifestList(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	// The sample image is also tagged as the image of another platform.
+	repo := testutil.SampleImageRepoName
+	r, err := ctx.ImageStore.Manifests.GetStoreFileReader(repo, testutil.SampleImageTag)
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(err)
+	manifestPath := filepath.Join(ctx.ImageStore.SandboxDir, "manifest")
+	require.NoError(ioutil.WriteFile(manifestPath, b, 0644))
+	require.NoError(ctx.ImageStore.Manifests.LinkStoreFileFrom(repo, "arm64", manifestPath))
+
+	name := image.MustParseName(fmt.Sprintf("localhost:5055/%s:multi", repo))
+	var overrides []responseOverride
+	for _, tag := range []string{"arm64", "multi"} {
+		overrides = append(overrides, responseOverride{
+			Method: "PUT",
+			Target: manifestRequest{name.WithTag(tag)},
+			Response: &http.Response{
+				StatusCode: http.StatusCreated,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+				Header:     make(http.Header),
+			},
+		})
+	}
+	p, err := PushClientFixture(ctx, overrides...)
+	require.NoError(err)
+	transport := &manifestCaptureTransport{RoundTripper: p.client.Transport}
+	p.client.Transport = transport
+
+	_, err = p.PushManifestList("multi", nil)
+	require.Error(err)
+
+	digest, err := p.PushManifestList("multi", []PlatformTag{
+		{testutil.SampleImageTag, image.Platform{OS: "linux", Architecture: "amd64"}},
+		{"arm64", image.Platform{OS: "linux", Architecture: "arm64"}},
+	})
+	require.NoError(err)
+	require.Len(transport.manifests, 3)
+	pushed, err := image.NewDigester().FromBytes(transport.manifests[2])
+	require.NoError(err)
+	require.Equal(pushed, digest)
+
+	list, err := image.UnmarshalManifestList(transport.manifests[2])
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifestList, list.MediaType)
+	require.Len(list.Manifests, 2)
+	for i, platform := range []string{"amd64", "arm64"} {
+		entry := list.Manifests[i]
+		require.Equal(platform, entry.Platform.Architecture)
+		require.Equal(image.MediaTypeManifest, entry.MediaType)
+		require.Equal(int64(len(transport.manifests[i])), entry.Size)
+		manifestDigest, err := image.NewDigester().FromBytes(transport.manifests[i])
+		require.NoError(err)
+		require.Equal(manifestDigest, entry.Digest)
+	}
+	descriptor, err := list.Find("linux", "arm64")
+	require.NoError(err)
+	require.Equal(list.Manifests[1].Descriptor, descriptor)
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+var (
+	blobSourcesMutex sync.Mutex
+	blobSources      = make(map[string]string)
+)
+
+// recordBlobSource records that a registry has a blob in the given repository,
+// so pushes to other repositories of that registry can mount it instead of
+// uploading it again.
+func recordBlobSource(registry, repository string, digest image.Digest) {
+	blobSourcesMutex.Lock()
+	defer blobSourcesMutex.Unlock()
+	blobSources[registry+"@"+string(digest)] = repository
+}
+
+// blobSource returns a repository of the registry known to have the blob.
+func blobSource(registry string, digest image.Digest) (string, bool) {
+	blobSourcesMutex.Lock()
+	defer blobSourcesMutex.Unlock()
+	repository, ok := blobSources[registry+"@"+string(digest)]
+	return repository, ok
+}
+
+// mountLayer asks the registry to mount a blob from another of its
+// repositories. It returns true if the blob was mounted. Otherwise the
+// registry started a regular upload, and its location is returned.
+func (c DockerRegistryClient) mountLayer(digest image.Digest, from string) (bool, string, error) {
+	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository, from)
+	if err != nil {
+		return false, "", fmt.Errorf("get security opt: %s", err)
+	}
+
+	query := url.Values{"mount": {string(digest)}, "from": {from}}
+	URL := fmt.Sprintf(baseStartQuery, c.registry, c.repository) + "?" + query.Encode()
+	resp, err := httputil.Send(
+		"POST",
+		URL,
+		httputil.SendClient(c.client),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		httputil.SendIdleTimeout(c.config.IdleTimeout),
+		c.config.sendRetry(),
+		httputil.SendRequestHook(RequestHook),
+		httputil.SendRateLimit(c.limits.requests),
+		httputil.SendHeaders(map[string]string{"Host": c.registry}),
+		httputil.SendAcceptedCodes(http.StatusCreated, http.StatusAccepted))
+	if err != nil {
+		return false, "", fmt.Errorf("send mount layer request %s: %w", URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return true, "", nil
+	}
+	location, err := resolveLocation(resp.Request.URL.String(), resp.Header.Get("Location"))
+	if err != nil {
+		return false, "", fmt.Errorf("layer upload URL: %s", err)
+	}
+	log.Infof("* Registry did not mount layer %s from %s, uploading it", digest, from)
+	return false, location, nil
+}
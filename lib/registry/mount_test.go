@@ -0,0 +1,116 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mountTransportFixture answers blob mount requests with the given status,
+// and accepts all other upload requests.
+type mountTransportFixture struct {
+	mountStatus int
+	requests    []string
+}
+
+func (t *mountTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, r.Method+" "+r.URL.RequestURI())
+	status := http.StatusAccepted
+	switch {
+	case r.Method == "HEAD":
+		status = http.StatusNotFound
+	case r.Method == "POST" && r.URL.Query().Get("mount") != "":
+		status = t.mountStatus
+	case r.Method == "PUT":
+		status = http.StatusCreated
+	}
+	header := make(http.Header)
+	header.Set("Location", "/v2/repo/blobs/uploads/1")
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Header:     header,
+		Request:    r,
+	}, nil
+}
+
+func TestPushLayerMount(t *testing.T) {
+	blob := []byte("0123456789")
+	digest, err := image.NewDigester().FromBytes(blob)
+	require.NoError(t, err)
+	mount := "POST /v2/repo/blobs/uploads/?" + url.Values{"mount": {string(digest)}, "from": {"base"}}.Encode()
+	commit := "PUT /v2/repo/blobs/uploads/1?" + url.Values{"digest": {string(digest)}}.Encode()
+
+	tests := []struct {
+		desc        string
+		registry    string
+		mountStatus int
+		requests    []string
+	}{
+		{"mounted", "mount.example.com", http.StatusCreated, []string{
+			"HEAD /v2/repo/blobs/" + string(digest),
+			mount,
+		}},
+		{"upload started instead", "upload.example.com", http.StatusAccepted, []string{
+			"HEAD /v2/repo/blobs/" + string(digest),
+			mount,
+			"PATCH /v2/repo/blobs/uploads/1",
+			commit,
+		}},
+		{"unknown source", "unknown.example.com", http.StatusCreated, []string{
+			"HEAD /v2/repo/blobs/" + string(digest),
+			"POST /v2/repo/blobs/uploads/",
+			"PATCH /v2/repo/blobs/uploads/1",
+			commit,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			require.NoError(ctx.ImageStore.Layers.CreateDownloadFile(digest.Hex(), 0))
+			w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter(digest.Hex())
+			require.NoError(err)
+			_, err = w.Write(blob)
+			require.NoError(err)
+			w.Close()
+			require.NoError(ctx.ImageStore.Layers.MoveDownloadFileToStore(digest.Hex()))
+
+			if test.registry != "unknown.example.com" {
+				recordBlobSource(test.registry, "base", digest)
+			}
+			transport := &mountTransportFixture{mountStatus: test.mountStatus}
+			p := NewWithClient(ctx.ImageStore, test.registry, "repo", &http.Client{Transport: transport})
+			p.config.Security.TLS.Client.Disabled = true
+
+			require.NoError(p.pushLayerHelper(digest, false, true))
+			require.Equal(test.requests, transport.requests)
+			source, ok := blobSource(test.registry, digest)
+			require.True(ok)
+			require.Equal("repo", source)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// SearchRegistries is an ordered list of registries that unqualified image
+// names (e.g. "ubuntu:18.04") are resolved against, similar to
+// unqualified-search-registries in containers-registries.conf.
+// If empty, unqualified image names default to docker hub.
+var SearchRegistries []string
+
+// ResolveNameForPull parses an image name for pull. If the name is not
+// qualified with a registry and SearchRegistries is not empty, search
+// registries are queried in order until one has the image.
+func ResolveNameForPull(input string) (image.Name, error) {
+	return resolveNameForPull(input, SearchRegistries, func(name image.Name) (bool, error) {
+		return New(nil, name.GetRegistry(), name.GetRepository()).manifestExists(name.GetTag())
+	})
+}
+
+func resolveNameForPull(
+	input string, registries []string, exists func(image.Name) (bool, error)) (image.Name, error) {
+
+	name, err := image.ParseName(input)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("parse image name %s: %s", input, err)
+	}
+	if len(registries) == 0 || name.IsQualified() || name.GetRepository() == image.Scratch {
+		return image.ParseNameForPull(input)
+	}
+
+	for _, registry := range registries {
+		candidate, err := image.ParseNameForPullFrom(input, registry)
+		if err != nil {
+			return image.Name{}, fmt.Errorf("parse image name %s: %s", input, err)
+		}
+		if ok, err := exists(candidate); err != nil {
+			log.Warnf("Failed to look up %s in search registry %s: %s", input, registry, err)
+		} else if ok {
+			log.Infof("Resolved short name %s to %s", input, candidate)
+			return candidate, nil
+		}
+	}
+	return image.Name{}, fmt.Errorf("image %s not found in search registries %v", input, registries)
+}
@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveNameForPull(t *testing.T) {
+	registries := []string{"registry-a.example.com", "registry-b.example.com", image.DockerHubRegistry}
+
+	t.Run("first match wins", func(t *testing.T) {
+		require := require.New(t)
+
+		var queried []string
+		name, err := resolveNameForPull("ubuntu:18.04", registries, func(n image.Name) (bool, error) {
+			queried = append(queried, n.GetRegistry())
+			return n.GetRegistry() != "registry-a.example.com", nil
+		})
+		require.NoError(err)
+		require.Equal(registries[:2], queried)
+		require.Equal("registry-b.example.com/ubuntu:18.04", name.String())
+	})
+
+	t.Run("docker hub namespace", func(t *testing.T) {
+		require := require.New(t)
+
+		name, err := resolveNameForPull("ubuntu", registries, func(n image.Name) (bool, error) {
+			return n.GetRegistry() == image.DockerHubRegistry, nil
+		})
+		require.NoError(err)
+		require.Equal("index.docker.io/library/ubuntu:latest", name.String())
+	})
+
+	t.Run("lookup error skips registry", func(t *testing.T) {
+		require := require.New(t)
+
+		name, err := resolveNameForPull("ubuntu", registries, func(n image.Name) (bool, error) {
+			if n.GetRegistry() == "registry-a.example.com" {
+				return false, errors.New("connection refused")
+			}
+			return true, nil
+		})
+		require.NoError(err)
+		require.Equal("registry-b.example.com", name.GetRegistry())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		require := require.New(t)
+
+		_, err := resolveNameForPull("ubuntu", registries, func(n image.Name) (bool, error) {
+			return false, nil
+		})
+		require.Error(err)
+	})
+
+	t.Run("fully qualified bypasses search", func(t *testing.T) {
+		require := require.New(t)
+
+		name, err := resolveNameForPull("registry-c.example.com/ubuntu:18.04", registries, func(n image.Name) (bool, error) {
+			require.FailNow("search registries should not be queried")
+			return false, nil
+		})
+		require.NoError(err)
+		require.Equal("registry-c.example.com/ubuntu:18.04", name.String())
+	})
+
+	t.Run("no search registries", func(t *testing.T) {
+		require := require.New(t)
+
+		name, err := resolveNameForPull("ubuntu", nil, func(n image.Name) (bool, error) {
+			require.FailNow("search registries should not be queried")
+			return false, nil
+		})
+		require.NoError(err)
+		require.Equal("index.docker.io/library/ubuntu:latest", name.String())
+	})
+}
@@ -0,0 +1,227 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	acrCredentialsStore = "acr"
+
+	// acrUsername is the username docker clients use with ACR refresh tokens.
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+
+	azureResource     = "https://management.azure.com/"
+	azureTimeout      = 30 * time.Second
+	azureProbeTimeout = 2 * time.Second
+	azureJWTAssertion = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// acrTokenTTL is how long refresh tokens are reused. ACR issues them for
+	// 3 hours.
+	acrTokenTTL = time.Hour
+)
+
+// Overridden in tests.
+var (
+	azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	acrScheme         = "https"
+)
+
+var (
+	azureIdentityOnce  sync.Once
+	azureIdentityFound bool
+
+	acrTokensMutex sync.Mutex
+	acrTokens      = make(map[string]acrToken)
+)
+
+// acrToken is a refresh token of a registry, reused until expiry.
+type acrToken struct {
+	token  string
+	expiry time.Time
+}
+
+// hasAzureIdentity returns true if makisu runs with an Azure identity. Without
+// one, ACR registries are accessed anonymously, which works for public images.
+// The instance metadata service is probed only once, with a short timeout,
+// since it doesn't exist outside of Azure.
+func hasAzureIdentity() bool {
+	if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" || os.Getenv("AZURE_CLIENT_SECRET") != "" {
+		return true
+	}
+	azureIdentityOnce.Do(func() {
+		_, err := getAADTokenFromIMDS(os.Getenv("AZURE_CLIENT_ID"), azureProbeTimeout)
+		if err != nil {
+			log.Debugf("Accessing ACR registries anonymously, no azure managed identity: %s", err)
+		}
+		azureIdentityFound = err == nil
+	})
+	return azureIdentityFound
+}
+
+// isACRRegistry returns true if addr is an Azure Container Registry, like
+// myregistry.azurecr.io.
+func isACRRegistry(addr string) bool {
+	return strings.HasSuffix(normalizeDockerConfigAddr(addr), ".azurecr.io")
+}
+
+// getACRCredentials gets an AAD access token of the identity makisu runs
+// with and exchanges it for a refresh token of the registry. The refresh token
+// is reused by later calls for acrTokenTTL.
+func getACRCredentials(addr string) (types.AuthConfig, error) {
+	registry := normalizeDockerConfigAddr(addr)
+	refreshToken, err := getACRRefreshToken(registry)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	return types.AuthConfig{
+		Username:      acrUsername,
+		Password:      refreshToken,
+		ServerAddress: registry,
+	}, nil
+}
+
+func getACRRefreshToken(registry string) (string, error) {
+	acrTokensMutex.Lock()
+	defer acrTokensMutex.Unlock()
+	if cached, ok := acrTokens[registry]; ok && time.Now().Before(cached.expiry) {
+		return cached.token, nil
+	}
+
+	aadToken, err := getAADToken()
+	if err != nil {
+		return "", fmt.Errorf("get aad token: %s", err)
+	}
+	refreshToken, err := exchangeAADToken(registry, os.Getenv("AZURE_TENANT_ID"), aadToken)
+	if err != nil {
+		return "", fmt.Errorf("exchange aad token: %s", err)
+	}
+	acrTokens[registry] = acrToken{refreshToken, time.Now().Add(acrTokenTTL)}
+	return refreshToken, nil
+}
+
+// getAADToken gets an AAD access token for the Azure Resource Manager from,
+// in order: the federated token of AKS workload identity, the secret of a
+// service principal, the managed identity of the VM.
+func getAADToken() (string, error) {
+	tenant := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		assertion, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read federated token: %s", err)
+		}
+		return getAADTokenFromClientCredentials(tenant, url.Values{
+			"client_id":             {clientID},
+			"client_assertion_type": {azureJWTAssertion},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		})
+	}
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		return getAADTokenFromClientCredentials(tenant, url.Values{
+			"client_id":     {clientID},
+			"client_secret": {secret},
+		})
+	}
+	return getAADTokenFromIMDS(clientID, azureTimeout)
+}
+
+func getAADTokenFromClientCredentials(tenant string, form url.Values) (string, error) {
+	if tenant == "" {
+		return "", fmt.Errorf("AZURE_TENANT_ID is not set")
+	}
+	authority := strings.TrimSuffix(os.Getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", azureResource+".default")
+	return postAzureForm(authority+"/"+tenant+"/oauth2/v2.0/token", form, "access_token")
+}
+
+func getAADTokenFromIMDS(clientID string, timeout time.Duration) (string, error) {
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {azureResource},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	resp, err := httputil.Get(
+		azureIMDSEndpoint+"?"+query.Encode(),
+		httputil.SendHeaders(map[string]string{"Metadata": "true"}),
+		httputil.SendTimeout(timeout))
+	if err != nil {
+		return "", fmt.Errorf("get managed identity token: %s", err)
+	}
+	defer resp.Body.Close()
+	return decodeAzureToken(resp.Body, "access_token")
+}
+
+// exchangeAADToken exchanges an AAD access token for a refresh token of the
+// registry.
+func exchangeAADToken(registry, tenant, aadToken string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {aadToken},
+	}
+	if tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	return postAzureForm(acrScheme+"://"+registry+"/oauth2/exchange", form, "refresh_token")
+}
+
+func postAzureForm(endpoint string, form url.Values, field string) (string, error) {
+	resp, err := httputil.Post(
+		endpoint,
+		httputil.SendBody(strings.NewReader(form.Encode())),
+		httputil.SendHeaders(map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+		}),
+		httputil.SendTimeout(azureTimeout),
+		httputil.DisableHTTPFallback())
+	if err != nil {
+		return "", fmt.Errorf("post %s: %s", endpoint, err)
+	}
+	defer resp.Body.Close()
+	return decodeAzureToken(resp.Body, field)
+}
+
+func decodeAzureToken(body io.Reader, field string) (string, error) {
+	var tokens map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("decode token response: %s", err)
+	}
+	token, ok := tokens[field].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("no %s in token response", field)
+	}
+	return token, nil
+}
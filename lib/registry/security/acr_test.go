@@ -0,0 +1,103 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetACRCredentials(t *testing.T) {
+	require := require.New(t)
+
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureResource {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "aad-token"}`)
+	}))
+	defer imds.Close()
+	var registry string
+	var exchanges int
+	acr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges++
+		require.NoError(r.ParseForm())
+		if r.URL.Path != "/oauth2/exchange" ||
+			r.PostForm.Get("grant_type") != "access_token" ||
+			r.PostForm.Get("service") != registry ||
+			r.PostForm.Get("access_token") != "aad-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"refresh_token": "acr-token"}`)
+	}))
+	defer acr.Close()
+	registry = acr.Listener.Addr().String()
+
+	defer func(endpoint, scheme string) {
+		azureIMDSEndpoint, acrScheme = endpoint, scheme
+	}(azureIMDSEndpoint, acrScheme)
+	azureIMDSEndpoint, acrScheme = imds.URL, "http"
+	for _, env := range []string{"AZURE_FEDERATED_TOKEN_FILE", "AZURE_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	authConfig, err := Config{}.getCredentialFromHelper(acrCredentialsStore, registry)
+	require.NoError(err)
+	require.Equal(acrUsername, authConfig.Username)
+	require.Equal("acr-token", authConfig.Password)
+
+	// The refresh token is reused.
+	authConfig, err = Config{}.getCredentialFromHelper(acrCredentialsStore, registry)
+	require.NoError(err)
+	require.Equal("acr-token", authConfig.Password)
+	require.Equal(1, exchanges)
+
+	require.True(isACRRegistry("myregistry.azurecr.io"))
+	require.False(isACRRegistry("azurecr.io.example.com"))
+}
+
+func TestGetHTTPOptionWithoutAzureIdentity(t *testing.T) {
+	require := require.New(t)
+
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	imds.Close()
+	defer func(endpoint string) {
+		azureIMDSEndpoint = endpoint
+		azureIdentityOnce = sync.Once{}
+	}(azureIMDSEndpoint)
+	azureIMDSEndpoint = imds.URL
+	azureIdentityOnce = sync.Once{}
+	for _, env := range []string{"AZURE_FEDERATED_TOKEN_FILE", "AZURE_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	// Public images are pulled anonymously.
+	c := Config{TLS: &httputil.TLSConfig{Client: httputil.X509Pair{Disabled: true}}}
+	_, err := c.GetHTTPOption("myregistry.azurecr.io", "repo")
+	require.NoError(err)
+	require.False(hasAzureIdentity())
+}
@@ -38,7 +38,11 @@ var v2Version = auth.APIVersion{
 }
 
 // BasicAuthTransport creates a transport that does basic authentication.
-func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig types.AuthConfig) (http.RoundTripper, error) {
+// Tokens are requested with pull access to pullRepos too.
+func BasicAuthTransport(
+	addr, repo string, tr http.RoundTripper, authConfig types.AuthConfig,
+	pullRepos ...string) (http.RoundTripper, error) {
+
 	cm, err := ping(addr, tr)
 	if err != nil {
 		return nil, fmt.Errorf("ping v2 registry: %s", err)
@@ -49,17 +53,24 @@ func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig type
 	if authConfig.Username != "" && authConfig.Password != "" && strings.HasSuffix(addr, "amazonaws.com") {
 		return transport.NewTransport(tr, auth.NewAuthorizer(cm, auth.NewBasicHandler(defaultCredStore{authConfig}))), nil
 	} else {
+		scopes := []auth.Scope{
+			auth.RepositoryScope{
+				Repository: repo,
+				Actions:    []string{"pull", "push"},
+			},
+		}
+		for _, pullRepo := range pullRepos {
+			scopes = append(scopes, auth.RepositoryScope{
+				Repository: pullRepo,
+				Actions:    []string{"pull"},
+			})
+		}
 		return transport.NewTransport(tr, auth.NewAuthorizer(cm, auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
 			Transport:   tr,
 			Credentials: defaultCredStore{authConfig},
-			Scopes: []auth.Scope{
-				auth.RepositoryScope{
-					Repository: repo,
-					Actions:    []string{"pull", "push"},
-				},
-			},
-			ClientID:   "docker",
-			ForceOAuth: false, // Only support basic auth.
+			Scopes:      scopes,
+			ClientID:    "docker",
+			ForceOAuth:  false, // Only support basic auth.
 		}))), nil
 	}
 }
@@ -0,0 +1,140 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+)
+
+// DockerConfig is the part of the config file of the docker CLI holding
+// registry credentials: static credentials saved by "docker login", and the
+// credential helpers to get them from.
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+// DockerAuth is an entry of the "auths" of a docker config. Auth is the
+// base64 encoding of "<username>:<password>".
+type DockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// GlobalDockerConfig provides the credentials of registries that have none in
+// the registry config.
+var GlobalDockerConfig *DockerConfig
+
+// DefaultDockerConfigPath returns the path of the config file of the docker
+// CLI: $DOCKER_CONFIG/config.json, or ~/.docker/config.json.
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// LoadDockerConfig reads the docker config at path. It returns nil if the file
+// doesn't exist.
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read docker config: %s", err)
+	}
+	var config DockerConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal docker config: %s", err)
+	}
+	auths := make(map[string]DockerAuth)
+	for addr, auth := range config.Auths {
+		auths[normalizeDockerConfigAddr(addr)] = auth
+	}
+	config.Auths = auths
+	helpers := make(map[string]string)
+	for addr, helper := range config.CredHelpers {
+		helpers[normalizeDockerConfigAddr(addr)] = helper
+	}
+	config.CredHelpers = helpers
+	return &config, nil
+}
+
+// apply returns the security config with the credentials of the registry at
+// addr in the docker config, if any. Like the docker CLI, the helper of the
+// registry in "credHelpers" is used first, then the static credentials in
+// "auths", then "credsStore" for registries that have an entry in "auths".
+func (d *DockerConfig) apply(c Config, addr string) (Config, error) {
+	addr = normalizeDockerConfigAddr(addr)
+	if helper, ok := d.CredHelpers[addr]; ok {
+		c.RemoteCredentialsStore = helper
+		return c, nil
+	}
+	auth, ok := d.Auths[addr]
+	if !ok {
+		return c, nil
+	}
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return c, fmt.Errorf("decode docker config auth of %s: %s", addr, err)
+		}
+		split := strings.SplitN(string(decoded), ":", 2)
+		if len(split) != 2 {
+			return c, fmt.Errorf("malformed docker config auth of %s", addr)
+		}
+		auth.Username, auth.Password = split[0], split[1]
+	}
+	if auth.Username != "" || auth.Password != "" || auth.IdentityToken != "" {
+		c.BasicAuth = &BasicAuthConfig{AuthConfig: types.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: addr,
+		}}
+	} else if d.CredsStore != "" {
+		c.RemoteCredentialsStore = d.CredsStore
+	}
+	return c, nil
+}
+
+// normalizeDockerConfigAddr returns the host of a registry address of a
+// docker config, which can be a URL. Docker Hub addresses are normalized to
+// index.docker.io.
+func normalizeDockerConfigAddr(addr string) string {
+	addr = strings.TrimPrefix(addr, "https://")
+	addr = strings.TrimPrefix(addr, "http://")
+	addr = strings.SplitN(addr, "/", 2)[0]
+	switch addr {
+	case "docker.io", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return addr
+}
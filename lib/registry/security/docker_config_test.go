@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfig(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "docker_config")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	config, err := LoadDockerConfig(path)
+	require.NoError(err)
+	require.Nil(config)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	require.NoError(ioutil.WriteFile(path, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "`+auth+`"},
+			"registry.example.com": {"auth": "`+auth+`"},
+			"store.example.com": {}
+		},
+		"credsStore": "desktop",
+		"credHelpers": {"123.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}
+	}`), 0644))
+	config, err = LoadDockerConfig(path)
+	require.NoError(err)
+
+	tests := []struct {
+		addr       string
+		username   string
+		credsStore string
+	}{
+		{addr: "index.docker.io", username: "user"},
+		{addr: "registry.example.com", username: "user"},
+		{addr: "store.example.com", credsStore: "desktop"},
+		{addr: "123.dkr.ecr.us-east-1.amazonaws.com", credsStore: "ecr-login"},
+		{addr: "other.example.com"},
+	}
+	for _, test := range tests {
+		c, err := config.apply(Config{}, test.addr)
+		require.NoError(err)
+		require.Equal(test.credsStore, c.RemoteCredentialsStore, test.addr)
+		if test.username == "" {
+			require.Nil(c.BasicAuth, test.addr)
+		} else {
+			require.Equal(test.username, c.BasicAuth.Username, test.addr)
+			require.Equal("pass", c.BasicAuth.Password, test.addr)
+		}
+	}
+}
+
+func TestHelperProgramInPath(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "helper")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	helper := filepath.Join(dir, "docker-credential-test")
+	require.NoError(ioutil.WriteFile(helper, []byte(
+		"#!/bin/sh\necho '{\"ServerURL\":\"registry.example.com\",\"Username\":\"user\",\"Secret\":\"pass\"}'\n"), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	require.Equal(helper, helperProgram("test"))
+	authConfig, err := Config{}.getCredentialFromHelper("test", "registry.example.com")
+	require.NoError(err)
+	require.Equal("user", authConfig.Username)
+	require.Equal("pass", authConfig.Password)
+}
@@ -0,0 +1,80 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// reauthTransport authenticates requests with the transport returned by
+// newTransport. Bearer tokens are refreshed by that transport when they
+// expire; if the registry still rejects a request with 401, because the
+// credentials it got them with expired too, the transport is built again with
+// fresh credentials and the request is sent one more time. GetHTTPOption
+// builds one per request, so it's not safe for concurrent use.
+type reauthTransport struct {
+	newTransport func() (http.RoundTripper, error)
+	transport    http.RoundTripper
+}
+
+func newReauthTransport(newTransport func() (http.RoundTripper, error)) (*reauthTransport, error) {
+	tr, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &reauthTransport{newTransport: newTransport, transport: tr}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	retry, err := rewindRequest(req)
+	if err != nil {
+		log.Warnf("Cannot resend request to %s after 401: %s", req.URL.Host, err)
+		return resp, nil
+	}
+	log.Infof("Registry %s returned 401, re-authenticating", req.URL.Host)
+	tr, err := t.newTransport()
+	if err != nil {
+		log.Warnf("Failed to re-authenticate to %s: %s", req.URL.Host, err)
+		return resp, nil
+	}
+	t.transport = tr
+	resp.Body.Close()
+	return tr.RoundTrip(retry)
+}
+
+// rewindRequest returns a copy of req that can be sent again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := req.WithContext(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("body cannot be read again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("get body: %s", err)
+	}
+	retry.Body = body
+	return retry, nil
+}
@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestReauthTransport(t *testing.T) {
+	var built int
+	newTransport := func() (http.RoundTripper, error) {
+		built++
+		// Only the credentials of the second transport are valid.
+		valid := built > 1
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			var body string
+			if req.Body != nil {
+				b, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				body = string(b)
+			}
+			code := http.StatusUnauthorized
+			if valid {
+				code = http.StatusOK
+			}
+			return &http.Response{
+				StatusCode: code,
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		}), nil
+	}
+
+	t.Run("replayable body", func(t *testing.T) {
+		require := require.New(t)
+		built = 0
+
+		tr, err := newReauthTransport(newTransport)
+		require.NoError(err)
+		req, err := http.NewRequest("PUT", "http://registry.example.com/v2/", strings.NewReader("manifest"))
+		require.NoError(err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(err)
+		require.Equal("manifest", string(body))
+		require.Equal(2, built)
+
+		// The new transport is kept for redirects.
+		resp, err = tr.RoundTrip(req)
+		require.NoError(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		require.Equal(2, built)
+	})
+
+	t.Run("streamed body", func(t *testing.T) {
+		require := require.New(t)
+		built = 0
+
+		tr, err := newReauthTransport(newTransport)
+		require.NoError(err)
+		req, err := http.NewRequest("PATCH", "http://registry.example.com/v2/",
+			ioutil.NopCloser(strings.NewReader("layer")))
+		require.NoError(err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(err)
+		require.Equal(http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(1, built)
+	})
+}
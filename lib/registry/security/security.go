@@ -15,15 +15,20 @@
 package security
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/docker-credential-gcr/config"
 	"github.com/GoogleCloudPlatform/docker-credential-gcr/credhelper"
 	"github.com/GoogleCloudPlatform/docker-credential-gcr/store"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
@@ -32,12 +37,23 @@ import (
 	"github.com/awslabs/amazon-ecr-credential-helper/ecr-login/api"
 	"github.com/docker/docker-credential-helpers/client"
 	"github.com/docker/engine-api/types"
+	"golang.org/x/oauth2/google"
 )
 
-const tokenUsername = "<token>"
+const (
+	tokenUsername       = "<token>"
+	ecrCredentialsStore = "ecr-login"
+	gcpCredentialsStore = "gcp"
+
+	gcpOAuth2Username = "oauth2accesstoken"
+	gcpScope          = "https://www.googleapis.com/auth/cloud-platform"
+)
 
 var credentialHelperPrefix = path.Join(pathutils.DefaultInternalDir, "docker-credential-")
 
+// Overridden in tests.
+var findGoogleCredentials = google.FindDefaultCredentials
+
 // BasicAuthConfig is a simple wrapper of Docker's types.AuthConfig with addtional support
 // for a password file.
 type BasicAuthConfig struct {
@@ -57,11 +73,13 @@ func (c *BasicAuthConfig) Get() (types.AuthConfig, error) {
 	return c.AuthConfig, nil
 }
 
-// Config contains tls and basic auth configuration.
+// Config contains tls, basic auth and proxy configuration.
 type Config struct {
 	TLS                    *httputil.TLSConfig `yaml:"tls" json:"tls"`
 	BasicAuth              *BasicAuthConfig    `yaml:"basic" json:"basic"`
 	RemoteCredentialsStore string              `yaml:"credsStore" json:"credsStore"`
+	// Overrides the proxy of the environment for the registry.
+	Proxy *httputil.ProxyConfig `yaml:"proxy" json:"proxy"`
 }
 
 // ApplyDefaults applies default configuration.
@@ -69,15 +87,55 @@ func (c Config) ApplyDefaults() Config {
 	if c.TLS == nil {
 		c.TLS = &httputil.TLSConfig{}
 	}
+	defaultCACerts := utils.DefaultEnv("SSL_CERT_DIR", pathutils.DefaultCACertsPath)
 	if c.TLS.CA.Cert.Path == "" {
-		c.TLS.CA.Cert.Path = utils.DefaultEnv("SSL_CERT_DIR", pathutils.DefaultCACertsPath)
+		c.TLS.CA.Cert.Path = defaultCACerts
+	} else if c.TLS.CA.Cert.Path != defaultCACerts {
+		// Registries with a private CA may still redirect blob requests to
+		// storage with public certs.
+		if _, err := os.Stat(defaultCACerts); err == nil {
+			c.TLS.AddCAPath(defaultCACerts)
+		}
 	}
 	return c
 }
 
+// HasCredentials returns true if basic auth or a credentials store is
+// configured.
+func (c Config) HasCredentials() bool {
+	return c.BasicAuth != nil || c.RemoteCredentialsStore != ""
+}
+
+// hasExplicitCredentials returns true if credentials other than the empty
+// basic auth of Docker Hub are configured.
+func (c Config) hasExplicitCredentials() bool {
+	return c.RemoteCredentialsStore != "" ||
+		(c.BasicAuth != nil && *c.BasicAuth != BasicAuthConfig{})
+}
+
 // GetHTTPOption returns httputil.Option based on the security configuration.
-func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
-	shouldUseBasicAuth := (c.BasicAuth != nil || c.RemoteCredentialsStore != "")
+// If no credentials are configured for the registry, those of
+// GlobalDockerConfig are used, and ECR registries get their tokens from the
+// standard AWS credential chain, GCR and Artifact Registry ones from the
+// Google Application Default Credentials, ACR ones from an Azure identity.
+// Tokens grant pull access to pullRepos too, for cross-repository mounts.
+func (c Config) GetHTTPOption(addr, repo string, pullRepos ...string) (httputil.SendOption, error) {
+	if GlobalDockerConfig != nil && !c.hasExplicitCredentials() {
+		var err error
+		if c, err = GlobalDockerConfig.apply(c, addr); err != nil {
+			return nil, fmt.Errorf("apply docker config: %s", err)
+		}
+	}
+	if !c.hasExplicitCredentials() {
+		if isECRRegistry(addr) {
+			c.RemoteCredentialsStore = ecrCredentialsStore
+		} else if isGCPRegistry(addr) && hasGCPCredentials() {
+			c.RemoteCredentialsStore = gcpCredentialsStore
+		} else if isACRRegistry(addr) && hasAzureIdentity() {
+			c.RemoteCredentialsStore = acrCredentialsStore
+		}
+	}
+	shouldUseBasicAuth := c.HasCredentials()
 
 	var tlsClientConfig *tls.Config
 	var err error
@@ -86,27 +144,61 @@ func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
 		if err != nil {
 			return nil, fmt.Errorf("build tls config: %s", err)
 		}
-		if !shouldUseBasicAuth {
+		if !shouldUseBasicAuth && c.Proxy == nil {
 			return httputil.SendTLS(tlsClientConfig), nil
 		}
 	}
 
 	if shouldUseBasicAuth {
-		authConfig, err := c.getCredentials(c.RemoteCredentialsStore, addr)
-		if err != nil {
-			return nil, fmt.Errorf("get credentials: %s", err)
-		}
 		tr := http.DefaultTransport.(*http.Transport)
+		if c.Proxy != nil {
+			if tr, err = c.proxyTransport(); err != nil {
+				return nil, err
+			}
+		}
 		tr.TLSClientConfig = tlsClientConfig // If tlsClientConfig is nil, default is used.
-		rt, err := BasicAuthTransport(addr, repo, tr, authConfig)
+		rt, err := newReauthTransport(func() (http.RoundTripper, error) {
+			authConfig, err := c.getCredentials(c.RemoteCredentialsStore, addr)
+			if err != nil {
+				return nil, fmt.Errorf("get credentials: %s", err)
+			}
+			rt, err := BasicAuthTransport(addr, repo, tr, authConfig, pullRepos...)
+			if err != nil {
+				return nil, fmt.Errorf("basic auth: %s", err)
+			}
+			return rt, nil
+		})
 		if err != nil {
-			return nil, fmt.Errorf("basic auth: %s", err)
+			return nil, err
 		}
 		return httputil.SendTLSTransport(rt), nil
 	}
+	if c.Proxy != nil {
+		tr, err := c.proxyTransport()
+		if err != nil {
+			return nil, err
+		}
+		if tlsClientConfig == nil {
+			return httputil.SendTransport(tr), nil
+		}
+		tr.TLSClientConfig = tlsClientConfig
+		return httputil.SendTLSTransport(tr), nil
+	}
 	return httputil.SendNoop(), nil
 }
 
+// proxyTransport returns a copy of the default transport using the proxy of
+// the config.
+func (c Config) proxyTransport() (*http.Transport, error) {
+	proxy, err := c.Proxy.ProxyFunc()
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %s", err)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = proxy
+	return tr, nil
+}
+
 func (c Config) getCredentials(helper, addr string) (types.AuthConfig, error) {
 	var authConfig types.AuthConfig
 	var err error
@@ -127,7 +219,7 @@ func (c Config) getCredentials(helper, addr string) (types.AuthConfig, error) {
 
 func (c Config) getCredentialFromHelper(helper, addr string) (types.AuthConfig, error) {
 	switch helper {
-	case "ecr-login":
+	case ecrCredentialsStore:
 		client := ecr.ECRHelper{ClientFactory: api.DefaultClientFactory{}}
 		username, password, err := client.Get(addr)
 		if err != nil {
@@ -154,9 +246,27 @@ func (c Config) getCredentialFromHelper(helper, addr string) (types.AuthConfig,
 			Username: username,
 			Password: password,
 		}, nil
+	case gcpCredentialsStore:
+		ts, err := google.DefaultTokenSource(context.Background(), gcpScope)
+		if err != nil {
+			return types.AuthConfig{}, fmt.Errorf("find google default credentials: %s", err)
+		}
+		token, err := ts.Token()
+		if err != nil {
+			return types.AuthConfig{}, fmt.Errorf("get google access token: %s", err)
+		}
+		return types.AuthConfig{
+			Username: gcpOAuth2Username,
+			Password: token.AccessToken,
+		}, nil
+	case acrCredentialsStore:
+		authConfig, err := getACRCredentials(addr)
+		if err != nil {
+			return types.AuthConfig{}, fmt.Errorf("get credentials from helper ACR: %s", err)
+		}
+		return authConfig, nil
 	default:
-		helperFullName := credentialHelperPrefix + helper
-		creds, err := client.Get(client.NewShellProgramFunc(helperFullName), addr)
+		creds, err := client.Get(client.NewShellProgramFunc(helperProgram(helper)), addr)
 		if err != nil {
 			return types.AuthConfig{}, err
 		}
@@ -178,3 +288,42 @@ func (c Config) getCredentialFromHelper(helper, addr string) (types.AuthConfig,
 		return ret, nil
 	}
 }
+
+// isECRRegistry returns true if addr is an AWS ECR registry, like
+// <account>.dkr.ecr.<region>.amazonaws.com.
+func isECRRegistry(addr string) bool {
+	_, err := api.ExtractRegistry(addr)
+	return err == nil
+}
+
+// isGCPRegistry returns true if addr is a Google Container Registry or an
+// Artifact Registry, like gcr.io, eu.gcr.io or europe-docker.pkg.dev.
+func isGCPRegistry(addr string) bool {
+	host := normalizeDockerConfigAddr(addr)
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") ||
+		strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// hasGCPCredentials returns true if Google Application Default Credentials
+// can be found. Without them, GCP registries are accessed anonymously, which
+// works for public images.
+func hasGCPCredentials() bool {
+	if _, err := findGoogleCredentials(context.Background(), gcpScope); err != nil {
+		log.Debugf("Accessing GCP registries anonymously, no google default credentials: %s", err)
+		return false
+	}
+	return true
+}
+
+// helperProgram returns the path of the binary of a docker credential helper:
+// the one in the makisu internal dir if it exists, the one in $PATH otherwise.
+func helperProgram(helper string) string {
+	helperFullName := credentialHelperPrefix + helper
+	if _, err := os.Stat(helperFullName); err == nil {
+		return helperFullName
+	}
+	if p, err := exec.LookPath("docker-credential-" + helper); err == nil {
+		return p
+	}
+	return helperFullName
+}
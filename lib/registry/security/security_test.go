@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2/google"
+)
+
+func TestECRRegistryDetection(t *testing.T) {
+	require := require.New(t)
+
+	require.True(isECRRegistry("123456789012.dkr.ecr.us-east-1.amazonaws.com"))
+	require.True(isECRRegistry("123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com"))
+	require.True(isECRRegistry("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn"))
+	require.False(isECRRegistry("index.docker.io"))
+	require.False(isECRRegistry("gcr.io"))
+}
+
+func TestGCPRegistryDetection(t *testing.T) {
+	require := require.New(t)
+
+	require.True(isGCPRegistry("gcr.io"))
+	require.True(isGCPRegistry("eu.gcr.io"))
+	require.True(isGCPRegistry("europe-west1-docker.pkg.dev"))
+	require.True(isGCPRegistry("https://us-docker.pkg.dev/v2/"))
+	require.False(isGCPRegistry("index.docker.io"))
+	require.False(isGCPRegistry("notgcr.io"))
+	require.False(isGCPRegistry("123456789012.dkr.ecr.us-east-1.amazonaws.com"))
+}
+
+func TestGetHTTPOptionWithoutGCPCredentials(t *testing.T) {
+	require := require.New(t)
+
+	defer func(find func(context.Context, ...string) (*google.Credentials, error)) {
+		findGoogleCredentials = find
+	}(findGoogleCredentials)
+	findGoogleCredentials = func(context.Context, ...string) (*google.Credentials, error) {
+		return nil, errors.New("could not find default credentials")
+	}
+
+	// Public images are pulled anonymously.
+	c := Config{TLS: &httputil.TLSConfig{Client: httputil.X509Pair{Disabled: true}}}
+	_, err := c.GetHTTPOption("gcr.io", "distroless/static")
+	require.NoError(err)
+}
+
+func TestGetHTTPOptionWithProxy(t *testing.T) {
+	require := require.New(t)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+		proxied = append(proxied, r.Host+" "+username+":"+password)
+	}))
+	defer proxy.Close()
+
+	c := Config{
+		TLS:   &httputil.TLSConfig{Client: httputil.X509Pair{Disabled: true}},
+		Proxy: &httputil.ProxyConfig{URL: proxy.URL, Username: "user", Password: "pass"},
+	}
+	opt, err := c.GetHTTPOption("registry.example.com", "repo")
+	require.NoError(err)
+	resp, err := httputil.Get("http://registry.example.com/v2/", opt)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal([]string{"registry.example.com user:pass"}, proxied)
+}
+
+func parseProxyAuthorization(header string) (string, string, bool) {
+	req := http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+const (
+	// Signatures are stored by cosign as layers of an image tagged after the
+	// digest of the signed manifest, "sha256-<hex>.sig".
+	_signatureTagSuffix  = ".sig"
+	_signatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// ImageSignaturePolicy verifies the signatures of all images pulled with
+// Pull, unless the registry config skips verification. It's off by default.
+var ImageSignaturePolicy *SignaturePolicy
+
+// SignaturePolicy verifies cosign signatures of images against a public key.
+type SignaturePolicy struct {
+	key crypto.PublicKey
+	// required fails pulls of unsigned images, instead of only warning.
+	required bool
+}
+
+// NewSignaturePolicy creates a new SignaturePolicy from a PEM encoded ECDSA,
+// RSA or ed25519 public key.
+func NewSignaturePolicy(keyPEM []byte, required bool) (*SignaturePolicy, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block found in public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %s", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	return &SignaturePolicy{key: key, required: required}, nil
+}
+
+// signaturePayload is the part of the signed simple signing payload that
+// identifies the signed manifest.
+type signaturePayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest image.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// signatureManifest is a manifest whose layers hold signature payloads.
+type signatureManifest struct {
+	Layers []struct {
+		Digest      image.Digest      `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// verify checks that the base64 encoded signature of payload was made with
+// the policy's key, and that payload identifies the given manifest digest.
+func (p *SignaturePolicy) verify(payload []byte, signature string, digest image.Digest) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %s", err)
+	}
+	h := sha256.Sum256(payload)
+	switch key := p.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, h[:], sig) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+			return fmt.Errorf("invalid signature: %s", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, sig) {
+			return errors.New("invalid signature")
+		}
+	}
+
+	var signed signaturePayload
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("unmarshal signature payload: %s", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for manifest %s",
+			signed.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// verifySignature verifies the signature of the manifest with the given
+// digest against ImageSignaturePolicy. One valid signature is enough.
+func (c DockerRegistryClient) verifySignature(digest image.Digest) error {
+	policy := ImageSignaturePolicy
+	if policy == nil || c.config.SkipSignatureVerification {
+		return nil
+	}
+
+	tag := strings.Replace(string(digest), ":", "-", 1) + _signatureTagSuffix
+	body, _, err := c.getManifest(tag, image.MediaTypeOCIManifest+", "+image.MediaTypeManifest)
+	if err == errManifestNotFound {
+		if policy.required {
+			return fmt.Errorf("no signature found for %s", digest)
+		}
+		log.Warnf("No signature found for %s/%s@%s", c.registry, c.repository, digest)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get signature manifest: %s", err)
+	}
+	var manifest signatureManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("unmarshal signature manifest: %s", err)
+	}
+
+	err = fmt.Errorf("no signature found for %s", digest)
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[_signatureAnnotation]
+		if !ok {
+			continue
+		}
+		payload, readErr := c.pullSignaturePayload(layer.Digest)
+		if readErr != nil {
+			return readErr
+		}
+		if err = policy.verify(payload, signature, digest); err == nil {
+			log.Infof("* Verified signature of %s/%s@%s", c.registry, c.repository, digest)
+			return nil
+		}
+	}
+	return err
+}
+
+// pullSignaturePayload pulls the signed payload with the given digest.
+func (c DockerRegistryClient) pullSignaturePayload(digest image.Digest) ([]byte, error) {
+	if _, err := c.PullLayer(digest); err != nil {
+		return nil, fmt.Errorf("pull signature payload %s: %s", digest, err)
+	}
+	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get signature payload reader: %s", err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
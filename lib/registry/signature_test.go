@@ -0,0 +1,121 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySignature(t *testing.T) {
+	digest := image.Digest("sha256:" + strings.Repeat("a", 64))
+	sigTag := "sha256-" + strings.Repeat("a", 64) + ".sig"
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		return key
+	}
+	trusted, untrusted := newKey(), newKey()
+	der, err := x509.MarshalPKIXPublicKey(&trusted.PublicKey)
+	require.NoError(t, err)
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	// signed returns the manifests of a signature of the given digest.
+	signed := func(key *ecdsa.PrivateKey, signedDigest image.Digest) map[string][]byte {
+		payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"localhost:5055/repo"},`+
+			`"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`,
+			signedDigest))
+		payloadDigest, err := image.NewDigester().FromBytes(payload)
+		require.NoError(t, err)
+		h := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+		require.NoError(t, err)
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     image.MediaTypeOCIManifest,
+			"layers": []map[string]interface{}{{
+				"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+				"digest":      payloadDigest,
+				"size":        len(payload),
+				"annotations": map[string]string{_signatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+			}},
+		})
+		require.NoError(t, err)
+		return map[string][]byte{sigTag: manifest, string(payloadDigest): payload}
+	}
+
+	tests := []struct {
+		desc      string
+		manifests map[string][]byte
+		required  bool
+		skip      bool
+		errMsg    string
+	}{
+		{"valid", signed(trusted, digest), true, false, ""},
+		{"untrusted key", signed(untrusted, digest), false, false, "invalid signature"},
+		{"other image", signed(trusted, "sha256:"+image.Digest(strings.Repeat("b", 64))), false, false, "signature is for manifest"},
+		{"missing and required", nil, true, false, "no signature found"},
+		{"missing", nil, false, false, ""},
+		{"skipped", signed(untrusted, digest), true, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			policy, err := NewSignaturePolicy(publicKey, test.required)
+			require.NoError(err)
+			ImageSignaturePolicy = policy
+			defer func() { ImageSignaturePolicy = nil }()
+
+			transport := &manifestTransportFixture{manifests: test.manifests}
+			p := NewWithClient(ctx.ImageStore, "localhost:5055", "repo", &http.Client{Transport: transport})
+			p.config.Security.TLS.Client.Disabled = true
+			p.config.SkipSignatureVerification = test.skip
+
+			err = p.verifySignature(digest)
+			if test.errMsg == "" {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), test.errMsg)
+			}
+		})
+	}
+}
+
+func TestNewSignaturePolicy(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewSignaturePolicy([]byte("not a key"), false)
+	require.Error(err)
+}
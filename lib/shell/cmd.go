@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/uber/makisu/lib/utils"
@@ -28,10 +29,31 @@ import (
 // ShellStreamBufferSize is the size of the output buffers when streaming command stdout and stderr
 const ShellStreamBufferSize = 1 << 20
 
+// KillOrphans makes ExecCommand kill the processes a command left running in
+// its process group once it exits, instead of waiting for them to close the
+// command's output. Processes that moved to another process group or session
+// are not affected.
+var KillOrphans bool
+
 type formatStream func(string, ...interface{})
 
 // ExecCommand exec a cmd and args inside workingDir as user, returns error if cmd fails
 func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName string, cmdArgs ...string) error {
+	return execCommand(outStream, errStream, false, workingDir, user, cmdName, cmdArgs...)
+}
+
+// ExecCommandWithoutNetwork is like ExecCommand, but runs the command in a new
+// network namespace, which only has a loopback interface that is down.
+func ExecCommandWithoutNetwork(
+	outStream, errStream formatStream, workingDir, user, cmdName string, cmdArgs ...string) error {
+
+	return execCommand(outStream, errStream, true, workingDir, user, cmdName, cmdArgs...)
+}
+
+func execCommand(
+	outStream, errStream formatStream, noNetwork bool, workingDir, user, cmdName string,
+	cmdArgs ...string) error {
+
 	cmd := exec.Command(cmdName, cmdArgs...)
 	if workingDir != "" {
 		cmd.Dir = workingDir
@@ -40,6 +62,11 @@ func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName st
 	if err := setProcAttributes(cmd, user); err != nil {
 		return fmt.Errorf("set command creds: %v", err)
 	}
+	if noNetwork {
+		if err := disableNetwork(cmd); err != nil {
+			return fmt.Errorf("disable network: %s", err)
+		}
+	}
 
 	cmd.Env = os.Environ()
 	if user != "" {
@@ -53,31 +80,78 @@ func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName st
 }
 
 func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
-	outReader, outWriter := io.Pipe()
-	errReader, errWriter := io.Pipe()
+	// Use os pipes so the command writes to them directly, and Wait doesn't
+	// wait for processes it left running to close its output.
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create stdout pipe: %s", err)
+	}
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		outReader.Close()
+		outWriter.Close()
+		return fmt.Errorf("create stderr pipe: %s", err)
+	}
 	cmd.Stdout, cmd.Stderr = outWriter, errWriter
 
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
+		defer outReader.Close()
 		if err := readerToStream(outReader, outStream); err != nil {
 			outStream("Failed to stream stdout from command: %s\n", err)
 		}
 	}()
 
 	go func() {
+		defer wg.Done()
+		defer errReader.Close()
 		if err := readerToStream(errReader, errStream); err != nil {
 			errStream("Failed to stream stderr from command: %s\n", err)
 		}
 	}()
 
-	if err := cmd.Start(); err != nil {
+	// The command has its own copies of the write ends after start.
+	err = cmd.Start()
+	outWriter.Close()
+	errWriter.Close()
+	if err != nil {
+		wg.Wait()
 		return fmt.Errorf("cmd start: %s", err)
-	} else if err := cmd.Wait(); err != nil {
+	}
+	err = cmd.Wait()
+	if KillOrphans {
+		killProcessGroup(cmd.Process.Pid, errStream)
+	}
+	// Without KillOrphans, this waits for processes left running by the
+	// command to close their output.
+	wg.Wait()
+	if err != nil {
 		errStream("Command exited with %d\n", cmd.ProcessState.ExitCode())
 		return fmt.Errorf("cmd wait: %s", err)
 	}
 	return nil
 }
 
+// killProcessGroup kills the processes left running in the process group of
+// an exited command, and reaps them if they were reparented to makisu.
+func killProcessGroup(pgid int, errStream formatStream) {
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err == syscall.ESRCH {
+		return
+	} else if err != nil {
+		errStream("Failed to kill processes left running by command: %s\n", err)
+		return
+	}
+	errStream("Killed processes left running by command\n")
+	for {
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(-pgid, &status, 0, nil); err != syscall.EINTR && err != nil {
+			return
+		}
+	}
+}
+
 func setProcAttributes(cmd *exec.Cmd, user string) error {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	if user == "" {
@@ -17,8 +17,13 @@ package shell
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -66,3 +71,60 @@ func TestExecCommandError(t *testing.T) {
 	require.Error(err)
 	require.NotEmpty(stderr.String())
 }
+
+func TestExecCommandKillOrphans(t *testing.T) {
+	require := require.New(t)
+
+	KillOrphans = true
+	defer func() { KillOrphans = false }()
+
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	done := make(chan error)
+	go func() {
+		// The background process holds on to the command's stdout.
+		done <- ExecCommand(stdout.Write, stderr.Write, ".", "", "sh", "-c", "sleep 100 & echo $!")
+	}()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(10 * time.Second):
+		require.FailNow("command with background process didn't return")
+	}
+	require.Contains(stderr.String(), "Killed processes left running by command")
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	require.NoError(err)
+	require.True(processGone(pid), "background process %d still running", pid)
+}
+
+// processGone returns true if the process doesn't exist anymore, or is a
+// zombie waiting to be reaped by its new parent.
+func processGone(pid int) bool {
+	for i := 0; i < 50; i++ {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if os.IsNotExist(err) {
+			return true
+		}
+		fields := strings.Fields(string(stat))
+		if len(fields) > 2 && fields[2] == "Z" {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestExecCommandWithoutNetwork(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	err := ExecCommandWithoutNetwork(stdout.Write, stderr.Write, ".", "", "cat", "/proc/net/dev")
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skip("creating network namespaces requires CAP_SYS_ADMIN")
+	}
+	require.NoError(err)
+
+	// Only the loopback interface is listed, after the two header lines.
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(lines, 3)
+	require.Equal("lo:", strings.Fields(lines[2])[0])
+}
@@ -20,3 +20,6 @@ const _whiteoutPrefix = ".wh."
 // Should be ignored during untar.
 // TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
 const _whiteoutMetaPrefix = _whiteoutPrefix + _whiteoutPrefix
+
+// _whiteoutOpaque marks a directory whose contents in lower layers are hidden.
+const _whiteoutOpaque = _whiteoutMetaPrefix + ".opq"
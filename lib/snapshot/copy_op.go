@@ -33,9 +33,13 @@ type CopyOperation struct {
 	uid           int
 	gid           int
 	chown         bool
+	mode          os.FileMode
+	chmod         bool
 	preserveOwner bool
 
 	blacklist []string
+	// Paths of sources that are excluded from the copy.
+	excludes []string
 	// Indicates if the copy op is used for copying from previous stages.
 	internal bool
 }
@@ -43,7 +47,7 @@ type CopyOperation struct {
 // NewCopyOperation initializes and validates a CopyOperation. Use "internal" to
 // specify if the copy op is used for copying from previous stages.
 func NewCopyOperation(
-	srcs []string, srcRoot, workDir, dst, chownStr string,
+	srcs []string, srcRoot, workDir, dst, chownStr, chmodStr string,
 	blacklist []string, internal, preserveOwner bool) (*CopyOperation, error) {
 
 	if err := checkCopyParams(srcs, workDir, dst); err != nil {
@@ -58,6 +62,10 @@ func NewCopyOperation(
 	if err != nil {
 		return nil, fmt.Errorf("resolve chown str: %s", err)
 	}
+	mode, err := utils.ResolveChmod(chmodStr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve chmod str: %s", err)
+	}
 
 	relSources := make([]string, len(srcs))
 	for k, src := range srcs {
@@ -73,12 +81,20 @@ func NewCopyOperation(
 		uid:           uid,
 		gid:           gid,
 		chown:         chown,
+		mode:          mode,
+		chmod:         chmodStr != "",
 		preserveOwner: preserveOwner,
 		blacklist:     blacklist,
 		internal:      internal,
 	}, nil
 }
 
+// Exclude excludes the given absolute paths under the src root, and
+// everything under them, from the copy.
+func (c *CopyOperation) Exclude(paths []string) {
+	c.excludes = append(c.excludes, paths...)
+}
+
 // Execute performs the actual copying of files specified by the CopyOperation.
 func (c *CopyOperation) Execute() error {
 	var err error
@@ -93,37 +109,43 @@ func (c *CopyOperation) Execute() error {
 			return fmt.Errorf("lstat %s: %s", src, err)
 		}
 
-		blacklist := c.blacklist
+		blacklist := append([]string{}, c.blacklist...)
 		if c.internal {
 			// Copying checkpointed files from sandbox dir, and there is no need to
 			// blacklist any path, since they would have been filtered out by checkpoint.
 			blacklist = []string{}
 		}
+		blacklist = append(blacklist, c.excludes...)
 
-		var copier *fileio.Copier
+		var opts []fileio.CopyOption
 		if c.chown {
 			// COPY --chown.
 			// Owner decided by --chown.
-			copier = fileio.NewCopier(blacklist,
+			opts = []fileio.CopyOption{
 				fileio.WithDstDirOwner(c.uid, c.gid, false),
 				fileio.WithDstFileAndChildrenOwner(c.uid, c.gid, true),
-			)
+			}
 		} else if !c.internal {
 			// Copying from context, owner should be root if no --chown.
 			// Whether --archive is provided doesn't matter in this case.
-			copier = fileio.NewCopier(blacklist,
+			opts = []fileio.CopyOption{
 				fileio.WithDstDirOwner(0, 0, false),
 				fileio.WithDstFileAndChildrenOwner(0, 0, true),
-			)
+			}
 		} else if c.preserveOwner {
 			// COPY --from --archive.
 			stat := utils.FileInfoStat(fi)
-			copier = fileio.NewCopier(blacklist,
-				fileio.WithDstDirOwner(int(stat.Uid), int(stat.Gid), false))
-		} else {
-			// COPY --from.
-			copier = fileio.NewCopier(blacklist)
+			opts = []fileio.CopyOption{
+				fileio.WithDstDirOwner(int(stat.Uid), int(stat.Gid), false),
+			}
 		}
+		// COPY --from without other flags keeps the owners of the sources.
+		if c.chmod {
+			// COPY --chmod.
+			// Mode decided by --chmod, whatever the owners are.
+			opts = append(opts, fileio.WithMode(c.mode))
+		}
+		copier := fileio.NewCopier(blacklist, opts...)
 
 		if fi.IsDir() {
 			// Dir to dir
@@ -146,6 +168,24 @@ func (c *CopyOperation) Execute() error {
 	return nil
 }
 
+// tarMode returns the tar header mode of a copied file with the given mode.
+func (c *CopyOperation) tarMode(mode int64) int64 {
+	if !c.chmod {
+		return mode
+	}
+	mode = mode&^07777 | int64(c.mode.Perm())
+	if c.mode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if c.mode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if c.mode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
 func resolveDestination(workDir, dst string) string {
 	if filepath.IsAbs(dst) {
 		return dst
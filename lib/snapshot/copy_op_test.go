@@ -45,28 +45,28 @@ func TestNewCopyOperation(t *testing.T) {
 	workDir := ""
 	dst := "/test2/test.txt"
 	_, err = NewCopyOperation(
-		srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+		srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 	require.Error(err)
 
 	srcs = []string{"file", "dir/"}
 	workDir = ""
 	dst = "/target/test"
 	_, err = NewCopyOperation(
-		srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+		srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 	require.Error(err)
 
 	srcs = []string{"file", "dir/"}
 	workDir = ""
 	dst = "target/test"
 	_, err = NewCopyOperation(
-		srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+		srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 	require.Error(err)
 
 	srcs = []string{"file", "dir/"}
 	workDir = "wrk/"
 	dst = "target/test/"
 	_, err = NewCopyOperation(
-		srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+		srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 	require.Error(err)
 }
 
@@ -94,7 +94,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		srcs := []string{"/test.txt"}
 		dst := filepath.Join(workDir, "test2/test.txt")
 		c, err := NewCopyOperation(
-			srcs, srcRoot, "", dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, "", dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(dst)
@@ -118,7 +118,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		srcs := []string{"/test.txt"}
 		dst := "test2/test.txt"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(filepath.Join(workDir, dst))
@@ -144,7 +144,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		srcs := []string{"/test.txt", "/test2.txt"}
 		dst := "test2/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(filepath.Join(workDir, dst, "test.txt"))
@@ -174,7 +174,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		workDir = filepath.Join(workDir, "test2")
 		dst := "."
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(filepath.Join(workDir, "test.txt"))
@@ -205,7 +205,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		srcs := []string{"/test/", "/test2/"}
 		dst := "test2/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(filepath.Join(workDir, dst, "test.txt"))
@@ -235,7 +235,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		srcs := []string{"/test/", "/test2.txt"}
 		dst := "test2/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		require.NoError(c.Execute())
 		b, err := ioutil.ReadFile(filepath.Join(workDir, dst, "test.txt"))
@@ -245,4 +245,58 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
+
+	t.Run("chmod", func(t *testing.T) {
+		require := require.New(t)
+
+		srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(srcRoot)
+		workDir, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(workDir)
+
+		require.NoError(os.MkdirAll(filepath.Join(srcRoot, "test"), 0700))
+		require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "test", "test.txt"), _hello, 0600))
+
+		_, err = NewCopyOperation(
+			[]string{"/test/"}, srcRoot, workDir, "test2/", validChown, "u+x",
+			pathutils.DefaultBlacklist, false, false)
+		require.Error(err)
+
+		c, err := NewCopyOperation(
+			[]string{"/test/"}, srcRoot, workDir, "test2/", validChown, "755",
+			pathutils.DefaultBlacklist, false, false)
+		require.NoError(err)
+		require.NoError(c.Execute())
+		fi, err := os.Stat(filepath.Join(workDir, "test2", "test.txt"))
+		require.NoError(err)
+		require.Equal(os.FileMode(0755), fi.Mode())
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		require := require.New(t)
+
+		srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(srcRoot)
+		workDir, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(workDir)
+
+		require.NoError(os.MkdirAll(filepath.Join(srcRoot, "test", "vendor"), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "test", "test.txt"), _hello, 0644))
+		require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "test", "vendor", "test2.txt"), _hello2, 0644))
+
+		c, err := NewCopyOperation(
+			[]string{"/test/"}, srcRoot, workDir, "test2/", validChown, "",
+			pathutils.DefaultBlacklist, false, false)
+		require.NoError(err)
+		c.Exclude([]string{filepath.Join(srcRoot, "test", "vendor")})
+		require.NoError(c.Execute())
+		_, err = os.Stat(filepath.Join(workDir, "test2", "test.txt"))
+		require.NoError(err)
+		_, err = os.Stat(filepath.Join(workDir, "test2", "vendor"))
+		require.True(os.IsNotExist(err))
+	})
 }
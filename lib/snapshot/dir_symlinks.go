@@ -0,0 +1,138 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// FollowDirSymlinks makes MemFS write the entries of layers that are under a
+// symlink to a directory from earlier layers to the link target, like they
+// would be at runtime, e.g. for /lib -> /usr/lib in merged-usr images.
+// Directory entries for the symlink itself don't replace it.
+// Otherwise, such symlinks are replaced with real directories.
+// Default to true.
+var FollowDirSymlinks = true
+
+// SetDirSymlinkPolicy sets global var FollowDirSymlinks. Mode could be
+// "follow" or "replace".
+func SetDirSymlinkPolicy(mode string) error {
+	switch mode {
+	case "follow":
+		FollowDirSymlinks = true
+	case "replace":
+		FollowDirSymlinks = false
+	default:
+		return fmt.Errorf("invalid dir symlink policy %s", mode)
+	}
+	return nil
+}
+
+// resolveDirSymlinks resolves the symlinks to directories among the ancestors
+// of absolute path p, and p itself if followLast is set. Absolute link targets
+// are relative to the root of the fs.
+func (fs *MemFS) resolveDirSymlinks(p string, followLast bool, depth int) (string, error) {
+	if depth >= 1024 {
+		return "", fmt.Errorf("symlink loop at %s", p)
+	}
+	parts := pathutils.SplitPath(p)
+	end := len(parts) - 1
+	if followLast {
+		end = len(parts)
+	}
+	curr := fs.tree
+	for i := 0; i < end; i++ {
+		n, ok := curr.children[parts[i]]
+		if !ok {
+			return p, nil
+		} else if n.hdr.Typeflag != tar.TypeSymlink {
+			curr = n
+			continue
+		}
+
+		target := n.hdr.Linkname
+		if !filepath.IsAbs(target) {
+			target = filepath.Join("/", filepath.Join(parts[:i]...), target)
+		}
+		target, err := fs.resolveDirSymlinks(target, true, depth+1)
+		if err != nil {
+			return "", err
+		}
+		if t := fs.lookup(target); t == nil || t.hdr.Typeflag != tar.TypeDir {
+			// Links to files or to nothing are not followed.
+			return p, nil
+		}
+		return fs.resolveDirSymlinks(
+			filepath.Join(append([]string{target}, parts[i+1:]...)...), followLast, depth+1)
+	}
+	return p, nil
+}
+
+// lookup returns the node at absolute path p without following symlinks, or
+// nil if there is none.
+func (fs *MemFS) lookup(p string) *memFSNode {
+	curr := fs.tree
+	for _, part := range pathutils.SplitPath(p) {
+		n, ok := curr.children[part]
+		if !ok {
+			return nil
+		}
+		curr = n
+	}
+	return curr
+}
+
+// isDirSymlink returns true if absolute path p is a symlink to a directory.
+func (fs *MemFS) isDirSymlink(p string) (bool, error) {
+	if n := fs.lookup(p); n == nil || n.hdr == nil || n.hdr.Typeflag != tar.TypeSymlink {
+		return false, nil
+	}
+	resolved, err := fs.resolveDirSymlinks(p, true, 0)
+	if err != nil {
+		return false, err
+	}
+	return resolved != p, nil
+}
+
+// resolveHeaderSymlinks rewrites the name and hard link target of a layer
+// entry to go through the targets of symlinks to directories. It returns true
+// if the entry is a directory replacing such a symlink, and should be skipped.
+func (fs *MemFS) resolveHeaderSymlinks(hdr *tar.Header) (bool, error) {
+	name, err := fs.resolveDirSymlinks(pathutils.AbsPath(hdr.Name), false, 0)
+	if err != nil {
+		return false, err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		if isLink, err := fs.isDirSymlink(name); err != nil {
+			return false, err
+		} else if isLink {
+			return true, nil
+		}
+	}
+	hdr.Name = pathutils.RelPath(name)
+
+	if hdr.Typeflag == tar.TypeLink {
+		linkname, err := fs.resolveDirSymlinks(pathutils.AbsPath(hdr.Linkname), false, 0)
+		if err != nil {
+			return false, err
+		}
+		hdr.Linkname = pathutils.RelPath(linkname)
+	}
+	return false, nil
+}
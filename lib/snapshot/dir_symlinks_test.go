@@ -0,0 +1,146 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+func tarFixture(t testing.TB, entries ...tarEntry) *tar.Reader {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0755,
+			Size:     int64(len(e.content)),
+		}
+		require.NoError(t, w.WriteHeader(hdr))
+		_, err := w.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return tar.NewReader(&b)
+}
+
+func TestUpdateFromTarReaderMergedUsr(t *testing.T) {
+	defer func() { FollowDirSymlinks = true }()
+
+	// Base layer of a merged-usr image.
+	base := []tarEntry{
+		{"usr/", tar.TypeDir, "", ""},
+		{"usr/lib/", tar.TypeDir, "", ""},
+		{"usr/lib/libc.so", tar.TypeReg, "", "libc"},
+		{"usr/bin/", tar.TypeDir, "", ""},
+		{"lib", tar.TypeSymlink, "/usr/lib", ""},
+		{"bin", tar.TypeSymlink, "usr/bin", ""},
+	}
+	// Later layer built on a distro without merged-usr.
+	layer := []tarEntry{
+		{"lib/", tar.TypeDir, "", ""},
+		{"lib/x86_64/", tar.TypeDir, "", ""},
+		{"lib/x86_64/libm.so", tar.TypeReg, "", "libm"},
+		{"bin/", tar.TypeDir, "", ""},
+		{"bin/sh", tar.TypeReg, "", "sh"},
+		{"bin/bash", tar.TypeLink, "bin/sh", ""},
+	}
+
+	setup := func(t *testing.T) *MemFS {
+		root, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(t, err)
+		fs, err := NewMemFS(clock.NewMock(), root, pathutils.DefaultBlacklist)
+		require.NoError(t, err)
+		fs.blacklist = nil
+		require.NoError(t, fs.UpdateFromTarReader(tarFixture(t, base...), true))
+		return fs
+	}
+
+	t.Run("follow", func(t *testing.T) {
+		require := require.New(t)
+		fs := setup(t)
+		defer os.RemoveAll(fs.tree.src)
+		root := fs.tree.src
+
+		require.NoError(fs.UpdateFromTarReader(tarFixture(t, layer...), true))
+
+		// Links are kept, and files are written to their targets.
+		for _, link := range []string{"lib", "bin"} {
+			fi, err := os.Lstat(filepath.Join(root, link))
+			require.NoError(err)
+			require.True(fi.Mode()&os.ModeSymlink != 0, link)
+			n, err := findNode(fs, "/"+link, false, 0)
+			require.NoError(err)
+			require.Equal(byte(tar.TypeSymlink), n.hdr.Typeflag)
+		}
+		for p, content := range map[string]string{
+			"usr/lib/libc.so":        "libc",
+			"usr/lib/x86_64/libm.so": "libm",
+			"usr/bin/sh":             "sh",
+			"usr/bin/bash":           "sh",
+		} {
+			b, err := ioutil.ReadFile(filepath.Join(root, p))
+			require.NoError(err)
+			require.Equal(content, string(b))
+			_, err = findNode(fs, "/"+p, false, 0)
+			require.NoError(err, p)
+		}
+		_, err := findNode(fs, "/lib/x86_64", false, 0)
+		require.Equal(os.ErrNotExist, err)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		require := require.New(t)
+		fs := setup(t)
+		defer os.RemoveAll(fs.tree.src)
+
+		require.NoError(SetDirSymlinkPolicy("replace"))
+		require.NoError(fs.UpdateFromTarReader(tarFixture(t, layer...), true))
+
+		fi, err := os.Lstat(filepath.Join(fs.tree.src, "lib"))
+		require.NoError(err)
+		require.True(fi.IsDir())
+		_, err = os.Stat(filepath.Join(fs.tree.src, "usr/lib/x86_64/libm.so"))
+		require.True(os.IsNotExist(err))
+	})
+}
+
+func TestSetDirSymlinkPolicy(t *testing.T) {
+	require := require.New(t)
+	defer func() { FollowDirSymlinks = true }()
+
+	require.NoError(SetDirSymlinkPolicy("replace"))
+	require.False(FollowDirSymlinks)
+	require.NoError(SetDirSymlinkPolicy("follow"))
+	require.True(FollowDirSymlinks)
+	require.Error(SetDirSymlinkPolicy("invalid"))
+}
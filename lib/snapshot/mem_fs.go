@@ -153,16 +153,22 @@ func (fs *MemFS) UpdateFromTarPath(source string, untar bool) error {
 		return fmt.Errorf("open tar file: %s", err)
 	}
 	defer reader.Close()
-	gzipReader, err := tario.NewGzipReader(reader)
+	layerReader, err := tario.NewDecompressionReader(reader)
 	if err != nil {
-		return fmt.Errorf("new gzip reader: %s", err)
+		return fmt.Errorf("new decompression reader: %s", err)
 	}
-	return fs.UpdateFromTarReader(tar.NewReader(gzipReader), untar)
+	defer layerReader.Close()
+	return fs.UpdateFromTarReader(tar.NewReader(layerReader), untar)
 }
 
 // UpdateFromTarReader updates MemFS with the contents of the tarball from the
 // given reader, and optionally untars the tarball onto the root of MemFS.
+// Without untar, the tarball is streamed into the in-memory fs view only.
 func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
+	if !untar {
+		return fs.streamFromTarReader(r)
+	}
+
 	start := time.Now()
 	// Keep a list of all hard links that we will create in a second pass.
 	hardlinks := make(map[string]*tar.Header)
@@ -177,14 +183,20 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		hdr, err := r.Next()
 		if err == io.EOF {
 			duration := time.Since(start).Round(time.Millisecond)
-			if untar {
-				log.Infow(fmt.Sprintf("* Untarred %d files to %s", count, fs.tree.src), "duration", duration)
-			}
+			log.Infow(fmt.Sprintf("* Untarred %d files to %s", count, fs.tree.src), "duration", duration)
 			break
 		} else if err != nil {
 			return fmt.Errorf("read header: %s", err)
 		}
 
+		if FollowDirSymlinks {
+			if skip, err := fs.resolveHeaderSymlinks(hdr); err != nil {
+				return fmt.Errorf("resolve symlinks of %s: %s", hdr.Name, err)
+			} else if skip {
+				continue
+			}
+		}
+
 		path := filepath.Join(fs.tree.src, hdr.Name)
 		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist); err != nil {
 			return fmt.Errorf("check if should skip %s: %s", path, err)
@@ -197,17 +209,14 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		}
 
 		// Record the modtime of the parent directory to reset it after we deal with all of
-		// the other files. If we are not untarring, this is not necessary and may fail
-		// because not all files are necessarily on disk.
-		if untar {
-			parentDir := filepath.Dir(path)
-			if _, found := modtimes[parentDir]; !found {
-				parentFi, err := os.Lstat(parentDir)
-				if err != nil {
-					return fmt.Errorf("stat parent dir of %s: %s", path, err)
-				}
-				modtimes[parentDir] = parentFi.ModTime()
+		// the other files.
+		parentDir := filepath.Dir(path)
+		if _, found := modtimes[parentDir]; !found {
+			parentFi, err := os.Lstat(parentDir)
+			if err != nil {
+				return fmt.Errorf("stat parent dir of %s: %s", path, err)
 			}
+			modtimes[parentDir] = parentFi.ModTime()
 		}
 
 		hdr.Name = pathutils.RelPath(hdr.Name)
@@ -219,10 +228,8 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 			hdr.Linkname = pathutils.AbsPath(hdr.Linkname)
 			hardlinks[path] = hdr
 		} else {
-			if untar {
-				if err := fs.untarOneItem(path, hdr, r); err != nil {
-					return fmt.Errorf("untar one item %s: %s", path, err)
-				}
+			if err := fs.untarOneItem(path, hdr, r); err != nil {
+				return fmt.Errorf("untar one item %s: %s", path, err)
 			}
 			if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
 				return fmt.Errorf("add hdr from tar to layer: %s", err)
@@ -233,10 +240,8 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 
 	// Run through all the hard links and create them.
 	for path, hdr := range hardlinks {
-		if untar {
-			if err := fs.untarOneItem(path, hdr, nil); err != nil {
-				return fmt.Errorf("untar one item %s: %s", path, err)
-			}
+		if err := fs.untarOneItem(path, hdr, nil); err != nil {
+			return fmt.Errorf("untar one item %s: %s", path, err)
 		}
 		if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
 			return fmt.Errorf("add hdr from tar to layer: %s", err)
@@ -288,6 +293,36 @@ func (fs *MemFS) AddLayerByCopyOps(cs []*CopyOperation, w *tar.Writer) error {
 	return nil
 }
 
+// AddLinkedLayerByCopyOps is like AddLayerByCopyOps, but the copy operations
+// are performed on an empty file system. The resulting layer doesn't depend on
+// the previous layers, so it can be reused on top of different ones. It
+// contains all the copied files and their ancestors, which are created with
+// default permissions, and is then merged in memory.
+func (fs *MemFS) AddLinkedLayerByCopyOps(cs []*CopyOperation, w *tar.Writer) error {
+	fs.sync()
+	scratch := &MemFS{
+		clk:       fs.clk,
+		tree:      newMemFSNode(fs.tree.contentMemFile),
+		blacklist: fs.blacklist,
+	}
+	l := newMemLayer()
+	for _, c := range cs {
+		if err := scratch.addToLayer(l, c); err != nil {
+			return fmt.Errorf("create linked layer by copy ops: %s", err)
+		}
+	}
+	if err := l.rangeFiles(func(f memFile) error {
+		return f.updateMemFS(fs.tree)
+	}); err != nil {
+		return fmt.Errorf("merge linked layer: %s", err)
+	}
+	if err := fs.commitLayer(l, w); err != nil {
+		return fmt.Errorf("commit linked layer by copy ops: %s", err)
+	}
+	log.Infof("* Created linked copy layer with %d files", l.count())
+	return nil
+}
+
 // sync flushes filesystem cache, so mtime would be guaranteed to be updated.
 // It also waits at least one sec, in case mtime doesn't have sub-second
 // resolution.
@@ -312,6 +347,9 @@ func (fs *MemFS) sync() {
 
 // createLayerByScan computes the differences between the file system and merged
 // layers in memory, updating MemFS as it goes and returning the diffs as a single layer.
+// Directories are compared like any other file, so new or modified empty
+// directories are kept, removed ones are whited out, and unchanged ones are only
+// added as ancestors of other changes.
 func (fs *MemFS) createLayerByScan() (*memLayer, error) {
 	start := time.Now()
 	log.Info("* Collecting filesystem diff")
@@ -382,7 +420,7 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 			return fmt.Errorf("eval symlinks for %s: %s", src, err)
 		}
 		src = filepath.Join(c.srcRoot, src)
-		if err := walk(src, nil, func(currSrc string, fi os.FileInfo) error {
+		if err := walk(src, c.excludes, func(currSrc string, fi os.FileInfo) error {
 			var currDst string
 			if currSrc == src {
 				if fi.IsDir() {
@@ -411,6 +449,9 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 			}
 			hdr.Uid = c.uid
 			hdr.Gid = c.gid
+			if hdr.Typeflag != tar.TypeSymlink {
+				hdr.Mode = c.tarMode(hdr.Mode)
+			}
 			return fs.maybeAddToLayer(l, currSrc, currDst, hdr, false)
 		}); err != nil {
 			return fmt.Errorf("copy src %s to dst %s: %s", src, c.dst, err)
@@ -459,11 +500,15 @@ func (fs *MemFS) maybeAddToLayer(
 	if createWhiteout {
 		// Handle deletions.
 		// Note: Only one whiteout file is needed for a deleted subtree.
-		if hdr.Typeflag == tar.TypeDir && n != nil {
-			for _, child := range n.children {
-				if ok, err := child.isOnDisk(); err != nil {
-					return fmt.Errorf("check on disk %s: %s", child.dst, err)
-				} else if !ok {
+		if hdr.Typeflag == tar.TypeDir && n != nil && len(n.children) > 0 {
+			// List the dir once instead of stating each child, which is a
+			// lot cheaper for dirs with many small files.
+			onDisk, err := readDirNames(src)
+			if err != nil {
+				return fmt.Errorf("read dir %s: %s", src, err)
+			}
+			for name, child := range n.children {
+				if !onDisk.Has(name) {
 					if mf, err := l.addWhiteout(child.dst); err != nil {
 						return fmt.Errorf(
 							"add whiteout to layer %s: %s", child.dst, err)
@@ -16,6 +16,7 @@ package snapshot
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
@@ -710,7 +711,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/test2/test.txt"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -750,7 +751,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -792,7 +793,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -839,7 +840,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -887,7 +888,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -945,7 +946,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := ""
 		dst := "/dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -1003,7 +1004,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		workDir := "/wrk"
 		dst := "dst/"
 		c, err := NewCopyOperation(
-			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+			srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 		require.NoError(err)
 		err = fs.addToLayer(newMemLayer(), c)
 		require.NoError(err)
@@ -1033,6 +1034,82 @@ func TestCreateLayerByCopy(t *testing.T) {
 		require.NotNil(n)
 		require.Equal(tmpRoot+"/test1/test4/test5/test6.txt", n.src)
 	})
+
+	t.Run("chmod", func(t *testing.T) {
+		require := require.New(t)
+
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		clk := clock.NewMock()
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		require.NoError(err)
+		fs.blacklist = nil
+
+		l1 := newMemLayer()
+		require.NoError(addDirectoryToLayer(l1, tmpRoot, "/test1", 0700))
+		require.NoError(addRegularFileToLayer(l1, tmpRoot, "/test1/test.txt", "hello", 0600))
+		require.NoError(fs.merge(l1))
+
+		c, err := NewCopyOperation(
+			[]string{"/test1"}, tmpRoot, "", "/test2", validChown, "4750",
+			pathutils.DefaultBlacklist, false, false)
+		require.NoError(err)
+		require.NoError(fs.addToLayer(newMemLayer(), c))
+
+		n, err := findNode(fs, "/test2/test.txt", false, 0)
+		require.NoError(err)
+		require.NotNil(n)
+		require.Equal(int64(04750), n.hdr.Mode)
+	})
+}
+
+func TestAddLinkedLayerByCopyOps(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	newFS := func() *MemFS {
+		fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+		require.NoError(err)
+		fs.blacklist = nil
+		l := newMemLayer()
+		require.NoError(addDirectoryToLayer(l, tmpRoot, "/test1", 0755))
+		require.NoError(addRegularFileToLayer(l, tmpRoot, "/test1/test.txt", "hello", 0644))
+		require.NoError(fs.merge(l))
+		return fs
+	}
+	layerFiles := func(add func(*MemFS, []*CopyOperation, *tar.Writer) error) []string {
+		c, err := NewCopyOperation(
+			[]string{"/test1/test.txt"}, tmpRoot, "", "/test1/", validChown, "",
+			pathutils.DefaultBlacklist, false, false)
+		require.NoError(err)
+
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		require.NoError(add(newFS(), []*CopyOperation{c}, w))
+		require.NoError(w.Close())
+
+		var names []string
+		r := tar.NewReader(&b)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+
+	// The file is unchanged on top of the previous layers, but not on top of
+	// an empty file system.
+	require.Empty(layerFiles((*MemFS).AddLayerByCopyOps))
+	require.Equal([]string{"test1", "test1/test.txt"}, layerFiles((*MemFS).AddLinkedLayerByCopyOps))
 }
 
 func TestAddLayerByScanWhiteout(t *testing.T) {
@@ -1159,7 +1236,7 @@ func TestAddLayersEqual(t *testing.T) {
 	workDir := "/wrk"
 	dst := "dst/"
 	c, err := NewCopyOperation(
-		srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false, false)
+		srcs, srcRoot, workDir, dst, validChown, "", pathutils.DefaultBlacklist, false, false)
 	require.NoError(err)
 	err = fs1.AddLayerByCopyOps([]*CopyOperation{c}, w1)
 	require.NoError(err)
@@ -1277,3 +1354,82 @@ func TestCompareFS(t *testing.T) {
 	require.Equal(expectedDiff, actualDiff1)
 	require.Equal(expectedDiff, actualDiff2)
 }
+
+func TestAddLayerByScanEmptyDirectories(t *testing.T) {
+	require := require.New(t)
+
+	tmpBase, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpBase)
+
+	tmpRoot, err := ioutil.TempDir(tmpBase, "root")
+	require.NoError(err)
+	unpackRoot, err := ioutil.TempDir(tmpBase, "unpack")
+	require.NoError(err)
+
+	clk := clock.NewMock()
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+	unpackFS, err := NewMemFS(clk, unpackRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	unpackFS.blacklist = nil
+
+	scan := func() []string {
+		tarFile, err := ioutil.TempFile(tmpBase, "layer")
+		require.NoError(err)
+		w := tar.NewWriter(tarFile)
+		require.NoError(fs.AddLayerByScan(w))
+		require.NoError(w.Close())
+		require.NoError(tarFile.Close())
+
+		tarFile, err = os.Open(tarFile.Name())
+		require.NoError(err)
+		defer tarFile.Close()
+		var names []string
+		r := tar.NewReader(tarFile)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		_, err = tarFile.Seek(0, io.SeekStart)
+		require.NoError(err)
+		require.NoError(unpackFS.UpdateFromTarReader(tar.NewReader(tarFile), true))
+		return names
+	}
+
+	// Empty directories at various depths are all part of the layer.
+	for _, p := range []string{"empty1", "test1/empty2", "test1/test2/empty3", "test3/keep"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpRoot, p), 0755))
+	}
+	names := scan()
+	for _, p := range []string{"empty1", "test1/empty2", "test1/test2/empty3", "test3/keep"} {
+		require.Contains(names, p+"/")
+		fi, err := os.Stat(filepath.Join(unpackRoot, p))
+		require.NoError(err)
+		require.True(fi.IsDir())
+	}
+
+	// Only the new directory and its parents are added, unchanged directories
+	// aren't.
+	require.NoError(os.Mkdir(filepath.Join(tmpRoot, "test1/test2/empty3/empty4"), 0755))
+	names = scan()
+	require.Equal([]string{
+		"test1/", "test1/test2/", "test1/test2/empty3/", "test1/test2/empty3/empty4/",
+	}, names)
+	_, err = os.Stat(filepath.Join(unpackRoot, "test1/test2/empty3/empty4"))
+	require.NoError(err)
+
+	// Removed empty directories are whited out.
+	require.NoError(os.Remove(filepath.Join(tmpRoot, "test3/keep")))
+	names = scan()
+	require.Equal([]string{"test3/", "test3/.wh.keep"}, names)
+	_, err = os.Stat(filepath.Join(unpackRoot, "test3/keep"))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(unpackRoot, "test3"))
+	require.NoError(err)
+}
@@ -81,7 +81,11 @@ func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 
 // commit writes the contentMemFile's contents to the tar writer.
 func (f *contentMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteEntry(w, f.src, f.hdr); err != nil {
+	hdr, err := applyNamePolicy(f.hdr)
+	if err != nil {
+		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
+	}
+	if err := tario.WriteEntry(w, f.src, hdr); err != nil {
 		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
@@ -125,7 +129,11 @@ func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
 
 // commit writes an empty whiteout file to the tar writer.
 func (f *whiteoutMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteHeader(w, f.hdr); err != nil {
+	hdr, err := applyNamePolicy(f.hdr)
+	if err != nil {
+		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
+	}
+	if err := tario.WriteHeader(w, hdr); err != nil {
 		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
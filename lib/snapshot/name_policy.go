@@ -0,0 +1,164 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// NamePolicy decides the names of the entries written to layer tars.
+type NamePolicy interface {
+	// Name returns the name to write for the given entry name or link target.
+	Name(name string) (string, error)
+}
+
+// TarNamePolicy is applied to the entries of all layers created by MemFS.
+// Layers pulled from registries or loaded from cache are not affected.
+// Default to passthrough.
+var TarNamePolicy NamePolicy = PassthroughNamePolicy{}
+
+// SetNamePolicy sets global var TarNamePolicy. Mode could be "passthrough",
+// "reject" or "remap".
+func SetNamePolicy(mode, illegalChars, replacement string) error {
+	switch mode {
+	case "passthrough":
+		TarNamePolicy = PassthroughNamePolicy{}
+	case "reject":
+		TarNamePolicy = RejectNamePolicy{IllegalChars: illegalChars}
+	case "remap":
+		policy, err := NewRemapNamePolicy(illegalChars, replacement)
+		if err != nil {
+			return err
+		}
+		TarNamePolicy = policy
+	default:
+		return fmt.Errorf("invalid filename policy %s", mode)
+	}
+	return nil
+}
+
+// PassthroughNamePolicy keeps all names as is.
+type PassthroughNamePolicy struct{}
+
+// Name implements NamePolicy.
+func (PassthroughNamePolicy) Name(name string) (string, error) {
+	return name, nil
+}
+
+// RejectNamePolicy fails on names containing any of IllegalChars.
+type RejectNamePolicy struct {
+	IllegalChars string
+}
+
+// Name implements NamePolicy.
+func (p RejectNamePolicy) Name(name string) (string, error) {
+	if i := strings.IndexAny(name, p.IllegalChars); i >= 0 {
+		return "", fmt.Errorf("illegal character %q in %s", name[i], name)
+	}
+	return name, nil
+}
+
+// RemapNamePolicy replaces each of the illegal chars with a replacement
+// string. The same name is always remapped the same way, so layers stay
+// reproducible and link targets keep pointing to the remapped entries. It
+// fails if two different names would end up with the same remapped name.
+type RemapNamePolicy struct {
+	sync.Mutex
+
+	replacer    *strings.Replacer
+	replacement string
+	remapped    map[string]string // Original to remapped name
+	owners      map[string]string // Remapped to original name
+}
+
+// NewRemapNamePolicy creates a new RemapNamePolicy.
+func NewRemapNamePolicy(illegalChars, replacement string) (*RemapNamePolicy, error) {
+	if illegalChars == "" {
+		return nil, fmt.Errorf("no illegal characters to remap")
+	} else if strings.ContainsAny(replacement, illegalChars) {
+		return nil, fmt.Errorf("replacement %s contains illegal characters", replacement)
+	}
+	var pairs []string
+	for _, c := range illegalChars {
+		pairs = append(pairs, string(c), replacement)
+	}
+	return &RemapNamePolicy{
+		replacer:    strings.NewReplacer(pairs...),
+		replacement: replacement,
+		remapped:    make(map[string]string),
+		owners:      make(map[string]string),
+	}, nil
+}
+
+// Name implements NamePolicy.
+func (p *RemapNamePolicy) Name(name string) (string, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	result := p.replacer.Replace(name)
+	if result == name && (p.replacement == "" || !strings.Contains(name, p.replacement)) {
+		// Names that don't contain the replacement can't collide.
+		return name, nil
+	}
+	if owner, ok := p.owners[result]; ok && owner != name {
+		return "", fmt.Errorf("remapped name %s of %s conflicts with %s", result, name, owner)
+	}
+	p.owners[result] = name
+	if result != name {
+		if _, ok := p.remapped[name]; !ok {
+			log.Warnf("Remapped tar entry %s to %s", name, result)
+		}
+		p.remapped[name] = result
+	}
+	return result, nil
+}
+
+// Remapped returns the sorted list of "<original> -> <remapped>" names.
+func (p *RemapNamePolicy) Remapped() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	var result []string
+	for name, remapped := range p.remapped {
+		result = append(result, fmt.Sprintf("%s -> %s", name, remapped))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// applyNamePolicy returns a copy of the header with name and link target
+// converted by TarNamePolicy.
+func applyNamePolicy(hdr *tar.Header) (*tar.Header, error) {
+	if _, ok := TarNamePolicy.(PassthroughNamePolicy); ok {
+		return hdr, nil
+	}
+	result := *hdr
+	var err error
+	if result.Name, err = TarNamePolicy.Name(hdr.Name); err != nil {
+		return nil, fmt.Errorf("apply filename policy: %s", err)
+	}
+	if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink {
+		if result.Linkname, err = TarNamePolicy.Name(hdr.Linkname); err != nil {
+			return nil, fmt.Errorf("apply filename policy to link target: %s", err)
+		}
+	}
+	return &result, nil
+}
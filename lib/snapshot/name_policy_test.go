@@ -0,0 +1,141 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestSetNamePolicy(t *testing.T) {
+	require := require.New(t)
+	defer func() { TarNamePolicy = PassthroughNamePolicy{} }()
+
+	require.NoError(SetNamePolicy("reject", ":", ""))
+	require.IsType(RejectNamePolicy{}, TarNamePolicy)
+	require.NoError(SetNamePolicy("remap", ":", "_"))
+	require.IsType(&RemapNamePolicy{}, TarNamePolicy)
+	require.NoError(SetNamePolicy("passthrough", ":", "_"))
+	require.IsType(PassthroughNamePolicy{}, TarNamePolicy)
+
+	require.Error(SetNamePolicy("invalid", ":", "_"))
+	require.Error(SetNamePolicy("remap", ":", ":"))
+	require.Error(SetNamePolicy("remap", "", "_"))
+}
+
+func TestRemapNamePolicy(t *testing.T) {
+	require := require.New(t)
+
+	policy, err := NewRemapNamePolicy(":*", "_")
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		name, err := policy.Name("etc/a:b*c")
+		require.NoError(err)
+		require.Equal("etc/a_b_c", name)
+	}
+	name, err := policy.Name("etc/plain")
+	require.NoError(err)
+	require.Equal("etc/plain", name)
+
+	// Different names can't be remapped to the same name.
+	_, err = policy.Name("etc/a_b_c")
+	require.Error(err)
+	_, err = policy.Name("etc/a*b:c")
+	require.Error(err)
+
+	require.Equal([]string{"etc/a:b*c -> etc/a_b_c"}, policy.Remapped())
+}
+
+func TestAddLayerByScanNamePolicy(t *testing.T) {
+	defer func() { TarNamePolicy = PassthroughNamePolicy{} }()
+
+	setup := func(t *testing.T) *MemFS {
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(t, err)
+
+		dir := filepath.Join(tmpRoot, "test:1")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a:b.txt"), []byte("hello"), 0644))
+		require.NoError(t, os.Symlink("test:1/a:b.txt", filepath.Join(tmpRoot, "link")))
+
+		fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+		require.NoError(t, err)
+		fs.blacklist = nil
+		return fs
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		require := require.New(t)
+		fs := setup(t)
+		defer os.RemoveAll(fs.tree.src)
+
+		TarNamePolicy = RejectNamePolicy{IllegalChars: ":"}
+		w := tar.NewWriter(ioutil.Discard)
+		err := fs.AddLayerByScan(w)
+		require.Error(err)
+		require.Contains(err.Error(), "illegal character")
+	})
+
+	t.Run("remap", func(t *testing.T) {
+		require := require.New(t)
+		fs := setup(t)
+		defer os.RemoveAll(fs.tree.src)
+
+		policy, err := NewRemapNamePolicy(":", "_")
+		require.NoError(err)
+		TarNamePolicy = policy
+
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		require.NoError(fs.AddLayerByScan(w))
+		require.NoError(w.Close())
+
+		headers := make(map[string]*tar.Header)
+		r := tar.NewReader(&b)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			headers[hdr.Name] = hdr
+		}
+		require.Len(headers, 3)
+		require.Contains(headers, "test_1/")
+		require.Contains(headers, "test_1/a_b.txt")
+		require.Equal("test_1/a_b.txt", headers["link"].Linkname)
+
+		// In-memory paths are unchanged, so the next scan is empty.
+		require.Contains(fs.tree.children, "test:1")
+		w = tar.NewWriter(ioutil.Discard)
+		require.NoError(fs.AddLayerByScan(w))
+		require.Equal(0, fs.layers[len(fs.layers)-1].count())
+
+		require.Equal([]string{
+			"test:1/ -> test_1/",
+			"test:1/a:b.txt -> test_1/a_b.txt",
+		}, policy.Remapped())
+	})
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/mountutils"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// streamFromTarReader merges the tarball from the given reader into the
+// in-memory fs view only, without writing anything to disk.
+// Whiteouts, including opaque ones, only hide files of lower layers, no matter
+// where they appear in the tarball.
+func (fs *MemFS) streamFromTarReader(r *tar.Reader) error {
+	start := time.Now()
+	l := newMemLayer()
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+
+		if FollowDirSymlinks {
+			if skip, err := fs.resolveHeaderSymlinks(hdr); err != nil {
+				return fmt.Errorf("resolve symlinks of %s: %s", hdr.Name, err)
+			} else if skip {
+				continue
+			}
+		}
+
+		path := filepath.Join(fs.tree.src, hdr.Name)
+		dst := pathutils.AbsPath(hdr.Name)
+		if filepath.Base(dst) == _whiteoutOpaque {
+			fs.hideLowerChildren(l, filepath.Dir(dst))
+			continue
+		}
+		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist); err != nil {
+			return fmt.Errorf("check if should skip %s: %s", path, err)
+		} else if skip {
+			continue
+		} else if isMounted, err := mountutils.IsMounted(path); err != nil {
+			return fmt.Errorf("check if mounted %s: %s", path, err)
+		} else if isMounted {
+			continue
+		}
+
+		hdr.Name = pathutils.RelPath(hdr.Name)
+		if strings.HasPrefix(filepath.Base(dst), _whiteoutPrefix) {
+			if err := fs.applyWhiteout(l, dst, hdr); err != nil {
+				return fmt.Errorf("apply whiteout %s: %s", dst, err)
+			}
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			// Docker hard link names are all absolute, but don't have a leading slash.
+			hdr.Linkname = pathutils.AbsPath(hdr.Linkname)
+		}
+		if err := fs.maybeAddToLayer(l, dst, dst, hdr, false); err != nil {
+			return fmt.Errorf("add hdr from tar to layer: %s", err)
+		}
+	}
+	fs.layers = append(fs.layers, l)
+	log.Infow(fmt.Sprintf("* Streamed %d headers from tar to memfs", l.count()),
+		"duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// applyWhiteout removes the file or directory designated by the whiteout
+// entry from the in-memory fs view. If layer l already added it, only the
+// contents it had in lower layers are removed.
+func (fs *MemFS) applyWhiteout(l *memLayer, whiteout string, hdr *tar.Header) error {
+	d, b := filepath.Split(whiteout)
+	deleted := d + strings.TrimPrefix(b, _whiteoutPrefix)
+	if _, ok := l.files[deleted].(*contentMemFile); ok {
+		fs.hideLowerChildren(l, deleted)
+		return nil
+	}
+	if _, err := fs.addAncestors(l, whiteout, false, 0, 0, 0); err != nil {
+		return fmt.Errorf("add ancestors: %s", err)
+	}
+	return l.addHeader(whiteout, whiteout, hdr).updateMemFS(fs.tree)
+}
+
+// hideLowerChildren removes the children of the directory at p that were not
+// added by layer l, and recursively the lower children of the ones that were.
+func (fs *MemFS) hideLowerChildren(l *memLayer, p string) {
+	var prune func(n *memFSNode)
+	prune = func(n *memFSNode) {
+		for name, child := range n.children {
+			if _, ok := l.files[child.dst].(*contentMemFile); ok {
+				prune(child)
+			} else {
+				delete(n.children, name)
+			}
+		}
+	}
+	if n := fs.lookup(p); n != nil {
+		prune(n)
+	}
+}
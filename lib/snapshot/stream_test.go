@@ -0,0 +1,125 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestStreamFromTarReaderWhiteouts(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	fs, err := NewMemFS(clock.NewMock(), root, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	require.NoError(fs.UpdateFromTarReader(tarFixture(t,
+		tarEntry{"a/", tar.TypeDir, "", ""},
+		tarEntry{"a/old", tar.TypeReg, "", "old"},
+		tarEntry{"a/sub/", tar.TypeDir, "", ""},
+		tarEntry{"a/sub/old", tar.TypeReg, "", "old"},
+		tarEntry{"b/", tar.TypeDir, "", ""},
+		tarEntry{"b/old", tar.TypeReg, "", "old"},
+		tarEntry{"c", tar.TypeReg, "", "old"},
+		tarEntry{"d/", tar.TypeDir, "", ""},
+		tarEntry{"d/old", tar.TypeReg, "", "old"},
+		tarEntry{"d/sub/", tar.TypeDir, "", ""},
+		tarEntry{"d/sub/old", tar.TypeReg, "", "old"},
+	), false))
+
+	// Whiteouts only hide lower files, before or after the replacing entries.
+	require.NoError(fs.UpdateFromTarReader(tarFixture(t,
+		tarEntry{"a/", tar.TypeDir, "", ""},
+		tarEntry{"a/new", tar.TypeReg, "", "new"},
+		tarEntry{".wh.a", tar.TypeReg, "", ""},
+		tarEntry{".wh.b", tar.TypeReg, "", ""},
+		tarEntry{"b/", tar.TypeDir, "", ""},
+		tarEntry{"b/new", tar.TypeReg, "", "new"},
+		tarEntry{".wh.c", tar.TypeReg, "", ""},
+		tarEntry{"d/", tar.TypeDir, "", ""},
+		tarEntry{"d/sub/", tar.TypeDir, "", ""},
+		tarEntry{"d/sub/new", tar.TypeReg, "", "new"},
+		tarEntry{"d/.wh..wh..opq", tar.TypeReg, "", ""},
+	), false))
+
+	var paths []string
+	var list func(n *memFSNode)
+	list = func(n *memFSNode) {
+		for _, child := range n.children {
+			paths = append(paths, child.dst)
+			list(child)
+		}
+	}
+	list(fs.tree)
+	sort.Strings(paths)
+	require.Equal([]string{
+		"/a", "/a/new", "/b", "/b/new", "/d", "/d/sub", "/d/sub/new",
+	}, paths)
+
+	// Nothing is written to disk.
+	infos, err := ioutil.ReadDir(root)
+	require.NoError(err)
+	require.Empty(infos)
+}
+
+// BenchmarkUpdateFromTarReader compares streaming a base layer into memory
+// with untarring it to disk.
+func BenchmarkUpdateFromTarReader(b *testing.B) {
+	var entries []tarEntry
+	for i := 0; i < 20; i++ {
+		dir := fmt.Sprintf("dir%d/", i)
+		entries = append(entries, tarEntry{dir, tar.TypeDir, "", ""})
+		for j := 0; j < 100; j++ {
+			entries = append(entries, tarEntry{
+				fmt.Sprintf("%sfile%d", dir, j), tar.TypeReg, "", "content"})
+		}
+	}
+
+	for _, untar := range []bool{false, true} {
+		name := "stream"
+		if untar {
+			name = "untar"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				root, err := ioutil.TempDir("/tmp", "makisu-bench")
+				require.NoError(b, err)
+				fs, err := NewMemFS(clock.NewMock(), root, nil)
+				require.NoError(b, err)
+				r := tarFixture(b, entries...)
+				b.StartTimer()
+
+				require.NoError(b, fs.UpdateFromTarReader(r, untar))
+
+				b.StopTimer()
+				os.RemoveAll(root)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
+	"github.com/uber/makisu/lib/utils/stringset"
 )
 
 // shouldSkip returns true if the path is a descendent of any path in the blacklist,
@@ -74,6 +75,20 @@ func walk(srcRoot string, blacklist []string, f func(string, os.FileInfo) error)
 	return nil
 }
 
+// readDirNames returns the names of the entries of a directory.
+func readDirNames(dir string) (stringset.Set, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return stringset.FromSlice(names), nil
+}
+
 // removePathRecursive attempts to recursively remove everything under the given path,
 // excluding paths specified by the blacklist. Returns true if it succeeds in removing
 // everything under the path.
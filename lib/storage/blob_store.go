@@ -0,0 +1,50 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"os"
+
+	"github.com/uber/makisu/lib/storage/base"
+)
+
+// BlobStore manages layer and image config blobs on local disk, named by the
+// hex of their digest. Blobs are written to a download file first, then moved
+// to the store.
+type BlobStore interface {
+	// CreateDownloadFile creates an empty download file with the given size.
+	CreateDownloadFile(fileName string, len int64) error
+	// GetDownloadFileReader returns a FileReader for a download file.
+	GetDownloadFileReader(fileName string) (base.FileReader, error)
+	// GetDownloadFileReadWriter returns a FileReadWriter for a download file.
+	GetDownloadFileReadWriter(fileName string) (base.FileReadWriter, error)
+	// DeleteDownloadFile deletes a download file.
+	DeleteDownloadFile(fileName string) error
+	// MoveDownloadFileToStore moves a download file to the store.
+	MoveDownloadFileToStore(fileName string) error
+	// LinkStoreFileFrom moves the file at src to the store.
+	LinkStoreFileFrom(fileName, src string) error
+	// GetStoreFileReader returns a FileReader for a blob in the store.
+	GetStoreFileReader(fileName string) (base.FileReader, error)
+	// GetDownloadOrCacheFileStat returns the FileInfo of a download file or
+	// of a blob in the store.
+	GetDownloadOrCacheFileStat(fileName string) (os.FileInfo, error)
+	// GetStoreFileStat returns the FileInfo of a blob in the store.
+	GetStoreFileStat(fileName string) (os.FileInfo, error)
+	// DeleteStoreFile deletes a blob from the store.
+	DeleteStoreFile(fileName string) error
+	// LinkStoreFileTo makes a blob of the store available at target.
+	LinkStoreFileTo(fileName, target string) error
+}
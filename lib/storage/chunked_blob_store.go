@@ -0,0 +1,613 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/storage/base"
+	"github.com/uber/makisu/lib/tario"
+)
+
+const (
+	layerTarChunkDir  = "layer_tar/chunks"
+	layerTarRecipeDir = "layer_tar/recipes"
+
+	// _chunkGCGracePeriod is how long unreferenced chunks are kept after they
+	// were last written, since they might belong to blobs other processes are
+	// still storing.
+	_chunkGCGracePeriod = time.Hour
+)
+
+// errNotReproducible is returned for blobs that compressing their content
+// again doesn't give back.
+var errNotReproducible = errors.New("blob is not reproducible from its content")
+
+// ChunkedBlobStore is a BlobStore that splits the uncompressed content of the
+// gzipped blobs moved to the store into content-defined chunks, so layers
+// sharing files, like layers of similar images, share storage. Chunks are
+// stored by digest, and each blob as a recipe listing its chunks, which are
+// concatenated and compressed again on read.
+// Only blobs that compressing their content at the current compression level
+// gives back are chunked, like the layers makisu builds. Other blobs, like
+// image configs or layers compressed by other tools, and downloads are
+// handled by the wrapped LayerTarStore. Chunks are kept when blobs are
+// deleted, until CollectGarbage removes the unreferenced ones.
+type ChunkedBlobStore struct {
+	*LayerTarStore
+
+	chunker   Chunker
+	chunkDir  string
+	recipeDir string
+
+	// gcLock keeps CollectGarbage from removing the chunks of blobs being
+	// stored.
+	gcLock        sync.RWMutex
+	gcGracePeriod time.Duration
+}
+
+// chunkRecipe lists the chunks of the uncompressed content of a blob, in
+// order.
+type chunkRecipe struct {
+	Size int64 `json:"size"` // Size of the blob
+	// Level is the gzip level the content is compressed with on read.
+	Level  int          `json:"level"`
+	Chunks []chunkEntry `json:"chunks"`
+}
+
+type chunkEntry struct {
+	Digest string `json:"digest"` // Hex of sha256
+	Size   int64  `json:"size"`
+}
+
+// NewChunkedBlobStore returns a new ChunkedBlobStore under rootDir, that
+// splits blobs with the given chunker.
+func NewChunkedBlobStore(
+	rootDir string, layers *LayerTarStore, chunker Chunker) (*ChunkedBlobStore, error) {
+
+	if err := chunker.validate(); err != nil {
+		return nil, err
+	}
+	s := &ChunkedBlobStore{
+		LayerTarStore: layers,
+		chunker:       chunker,
+		chunkDir:      filepath.Join(rootDir, layerTarChunkDir),
+		recipeDir:     filepath.Join(rootDir, layerTarRecipeDir),
+		gcGracePeriod: _chunkGCGracePeriod,
+	}
+	for _, dir := range []string{s.chunkDir, s.recipeDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create dir %s: %s", dir, err)
+		}
+	}
+	return s, nil
+}
+
+// MoveDownloadFileToStore chunks a download file into the store, and deletes
+// it. Blobs that can't be chunked are moved to the wrapped store.
+func (s *ChunkedBlobStore) MoveDownloadFileToStore(fileName string) error {
+	r, err := s.LayerTarStore.GetDownloadFileReader(fileName)
+	if err != nil {
+		return err
+	}
+	err = s.chunkFrom(fileName, r)
+	r.Close()
+	if err == errNotReproducible {
+		return s.LayerTarStore.MoveDownloadFileToStore(fileName)
+	} else if err != nil && !os.IsExist(err) {
+		return err
+	}
+	// The download file is deleted even if the blob was already stored.
+	if deleteErr := s.LayerTarStore.DeleteDownloadFile(fileName); deleteErr != nil {
+		return deleteErr
+	}
+	return err
+}
+
+// LinkStoreFileFrom chunks the file at src into the store, and removes it.
+// Blobs that can't be chunked are moved to the wrapped store.
+func (s *ChunkedBlobStore) LinkStoreFileFrom(fileName, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	err = s.chunkFrom(fileName, f)
+	f.Close()
+	if err == errNotReproducible {
+		return s.LayerTarStore.LinkStoreFileFrom(fileName, src)
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// chunkFrom splits the uncompressed content of the blob read by r into
+// chunks, stores the missing ones, and writes the recipe of the blob. It
+// returns os.ErrExist if the blob is already stored, and errNotReproducible if
+// compressing the content doesn't give the blob back.
+func (s *ChunkedBlobStore) chunkFrom(fileName string, r base.FileReader) error {
+	if _, err := s.GetStoreFileStat(fileName); err == nil {
+		return os.ErrExist
+	}
+	// Checking first keeps chunks of blobs that can't be chunked out of the
+	// store.
+	level := tario.CompressionLevel
+	size, err := checkReproducible(fileName, r, level)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek %s: %s", fileName, err)
+	}
+	gzipReader, err := tario.NewGzipReader(r)
+	if err != nil {
+		return fmt.Errorf("read %s: %s", fileName, err)
+	}
+	defer gzipReader.Close()
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+	recipe := &chunkRecipe{Size: size, Level: level, Chunks: []chunkEntry{}}
+	if err := s.chunker.Split(gzipReader, func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		entry := chunkEntry{Digest: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+		if err := s.writeChunk(entry.Digest, chunk); err != nil {
+			return fmt.Errorf("write chunk %s: %s", entry.Digest, err)
+		}
+		recipe.Chunks = append(recipe.Chunks, entry)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("chunk %s: %s", fileName, err)
+	}
+	b, err := json.Marshal(recipe)
+	if err != nil {
+		return fmt.Errorf("marshal recipe: %s", err)
+	}
+	return writeFileAtomic(filepath.Join(s.recipeDir, fileName), b)
+}
+
+// checkReproducible returns the size of the gzipped blob read by r, named by
+// the hex of its digest, if compressing its content at the given level gives
+// it back. It returns errNotReproducible otherwise.
+func checkReproducible(fileName string, r io.Reader, level int) (int64, error) {
+	gzipReader, err := tario.NewGzipReader(r)
+	if err != nil {
+		return 0, errNotReproducible
+	}
+	defer gzipReader.Close()
+	hash := sha256.New()
+	counter := &countingWriter{w: hash}
+	gzipWriter, err := tario.NewGzipWriterLevel(counter, level)
+	if err != nil {
+		return 0, fmt.Errorf("create gzip writer: %s", err)
+	}
+	if _, err := io.Copy(gzipWriter, gzipReader); err != nil {
+		gzipWriter.Close()
+		return 0, errNotReproducible
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return 0, fmt.Errorf("compress %s: %s", fileName, err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != fileName {
+		return 0, errNotReproducible
+	}
+	return counter.n, nil
+}
+
+// writeChunk stores a chunk, unless a chunk with the same digest is stored.
+// Stored chunks are touched, so CollectGarbage keeps them while the recipe
+// referencing them is written.
+func (s *ChunkedBlobStore) writeChunk(digest string, chunk []byte) error {
+	p := filepath.Join(s.chunkDir, digest)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err == nil {
+		return nil
+	}
+	return writeFileAtomic(p, chunk)
+}
+
+// CollectGarbage removes the chunks no recipe references, and returns how
+// many it removed. Chunks written within the grace period are kept.
+func (s *ChunkedBlobStore) CollectGarbage() (int, error) {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+
+	recipes, err := ioutil.ReadDir(s.recipeDir)
+	if err != nil {
+		return 0, fmt.Errorf("list recipes: %s", err)
+	}
+	referenced := make(map[string]bool)
+	for _, info := range recipes {
+		// Skip temp files of recipes being written.
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		recipe, err := s.readRecipe(info.Name())
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		for _, chunk := range recipe.Chunks {
+			referenced[chunk.Digest] = true
+		}
+	}
+
+	chunks, err := ioutil.ReadDir(s.chunkDir)
+	if err != nil {
+		return 0, fmt.Errorf("list chunks: %s", err)
+	}
+	var removed int
+	for _, info := range chunks {
+		if referenced[info.Name()] || time.Since(info.ModTime()) < s.gcGracePeriod {
+			continue
+		}
+		err := os.Remove(filepath.Join(s.chunkDir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("remove chunk %s: %s", info.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// GetStoreFileReader returns a FileReader that compresses the chunks of a
+// blob again.
+func (s *ChunkedBlobStore) GetStoreFileReader(fileName string) (base.FileReader, error) {
+	recipe, err := s.readRecipe(fileName)
+	if os.IsNotExist(err) {
+		return s.LayerTarStore.GetStoreFileReader(fileName)
+	} else if err != nil {
+		return nil, err
+	}
+	return newGzipChunkedReader(s.chunkDir, recipe), nil
+}
+
+// GetDownloadOrCacheFileStat returns the FileInfo of a download file or of
+// a blob in the store.
+func (s *ChunkedBlobStore) GetDownloadOrCacheFileStat(fileName string) (os.FileInfo, error) {
+	if info, err := s.GetStoreFileStat(fileName); err == nil {
+		return info, nil
+	}
+	return s.LayerTarStore.GetDownloadOrCacheFileStat(fileName)
+}
+
+// GetStoreFileStat returns the FileInfo of a blob in the store, with the size
+// of the blob.
+func (s *ChunkedBlobStore) GetStoreFileStat(fileName string) (os.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(s.recipeDir, fileName))
+	if os.IsNotExist(err) {
+		return s.LayerTarStore.GetStoreFileStat(fileName)
+	} else if err != nil {
+		return nil, err
+	}
+	recipe, err := s.readRecipe(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return blobInfo{name: fileName, size: recipe.Size, modTime: info.ModTime()}, nil
+}
+
+// DeleteStoreFile deletes the recipe of a blob. Its chunks are kept, since
+// other blobs might share them, until CollectGarbage runs.
+func (s *ChunkedBlobStore) DeleteStoreFile(fileName string) error {
+	err := os.Remove(filepath.Join(s.recipeDir, fileName))
+	if os.IsNotExist(err) {
+		return s.LayerTarStore.DeleteStoreFile(fileName)
+	}
+	return err
+}
+
+// LinkStoreFileTo writes the reassembled blob to target, since chunked blobs
+// can't be hardlinked. It returns os.ErrExist if target exists.
+func (s *ChunkedBlobStore) LinkStoreFileTo(fileName, target string) error {
+	recipe, err := s.readRecipe(fileName)
+	if os.IsNotExist(err) {
+		return s.LayerTarStore.LinkStoreFileTo(fileName, target)
+	} else if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	r := newGzipChunkedReader(s.chunkDir, recipe)
+	defer r.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %s", target, err)
+	}
+	return f.Close()
+}
+
+func (s *ChunkedBlobStore) readRecipe(fileName string) (*chunkRecipe, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.recipeDir, fileName))
+	if err != nil {
+		return nil, err
+	}
+	recipe := new(chunkRecipe)
+	if err := json.Unmarshal(b, recipe); err != nil {
+		return nil, fmt.Errorf("unmarshal recipe of %s: %s", fileName, err)
+	}
+	return recipe, nil
+}
+
+// writeFileAtomic writes a file through a temp file in the same dir, so
+// readers never see partial content.
+func writeFileAtomic(p string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// gzipChunkedReader implements base.FileReader over a chunked blob, by
+// compressing the content of its chunks again. Seeking backwards restarts the
+// compression from the start of the blob, so reads are best sequential.
+type gzipChunkedReader struct {
+	chunkDir string
+	recipe   *chunkRecipe
+	pos      int64
+
+	// stream is the compressed blob, read up to streamPos.
+	stream    *io.PipeReader
+	streamPos int64
+}
+
+func newGzipChunkedReader(chunkDir string, recipe *chunkRecipe) *gzipChunkedReader {
+	return &gzipChunkedReader{chunkDir: chunkDir, recipe: recipe}
+}
+
+// restart starts compressing the content from the start.
+func (r *gzipChunkedReader) restart() {
+	r.Close()
+	pr, pw := io.Pipe()
+	chunkDir, recipe := r.chunkDir, r.recipe
+	go func() {
+		content := newChunkedReader(chunkDir, recipe)
+		defer content.Close()
+		gzipWriter, err := tario.NewGzipWriterLevel(pw, recipe.Level)
+		if err == nil {
+			_, err = io.Copy(gzipWriter, content)
+			if closeErr := gzipWriter.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	r.stream, r.streamPos = pr, 0
+}
+
+// Read implements io.Reader.
+func (r *gzipChunkedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.recipe.Size {
+		return 0, io.EOF
+	}
+	if r.stream == nil || r.streamPos > r.pos {
+		r.restart()
+	}
+	if r.streamPos < r.pos {
+		n, err := io.CopyN(ioutil.Discard, r.stream, r.pos-r.streamPos)
+		r.streamPos += n
+		if err != nil {
+			return 0, fmt.Errorf("skip to offset %d: %s", r.pos, err)
+		}
+	}
+	n, err := r.stream.Read(p)
+	r.pos += int64(n)
+	r.streamPos += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *gzipChunkedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	pos := r.pos
+	defer func() { r.pos = pos }()
+	r.pos = off
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *gzipChunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.recipe.Size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *gzipChunkedReader) Close() error {
+	if r.stream == nil {
+		return nil
+	}
+	err := r.stream.Close()
+	r.stream = nil
+	return err
+}
+
+// chunkedReader implements base.FileReader over the content of a recipe, the
+// concatenation of its chunks.
+type chunkedReader struct {
+	chunkDir string
+	recipe   *chunkRecipe
+	offsets  []int64 // Start offset of each chunk
+	size     int64   // Size of the content
+	pos      int64
+
+	// The last chunk file read from, kept open for sequential reads.
+	current int
+	file    *os.File
+}
+
+func newChunkedReader(chunkDir string, recipe *chunkRecipe) *chunkedReader {
+	offsets := make([]int64, len(recipe.Chunks))
+	var offset int64
+	for i, chunk := range recipe.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+	}
+	return &chunkedReader{
+		chunkDir: chunkDir, recipe: recipe, offsets: offsets, size: offset, current: -1}
+}
+
+// Read implements io.Reader.
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *chunkedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		// Find the last chunk starting at or before off.
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+		f, err := r.open(i)
+		if err != nil {
+			return n, err
+		}
+		end := len(p)
+		if remaining := r.offsets[i] + r.recipe.Chunks[i].Size - off; int64(end-n) > remaining {
+			end = n + int(remaining)
+		}
+		m, err := f.ReadAt(p[n:end], off-r.offsets[i])
+		n += m
+		off += int64(m)
+		if err != nil && err != io.EOF {
+			return n, err
+		} else if m == 0 {
+			return n, fmt.Errorf("chunk %s is truncated", r.recipe.Chunks[i].Digest)
+		}
+	}
+	return n, nil
+}
+
+func (r *chunkedReader) open(i int) (*os.File, error) {
+	if r.current == i {
+		return r.file, nil
+	}
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	f, err := os.Open(filepath.Join(r.chunkDir, r.recipe.Chunks[i].Digest))
+	if err != nil {
+		return nil, fmt.Errorf("open chunk: %s", err)
+	}
+	r.current, r.file = i, f
+	return f, nil
+}
+
+// Seek implements io.Seeker.
+func (r *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *chunkedReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.current = nil, -1
+	return err
+}
+
+// blobInfo implements os.FileInfo for chunked blobs.
+type blobInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i blobInfo) Name() string       { return i.name }
+func (i blobInfo) Size() int64        { return i.size }
+func (i blobInfo) Mode() os.FileMode  { return 0644 }
+func (i blobInfo) ModTime() time.Time { return i.modTime }
+func (i blobInfo) IsDir() bool        { return false }
+func (i blobInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,275 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+var _testChunker = Chunker{MinSize: 64, AvgSize: 256, MaxSize: 1024}
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func splitFixture(t *testing.T, c Chunker, data []byte) [][]byte {
+	var chunks [][]byte
+	require.NoError(t, c.Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	}))
+	return chunks
+}
+
+func TestChunkerSplit(t *testing.T) {
+	require := require.New(t)
+
+	data := randomBytes(1, 64<<10)
+	chunks := splitFixture(t, _testChunker, data)
+	require.True(len(chunks) > 1)
+	require.Equal(data, bytes.Join(chunks, nil))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		require.True(len(chunk) >= _testChunker.MinSize)
+		require.True(len(chunk) <= _testChunker.MaxSize)
+	}
+
+	// Chunks don't depend on what follows them.
+	prefixChunks := splitFixture(t, _testChunker, data[:32<<10])
+	require.Equal(chunks[:len(prefixChunks)-1], prefixChunks[:len(prefixChunks)-1])
+
+	require.Error(Chunker{MinSize: 64, AvgSize: 100, MaxSize: 1024}.Split(bytes.NewReader(data), nil))
+	require.Error(Chunker{MinSize: 512, AvgSize: 256, MaxSize: 1024}.Split(bytes.NewReader(data), nil))
+}
+
+// gzipBlobFixture compresses content like makisu compresses layers, and
+// returns the blob with the hex of its digest.
+func gzipBlobFixture(t *testing.T, content []byte) (string, []byte) {
+	var b bytes.Buffer
+	w, err := tario.NewGzipWriter(&b)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	sum := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(sum[:]), b.Bytes()
+}
+
+func TestChunkedBlobStore(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	layers, err := NewLayerTarStore(root)
+	require.NoError(err)
+	store, err := NewChunkedBlobStore(root, layers, _testChunker)
+	require.NoError(err)
+
+	// Two blobs whose content shares a prefix.
+	prefix := randomBytes(1, 32<<10)
+	content1 := append(append([]byte(nil), prefix...), randomBytes(2, 8<<10)...)
+	content2 := append(append([]byte(nil), prefix...), randomBytes(3, 8<<10)...)
+	name1, blob1 := gzipBlobFixture(t, content1)
+	name2, blob2 := gzipBlobFixture(t, content2)
+	for name, blob := range map[string][]byte{name1: blob1, name2: blob2} {
+		src := filepath.Join(root, name)
+		require.NoError(ioutil.WriteFile(src, blob, 0644))
+		require.NoError(store.LinkStoreFileFrom(name, src))
+		_, err := os.Stat(src)
+		require.True(os.IsNotExist(err))
+	}
+
+	// Chunks of the shared prefix of the content are only stored once. Only
+	// the chunk crossing the end of the prefix differs.
+	chunks1 := splitFixture(t, _testChunker, content1)
+	chunks2 := splitFixture(t, _testChunker, content2)
+	unique := make(map[string]bool)
+	for _, chunk := range chunks1 {
+		unique[string(chunk)] = true
+	}
+	var shared int
+	for _, chunk := range chunks2 {
+		if unique[string(chunk)] {
+			shared += len(chunk)
+		}
+		unique[string(chunk)] = true
+	}
+	require.True(shared >= len(prefix)-_testChunker.MaxSize, "shared %d bytes", shared)
+
+	files, err := ioutil.ReadDir(filepath.Join(root, layerTarChunkDir))
+	require.NoError(err)
+	require.Len(files, len(unique))
+	var stored int
+	for _, f := range files {
+		stored += int(f.Size())
+	}
+	require.Equal(len(content1)+len(content2)-shared, stored)
+
+	// Blobs are reassembled and compressed again on read.
+	info, err := store.GetStoreFileStat(name2)
+	require.NoError(err)
+	require.Equal(int64(len(blob2)), info.Size())
+	r, err := store.GetStoreFileReader(name2)
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob2, b)
+
+	p := make([]byte, 3000)
+	n, err := r.ReadAt(p, 30000)
+	require.NoError(err)
+	require.Equal(3000, n)
+	require.Equal(blob2[30000:30000+n], p[:n])
+	_, err = r.Seek(-100, io.SeekEnd)
+	require.NoError(err)
+	b, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob2[len(blob2)-100:], b)
+	require.NoError(r.Close())
+
+	target := filepath.Join(root, "target")
+	require.NoError(store.LinkStoreFileTo(name1, target))
+	b, err = ioutil.ReadFile(target)
+	require.NoError(err)
+	require.Equal(blob1, b)
+	require.True(os.IsExist(store.LinkStoreFileTo(name1, target)))
+
+	// Storing the same blob again is reported like for LayerTarStore.
+	require.NoError(ioutil.WriteFile(target, blob1, 0644))
+	require.True(os.IsExist(store.LinkStoreFileFrom(name1, target)))
+
+	// Chunks of deleted blobs are kept until garbage is collected, and only
+	// the ones of other blobs are left.
+	require.NoError(store.DeleteStoreFile(name1))
+	_, err = store.GetStoreFileStat(name1)
+	require.True(os.IsNotExist(err))
+	removed, err := store.CollectGarbage()
+	require.NoError(err)
+	require.Equal(0, removed)
+	store.gcGracePeriod = 0
+	removed, err = store.CollectGarbage()
+	require.NoError(err)
+	require.Equal(len(unique)-len(stringSetOf(chunks2)), removed)
+	r, err = store.GetStoreFileReader(name2)
+	require.NoError(err)
+	defer r.Close()
+	b, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob2, b)
+}
+
+func stringSetOf(chunks [][]byte) map[string]bool {
+	set := make(map[string]bool)
+	for _, chunk := range chunks {
+		set[string(chunk)] = true
+	}
+	return set
+}
+
+func TestChunkedBlobStoreNotReproducible(t *testing.T) {
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	layers, err := NewLayerTarStore(root)
+	require.NoError(t, err)
+	store, err := NewChunkedBlobStore(root, layers, _testChunker)
+	require.NoError(t, err)
+
+	// Image configs aren't compressed, and other tools compress layers
+	// differently.
+	var other bytes.Buffer
+	w, err := gzip.NewWriterLevel(&other, gzip.BestSpeed)
+	require.NoError(t, err)
+	_, err = w.Write(randomBytes(1, 32<<10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	for name, blob := range map[string][]byte{
+		"config": []byte(`{"architecture":"amd64"}`),
+		"other":  other.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			sum := sha256.Sum256(blob)
+			name := hex.EncodeToString(sum[:])
+			src := filepath.Join(root, name)
+			require.NoError(ioutil.WriteFile(src, blob, 0644))
+			require.NoError(store.LinkStoreFileFrom(name, src))
+
+			// The blob is stored as is.
+			_, err := layers.GetStoreFileStat(name)
+			require.NoError(err)
+			r, err := store.GetStoreFileReader(name)
+			require.NoError(err)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(blob, b)
+		})
+	}
+	files, err := ioutil.ReadDir(filepath.Join(root, layerTarChunkDir))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestChunkedImageStoreDownload(t *testing.T) {
+	require := require.New(t)
+
+	ChunkLayers = true
+	defer func() { ChunkLayers = false }()
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	store, err := NewImageStore(root)
+	require.NoError(err)
+	require.IsType(&ChunkedBlobStore{}, store.Layers)
+
+	name, blob := gzipBlobFixture(t, randomBytes(1, 200<<10))
+	require.NoError(store.Layers.CreateDownloadFile(name, 0))
+	w, err := store.Layers.GetDownloadFileReadWriter(name)
+	require.NoError(err)
+	_, err = w.Write(blob)
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(store.Layers.MoveDownloadFileToStore(name))
+
+	_, err = store.Layers.GetDownloadFileReader(name)
+	require.Error(err)
+	info, err := store.Layers.GetDownloadOrCacheFileStat(name)
+	require.NoError(err)
+	require.Equal(int64(len(blob)), info.Size())
+	r, err := store.Layers.GetStoreFileReader(name)
+	require.NoError(err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob, b)
+}
@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// DefaultChunker splits blobs into chunks of 64KB on average.
+var DefaultChunker = Chunker{MinSize: 16 << 10, AvgSize: 64 << 10, MaxSize: 256 << 10}
+
+// _gearTable maps bytes to the random values of the gear rolling hash. It's
+// generated from a fixed seed, so chunk boundaries are stable across builds.
+var _gearTable = func() [256]uint64 {
+	var table [256]uint64
+	r := rand.New(rand.NewSource(0x6d616b697375))
+	for i := range table {
+		table[i] = r.Uint64()
+	}
+	return table
+}()
+
+// Chunker splits data into content-defined chunks with a gear rolling hash.
+// Boundaries only depend on the 64 bytes before them, so data sharing content
+// is split into the same chunks, except around the differences.
+type Chunker struct {
+	// MinSize and MaxSize bound the size of chunks, except for the last one,
+	// which can be smaller. AvgSize must be a power of two.
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+func (c Chunker) validate() error {
+	if c.MinSize <= 0 || c.AvgSize < c.MinSize || c.MaxSize < c.AvgSize {
+		return fmt.Errorf("invalid chunk sizes %d/%d/%d", c.MinSize, c.AvgSize, c.MaxSize)
+	} else if c.AvgSize&(c.AvgSize-1) != 0 {
+		return fmt.Errorf("average chunk size %d is not a power of two", c.AvgSize)
+	}
+	return nil
+}
+
+// Split reads r until EOF and calls fn with each chunk. The chunk is only
+// valid until fn returns.
+func (c Chunker) Split(r io.Reader, fn func(chunk []byte) error) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	// buf holds the data read but not chunked yet, up to a chunk of MaxSize.
+	buf := make([]byte, c.MaxSize)
+	var n int
+	var eof bool
+	for {
+		if !eof && n < len(buf) {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("read: %s", err)
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		size := c.cut(buf[:n])
+		if err := fn(buf[:size]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[size:n])
+	}
+}
+
+// cut returns the size of the chunk at the start of data, which holds either
+// MaxSize bytes or the rest of the input.
+func (c Chunker) cut(data []byte) int {
+	if len(data) <= c.MinSize {
+		return len(data)
+	}
+	// A boundary is found on average every AvgSize bytes after MinSize. The
+	// hash only depends on the last 64 bytes, so earlier ones are skipped.
+	mask := uint64(c.AvgSize - 1)
+	var hash uint64
+	start := 0
+	if c.MinSize > 64 {
+		start = c.MinSize - 64
+	}
+	for i := start; i < len(data); i++ {
+		hash = (hash << 1) + _gearTable[data[i]]
+		if i+1 >= c.MinSize && hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -24,12 +24,22 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 )
 
+// ChunkLayers makes new image stores keep layers as content-defined chunks,
+// see ChunkedBlobStore.
+var ChunkLayers bool
+
+// HasChunkedLayers returns true if layers were stored as chunks under rootDir.
+func HasChunkedLayers(rootDir string) bool {
+	_, err := os.Stat(filepath.Join(rootDir, layerTarRecipeDir))
+	return err == nil
+}
+
 // ImageStore contains a manifeststore, a layertarstore, and a sandbox dir.
 type ImageStore struct {
 	RootDir    string
 	SandboxDir string
 	Manifests  *ManifestStore
-	Layers     *LayerTarStore
+	Layers     BlobStore
 }
 
 // NewImageStore creates a new ImageStore.
@@ -51,12 +61,18 @@ func NewImageStore(rootDir string) (*ImageStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("init layer store: %s", err)
 	}
+	var layers BlobStore = l
+	if ChunkLayers {
+		if layers, err = NewChunkedBlobStore(rootDir, l, DefaultChunker); err != nil {
+			return nil, fmt.Errorf("init chunked layer store: %s", err)
+		}
+	}
 
 	return &ImageStore{
 		RootDir:    rootDir,
 		SandboxDir: sandboxDir,
 		Manifests:  m,
-		Layers:     l,
+		Layers:     layers,
 	}, nil
 }
 
@@ -100,6 +100,11 @@ func (s *LayerTarStore) GetDownloadFileReadWriter(fileName string) (base.FileRea
 	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileReadWriter(fileName)
 }
 
+// DeleteDownloadFile deletes a file from download directory.
+func (s *LayerTarStore) DeleteDownloadFile(fileName string) error {
+	return s.backend.NewFileOp().AcceptState(s.downloadState).DeleteFile(fileName)
+}
+
 // MoveDownloadFileToStore moves a file from store directory to cache directory.
 func (s *LayerTarStore) MoveDownloadFileToStore(fileName string) error {
 	return s.backend.NewFileOp().AcceptState(s.downloadState).MoveFile(fileName, s.cacheState)
@@ -0,0 +1,111 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Compression formats of image layers.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// CompressionFormat is the compression format of layers created by makisu.
+// Default to gzip.
+var CompressionFormat = CompressionGzip
+
+// zstdEncoderLevel returns the closest zstd encoder level to a gzip
+// compression level. zstd can't store data uncompressed, so 0 is the fastest
+// level.
+func zstdEncoderLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level == pgzip.DefaultCompression:
+		return zstd.SpeedDefault
+	case level <= pgzip.BestSpeed:
+		return zstd.SpeedFastest
+	case level <= 6:
+		return zstd.SpeedDefault
+	case level < pgzip.BestCompression:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// _zstdMagic is the magic number zstd frames start with.
+var _zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// SetCompressionFormat sets global var CompressionFormat. Format could be
+// "gzip" or "zstd".
+func SetCompressionFormat(format string) error {
+	switch format {
+	case CompressionGzip, CompressionZstd:
+		CompressionFormat = format
+	default:
+		return fmt.Errorf("invalid compression format %s", format)
+	}
+	return nil
+}
+
+// LayerMediaType returns the media type of layers compressed with
+// CompressionFormat.
+func LayerMediaType() string {
+	if CompressionFormat == CompressionZstd {
+		return image.MediaTypeOCILayerZstd
+	}
+	return image.MediaTypeLayer
+}
+
+// NewCompressionWriter returns a new writer that compresses with
+// CompressionFormat and CompressionLevel.
+func NewCompressionWriter(w io.Writer) (io.WriteCloser, error) {
+	if CompressionFormat == CompressionZstd {
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstdEncoderLevel(CompressionLevel))}
+		if CompressionConcurrency > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(CompressionConcurrency))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return NewGzipWriter(w)
+}
+
+// NewDecompressionReader returns a new reader that decompresses gzip or zstd
+// streams. The format is detected from the first bytes of the stream, so
+// layers can be read regardless of the format they were created with.
+func NewDecompressionReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(_zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read compression header: %s", err)
+	}
+	if bytes.Equal(magic, _zstdMagic) {
+		decoder, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("new zstd reader: %s", err)
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return NewGzipReader(br)
+}
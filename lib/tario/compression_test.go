@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetCompressionFormat(t *testing.T) {
+	require := require.New(t)
+	defer func() { CompressionFormat = CompressionGzip }()
+
+	require.Error(SetCompressionFormat("invalid"))
+	require.Equal(CompressionGzip, CompressionFormat)
+	require.Equal(image.MediaTypeLayer, LayerMediaType())
+
+	require.NoError(SetCompressionFormat("zstd"))
+	require.Equal(CompressionZstd, CompressionFormat)
+	require.Equal(image.MediaTypeOCILayerZstd, LayerMediaType())
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	defer func() { CompressionFormat = CompressionGzip }()
+
+	content := bytes.Repeat([]byte("makisu layer content "), 1000)
+	for _, format := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(format, func(t *testing.T) {
+			require := require.New(t)
+			require.NoError(SetCompressionFormat(format))
+
+			var compressed bytes.Buffer
+			w, err := NewCompressionWriter(&compressed)
+			require.NoError(err)
+			_, err = w.Write(content)
+			require.NoError(err)
+			require.NoError(w.Close())
+			require.True(compressed.Len() < len(content))
+
+			// The format is detected when reading, regardless of the
+			// format currently set.
+			CompressionFormat = CompressionGzip
+			r, err := NewDecompressionReader(&compressed)
+			require.NoError(err)
+			defer r.Close()
+			result, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(content, result)
+		})
+	}
+}
+
+func TestDecompressionReaderInvalidInput(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewDecompressionReader(bytes.NewReader([]byte("not compressed")))
+	require.Error(err)
+	_, err = NewDecompressionReader(bytes.NewReader(nil))
+	require.Error(err)
+}
@@ -21,7 +21,7 @@ import (
 	"github.com/klauspost/pgzip"
 )
 
-// CompressionLevel is the compression level of image layers.
+// CompressionLevel is the gzip compression level of image layers, from 0 to 9.
 // Default is pgzip.DefaultCompression.
 var CompressionLevel = pgzip.DefaultCompression
 
@@ -32,6 +32,16 @@ var _compressionLevelMap = map[string]int{
 	"default": pgzip.DefaultCompression,
 }
 
+// CompressionConcurrency is the number of blocks of a layer compressed in
+// parallel. Layers are split into blocks of _gzipBlockSize, compressed by a
+// pool of goroutines, and written out in order, so the output doesn't depend
+// on concurrency. Default to 0, which uses the default of pgzip.
+var CompressionConcurrency = 0
+
+// _gzipBlockSize is the size of the blocks compressed in parallel, same as
+// the default of pgzip.
+const _gzipBlockSize = 256 << 10
+
 // SetCompressionLevel sets global var CompressionLevel.
 func SetCompressionLevel(compressionLevelStr string) error {
 	level, ok := _compressionLevelMap[compressionLevelStr]
@@ -42,9 +52,46 @@ func SetCompressionLevel(compressionLevelStr string) error {
 	return nil
 }
 
-// NewGzipWriter returns a new gzip writer with compression level.
+// SetNumericCompressionLevel sets global var CompressionLevel to a numeric
+// gzip level, from 0 (no compression) to 9 (best compression).
+func SetNumericCompressionLevel(level int) error {
+	if level < pgzip.NoCompression || level > pgzip.BestCompression {
+		return fmt.Errorf("invalid compression level %d, must be between %d and %d",
+			level, pgzip.NoCompression, pgzip.BestCompression)
+	}
+	CompressionLevel = level
+	return nil
+}
+
+// SetCompressionConcurrency sets global var CompressionConcurrency. 0 means
+// the default concurrency.
+func SetCompressionConcurrency(concurrency int) error {
+	if concurrency < 0 {
+		return fmt.Errorf("invalid compression concurrency %d", concurrency)
+	}
+	CompressionConcurrency = concurrency
+	return nil
+}
+
+// NewGzipWriter returns a new gzip writer with compression level and
+// concurrency.
 func NewGzipWriter(w io.Writer) (io.WriteCloser, error) {
-	return pgzip.NewWriterLevel(w, CompressionLevel)
+	return NewGzipWriterLevel(w, CompressionLevel)
+}
+
+// NewGzipWriterLevel returns a new gzip writer with the given compression
+// level and the compression concurrency. Its output only depends on the level.
+func NewGzipWriterLevel(w io.Writer, level int) (io.WriteCloser, error) {
+	gw, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if CompressionConcurrency > 0 {
+		if err := gw.SetConcurrency(_gzipBlockSize, CompressionConcurrency); err != nil {
+			return nil, fmt.Errorf("set gzip concurrency: %s", err)
+		}
+	}
+	return gw, nil
 }
 
 // NewGzipReader returns a new gzip reader.
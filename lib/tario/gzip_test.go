@@ -15,8 +15,12 @@
 package tario
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
 	"testing"
 
+	"github.com/klauspost/pgzip"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,3 +29,69 @@ func TestSetCompressionLevelFail(t *testing.T) {
 
 	require.Error(SetCompressionLevel("invalid"))
 }
+
+func TestSetNumericCompressionLevel(t *testing.T) {
+	require := require.New(t)
+	defer func() { CompressionLevel = pgzip.DefaultCompression }()
+
+	require.Error(SetNumericCompressionLevel(-1))
+	require.Error(SetNumericCompressionLevel(10))
+	require.Equal(pgzip.DefaultCompression, CompressionLevel)
+
+	content := bytes.Repeat([]byte("makisu layer content "), 1000)
+	compressedSize := func(level int) int {
+		require.NoError(SetNumericCompressionLevel(level))
+		var compressed bytes.Buffer
+		w, err := NewGzipWriter(&compressed)
+		require.NoError(err)
+		_, err = w.Write(content)
+		require.NoError(err)
+		require.NoError(w.Close())
+		return compressed.Len()
+	}
+	require.True(compressedSize(0) > len(content))
+	require.True(compressedSize(9) <= compressedSize(1))
+}
+
+func TestSetCompressionConcurrency(t *testing.T) {
+	require := require.New(t)
+	defer func() { CompressionConcurrency = 0 }()
+
+	require.Error(SetCompressionConcurrency(-1))
+	require.Equal(0, CompressionConcurrency)
+	require.NoError(SetCompressionConcurrency(4))
+	require.Equal(4, CompressionConcurrency)
+}
+
+func TestGzipWriterConcurrency(t *testing.T) {
+	require := require.New(t)
+	defer func() { CompressionConcurrency = 0 }()
+
+	// Spans several blocks.
+	content := make([]byte, 5*_gzipBlockSize/2)
+	rand.New(rand.NewSource(0)).Read(content[:len(content)/2])
+
+	compress := func(concurrency int) []byte {
+		require.NoError(SetCompressionConcurrency(concurrency))
+		var compressed bytes.Buffer
+		w, err := NewGzipWriter(&compressed)
+		require.NoError(err)
+		_, err = w.Write(content)
+		require.NoError(err)
+		require.NoError(w.Close())
+		return compressed.Bytes()
+	}
+
+	serial := compress(1)
+	parallel := compress(4)
+	// Blocks are written in order, so the output doesn't depend on
+	// concurrency.
+	require.Equal(serial, parallel)
+
+	r, err := NewGzipReader(bytes.NewReader(parallel))
+	require.NoError(err)
+	defer r.Close()
+	result, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(content, result)
+}
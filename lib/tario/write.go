@@ -20,9 +20,20 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
+// copyBuffers holds the buffers used to copy file contents to tar writers.
+// Reusing them avoids allocating one buffer per file, which adds up for
+// layers with many small files.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
 // WriteEntry write the file from the local filesystem into the tar writer.
 // This function doesn't handle parent directories.
 func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
@@ -40,10 +51,15 @@ func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
 		}
 		defer f.Close()
 
-		// Using CopyN here because there could be dangling process still
-		// writing to the file at the time size is collected.
-		if _, err := io.CopyN(w, f, h.Size); err != nil {
+		// Limiting the copy to the header size here because there could be
+		// dangling process still writing to the file at the time size is
+		// collected.
+		buf := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(buf)
+		if n, err := io.CopyBuffer(w, io.LimitReader(f, h.Size), *buf); err != nil {
 			return fmt.Errorf("copy file %s to tar writer: %s", src, err)
+		} else if n < h.Size {
+			return fmt.Errorf("copy file %s to tar writer: %s", src, io.EOF)
 		}
 		return nil
 	default:
@@ -0,0 +1,57 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Run runs a non-interactive git command in dir, or in the working directory
+// if dir is empty, and returns its trimmed output. Arguments that come from
+// users, like repo URLs, must follow a "--" so they aren't read as options.
+func Run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Revision returns the commit checked out in the git repo containing dir, or
+// an empty string if dir isn't in a git repo or nothing is committed yet.
+// Worktrees and submodules are resolved by git itself.
+func Revision(dir string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", fmt.Errorf("find git: %s", err)
+	}
+	if _, err := Run(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return "", nil
+	}
+	revision, err := Run(dir, "rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		// HEAD is unborn.
+		return "", nil
+	}
+	return revision, nil
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "gitutil")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = Run(dir, "init", "-q", "--", dir)
+	require.NoError(err)
+	out, err := Run(dir, "rev-parse", "--is-inside-work-tree")
+	require.NoError(err)
+	require.Equal("true", out)
+
+	_, err = Run(dir, "rev-parse", "--verify", "nonexistent")
+	require.Error(err)
+	require.Contains(err.Error(), "git rev-parse:")
+}
+
+func TestRevision(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "gitutil")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo")
+	require.NoError(os.MkdirAll(filepath.Join(repo, "sub"), 0755))
+
+	// Not a repo.
+	revision, err := Revision(repo)
+	require.NoError(err)
+	require.Equal("", revision)
+
+	// Nothing committed.
+	_, err = Run(repo, "init", "-q")
+	require.NoError(err)
+	revision, err = Revision(repo)
+	require.NoError(err)
+	require.Equal("", revision)
+
+	_, err = Run(repo, "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "--allow-empty", "-m", "init")
+	require.NoError(err)
+	head, err := Run(repo, "rev-parse", "HEAD")
+	require.NoError(err)
+	revision, err = Revision(filepath.Join(repo, "sub"))
+	require.NoError(err)
+	require.Equal(head, revision)
+
+	// Worktrees have a .git file instead of a dir.
+	worktree := filepath.Join(dir, "worktree")
+	_, err = Run(repo, "worktree", "add", "-q", "--detach", "--", worktree)
+	require.NoError(err)
+	revision, err = Revision(worktree)
+	require.NoError(err)
+	require.Equal(head, revision)
+}
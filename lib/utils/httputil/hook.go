@@ -0,0 +1,161 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// Headers whose values are never passed to a RequestHook.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Registry-Auth",
+}
+
+// Query parameters containing any of these words are never passed to a
+// RequestHook. Covers bearer tokens and pre-signed storage URLs that
+// registries redirect blob downloads to.
+var sensitiveQueryWords = []string{
+	"token",
+	"signature",
+	"credential",
+	"password",
+	"secret",
+}
+
+// RequestEvent describes one HTTP request attempt made by Send, retries and
+// fallbacks included. Credentials are redacted from URL and Header.
+type RequestEvent struct {
+	Method string
+	URL    string
+	Header http.Header
+	// Status is 0 if no response was received.
+	Status int
+	// RequestBytes is the number of body bytes sent.
+	RequestBytes int64
+	// ResponseBytes is the Content-Length of the response, -1 if unknown.
+	ResponseBytes int64
+	// Duration is the time until the response headers were received.
+	Duration time.Duration
+	Err      error
+}
+
+// RequestHook is called for each HTTP request sent by Send.
+type RequestHook func(RequestEvent)
+
+// SendRequestHook calls hook for each HTTP request sent. A nil hook is a
+// no-op.
+func SendRequestHook(hook RequestHook) SendOption {
+	return func(o *sendOptions) { o.hook = hook }
+}
+
+// hookTransport is a http.RoundTripper that reports each request to a
+// RequestHook.
+type hookTransport struct {
+	base http.RoundTripper
+	hook RequestHook
+}
+
+func (t *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	var sent int64
+	if req.Body != nil && req.Body != http.NoBody {
+		// RoundTrip must not modify the request, so count the body on a
+		// shallow copy.
+		body := req.Body
+		req = req.WithContext(req.Context())
+		req.Body = &countingReadCloser{body, &sent}
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	event := RequestEvent{
+		Method:        req.Method,
+		URL:           RedactURL(req.URL),
+		Header:        RedactHeader(req.Header),
+		RequestBytes:  atomic.LoadInt64(&sent),
+		ResponseBytes: -1,
+		Duration:      time.Since(start),
+		Err:           err,
+	}
+	if resp != nil {
+		event.Status = resp.StatusCode
+		event.ResponseBytes = resp.ContentLength
+	}
+	t.hook(event)
+	return resp, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// RedactURL returns the string form of u without user info or sensitive
+// query parameters.
+func RedactURL(u *url.URL) string {
+	redactedURL := *u
+	if u.User != nil {
+		redactedURL.User = url.User(redacted)
+	}
+	query := u.Query()
+	changed := false
+	for key := range query {
+		lower := strings.ToLower(key)
+		for _, word := range sensitiveQueryWords {
+			if strings.Contains(lower, word) {
+				query.Set(key, redacted)
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		redactedURL.RawQuery = query.Encode()
+	}
+	return redactedURL.String()
+}
+
+// RedactHeader returns a copy of header with sensitive values redacted.
+func RedactHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	for _, key := range sensitiveHeaders {
+		if _, ok := result[key]; ok {
+			result.Set(key, redacted)
+		}
+	}
+	return result
+}
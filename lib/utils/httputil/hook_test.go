@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendRequestHook(t *testing.T) {
+	require := require.New(t)
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	var events []RequestEvent
+	hook := func(e RequestEvent) { events = append(events, e) }
+
+	url := strings.Replace(server.URL, "http://", "http://user:pass@", 1) +
+		"/v2/repo/blobs/uploads/?_state=abc&access_token=secret&X-Amz-Signature=secret"
+	_, err := Get(url,
+		SendHeaders(map[string]string{"Authorization": "Bearer secret", "Accept": "*/*"}),
+		SendRetry(),
+		SendRequestHook(hook))
+	require.NoError(err)
+
+	// One event per attempt.
+	require.Len(events, 2)
+	require.Equal(http.StatusServiceUnavailable, events[0].Status)
+	require.Equal(http.StatusOK, events[1].Status)
+	for _, e := range events {
+		require.Equal("GET", e.Method)
+		require.NotContains(e.URL, "secret")
+		require.NotContains(e.URL, "pass")
+		require.Contains(e.URL, "_state=abc")
+		require.Equal("REDACTED", e.Header.Get("Authorization"))
+		require.Equal("*/*", e.Header.Get("Accept"))
+		require.True(e.Duration > 0)
+		require.NoError(e.Err)
+	}
+	require.Equal(int64(len("OK")), events[1].ResponseBytes)
+
+	// Request body bytes are counted.
+	events = nil
+	_, err = Put(server.URL, SendBody(bytes.NewReader([]byte("payload"))), SendRequestHook(hook))
+	require.NoError(err)
+	require.Len(events, 1)
+	require.Equal(int64(len("payload")), events[0].RequestBytes)
+}
+
+func TestSendRequestHookNetworkError(t *testing.T) {
+	require := require.New(t)
+
+	var events []RequestEvent
+	_, err := Send("GET", "http://localhost:0/test",
+		SendRequestHook(func(e RequestEvent) { events = append(events, e) }))
+	require.Error(err)
+	require.Len(events, 1)
+	require.Equal(0, events[0].Status)
+	require.Error(events[0].Err)
+}
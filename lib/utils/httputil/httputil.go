@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/juju/ratelimit"
 	"github.com/uber/makisu/lib/log"
 )
 
@@ -128,6 +129,11 @@ func (e NetworkError) Error() string {
 	return fmt.Sprintf("network error: %s", e.err)
 }
 
+// Unwrap returns the error the request failed with.
+func (e NetworkError) Unwrap() error {
+	return e.err
+}
+
 // IsNetworkError returns true if err is a NetworkError.
 func IsNetworkError(err error) bool {
 	var e NetworkError
@@ -143,6 +149,9 @@ type sendOptions struct {
 	retry         retryOptions
 	transport     http.RoundTripper
 	ctx           context.Context
+	hook          RequestHook
+	idleTimeout   time.Duration
+	rateLimit     *ratelimit.Bucket
 
 	// This is not a valid http option. It provides a way to override
 	// http.Client. This should always used by tests.
@@ -259,7 +268,7 @@ func SendTLS(config *tls.Config) SendOption {
 		if config == nil {
 			return
 		}
-		o.transport = &http.Transport{TLSClientConfig: config}
+		o.transport = &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}
 		o.url.Scheme = "https"
 	}
 }
@@ -315,10 +324,27 @@ func Send(method, rawurl string, options ...SendOption) (*http.Response, error)
 			CheckRedirect: opts.redirect,
 			Transport:     opts.transport,
 		}
+	} else if opts.redirect != nil {
+		redirected := *client
+		redirected.CheckRedirect = opts.redirect
+		client = &redirected
+	}
+	if opts.hook != nil {
+		hooked := *client
+		hooked.Transport = &hookTransport{base: client.Transport, hook: opts.hook}
+		client = &hooked
+	}
+	if opts.idleTimeout > 0 {
+		idle := *client
+		idle.Transport = &idleTimeoutTransport{base: client.Transport, timeout: opts.idleTimeout}
+		client = &idle
 	}
 
 	var resp *http.Response
 	for {
+		if opts.rateLimit != nil {
+			opts.rateLimit.Wait(1)
+		}
 		resp, err = client.Do(req)
 		// Retry without tls. During migration there would be a time when the
 		// component receiving the tls request does not serve https response.
@@ -341,6 +367,14 @@ func Send(method, rawurl string, options ...SendOption) (*http.Response, error)
 			if d == backoff.Stop {
 				break // Backoff timed out.
 			}
+			if resp != nil {
+				if retryAfter := RetryAfter(resp.Header); retryAfter > d {
+					d = retryAfter
+				}
+				if resp.StatusCode == http.StatusTooManyRequests {
+					log.Warnf("Rate limited by %s, retrying in %s", req.URL.Host, d)
+				}
+			}
 			time.Sleep(d)
 			continue
 		}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned when no bytes of a request or its response moved
+// for longer than the idle timeout set with SendIdleTimeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// SendIdleTimeout aborts requests if no bytes of their body or of the
+// response are transferred for the given duration, e.g. because the
+// connection stalled. Unlike SendTimeout, it doesn't limit the total duration
+// of transfers that keep making progress. A non-positive timeout is a no-op.
+func SendIdleTimeout(timeout time.Duration) SendOption {
+	return func(o *sendOptions) { o.idleTimeout = timeout }
+}
+
+// idleTimeoutTransport is a http.RoundTripper that cancels requests once
+// neither their body nor their response were read from for timeout.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	w := newIdleWatchdog(t.timeout, cancel)
+
+	// RoundTrip must not modify the request, so the body is wrapped on a
+	// shallow copy.
+	body := req.Body
+	req = req.WithContext(ctx)
+	if body != nil && body != http.NoBody {
+		req.Body = &idleReadCloser{body, w, false}
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		w.stop()
+		return nil, w.wrap(err)
+	}
+	resp.Body = &idleReadCloser{resp.Body, w, true}
+	return resp, nil
+}
+
+// idleWatchdog calls cancel if it isn't kicked for timeout.
+type idleWatchdog struct {
+	sync.Mutex
+
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  func()
+	fired   bool
+}
+
+func newIdleWatchdog(timeout time.Duration, cancel func()) *idleWatchdog {
+	w := &idleWatchdog{timeout: timeout, cancel: cancel}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.Lock()
+		w.fired = true
+		w.Unlock()
+		cancel()
+	})
+	return w
+}
+
+func (w *idleWatchdog) kick() {
+	w.Lock()
+	defer w.Unlock()
+	if !w.fired {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+func (w *idleWatchdog) stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+// wrap replaces errors caused by the watchdog with ErrIdleTimeout.
+func (w *idleWatchdog) wrap(err error) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.fired && err != nil && err != io.EOF {
+		return fmt.Errorf("%w: no data transferred for %s", ErrIdleTimeout, w.timeout)
+	}
+	return err
+}
+
+// idleReadCloser kicks the watchdog whenever bytes are read. The watchdog is
+// stopped when the response body is closed, the request body is closed by the
+// transport before the response is received.
+type idleReadCloser struct {
+	io.ReadCloser
+	w        *idleWatchdog
+	response bool
+}
+
+func (r *idleReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.w.kick()
+	}
+	return n, r.w.wrap(err)
+}
+
+func (r *idleReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if r.response {
+		r.w.stop()
+	}
+	return err
+}
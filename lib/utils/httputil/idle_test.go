@@ -0,0 +1,133 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _idleTimeout = 100 * time.Millisecond
+
+// stalledServerFixture returns the address of a server that accepts
+// connections, then never reads from or writes to them.
+func stalledServerFixture(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return "http://" + l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestSendIdleTimeout(t *testing.T) {
+	t.Run("stalled_response", func(t *testing.T) {
+		require := require.New(t)
+		addr, cleanup := stalledServerFixture(t)
+		defer cleanup()
+
+		start := time.Now()
+		_, err := Get(addr, SendTimeout(time.Minute), SendIdleTimeout(_idleTimeout))
+		require.Error(err)
+		require.True(IsNetworkError(err))
+		require.True(errors.Is(err, ErrIdleTimeout), err.Error())
+		require.True(time.Since(start) < 10*time.Second)
+	})
+
+	t.Run("stalled_upload", func(t *testing.T) {
+		require := require.New(t)
+		addr, cleanup := stalledServerFixture(t)
+		defer cleanup()
+
+		// Large enough to fill the socket buffers.
+		body := io.LimitReader(zeroReader{}, 256*1024*1024)
+		_, err := Patch(addr, SendBody(body), SendTimeout(time.Minute), SendIdleTimeout(_idleTimeout))
+		require.Error(err)
+		require.True(errors.Is(err, ErrIdleTimeout), err.Error())
+	})
+
+	t.Run("stalled_download", func(t *testing.T) {
+		require := require.New(t)
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-done
+		}))
+		defer server.Close()
+		defer close(done)
+
+		resp, err := Get(server.URL, SendTimeout(time.Minute), SendIdleTimeout(_idleTimeout))
+		require.NoError(err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Equal("partial", string(b))
+		require.True(errors.Is(err, ErrIdleTimeout))
+	})
+
+	t.Run("slow_progress", func(t *testing.T) {
+		require := require.New(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 5; i++ {
+				time.Sleep(_idleTimeout / 2)
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+			}
+		}))
+		defer server.Close()
+
+		resp, err := Get(server.URL, SendIdleTimeout(_idleTimeout))
+		require.NoError(err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(err)
+		require.Equal("xxxxx", string(b))
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
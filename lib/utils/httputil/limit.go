@@ -0,0 +1,65 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// maxRetryAfter caps the delays requested by Retry-After headers.
+const maxRetryAfter = 5 * time.Minute
+
+// SendRateLimit takes a token from the bucket before sending the request and
+// each of its retries, waiting for one if needed. A nil bucket is a no-op.
+func SendRateLimit(bucket *ratelimit.Bucket) SendOption {
+	return func(o *sendOptions) { o.rateLimit = bucket }
+}
+
+// RetryAfter returns the delay requested by the Retry-After header of a
+// response, in seconds or as a date, capped at 5 minutes. It returns 0 if
+// there is none.
+func RetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		d = time.Until(date)
+	}
+	if d < 0 {
+		return 0
+	} else if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// ErrRetryAfter returns the delay requested by the Retry-After header of the
+// response of a StatusError, or 0.
+func ErrRetryAfter(err error) time.Duration {
+	var e StatusError
+	if errors.As(err, &e) {
+		return RetryAfter(e.Header)
+	}
+	return 0
+}
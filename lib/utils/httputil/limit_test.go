@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-3", 0},
+		{"3600", maxRetryAfter},
+		{"invalid", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set("Retry-After", test.value)
+		require.Equal(t, test.expected, RetryAfter(header), test.value)
+	}
+
+	header := http.Header{}
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	d := RetryAfter(header)
+	require.True(t, d > 58*time.Second && d <= time.Minute)
+}
+
+func TestSendRetryAfterAndRateLimit(t *testing.T) {
+	require := require.New(t)
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := Get(server.URL, SendRetry(), SendRateLimit(ratelimit.NewBucketWithRate(100, 1)))
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(2, requests)
+	require.True(time.Since(start) >= time.Second)
+}
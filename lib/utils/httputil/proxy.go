@@ -0,0 +1,68 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ProxyConfig defines the HTTP proxy of requests. If URL is empty, the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+type ProxyConfig struct {
+	URL      string `yaml:"url" json:"url"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// Send requests directly, ignoring the environment variables.
+	Disabled bool `yaml:"disabled" json:"disabled"`
+}
+
+// ProxyFunc returns the proxy function of http.Transport for the config.
+// Username and password, if any, are used for basic auth with the proxy.
+func (c *ProxyConfig) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c == nil {
+		return http.ProxyFromEnvironment, nil
+	}
+	if c.Disabled {
+		return nil, nil
+	}
+	if c.URL == "" {
+		return func(req *http.Request) (*url.URL, error) {
+			u, err := http.ProxyFromEnvironment(req)
+			if err != nil || u == nil {
+				return u, err
+			}
+			return c.withUser(u), nil
+		}, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy url: %s", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q", c.URL)
+	}
+	return http.ProxyURL(c.withUser(u)), nil
+}
+
+func (c *ProxyConfig) withUser(u *url.URL) *url.URL {
+	if c.Username == "" {
+		return u
+	}
+	withUser := *u
+	withUser.User = url.UserPassword(c.Username, c.Password)
+	return &withUser
+}
@@ -37,10 +37,24 @@ type TLSConfig struct {
 	CA     X509Pair `yaml:"ca"`
 	Client X509Pair `yaml:"client"`
 
+	// Paths of CA certs trusted along with CA.Cert.
+	extraCAPaths []string
+
 	// Lazy init.
 	tls *tls.Config
 }
 
+// AddCAPath adds a path of CA certs trusted along with CA.Cert.
+func (c *TLSConfig) AddCAPath(path string) {
+	for _, p := range c.extraCAPaths {
+		if p == path {
+			return
+		}
+	}
+	c.extraCAPaths = append(c.extraCAPaths, path)
+	c.tls = nil
+}
+
 // X509Pair contains x509 cert configuration.
 // Both Cert and Key should be already in pem format.
 type X509Pair struct {
@@ -74,7 +88,7 @@ func (c *TLSConfig) BuildClient() (*tls.Config, error) {
 	var certs []tls.Certificate
 	var err error
 	if c.CA.Cert.Path != "" {
-		caPool, err = createCertPool(c.CA.Cert.Path)
+		caPool, err = createCertPool(append([]string{c.CA.Cert.Path}, c.extraCAPaths...)...)
 		if err != nil {
 			return nil, fmt.Errorf("create cert pool: %s", err)
 		}
@@ -157,11 +171,13 @@ func parseKey(path, passphrasePath string) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("read passphrase file: %s", err)
 		}
-		keyBytes, err := decryptPEMBlock(keyPEM, passphrase)
+		// Passphrase files usually end with a newline.
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		keyType, keyBytes, err := decryptPEMBlock(keyPEM, passphrase)
 		if err != nil {
 			return nil, fmt.Errorf("decrypt key: %s", err)
 		}
-		keyPEM, err = encodePEMKey(keyBytes)
+		keyPEM, err = encodePEMKey(keyType, keyBytes)
 		if err != nil {
 			return nil, fmt.Errorf("encode key: %s", err)
 		}
@@ -169,23 +185,24 @@ func parseKey(path, passphrasePath string) ([]byte, error) {
 	return keyPEM, nil
 }
 
-// decryptPEMBlock decrypts the block of data.
-func decryptPEMBlock(data, secret []byte) ([]byte, error) {
+// decryptPEMBlock decrypts the block of data, and returns its type, e.g.
+// "RSA PRIVATE KEY" or "EC PRIVATE KEY".
+func decryptPEMBlock(data, secret []byte) (string, []byte, error) {
 	block, _ := pem.Decode(data)
 	if block == nil || len(block.Bytes) < 1 {
-		return nil, errors.New("empty block")
+		return "", nil, errors.New("empty block")
 	}
 	decoded, err := x509.DecryptPEMBlock(block, secret)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt block: %s", err)
+		return "", nil, fmt.Errorf("decrypt block: %s", err)
 	}
-	return decoded, nil
+	return block.Type, decoded, nil
 }
 
-// encodePEMKey marshals the DER-encoded private key.
-func encodePEMKey(data []byte) ([]byte, error) {
+// encodePEMKey marshals the DER-encoded private key of the given type.
+func encodePEMKey(keyType string, data []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	err := pem.Encode(buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: data})
+	err := pem.Encode(buf, &pem.Block{Type: keyType, Bytes: data})
 	if err != nil {
 		return nil, fmt.Errorf("encode key: %s", err)
 	}
@@ -16,6 +16,8 @@ package httputil
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -225,3 +227,74 @@ func TestTLSClient(t *testing.T) {
 		require.Equal(http.StatusOK, resp.StatusCode)
 	})
 }
+
+func TestParseKeyEncryptedEC(t *testing.T) {
+	require := require.New(t)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "makisu"},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	require.NoError(err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(err)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", keyDER, []byte("secret"), x509.PEMCipherAES256)
+	require.NoError(err)
+	key, cleanup := genFile(t, pem.EncodeToMemory(block))
+	defer cleanup()
+	passphrase, cleanup := genFile(t, []byte("secret\n"))
+	defer cleanup()
+
+	keyPEM, err := parseKey(key, passphrase)
+	require.NoError(err)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(err)
+}
+
+func TestTLSClientExtraCAPath(t *testing.T) {
+	require := require.New(t)
+
+	genCA := func(name string) (*x509.Certificate, string, func()) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(err)
+		template := x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-5 * time.Minute),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+		require.NoError(err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(err)
+		path, cleanup := genFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		return cert, path, cleanup
+	}
+	private, privatePath, cleanup := genCA("private")
+	defer cleanup()
+	public, publicPath, cleanup := genCA("public")
+	defer cleanup()
+
+	config := &TLSConfig{}
+	config.CA.Cert.Path = privatePath
+	config.AddCAPath(publicPath)
+	config.AddCAPath(publicPath)
+	tls, err := config.BuildClient()
+	require.NoError(err)
+	require.Len(config.extraCAPaths, 1)
+
+	for _, cert := range []*x509.Certificate{private, public} {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: tls.RootCAs})
+		require.NoError(err)
+	}
+}
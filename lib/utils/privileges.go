@@ -0,0 +1,52 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DropPrivileges gives ownership of everything under ownedPaths to uid and
+// gid, so the process can keep using and cleaning them up, then switches the
+// process to uid and gid. It cannot be undone, and requires running as root.
+func DropPrivileges(uid, gid int, ownedPaths ...string) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("dropping privileges requires running as root, running as uid %d", os.Getuid())
+	}
+	for _, p := range ownedPaths {
+		if err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		}); err != nil {
+			return fmt.Errorf("chown %s: %s", p, err)
+		}
+	}
+	// Group has to be changed first, while still being root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("set groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("set gid %d: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("set uid %d: %s", uid, err)
+	}
+	return nil
+}
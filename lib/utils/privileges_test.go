@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _dropPrivilegesEnv = "MAKISU_TEST_DROP_PRIVILEGES_DIR"
+
+func TestDropPrivileges(t *testing.T) {
+	require := require.New(t)
+
+	// Privileges can't be regained, so they are dropped in a child process
+	// running this same test.
+	if dir := os.Getenv(_dropPrivilegesEnv); dir != "" {
+		require.NoError(DropPrivileges(65534, 65534, filepath.Join(dir, "storage")))
+		require.Equal(65534, os.Getuid())
+		require.Equal(65534, os.Getgid())
+
+		// Owned paths can still be written to and cleaned up, others can't.
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, "storage", "layer"), []byte("layer"), 0644))
+		require.NoError(os.RemoveAll(filepath.Join(dir, "storage", "sandbox")))
+		require.Error(ioutil.WriteFile(filepath.Join(dir, "root"), []byte("root"), 0644))
+		return
+	}
+	if os.Getuid() != 0 {
+		require.Error(DropPrivileges(65534, 65534))
+		t.Skip("dropping privileges requires root")
+	}
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(os.MkdirAll(filepath.Join(dir, "storage", "sandbox", "stage"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "storage", "sandbox", "stage", "file"), nil, 0644))
+	require.NoError(os.Chmod(dir, 0755))
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), _dropPrivilegesEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(err, string(out))
+
+	fi, err := os.Stat(filepath.Join(dir, "storage", "layer"))
+	require.NoError(err)
+	require.Equal(uint32(65534), FileInfoStat(fi).Uid)
+	_, err = os.Stat(filepath.Join(dir, "storage", "sandbox"))
+	require.True(os.IsNotExist(err))
+}
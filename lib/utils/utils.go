@@ -104,6 +104,8 @@ func ConvertStringSliceToMap(values []string) map[string]string {
 // MergeEnv merges a new env key value pair into existing list.
 // This is needed because Docker image config defines Env as []string, but
 // actually uses it as map[string]string.
+// Existing entries keep their position and are overridden in place, new ones
+// are appended in sorted order.
 func MergeEnv(envList []string, newEnvMap map[string]string) []string {
 	envMap := ConvertStringSliceToMap(envList)
 	for newK, newV := range newEnvMap {
@@ -111,10 +113,24 @@ func MergeEnv(envList []string, newEnvMap map[string]string) []string {
 	}
 
 	result := []string{}
-	for k, v := range envMap {
-		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	added := make(map[string]bool, len(envMap))
+	for _, env := range envList {
+		k := strings.SplitN(env, "=", 2)[0]
+		if !added[k] {
+			result = append(result, fmt.Sprintf("%s=%s", k, envMap[k]))
+			added[k] = true
+		}
+	}
+	var newKeys []string
+	for newK := range newEnvMap {
+		if !added[newK] {
+			newKeys = append(newKeys, newK)
+		}
+	}
+	sort.Strings(newKeys)
+	for _, newK := range newKeys {
+		result = append(result, fmt.Sprintf("%s=%s", newK, newEnvMap[newK]))
 	}
-	sort.Strings(result)
 	return result
 }
 
@@ -183,6 +199,29 @@ func IsValidJSON(blob []byte) bool {
 	return json.Unmarshal(blob, &into) == nil
 }
 
+// ResolveChmod converts an octal chmod string to a file mode, including the
+// setuid, setgid and sticky bits. Returns 0 if chmod is empty.
+func ResolveChmod(chmod string) (os.FileMode, error) {
+	if chmod == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid octal mode '%s'", chmod)
+	}
+	mode := os.FileMode(m) & os.ModePerm
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
 // ResolveChown converts a chown string to uid and gid integers.
 // Format: <user>[:<group>]
 // Both <user> and <group> can be either user/group strings or uid/gids.
@@ -111,6 +111,10 @@ func TestMergeEnv(t *testing.T) {
 	require.NotNil(out)
 	require.Contains(out, "a=e")
 	require.Contains(out, "g=h")
+
+	// Inherited entries keep their order, new ones are appended.
+	out = MergeEnv([]string{"PATH=/bin", "c=d", "a=b"}, map[string]string{"a": "e", "PATH": "/opt:/bin", "b": "f"})
+	require.Equal([]string{"PATH=/opt:/bin", "c=d", "a=e", "b=f"}, out)
 }
 
 func TestMergeStringMaps(t *testing.T) {
@@ -176,6 +180,36 @@ func TestIsSpecialFileWithSocket(t *testing.T) {
 	require.True(IsSpecialFile(fi))
 }
 
+func TestResolveChmod(t *testing.T) {
+	tests := []struct {
+		desc    string
+		succeed bool
+		chmod   string
+		mode    os.FileMode
+	}{
+		{"empty", true, "", 0},
+		{"perm", true, "755", 0755},
+		{"leading zero", true, "0640", 0640},
+		{"special bits", true, "7755", 0755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky},
+		{"not octal", false, "u+x", 0},
+		{"invalid digit", false, "789", 0},
+		{"too large", false, "17777", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			mode, err := ResolveChmod(test.chmod)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.mode, mode)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
 func TestResolveChown(t *testing.T) {
 	tests := []struct {
 		desc    string
@@ -149,3 +149,18 @@ func (mr *MockClientMockRecorder) PushManifest(arg0, arg1 interface{}) *gomock.C
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushManifest", reflect.TypeOf((*MockClient)(nil).PushManifest), arg0, arg1)
 }
+
+// ResolveDigest mocks base method
+func (m *MockClient) ResolveDigest(arg0 string) (image.Digest, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveDigest", arg0)
+	ret0, _ := ret[0].(image.Digest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveDigest indicates an expected call of ResolveDigest
+func (mr *MockClientMockRecorder) ResolveDigest(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveDigest", reflect.TypeOf((*MockClient)(nil).ResolveDigest), arg0)
+}